@@ -0,0 +1,157 @@
+package main
+
+import (
+  "net/http"
+  "time"
+)
+
+/* Page access
+  - Whether someone may read or change a page is decided here, whichever way
+    they come in: the HTML pages, the API, GraphQL, gRPC, WebDAV, live
+    collaboration, attachments, search and the listings. Handlers ask here
+    rather than looking at the page's metadata themselves
+  - Reading takes in the page's visibility and share links (visibility.go,
+    share.go), its publishing schedule (schedule.go) and whether it's a draft
+    (drafts.go). authorizeRead gives the version of a page the reader sees;
+    readAccess is the same decision for when the metadata is to hand
+  - Changing a page needs reading it, and an admin if it's protected
+    (protect.go); see authorizeWrite. Saving it, with -review, may need a
+    proposal instead (review.go); see authorizeSave
+*/
+
+/* Whether u, nil when not signed in, may read title with metadata m, share
+  being the ?share= token they came with, if any: http.StatusOK, or the
+  http.StatusNotFound or http.StatusGone to answer with instead
+  - Signed in users see drafts and pages that aren't published yet, with a
+    banner (see readStatus)
+*/
+func readAccess(title string, m PageMeta, u *User, share string) int {
+  if !m.readableBy(u) && !sharedWith(title, m, share) {
+    return http.StatusNotFound
+  }
+  if u != nil {
+    return http.StatusOK
+  }
+  now := time.Now()
+  switch {
+  case !m.PublishAt.IsZero() && now.Before(m.PublishAt):
+    return http.StatusNotFound
+  case !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt) && m.ExpiryGone:
+    return http.StatusGone
+  case m.Draft && m.Published == 0:
+    return http.StatusNotFound
+  }
+  return http.StatusOK
+}
+
+/* The version of p, the page as it's stored, that u may read, or the status
+  to answer with instead
+*/
+func authorizeRead(p *Page, u *User, share string) (*Page, int, error) {
+  m, err := pageMeta.Load(p.Title)
+  if err != nil {
+    return nil, 0, err
+  }
+  return readableVersion(p, m, u, share)
+}
+
+func readableVersion(p *Page, m PageMeta, u *User, share string) (*Page, int, error) {
+  if status := readAccess(p.Title, m, u, share); status != http.StatusOK {
+    return nil, status, nil
+  }
+  if m.Draft && u == nil {
+    // Everyone else keeps seeing the revision from before the drafting
+    body, err := history.LoadRevision(p.Title, m.Published)
+    if err != nil {
+      return nil, 0, err
+    }
+    return &Page{Title: p.Title, Body: body, Revision: m.Published}, http.StatusOK, nil
+  }
+  return p, http.StatusOK, nil
+}
+
+/* Whether title may be read by u, without a share link */
+func pageReadableBy(title string, u *User) (bool, error) {
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    return false, err
+  }
+  return readAccess(title, m, u, "") == http.StatusOK, nil
+}
+
+/* titles without the ones u may not read, for listings: those hidden by
+  their visibility, and from anyone not signed in, those not published yet,
+  expired and gone, or drafts never published
+*/
+func visiblePages(titles []string, u *User) ([]string, error) {
+  all, err := pageMeta.All()
+  if err != nil {
+    return nil, err
+  }
+  visible := titles[:0:0]
+  for _, title := range titles {
+    if m, ok := all[title]; !ok || readAccess(title, m, u, "") == http.StatusOK {
+      visible = append(visible, title)
+    }
+  }
+  return visible, nil
+}
+
+/* Whether u, nil when not signed in, may change title: errNoSuchPage if they
+  can't read it as it stands, errProtected if it's protected and they aren't
+  an admin
+  - Someone shown an older revision of a draft can't see what they'd be
+    changing, so it's errNoSuchPage for them too
+*/
+func authorizeWrite(title string, u *User) error {
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    return err
+  }
+  return writeAccess(title, m, u)
+}
+
+func writeAccess(title string, m PageMeta, u *User) error {
+  if readAccess(title, m, u, "") != http.StatusOK || m.Draft && u == nil {
+    return errNoSuchPage
+  }
+  if m.Protected && (u == nil || !u.Admin) {
+    return errProtected
+  }
+  return nil
+}
+
+/* As authorizeWrite, for saving a new body: errNeedsReview, for admins too,
+  if the change has to be proposed instead
+  - Someone who can't read the page is told there's no such page before
+    anything about review, so they can't propose to it either
+*/
+func authorizeSave(title string, u *User) error {
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    return err
+  }
+  if err := writeAccess(title, m, u); err != nil && err != errProtected {
+    return err
+  }
+  if needsReview(m) {
+    return errNeedsReview
+  }
+  return writeAccess(title, m, u)
+}
+
+/* 404 for a page the reader of r may not read, honouring a share link;
+  reports whether it was
+*/
+func hideUnreadable(w http.ResponseWriter, r *http.Request, title string) bool {
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return true
+  }
+  if readAccess(title, m, currentUser(r), r.URL.Query().Get("share")) != http.StatusOK {
+    http.NotFound(w, r)
+    return true
+  }
+  return false
+}
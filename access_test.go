@@ -0,0 +1,434 @@
+package main
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "html/template"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+/* Tests of page access (see access.go) by every way in
+  - Each test starts from the same fixture: a page of each kind, each with an
+    attachment, and readers bob, alice (who owns the private pages) and an
+    admin, all with the password "password"
+  - A surface is one way of reading or changing a page. Every surface is
+    asked about every case, and has to come to the decision the view page
+    and authorizeSave come to
+*/
+
+var accessMux = http.NewServeMux()
+
+func TestMain(m *testing.M) {
+  templates.Store(template.Must(parseTemplates()))
+  dir, err := ioutil.TempDir("", "wiki-test-")
+  if err != nil {
+    panic(err)
+  }
+  if err := os.Chdir(dir); err != nil {
+    panic(err)
+  }
+  if err := configureSessions("memory", "", ""); err != nil {
+    panic(err)
+  }
+  if err := configureStorage("file", "none", false, ""); err != nil {
+    panic(err)
+  }
+  registerAPI()
+  accessMux.Handle("/", http.DefaultServeMux)
+  accessMux.HandleFunc("/view/", makeHandler(viewHandler))
+  accessMux.HandleFunc("/save/", makeHandler(saveHandler))
+  accessMux.HandleFunc("/files/", filesHandler)
+  accessMux.HandleFunc(davPrefix, davHandler)
+  accessMux.HandleFunc("/graphql", graphqlHandler)
+  code := m.Run()
+  os.RemoveAll(dir)
+  os.Exit(code)
+}
+
+/* The ?share= token for Private */
+var accessShare string
+
+var accessHash string
+
+func accessFixture(t *testing.T) {
+  t.Helper()
+  reviewMode = false
+  if err := os.RemoveAll("data"); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.MkdirAll("data", 0700); err != nil {
+    t.Fatal(err)
+  }
+  users.users = map[string]*User{}
+  var err error
+  if accessHash == "" {
+    // Hashing is slow on purpose, so once for all the fixtures
+    if accessHash, err = hashPassword("password"); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, u := range []*User{{Name: "bob"}, {Name: "alice"}, {Name: "admin", Admin: true}} {
+    u.PasswordHash = accessHash
+    if err := users.create(u); err != nil {
+      t.Fatal(err)
+    }
+  }
+  share := Share{ID: "0123456789abcdef", Created: time.Now().UTC(), By: "alice"}
+  pages := []struct {
+    title string
+    bodies []string
+    meta PageMeta
+  }{
+    {"Open", []string{"open text"}, PageMeta{}},
+    {"Private", []string{"private text"}, PageMeta{Visibility: visibilityOwner, Owner: "alice", Shares: []Share{share}}},
+    {"Draft", []string{"published text", "draft text"}, PageMeta{Draft: true, Published: 1}},
+    {"Scheduled", []string{"scheduled text"}, PageMeta{PublishAt: time.Now().Add(time.Hour)}},
+    {"Gone", []string{"gone text"}, PageMeta{ExpiresAt: time.Now().Add(-time.Hour), ExpiryGone: true}},
+    {"Locked", []string{"locked text"}, PageMeta{Protected: true}},
+    {"Vault", []string{"vault text"}, PageMeta{Protected: true, Visibility: visibilityOwner, Owner: "alice"}},
+  }
+  for _, p := range pages {
+    for _, body := range p.bodies {
+      if err := (&Page{Title: p.title, Body: []byte(body)}).save("admin", false); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if err := pageMeta.Save(p.title, p.meta); err != nil {
+      t.Fatal(err)
+    }
+    data := []byte("attachment of " + p.title)
+    if err := attachments.Save(newAttachment(p.title, "note.txt", data, "admin"), data); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if accessShare, err = shareToken("Private", share); err != nil {
+    t.Fatal(err)
+  }
+}
+
+/* A request to the wiki as user, "" for someone not signed in */
+func accessRequest(t *testing.T, method, target, user string, body string) *httptest.ResponseRecorder {
+  t.Helper()
+  r := httptest.NewRequest(method, target, strings.NewReader(body))
+  if user != "" {
+    // A session for the HTML pages and the API, basic auth for WebDAV
+    w := httptest.NewRecorder()
+    if err := startSession(w, r, user, false); err != nil {
+      t.Fatal(err)
+    }
+    for _, c := range w.Result().Cookies() {
+      r.AddCookie(c)
+    }
+    r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":password")))
+  }
+  if method == http.MethodPost && strings.HasPrefix(target, "/save/") {
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  } else if body != "" {
+    r.Header.Set("Content-Type", "application/json")
+  }
+  w := httptest.NewRecorder()
+  accessMux.ServeHTTP(w, r)
+  return w
+}
+
+/* A way of reading a page: the status it answers with and what it shows
+  - exact is false for those that can't tell 404 from 410, which are
+    expected to say 404 for both
+*/
+type readSurface struct {
+  name string
+  exact bool
+  anonymous, signedIn, share bool // the readers it can serve
+  read func(t *testing.T, title, user, share string) (int, string)
+}
+
+func withShare(target, share string) string {
+  if share != "" {
+    return target + "?share=" + url.QueryEscape(share)
+  }
+  return target
+}
+
+var readSurfaces = []readSurface{
+  {"html", true, true, true, true, func(t *testing.T, title, user, share string) (int, string) {
+    w := accessRequest(t, http.MethodGet, withShare("/view/"+title, share), user, "")
+    return w.Code, w.Body.String()
+  }},
+  {"api", true, true, true, true, func(t *testing.T, title, user, share string) (int, string) {
+    w := accessRequest(t, http.MethodGet, withShare("/api/v1/pages/"+title, share), user, "")
+    return w.Code, w.Body.String()
+  }},
+  {"graphql", false, true, true, false, func(t *testing.T, title, user, share string) (int, string) {
+    q, _ := json.Marshal(map[string]string{"query": `{ page(title: "` + title + `") { body } }`})
+    w := accessRequest(t, http.MethodPost, "/graphql", user, string(q))
+    var out struct {
+      Data struct {
+        Page *struct{ Body string } `json:"page"`
+      } `json:"data"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+      t.Fatalf("graphql: %v: %s", err, w.Body)
+    }
+    if out.Data.Page == nil {
+      return http.StatusNotFound, ""
+    }
+    return http.StatusOK, out.Data.Page.Body
+  }},
+  {"grpc", false, true, false, false, func(t *testing.T, title, user, share string) (int, string) {
+    w := httptest.NewRecorder()
+    err := grpcGet(w, protoAppendBytes(nil, 1, []byte(title)))
+    if ge, ok := err.(*grpcError); ok && ge.code == grpcNotFound {
+      return http.StatusNotFound, ""
+    } else if err != nil {
+      t.Fatalf("grpc: %v", err)
+    }
+    fields, err := protoDecode(w.Body.Bytes()[5:])
+    if err != nil {
+      t.Fatalf("grpc: %v", err)
+    }
+    return http.StatusOK, string(fields[2])
+  }},
+  {"webdav", true, false, true, false, func(t *testing.T, title, user, share string) (int, string) {
+    w := accessRequest(t, http.MethodGet, davPrefix+title+".txt", user, "")
+    return w.Code, w.Body.String()
+  }},
+  {"attachments", false, true, true, true, func(t *testing.T, title, user, share string) (int, string) {
+    w := accessRequest(t, http.MethodGet, withShare("/files/"+title+"/note.txt", share), user, "")
+    if w.Code == http.StatusOK && w.Body.String() != "attachment of "+title {
+      t.Errorf("attachments: got %q", w.Body)
+    }
+    return w.Code, ""
+  }},
+}
+
+func TestReadAccess(t *testing.T) {
+  accessFixture(t)
+  cases := []struct {
+    title, user string
+    share bool
+    want int
+    text string // what the reader is shown, when they're shown the page
+  }{
+    {"Open", "", false, http.StatusOK, "open text"},
+    {"Open", "bob", false, http.StatusOK, "open text"},
+    {"Private", "", false, http.StatusNotFound, ""},
+    {"Private", "", true, http.StatusOK, "private text"},
+    {"Private", "bob", false, http.StatusNotFound, ""},
+    {"Private", "bob", true, http.StatusOK, "private text"},
+    {"Private", "alice", false, http.StatusOK, "private text"},
+    {"Private", "admin", false, http.StatusOK, "private text"},
+    {"Draft", "", false, http.StatusOK, "published text"},
+    {"Draft", "bob", false, http.StatusOK, "draft text"},
+    {"Scheduled", "", false, http.StatusNotFound, ""},
+    {"Scheduled", "bob", false, http.StatusOK, "scheduled text"},
+    {"Gone", "", false, http.StatusGone, ""},
+    {"Gone", "bob", false, http.StatusOK, "gone text"},
+    {"Locked", "", false, http.StatusOK, "locked text"},
+    {"Vault", "bob", false, http.StatusNotFound, ""},
+    {"Vault", "alice", false, http.StatusOK, "vault text"},
+  }
+  for _, s := range readSurfaces {
+    for _, c := range cases {
+      if c.user == "" && !s.anonymous || c.user != "" && !s.signedIn || c.share && !s.share {
+        continue
+      }
+      share := ""
+      if c.share {
+        share = accessShare
+      }
+      want := c.want
+      if !s.exact && want != http.StatusOK {
+        want = http.StatusNotFound
+      }
+      status, body := s.read(t, c.title, c.user, share)
+      if status != want {
+        t.Errorf("%s: %s as %q (share %v): status %d, want %d", s.name, c.title, c.user, c.share, status, want)
+        continue
+      }
+      if status == http.StatusOK && s.name != "attachments" && !strings.Contains(body, c.text) {
+        t.Errorf("%s: %s as %q (share %v): doesn't show %q", s.name, c.title, c.user, c.share, c.text)
+      }
+      if c.text != "draft text" && strings.Contains(body, "draft text") {
+        t.Errorf("%s: %s as %q (share %v): shows the draft", s.name, c.title, c.user, c.share)
+      }
+    }
+  }
+}
+
+/* What a write comes to */
+const (
+  writeOK = "ok"
+  writeNotFound = "not found"
+  writeProtected = "protected"
+  writeReview = "review"
+)
+
+/* A way of changing a page
+  - review is false for those that -review doesn't apply to
+*/
+type writeSurface struct {
+  name string
+  anonymous, signedIn, review bool
+  write func(t *testing.T, title, user string) string
+}
+
+/* The outcome for an HTTP status and error message */
+func writeOutcome(t *testing.T, surface string, status int, msg string) string {
+  switch {
+  case status < 400:
+    return writeOK
+  case status == http.StatusNotFound:
+    return writeNotFound
+  case status == http.StatusForbidden && strings.Contains(msg, errNeedsReview.Error()):
+    return writeReview
+  case status == http.StatusForbidden:
+    return writeProtected
+  }
+  t.Fatalf("%s: status %d: %s", surface, status, msg)
+  return ""
+}
+
+func errOutcome(t *testing.T, surface string, err error) string {
+  switch err {
+  case nil:
+    return writeOK
+  case errNoSuchPage:
+    return writeNotFound
+  case errProtected:
+    return writeProtected
+  case errNeedsReview:
+    return writeReview
+  }
+  t.Fatalf("%s: %v", surface, err)
+  return ""
+}
+
+var writeSurfaces = []writeSurface{
+  {"authorizeSave", true, true, true, func(t *testing.T, title, user string) string {
+    return errOutcome(t, "authorizeSave", authorizeSave(title, users.get(user)))
+  }},
+  {"html", true, true, true, func(t *testing.T, title, user string) string {
+    before, err := proposals.Proposals(title)
+    if err != nil {
+      t.Fatal(err)
+    }
+    w := accessRequest(t, http.MethodPost, "/save/"+title, user, "body=changed")
+    after, err := proposals.Proposals(title)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(after) > len(before) {
+      return writeReview
+    }
+    return writeOutcome(t, "html", w.Code, w.Body.String())
+  }},
+  {"api", true, true, true, func(t *testing.T, title, user string) string {
+    w := accessRequest(t, http.MethodPut, "/api/v1/pages/"+title, user, `{"body": "changed"}`)
+    return writeOutcome(t, "api", w.Code, w.Body.String())
+  }},
+  {"graphql", true, true, true, func(t *testing.T, title, user string) string {
+    q, _ := json.Marshal(map[string]string{"query": `mutation { savePage(title: "` + title + `", body: "changed") { title } }`})
+    w := accessRequest(t, http.MethodPost, "/graphql", user, string(q))
+    var out struct {
+      Errors []struct{ Message string } `json:"errors"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+      t.Fatalf("graphql: %v: %s", err, w.Body)
+    }
+    if len(out.Errors) == 0 {
+      return writeOK
+    }
+    for _, err := range []error{errNoSuchPage, errProtected, errNeedsReview} {
+      if strings.Contains(out.Errors[0].Message, err.Error()) {
+        return errOutcome(t, "graphql", err)
+      }
+    }
+    t.Fatalf("graphql: %s", out.Errors[0].Message)
+    return ""
+  }},
+  {"grpc", true, false, true, func(t *testing.T, title, user string) string {
+    req := protoAppendBytes(protoAppendBytes(nil, 1, []byte(title)), 2, []byte("changed"))
+    err := grpcPut(httptest.NewRecorder(), req, "grpc")
+    if ge, ok := err.(*grpcError); ok {
+      switch {
+      case ge.code == grpcNotFound:
+        return writeNotFound
+      case ge.msg == errNeedsReview.Error():
+        return writeReview
+      case ge.msg == errProtected.Error():
+        return writeProtected
+      }
+    }
+    return errOutcome(t, "grpc", err)
+  }},
+  {"webdav", false, true, true, func(t *testing.T, title, user string) string {
+    w := accessRequest(t, http.MethodPut, davPrefix+title+".txt", user, "changed")
+    return writeOutcome(t, "webdav", w.Code, w.Body.String())
+  }},
+  {"collab", true, true, true, func(t *testing.T, title, user string) string {
+    status, err := collabAccess(title, users.get(user))
+    if err != nil {
+      t.Fatal(err)
+    }
+    if status == http.StatusForbidden && reviewMode {
+      // The socket can't say why; under -review protection is always review
+      return writeReview
+    }
+    return writeOutcome(t, "collab", status, "")
+  }},
+  {"attachments", true, true, false, func(t *testing.T, title, user string) string {
+    w := accessRequest(t, http.MethodPut, "/files/"+title+"/new.txt", user, "new file")
+    return writeOutcome(t, "attachments", w.Code, w.Body.String())
+  }},
+}
+
+func TestWriteAccess(t *testing.T) {
+  cases := []struct {
+    title, user string
+    want, wantReview string // without and with -review
+  }{
+    {"Open", "", writeOK, writeOK},
+    {"Open", "bob", writeOK, writeOK},
+    {"Private", "", writeNotFound, writeNotFound},
+    {"Private", "bob", writeNotFound, writeNotFound},
+    {"Private", "alice", writeOK, writeOK},
+    {"Draft", "", writeNotFound, writeNotFound},
+    {"Draft", "bob", writeOK, writeOK},
+    {"Scheduled", "", writeNotFound, writeNotFound},
+    {"Scheduled", "bob", writeOK, writeOK},
+    {"Gone", "", writeNotFound, writeNotFound},
+    {"Locked", "", writeProtected, writeReview},
+    {"Locked", "bob", writeProtected, writeReview},
+    {"Locked", "admin", writeOK, writeReview},
+    {"Vault", "bob", writeNotFound, writeNotFound},
+    {"Vault", "alice", writeProtected, writeReview},
+    {"Vault", "admin", writeOK, writeReview},
+  }
+  for _, review := range []bool{false, true} {
+    for _, s := range writeSurfaces {
+      for _, c := range cases {
+        if c.user == "" && !s.anonymous || c.user != "" && !s.signedIn {
+          continue
+        }
+        // Each write starts from the fixture, as a successful one changes it
+        accessFixture(t)
+        reviewMode = review && s.review
+        want := c.want
+        if reviewMode {
+          want = c.wantReview
+        }
+        if got := s.write(t, c.title, c.user); got != want {
+          t.Errorf("%s: %s as %q (review %v): %s, want %s", s.name, c.title, c.user, reviewMode, got, want)
+        }
+      }
+    }
+  }
+  reviewMode = false
+}
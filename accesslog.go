@@ -0,0 +1,194 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "log"
+  "net"
+  "net/http"
+  "os"
+  "strconv"
+  "sync"
+  "time"
+)
+
+/* Access log
+  - With -access-log, one line per request goes to that file in the Combined
+    Log Format Apache uses, so the usual log analysers can read it:
+      127.0.0.1 - alice [02/Jan/2006:15:04:05 -0700] "GET /view/FrontPage HTTP/1.1" 200 1234 "-" "curl/8.0"
+  - Kept apart from the application log, which still goes to stderr
+  - Once the file reaches -access-log-max-size MB it is renamed to .1 (.1
+    to .2 and so on, keeping -access-log-keep old files) and a new one begun.
+    A reload reopens it, for when logrotate is moving it instead
+  - Requests that upgrade to a WebSocket are logged when they upgrade, with 101
+*/
+var accessLog = &rotatingFile{}
+
+type rotatingFile struct {
+  mu sync.Mutex
+  path string
+  maxSize int64 // 0 never rotates
+  keep int
+  f *os.File
+  size int64
+}
+
+/* Open the log at path for appending */
+func (l *rotatingFile) open(path string, maxSize int64, keep int) error {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.path, l.maxSize, l.keep = path, maxSize, keep
+  return l.reopen()
+}
+
+/* The caller holds mu */
+func (l *rotatingFile) reopen() error {
+  f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+  if err != nil {
+    return err
+  }
+  info, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return err
+  }
+  if l.f != nil {
+    l.f.Close()
+  }
+  l.f, l.size = f, info.Size()
+  return nil
+}
+
+/* Start a new file if the log is open; for reloads */
+func (l *rotatingFile) reload() error {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if l.f == nil {
+    return nil
+  }
+  return l.reopen()
+}
+
+func (l *rotatingFile) write(line []byte) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if l.f == nil {
+    return
+  }
+  if l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize && l.size > 0 {
+    if err := l.rotate(); err != nil {
+      log.Printf("access log: %v", err)
+    }
+  }
+  n, err := l.f.Write(line)
+  l.size += int64(n)
+  if err != nil {
+    log.Printf("access log: %v", err)
+  }
+}
+
+/* Shift path.1.. along, dropping the oldest, and start afresh; the caller holds mu */
+func (l *rotatingFile) rotate() error {
+  for i := l.keep - 1; i >= 1; i-- {
+    os.Rename(l.path+"."+strconv.Itoa(i), l.path+"."+strconv.Itoa(i+1))
+  }
+  if l.keep > 0 {
+    if err := os.Rename(l.path, l.path+".1"); err != nil {
+      return err
+    }
+  } else if err := os.Truncate(l.path, 0); err != nil {
+    return err
+  }
+  return l.reopen()
+}
+
+/* Wrapper writing each request to the access log */
+func logAccess(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    lw := &logWriter{ResponseWriter: w, r: r, start: time.Now()}
+    defer func() {
+      if !lw.hijacked {
+        accessLog.write(combinedLine(r, lw.status, lw.size, lw.start))
+      }
+    }()
+    next.ServeHTTP(lw, r)
+  })
+}
+
+/* One Combined Log Format line */
+func combinedLine(r *http.Request, status int, size int64, t time.Time) []byte {
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    host = requestAuthor(r) // a Unix socket: the proxy's forwarded address
+  }
+  user := "-"
+  if u := currentUser(r); u != nil {
+    user = u.Name
+  }
+  if status == 0 {
+    status = http.StatusOK
+  }
+  bytes := "-"
+  if size > 0 {
+    bytes = strconv.FormatInt(size, 10)
+  }
+  return []byte(fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n", orDash(host), user, t.Format("02/Jan/2006:15:04:05 -0700"),
+    strconv.Quote(r.Method+" "+r.RequestURI+" "+r.Proto), status, bytes,
+    strconv.Quote(orDash(r.Referer())), strconv.Quote(orDash(r.UserAgent()))))
+}
+
+func orDash(s string) string {
+  if s == "" {
+    return "-"
+  }
+  return s
+}
+
+/* Records the status and size for the log, passing flushes and hijacks through */
+type logWriter struct {
+  http.ResponseWriter
+  r *http.Request
+  start time.Time
+  status int
+  size int64
+  hijacked bool
+}
+
+func (lw *logWriter) WriteHeader(status int) {
+  if lw.status == 0 {
+    lw.status = status
+  }
+  lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *logWriter) Write(b []byte) (int, error) {
+  if lw.status == 0 {
+    lw.status = http.StatusOK
+  }
+  n, err := lw.ResponseWriter.Write(b)
+  lw.size += int64(n)
+  return n, err
+}
+
+func (lw *logWriter) Flush() {
+  if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+/* WebSockets take the connection over, so their line is written here */
+func (lw *logWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  hj, ok := lw.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errors.New("hijacking not supported")
+  }
+  conn, rw, err := hj.Hijack()
+  if err == nil {
+    lw.hijacked = true
+    accessLog.write(combinedLine(lw.r, http.StatusSwitchingProtocols, 0, lw.start))
+  }
+  return conn, rw, err
+}
+
+func (lw *logWriter) Unwrap() http.ResponseWriter { return lw.ResponseWriter }
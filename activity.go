@@ -0,0 +1,97 @@
+package main
+
+import (
+  "net/http"
+  "strings"
+  "time"
+)
+
+/* Activity stream
+  - Saving, deleting and renaming pages and uploading files are written to
+    the audit log (audit.go) with who did it, and /activity lists what the
+    signed in user has done, newest first. /activity/{name} lists another
+    user's
+  - A rename through the API or WebDAV saves the new page and deletes the
+    old one, so it shows as those two as well as the rename
+  - Anonymous changes are logged with the address they came from, and have
+    no stream
+  - Only the newest activityLimit entries are shown, and not those on pages
+    the viewer can't read
+  - There are no comments in the wiki, so there are none in the stream
+*/
+var activityEvents = map[string]bool{"page-saved": true, "page-deleted": true, "page-renamed": true, "file-uploaded": true}
+
+const activityLimit = 100
+
+/* Log a change to page by author, a user name or, for anonymous changes,
+  an address (see requestAuthor)
+*/
+func auditActivity(event, author, page, detail string) {
+  e := auditEntry{Time: time.Now().UTC(), Event: event, Page: page, Detail: detail}
+  if users.get(author) != nil {
+    e.User = author
+  } else {
+    e.IP = author
+  }
+  appendAudit(e)
+}
+
+type activityItem struct {
+  auditEntry
+}
+
+/* What happened, for the list */
+func (a activityItem) Action() string {
+  switch a.Event {
+  case "page-saved":
+    return "saved"
+  case "page-deleted":
+    return "deleted"
+  case "page-renamed":
+    return "renamed " + a.Detail + " to"
+  case "file-uploaded":
+    return "uploaded " + a.Detail + " to"
+  }
+  return a.Event
+}
+
+/* Data for the activity page */
+type activityData struct {
+  Name string
+  Own bool
+  Items []activityItem
+  Zone *time.Location
+}
+
+/* A user's activity at /activity/{name}, or the viewer's own at /activity */
+func activityHandler(w http.ResponseWriter, r *http.Request) {
+  viewer := currentUser(r)
+  name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/activity"), "/")
+  if name == "" {
+    if viewer == nil {
+      http.Redirect(w, r, "/login?next=/activity", http.StatusFound)
+      return
+    }
+    name = viewer.Name
+  }
+  if users.get(name) == nil {
+    http.NotFound(w, r)
+    return
+  }
+  entries, err := recentAudit(activityLimit, func(e auditEntry) bool {
+    if !activityEvents[e.Event] || e.User != name {
+      return false
+    }
+    ok, err := pageReadableBy(e.Page, viewer)
+    return err == nil && ok
+  })
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data := &activityData{Name: name, Own: viewer != nil && viewer.Name == name, Zone: viewerZone(r)}
+  for _, e := range entries {
+    data.Items = append(data.Items, activityItem{e})
+  }
+  renderTemplate(w, "activity", data)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+  "net/http"
+  "net/url"
+  "time"
+)
+
+/* Wrapper that only lets admins through
+  - Takes the signed in user, or HTTP basic auth for scripts
+  - Browsers that aren't signed in are sent to the login page and back
+*/
+func requireAdmin(fn http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    u := currentUser(r)
+    if name, pass, ok := r.BasicAuth(); ok && u == nil {
+      if loginLocked(w, name, clientIP(r)) {
+        http.Error(w, errLockedOut.Error(), http.StatusTooManyRequests)
+        return
+      }
+      u, _ = users.authenticate(name, pass)
+      if u == nil {
+        loginFailed(name, clientIP(r), errBadLogin.Error())
+        w.Header().Set("WWW-Authenticate", `Basic realm="wiki admin"`)
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+      }
+      // Basic auth has no room for a second factor
+      if u.TOTPSecret != "" || twoFactorRequired(u) {
+        http.Error(w, "This account uses two-factor sign in: sign in at /login", http.StatusUnauthorized)
+        return
+      }
+    }
+    if u == nil {
+      http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+      return
+    }
+    if !u.Admin {
+      http.Error(w, "Forbidden", http.StatusForbidden)
+      return
+    }
+    fn(w, r)
+  }
+}
+
+/* Data for the admin dashboard */
+type adminData struct {
+  Usage []*Usage
+  QuotaPages int
+  QuotaBytes int64
+  Interwiki string
+  Features []featureState
+  Groups []groupInfo
+  Invites []inviteInfo
+  OpenRegistration bool
+  Base string // for the invite links
+  Lockouts []lockout
+  Audit []auditEntry
+  Tokens []tokenInfo
+  APIQuota int
+  Jobs []Job
+  Cron []cronInfo
+  Integrity []integrityProblem
+  Zone *time.Location
+}
+
+/* Admin dashboard at /admin
+  - Shows storage used by each namespace against the quota, and the forms
+    for maintenance mode, feature flags, invites, groups, branding, interwiki
+    prefixes and rolling back a user's edits
+  - Lists sign in lockouts, API tokens with their quotas, scheduled tasks,
+    background jobs, corrupted content, and the newest audit log entries
+*/
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+  usage, err := sortedUsage()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  invites, err := inviteList()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  entries, err := recentAudit(20, func(e auditEntry) bool { return !activityEvents[e.Event] })
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data := &adminData{
+    Usage: usage, QuotaPages: quotaPages, QuotaBytes: quotaBytes, Interwiki: interwikiText(), Features: featureList(),
+    Groups: groupList(), Invites: invites, OpenRegistration: openRegistration, Base: siteBase(r),
+    Lockouts: lockoutList(), Audit: entries, Zone: viewerZone(r),
+    Tokens: tokenList(""), APIQuota: apiQuota, Jobs: jobList(30), Cron: cronList(),
+    Integrity: integrityList(),
+  }
+  err = templates.Load().ExecuteTemplate(w, "admin.html", data)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+  }
+}
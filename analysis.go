@@ -0,0 +1,442 @@
+package main
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+)
+
+/* Text analysis for search (search.go)
+  - Text is split into words, which are folded to lower case and reduced to
+    their stem, so "connections", "connected" and "connecting" all find one
+    another. -search-language picks the stemmer: english (the default, with
+    Porter's algorithm), german, french and spanish (light stemmers that
+    remove plurals and gender endings), or simple, which only folds case, for
+    content in any other language
+  - Chinese, Japanese and Korean aren't written with spaces between words, so
+    runs of their characters are split into overlapping pairs instead, and
+    a search for a run finds its pairs in order. This happens whatever the
+    language
+  - The language's stop words ("the", "of", ...) are left out of queries,
+    unless that would leave nothing or they're in a quoted phrase; they're
+    kept in the text, so phrases match as written
+*/
+var searchLanguage = "english"
+
+type analyzer struct {
+  stem func(string) string // nil for none
+  stop map[string]bool
+}
+
+var analyzers = map[string]analyzer{
+  "english": {stem: porterStem, stop: wordSet(englishStopWords)},
+  "german": {stem: germanStem, stop: wordSet(germanStopWords)},
+  "french": {stem: frenchStem, stop: wordSet(frenchStopWords)},
+  "spanish": {stem: spanishStem, stop: wordSet(spanishStopWords)},
+  "simple": {},
+}
+
+func setSearchLanguage(s string) error {
+  if _, ok := analyzers[s]; !ok {
+    names := make([]string, 0, len(analyzers))
+    for name := range analyzers {
+      names = append(names, name)
+    }
+    sort.Strings(names)
+    return fmt.Errorf("-search-language must be one of %s, not %q", strings.Join(names, ", "), s)
+  }
+  searchLanguage = s
+  return nil
+}
+
+/* The analyzer for -search-language */
+func searchAnalyzer() analyzer {
+  return analyzers[searchLanguage]
+}
+
+/* A word of analysed text, and where it came from */
+type token struct {
+  term string
+  start, end int // byte offsets in the text
+}
+
+func isCJK(r rune) bool {
+  return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func isWordRune(r rune) bool {
+  return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+/* The tokens of text, in order */
+func (a analyzer) tokens(text string) []token {
+  var toks []token
+  for i := 0; i < len(text); {
+    r, size := utf8.DecodeRuneInString(text[i:])
+    switch {
+    case isCJK(r):
+      // Offsets of each character of the run, and of its end
+      at := []int{i}
+      for i += size; i < len(text); i += size {
+        if r, size = utf8.DecodeRuneInString(text[i:]); !isCJK(r) {
+          break
+        }
+        at = append(at, i)
+      }
+      at = append(at, i)
+      if len(at) == 2 {
+        toks = append(toks, token{text[at[0]:at[1]], at[0], at[1]})
+      }
+      for k := 0; k+2 < len(at); k++ {
+        toks = append(toks, token{text[at[k]:at[k+2]], at[k], at[k+2]})
+      }
+    case isWordRune(r):
+      start := i
+      for i += size; i < len(text); i += size {
+        if r, size = utf8.DecodeRuneInString(text[i:]); !isWordRune(r) || isCJK(r) {
+          break
+        }
+      }
+      toks = append(toks, token{a.term(text[start:i]), start, i})
+    default:
+      i += size
+    }
+  }
+  return toks
+}
+
+/* A word as it's compared: in lower case and stemmed */
+func (a analyzer) term(word string) string {
+  word = strings.ToLower(word)
+  if a.stem != nil {
+    word = a.stem(word)
+  }
+  return word
+}
+
+/* Whether word, as written, is one of the language's stop words */
+func (a analyzer) isStop(word string) bool {
+  return a.stop[strings.ToLower(word)]
+}
+
+func wordSet(s string) map[string]bool {
+  m := map[string]bool{}
+  for _, w := range strings.Fields(s) {
+    m[w] = true
+  }
+  return m
+}
+
+const englishStopWords = `a an and are as at be but by for if in into is it no not of on or
+  such that the their then there these they this to was will with`
+
+const germanStopWords = `aber als am an auch auf aus bei bin bis bist da dadurch daher darum
+  das dass dein deine dem den der des dessen dich die dies dieser dieses dir du durch ein eine
+  einem einen einer eines er es euer eure für hatte hatten hattest hattet hier hinter ich ihr
+  ihre im in ist ja jede jedem jeden jeder jedes jener jenes jetzt kann kannst können könnt
+  machen mein meine mit muß mußt musst müssen müßt nach nachdem nein nicht nun oder seid sein
+  seine sich sie sind soll sollen sollst sollt sonst soweit sowie und unser unsere unter vom
+  von vor wann warum was weiter weitere wenn wer werde werden werdet weshalb wie wieder wieso
+  wir wird wirst wo woher wohin zu zum zur über`
+
+const frenchStopWords = `au aux avec ce ces dans de des du elle en et eux il je la le les leur
+  lui ma mais me même mes moi mon ne nos notre nous on ou par pas pour qu que qui sa se ses son
+  sur ta te tes toi ton tu un une vos votre vous c d j l à m n s t y été étée étées étés étant
+  suis es est sommes êtes sont serai seras sera serons serez seront`
+
+const spanishStopWords = `de la que el en y a los del se las por un para con no una su al lo
+  como más pero sus le ya o este sí porque esta entre cuando muy sin sobre también me hasta hay
+  donde quien desde todo nos durante todos uno les ni contra otros ese eso ante ellos e esto mí
+  antes algunos qué unos yo otro otras otra él tanto esa estos mucho quienes nada muchos cual
+  poco ella estar estas algunas algo nosotros`
+
+/* Porter's stemming algorithm for English, as he published it in 1980 */
+func porterStem(word string) string {
+  if len(word) <= 2 {
+    return word
+  }
+  for i := 0; i < len(word); i++ {
+    if word[i] < 'a' || word[i] > 'z' {
+      return word
+    }
+  }
+  w := &porterWord{b: []byte(word), k: len(word) - 1}
+  w.step1ab()
+  if w.k > 0 {
+    w.step1c()
+    w.replace(porterStep2)
+    w.replace(porterStep3)
+    w.step4()
+    w.step5()
+  }
+  return string(w.b[:w.k+1])
+}
+
+/* The word being stemmed: b[:k+1], and j marking the end of the stem while a
+  suffix is looked at
+*/
+type porterWord struct {
+  b []byte
+  k, j int
+}
+
+func (w *porterWord) cons(i int) bool {
+  switch w.b[i] {
+  case 'a', 'e', 'i', 'o', 'u':
+    return false
+  case 'y':
+    return i == 0 || !w.cons(i-1)
+  }
+  return true
+}
+
+/* The number of vowel-consonant sequences in b[:j+1] */
+func (w *porterWord) m() int {
+  n, i := 0, 0
+  for ; i <= w.j && w.cons(i); i++ {
+  }
+  for i <= w.j {
+    for ; i <= w.j && !w.cons(i); i++ {
+    }
+    if i > w.j {
+      break
+    }
+    n++
+    for ; i <= w.j && w.cons(i); i++ {
+    }
+  }
+  return n
+}
+
+func (w *porterWord) vowelInStem() bool {
+  for i := 0; i <= w.j; i++ {
+    if !w.cons(i) {
+      return true
+    }
+  }
+  return false
+}
+
+func (w *porterWord) doubleCons(i int) bool {
+  return i >= 1 && w.b[i] == w.b[i-1] && w.cons(i)
+}
+
+/* Whether i ends consonant-vowel-consonant, the last not w, x or y */
+func (w *porterWord) cvc(i int) bool {
+  if i < 2 || !w.cons(i) || w.cons(i-1) || !w.cons(i-2) {
+    return false
+  }
+  c := w.b[i]
+  return c != 'w' && c != 'x' && c != 'y'
+}
+
+func (w *porterWord) ends(s string) bool {
+  if len(s) > w.k+1 || string(w.b[w.k+1-len(s):w.k+1]) != s {
+    return false
+  }
+  w.j = w.k - len(s)
+  return true
+}
+
+func (w *porterWord) setTo(s string) {
+  w.b = append(w.b[:w.j+1], s...)
+  w.k = w.j + len(s)
+}
+
+/* Plurals, -ed and -ing */
+func (w *porterWord) step1ab() {
+  if w.b[w.k] == 's' {
+    switch {
+    case w.ends("sses"):
+      w.k -= 2
+    case w.ends("ies"):
+      w.setTo("i")
+    case w.b[w.k-1] != 's':
+      w.k--
+    }
+  }
+  if w.ends("eed") {
+    if w.m() > 0 {
+      w.k--
+    }
+  } else if (w.ends("ed") || w.ends("ing")) && w.vowelInStem() {
+    w.k = w.j
+    switch {
+    case w.ends("at"):
+      w.setTo("ate")
+    case w.ends("bl"):
+      w.setTo("ble")
+    case w.ends("iz"):
+      w.setTo("ize")
+    case w.doubleCons(w.k):
+      if c := w.b[w.k]; c != 'l' && c != 's' && c != 'z' {
+        w.k--
+      }
+    default:
+      w.j = w.k
+      if w.m() == 1 && w.cvc(w.k) {
+        w.setTo("e")
+      }
+    }
+  }
+}
+
+/* A final y to i when there's a vowel before it */
+func (w *porterWord) step1c() {
+  if w.ends("y") && w.vowelInStem() {
+    w.b[w.k] = 'i'
+  }
+}
+
+var porterStep2 = [][2]string{
+  {"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+  {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+  {"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+  {"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+  {"logi", "log"},
+}
+
+var porterStep3 = [][2]string{
+  {"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"}, {"ful", ""},
+  {"ness", ""},
+}
+
+/* Replace the first of the suffixes the word ends with, if the stem is long enough */
+func (w *porterWord) replace(suffixes [][2]string) {
+  for _, s := range suffixes {
+    if w.ends(s[0]) {
+      if w.m() > 0 {
+        w.setTo(s[1])
+      }
+      return
+    }
+  }
+}
+
+var porterStep4 = []string{
+  "al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment", "ent", "ion", "ou",
+  "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+/* -ant, -ence and the like, from a long enough stem */
+func (w *porterWord) step4() {
+  for _, s := range porterStep4 {
+    if !w.ends(s) {
+      continue
+    }
+    if s == "ion" && (w.j < 0 || (w.b[w.j] != 's' && w.b[w.j] != 't')) {
+      return
+    }
+    if w.m() > 1 {
+      w.k = w.j
+    }
+    return
+  }
+}
+
+/* A final -e, and -ll to -l */
+func (w *porterWord) step5() {
+  w.j = w.k
+  if w.b[w.k] == 'e' {
+    if a := w.m(); a > 1 || a == 1 && !w.cvc(w.k-1) {
+      w.k--
+    }
+  }
+  if w.b[w.k] == 'l' && w.doubleCons(w.k) && w.m() > 1 {
+    w.k--
+  }
+}
+
+/* The light stemmers below follow Jacques Savoy's, as Lucene has them */
+
+/* German: umlauts folded, then plural and case endings removed */
+func germanStem(word string) string {
+  r := []rune(word)
+  if len(r) < 5 {
+    return word
+  }
+  for i, c := range r {
+    switch c {
+    case 'ä':
+      r[i] = 'a'
+    case 'ö':
+      r[i] = 'o'
+    case 'ü':
+      r[i] = 'u'
+    }
+  }
+  n := len(r)
+  switch {
+  case n > 6 && string(r[n-3:]) == "nen":
+    n -= 3
+  case n > 5 && (string(r[n-2:]) == "en" || string(r[n-2:]) == "se" || string(r[n-2:]) == "es" || string(r[n-2:]) == "er"):
+    n -= 2
+  case r[n-1] == 'n' || r[n-1] == 's' || r[n-1] == 'r' || r[n-1] == 'e':
+    n--
+  }
+  return string(r[:n])
+}
+
+/* French: plurals, and the feminine and -er endings */
+func frenchStem(word string) string {
+  r := []rune(word)
+  n := len(r)
+  if n < 6 {
+    return word
+  }
+  if r[n-1] == 'x' {
+    if r[n-3] == 'a' && r[n-2] == 'u' && r[n-4] != 'e' {
+      r[n-2] = 'l' // chevaux to cheval
+    }
+    return string(r[:n-1])
+  }
+  for _, c := range []rune{'s', 'r', 'e', 'é'} {
+    if r[n-1] == c {
+      n--
+    }
+  }
+  if r[n-1] == r[n-2] && unicode.IsLetter(r[n-1]) {
+    n--
+  }
+  return string(r[:n])
+}
+
+/* Spanish: accents folded, then plurals and gender endings removed */
+func spanishStem(word string) string {
+  r := []rune(word)
+  n := len(r)
+  if n < 5 {
+    return word
+  }
+  for i, c := range r {
+    switch c {
+    case 'à', 'á', 'â', 'ä':
+      r[i] = 'a'
+    case 'ò', 'ó', 'ô', 'ö':
+      r[i] = 'o'
+    case 'è', 'é', 'ê', 'ë':
+      r[i] = 'e'
+    case 'ù', 'ú', 'û', 'ü':
+      r[i] = 'u'
+    case 'ì', 'í', 'î', 'ï':
+      r[i] = 'i'
+    }
+  }
+  switch r[n-1] {
+  case 'o', 'a', 'e':
+    n--
+  case 's':
+    switch {
+    case r[n-2] == 'e' && r[n-3] == 's' && r[n-4] == 'e':
+      n -= 2
+    case r[n-2] == 'e' && r[n-3] == 'c':
+      r[n-3] = 'z' // luces to luz
+      n -= 2
+    case r[n-2] == 'o' || r[n-2] == 'a' || r[n-2] == 'e':
+      n -= 2
+    }
+  }
+  return string(r[:n])
+}
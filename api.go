@@ -0,0 +1,470 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/* JSON API
+  - Served in versions, /api/v1 and /api/v2, which differ in the JSON for
+    pages (see apiversion.go); the paths below are the same in each
+  - GET /api/v1/pages lists page titles, with paging and sorting as /pages
+    (see listing.go); X-Total-Count and Link headers point at the rest
+  - GET /api/v1/pages/{title} returns a page
+  - GET /api/v1/search?q= searches the pages' text (see search.go)
+  - PUT /api/v1/pages/{title} saves a page from {"body": "..."}
+  - GET /api/v1/preview/{title} returns a short summary of a page for link previews
+  - POST /api/v1/upload/{title} stores an image from the editor (see attachments.go)
+  - POST /api/v1/batch applies several creates, updates, deletes and renames at once
+  - POST /api/v1/shortlinks/{title} gives a page a short link (see shortlink.go)
+  - GET /api/v1/graph returns the links between pages (see graph.go)
+  - GET /api/v1/tree returns the pages nested by title (see tree.go)
+  - GET /api/v1/notifications returns the caller's notifications (see notification.go)
+  - A page's ETag is a hash of its body. GET honours If-None-Match, and PUT
+    honours If-Match and If-None-Match: * for optimistic concurrency
+  - Errors are returned as {"error": "..."} with the matching status code
+  - Scripts sign in with an API token (apitoken.go) and are held to a quota
+    of requests (ratelimit.go)
+  - PUT and POST take an Idempotency-Key header so a retry doesn't save twice
+    (idempotency.go)
+*/
+
+/* JSON form of a Page
+  - Body is a string here rather than []byte, which encoding/json would base64
+*/
+type apiPage struct {
+  Title string `json:"title"`
+  Body string `json:"body"`
+  Stats *pageStats `json:"stats,omitempty"` // only in responses
+  Minor bool `json:"minor,omitempty"` // only in requests, marks a minor edit
+}
+
+func newAPIPage(p *Page) apiPage {
+  stats := bodyStats(p.Body)
+  return apiPage{Title: p.Title, Body: string(p.Body), Stats: &stats}
+}
+
+/* Write v as a JSON response with the given status */
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json; charset=utf-8")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(v)
+}
+
+/* Write an error as a JSON response */
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+  writeJSON(w, status, map[string]string{"error": msg})
+}
+
+/* GET /api/{version}/pages */
+func apiPagesHandler(w http.ResponseWriter, r *http.Request, v *apiVersion) {
+  if r.Method != http.MethodGet {
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  q, err := parseListQuery(r.URL.Query(), v.listLimit)
+  if err != nil {
+    writeJSONError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  titles, total, err := queryPages(q, currentUser(r))
+  if err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  w.Header().Set("X-Total-Count", strconv.Itoa(total))
+  prev, next := q.neighbours(total)
+  if prev != "" {
+    w.Header().Add("Link", "<"+v.prefix()+"/pages?"+prev+`>; rel="prev"`)
+  }
+  if next != "" {
+    w.Header().Add("Link", "<"+v.prefix()+"/pages?"+next+`>; rel="next"`)
+  }
+  writeJSON(w, http.StatusOK, v.list(v, titles, total, prev, next))
+}
+
+/* GET or PUT /api/{version}/pages/{title}
+  - Title is validated with the same pattern as the HTML handlers
+  - PUT applies the same checks as saveHandler (see checkSave)
+*/
+func apiPageHandler(w http.ResponseWriter, r *http.Request, v *apiVersion) {
+  title := strings.TrimPrefix(r.URL.Path, "/pages/")
+  if !validTitle.MatchString(title) {
+    writeJSONError(w, http.StatusNotFound, "invalid page title")
+    return
+  }
+  switch r.Method {
+  case http.MethodGet:
+    p, err := viewPage(title)
+    if os.IsNotExist(err) {
+      writeJSONError(w, http.StatusNotFound, "page not found")
+      return
+    }
+    if err != nil {
+      writeJSONError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    p, _, status, err := readStatus(r, p)
+    if err != nil {
+      writeJSONError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    switch status {
+    case http.StatusNotFound:
+      writeJSONError(w, status, "page not found")
+      return
+    case http.StatusGone:
+      writeJSONError(w, status, "page has expired")
+      return
+    }
+    w.Header().Set("ETag", pageETag(p.Body))
+    if etagMatches(r.Header.Get("If-None-Match"), pageETag(p.Body), true) {
+      w.WriteHeader(http.StatusNotModified)
+      return
+    }
+    writeJSON(w, http.StatusOK, v.page(p))
+  case http.MethodPut:
+    // JSON escaping can grow the body up to 6x (\u0000), so allow for that here
+    data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 6*maxBodySize+4096))
+    if err != nil {
+      writeJSONError(w, http.StatusRequestEntityTooLarge, errBodyTooLarge.Error())
+      return
+    }
+    in, err := v.decodePage(data)
+    if err != nil {
+      writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+      return
+    }
+    p := &Page{Title: title, Body: []byte(in.Body)}
+    if err := authorizeSave(title, currentUser(r)); err != nil {
+      writeJSONError(w, saveErrorStatus(err), err.Error())
+      return
+    }
+    if err := checkSave(p); err != nil {
+      writeJSONError(w, saveErrorStatus(err), err.Error())
+      return
+    }
+    unlock, err := lockPage(title)
+    if err != nil {
+      writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+      return
+    }
+    defer unlock()
+    if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+      if err := checkPreconditions(r, title); err == errPrecondition {
+        writeJSONError(w, http.StatusPreconditionFailed, err.Error())
+        return
+      } else if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+      }
+    }
+    if err := p.saveLocked(requestAuthor(r), in.Minor); err != nil {
+      writeJSONError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    p, _, status, err := readStatus(r, p)
+    if err != nil {
+      writeJSONError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    switch status {
+    case http.StatusNotFound:
+      writeJSONError(w, status, "page not found")
+      return
+    case http.StatusGone:
+      writeJSONError(w, status, "page has expired")
+      return
+    }
+    w.Header().Set("ETag", pageETag(p.Body))
+    writeJSON(w, http.StatusOK, v.page(p))
+  default:
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+  }
+}
+
+/* Longest summary in a link preview, in characters */
+const previewLength = 300
+
+type apiPreview struct {
+  Title string `json:"title"`
+  Summary string `json:"summary"`
+  Modified time.Time `json:"modified"`
+}
+
+/* GET /api/v1/preview/{title}: the title, first paragraph and modification time */
+func apiPreviewHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  title := strings.TrimPrefix(r.URL.Path, "/preview/")
+  if !validTitle.MatchString(title) {
+    writeJSONError(w, http.StatusNotFound, "invalid page title")
+    return
+  }
+  info, err := store.Stat(title)
+  if err == nil {
+    var p *Page
+    p, err = loadPage(title)
+    if err == nil {
+      var status int
+      p, _, status, err = readStatus(r, p)
+      if err == nil && status == http.StatusOK {
+        writeJSON(w, http.StatusOK, apiPreview{Title: title, Summary: firstParagraph(p.Body, previewLength), Modified: info.Modified})
+        return
+      }
+      if err == nil {
+        err = os.ErrNotExist
+      }
+    }
+  }
+  if os.IsNotExist(err) {
+    writeJSONError(w, http.StatusNotFound, "page not found")
+    return
+  }
+  writeJSONError(w, http.StatusInternalServerError, err.Error())
+}
+
+/* Strong ETag for a page body */
+func pageETag(body []byte) string {
+  sum := sha256.Sum256(body)
+  return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+/* Whether an If-Match or If-None-Match header value matches etag
+  - weak compares ignoring W/, as If-None-Match does; If-Match needs strong tags
+*/
+func etagMatches(header, etag string, weak bool) bool {
+  for _, tag := range strings.Split(header, ",") {
+    tag = strings.TrimSpace(tag)
+    if tag == "*" {
+      return true
+    }
+    if weak {
+      tag = strings.TrimPrefix(tag, "W/")
+    }
+    if tag == etag {
+      return true
+    }
+  }
+  return false
+}
+
+var errPrecondition = errors.New("page does not match the request's If-Match or If-None-Match")
+
+/* Check a PUT's If-Match and If-None-Match against the current page */
+func checkPreconditions(r *http.Request, title string) error {
+  var current string
+  exists := true
+  body, err := store.Load(title)
+  if os.IsNotExist(err) {
+    exists = false
+  } else if err != nil {
+    return err
+  } else {
+    current = pageETag(body)
+  }
+  if im := r.Header.Get("If-Match"); im != "" && (!exists || !etagMatches(im, current, false)) {
+    return errPrecondition
+  }
+  if inm := r.Header.Get("If-None-Match"); inm != "" && exists && etagMatches(inm, current, true) {
+    return errPrecondition
+  }
+  return nil
+}
+
+/* One operation in a batch request
+  - create and update take a body, rename takes new_title
+  - A rename takes the page's visibility, protection, schedule and draft
+    status with it, leaving none behind at the old title
+*/
+type batchOp struct {
+  Op string `json:"op"`
+  Title string `json:"title"`
+  NewTitle string `json:"new_title,omitempty"`
+  Body string `json:"body,omitempty"`
+}
+
+/* Most operations one batch may hold */
+const maxBatchOps = 10
+
+/* Error for a batch, pointing at the operation that caused it */
+type batchError struct {
+  Error string `json:"error"`
+  Index int `json:"index"`
+}
+
+/* Turn batch operations into store writes
+  - Checks every operation against the state the earlier operations leave behind,
+    so e.g. a create followed by a rename of the new page is fine
+  - Returns the index of the offending operation with the error
+*/
+func planBatch(ops []batchOp, u *User) ([]storeOp, int, int, error) {
+  exists := map[string]bool{}
+  has := func(title string) bool {
+    if e, ok := exists[title]; ok {
+      return e
+    }
+    return pageExists(title)
+  }
+  writes := []storeOp{}
+  for i, op := range ops {
+    if !validTitle.MatchString(op.Title) {
+      return nil, i, http.StatusUnprocessableEntity, errors.New("invalid page title")
+    }
+    if err := authorizeWrite(op.Title, u); err != nil {
+      return nil, i, saveErrorStatus(err), err
+    }
+    switch op.Op {
+    case "create", "update":
+      if op.Op == "create" && has(op.Title) {
+        return nil, i, http.StatusConflict, errors.New("page already exists")
+      }
+      if op.Op == "update" && !has(op.Title) {
+        return nil, i, http.StatusNotFound, errors.New("page not found")
+      }
+      p := &Page{Title: op.Title, Body: []byte(op.Body)}
+      if err := authorizeSave(op.Title, u); err != nil {
+        return nil, i, saveErrorStatus(err), err
+      }
+      if err := checkSave(p); err != nil {
+        return nil, i, saveErrorStatus(err), err
+      }
+      writes = append(writes, storeOp{Title: op.Title, Body: p.Body})
+      exists[op.Title] = true
+    case "delete":
+      if !has(op.Title) {
+        return nil, i, http.StatusNotFound, errors.New("page not found")
+      }
+      writes = append(writes, storeOp{Title: op.Title, Delete: true})
+      exists[op.Title] = false
+    case "rename":
+      if !has(op.Title) {
+        return nil, i, http.StatusNotFound, errors.New("page not found")
+      }
+      if !validTitle.MatchString(op.NewTitle) {
+        return nil, i, http.StatusUnprocessableEntity, errors.New("invalid new title")
+      }
+      if has(op.NewTitle) {
+        return nil, i, http.StatusConflict, errors.New("new title already exists")
+      }
+      if err := authorizeWrite(op.NewTitle, u); err != nil {
+        return nil, i, saveErrorStatus(err), err
+      }
+      body, err := batchBody(writes, op.Title)
+      if err != nil {
+        return nil, i, http.StatusInternalServerError, err
+      }
+      meta, err := batchMeta(writes, op.Title)
+      if err != nil {
+        return nil, i, http.StatusInternalServerError, err
+      }
+      // Share links are signed for the old title, so they don't come along
+      meta.Shares = nil
+      writes = append(writes, storeOp{Title: op.NewTitle, Body: body, Meta: &meta}, storeOp{Title: op.Title, Delete: true, Meta: &PageMeta{}})
+      exists[op.NewTitle], exists[op.Title] = true, false
+    default:
+      return nil, i, http.StatusBadRequest, errors.New("unknown op " + strconv.Quote(op.Op))
+    }
+  }
+  return writes, 0, 0, nil
+}
+
+/* Body of title once writes have been applied, for renaming a page the batch wrote */
+func batchBody(writes []storeOp, title string) ([]byte, error) {
+  for i := len(writes) - 1; i >= 0; i-- {
+    if writes[i].Title == title {
+      return writes[i].Body, nil
+    }
+  }
+  return store.Load(title)
+}
+
+/* Metadata of title once writes have been applied, for renaming a page the
+  batch renamed
+*/
+func batchMeta(writes []storeOp, title string) (PageMeta, error) {
+  for i := len(writes) - 1; i >= 0; i-- {
+    if writes[i].Title == title && writes[i].Meta != nil {
+      return *writes[i].Meta, nil
+    }
+  }
+  return pageMeta.Load(title)
+}
+
+/* POST /api/v1/batch
+  - Takes {"ops": [{"op": "create", "title": "...", "body": "..."}, ...]}
+  - Every operation is checked before anything is written; if one fails the
+    whole batch is rejected with its index
+  - The writes are applied atomically when the store supports it, which the
+    response reports as "atomic"
+  - At most maxBatchOps operations, and a body no bigger than that many
+    PUTs could send, or it's turned away with a 413
+*/
+func apiBatchHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchOps*(6*maxBodySize+4096)))
+  if err != nil {
+    writeJSONError(w, http.StatusRequestEntityTooLarge, errBodyTooLarge.Error())
+    return
+  }
+  var in struct {
+    Ops []batchOp `json:"ops"`
+  }
+  if err := json.Unmarshal(data, &in); err != nil {
+    writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+    return
+  }
+  if len(in.Ops) > maxBatchOps {
+    writeJSONError(w, http.StatusRequestEntityTooLarge, "too many operations, at most "+strconv.Itoa(maxBatchOps))
+    return
+  }
+  var titles []string
+  for _, op := range in.Ops {
+    titles = append(titles, op.Title)
+    if op.NewTitle != "" {
+      titles = append(titles, op.NewTitle)
+    }
+  }
+  unlock, err := lockPages(titles)
+  if err != nil {
+    writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+    return
+  }
+  defer unlock()
+  writes, index, status, err := planBatch(in.Ops, currentUser(r))
+  if err != nil {
+    writeJSON(w, status, batchError{Error: err.Error(), Index: index})
+    return
+  }
+  atomic, err := applyOps(writes, requestAuthor(r))
+  if err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  for _, op := range in.Ops {
+    if op.Op == "rename" {
+      if err := recordRename(op.Title, op.NewTitle, requestAuthor(r)); err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+      }
+      if err := renameShortLink(op.Title, op.NewTitle); err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+      }
+    }
+  }
+  writeJSON(w, http.StatusOK, map[string]interface{}{"applied": len(in.Ops), "atomic": atomic})
+}
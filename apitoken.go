@@ -0,0 +1,250 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* API tokens
+  - For scripts using the JSON API: a request with "Authorization: Bearer
+    {token}" acts as the token's user, without a session
+  - Users make and revoke their tokens at /account/tokens. A token is shown
+    once when it is made; only its SHA-256 is kept, in data/tokens.json
+  - Each token has a quota of API requests per -api-quota-window (see
+    ratelimit.go): -api-quota unless an admin sets its own on the admin page
+*/
+type APIToken struct {
+  User string
+  Name string
+  Created time.Time
+  Quota int `json:",omitempty"` // requests per window, 0 for -api-quota
+}
+
+var apiTokens = struct {
+  sync.RWMutex
+  path string
+  m map[string]APIToken // hash -> token
+}{path: "data/tokens.json", m: map[string]APIToken{}}
+
+const tokenPrefix = "wiki_"
+
+var errBadToken = errors.New("invalid API token")
+
+func loadTokens() error {
+  data, err := ioutil.ReadFile(apiTokens.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  m := map[string]APIToken{}
+  if err := json.Unmarshal(data, &m); err != nil {
+    return err
+  }
+  apiTokens.Lock()
+  apiTokens.m = m
+  apiTokens.Unlock()
+  return nil
+}
+
+/* Apply fn to a copy of the tokens and save it */
+func updateTokens(fn func(m map[string]APIToken) error) error {
+  apiTokens.Lock()
+  defer apiTokens.Unlock()
+  m := make(map[string]APIToken, len(apiTokens.m))
+  for hash, t := range apiTokens.m {
+    m[hash] = t
+  }
+  if err := fn(m); err != nil {
+    return err
+  }
+  data, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(apiTokens.path, data, 0600); err != nil {
+    return err
+  }
+  apiTokens.m = m
+  settingsChanged("tokens")
+  return nil
+}
+
+func hashToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+/* The bearer token r carries, "" if it has none */
+func bearerToken(r *http.Request) string {
+  scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+  if !ok || !strings.EqualFold(scheme, "Bearer") {
+    return ""
+  }
+  return strings.TrimSpace(token)
+}
+
+/* The token r carries and its hash; ok is false if it carries none, and
+  err is set if the one it carries isn't valid
+*/
+func requestToken(r *http.Request) (t APIToken, hash string, ok bool, err error) {
+  token := bearerToken(r)
+  if token == "" {
+    return t, "", false, nil
+  }
+  hash = hashToken(token)
+  apiTokens.RLock()
+  t, found := apiTokens.m[hash]
+  apiTokens.RUnlock()
+  if !found || users.get(t.User) == nil {
+    return t, hash, true, errBadToken
+  }
+  return t, hash, true, nil
+}
+
+/* A token as the account and admin pages list it; ID is the start of its hash */
+type tokenInfo struct {
+  APIToken
+  ID string
+}
+
+/* The tokens of user, or everyone's when user is "" */
+func tokenList(user string) []tokenInfo {
+  apiTokens.RLock()
+  defer apiTokens.RUnlock()
+  list := []tokenInfo{}
+  for hash, t := range apiTokens.m {
+    if user == "" || t.User == user {
+      list = append(list, tokenInfo{t, hash[:12]})
+    }
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+  return list
+}
+
+/* The hash of the token whose ID is id, "" if there is none */
+func tokenHash(m map[string]APIToken, id string) string {
+  for hash := range m {
+    if len(id) == 12 && strings.HasPrefix(hash, id) {
+      return hash
+    }
+  }
+  return ""
+}
+
+/* Data for the tokens page */
+type tokensData struct {
+  Tokens []tokenInfo
+  New string // the token just made, shown once
+  Quota int
+  Window time.Duration
+  Zone *time.Location
+  Error string
+}
+
+/* API tokens at /account/tokens
+  - POST action=create with name makes a token; action=revoke with id ends one
+*/
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+    return
+  }
+  data := &tokensData{Quota: apiQuota, Window: apiQuotaWindow, Zone: viewerZone(r)}
+  if r.Method == http.MethodPost {
+    var err error
+    switch r.FormValue("action") {
+    case "create":
+      name := strings.TrimSpace(r.FormValue("name"))
+      if name == "" || len(name) > 64 {
+        err = errors.New("Give the token a name of up to 64 characters, saying what uses it")
+        break
+      }
+      var id string
+      if id, err = randomID(); err != nil {
+        break
+      }
+      token := tokenPrefix + id
+      err = updateTokens(func(m map[string]APIToken) error {
+        m[hashToken(token)] = APIToken{User: u.Name, Name: name, Created: time.Now().UTC()}
+        return nil
+      })
+      if err == nil {
+        data.New = token
+        audit("token-created", u.Name, clientIP(r), name)
+      }
+    case "revoke":
+      id := r.FormValue("id")
+      err = updateTokens(func(m map[string]APIToken) error {
+        if hash := tokenHash(m, id); hash != "" && m[hash].User == u.Name {
+          delete(m, hash)
+        }
+        return nil
+      })
+      if err == nil {
+        audit("token-revoked", u.Name, clientIP(r), id)
+        http.Redirect(w, r, "/account/tokens", http.StatusSeeOther)
+        return
+      }
+    default:
+      http.Error(w, "unknown action", http.StatusBadRequest)
+      return
+    }
+    if err != nil {
+      data.Error = err.Error()
+      w.WriteHeader(http.StatusBadRequest)
+    }
+  }
+  data.Tokens = tokenList(u.Name)
+  renderTemplate(w, "tokens", data)
+}
+
+/* POST /admin/tokens: action=quota with id and quota (0 for the default),
+  or action=revoke with id
+*/
+func adminTokensHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  id, action := r.FormValue("id"), r.FormValue("action")
+  err := updateTokens(func(m map[string]APIToken) error {
+    hash := tokenHash(m, id)
+    if hash == "" {
+      return errors.New("no such token")
+    }
+    switch action {
+    case "quota":
+      n, err := strconv.Atoi(r.FormValue("quota"))
+      if err != nil || n < 0 {
+        return errors.New("the quota must be a number of requests, or 0 for the default")
+      }
+      t := m[hash]
+      t.Quota = n
+      m[hash] = t
+    case "revoke":
+      delete(m, hash)
+    default:
+      return errors.New("unknown action")
+    }
+    return nil
+  })
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+/* API versions
+  - Every version is served under /api/{name}/ with the same resources;
+    what differs is the JSON the pages resources take and return, which
+    each version defines itself (see apiVersion)
+  - v2 returns a page's revision and modification time, lists pages as
+    {"pages", "total", "prev", "next"} a hundred at a time rather than a
+    bare array, and a PUT takes only "body" and "minor", rejecting other
+    fields so a misspelt one isn't silently ignored
+  - A deprecated version still works, but each response carries a
+    Deprecation header with the date it was deprecated, a Sunset header if a
+    date for removing it is set, and a Link to the same resource in the
+    version that replaces it
+  - Changing what a version returns breaks its clients: add a version
+    instead, and deprecate the old one
+*/
+type apiVersion struct {
+  Name string
+  Deprecated time.Time // zero while current
+  Sunset time.Time // zero until a removal date is set
+  Successor string
+
+  listLimit int // titles GET pages returns when no limit is given, 0 for all
+  // JSON for a page, a listing, and the page a PUT gives
+  page func(p *Page) interface{}
+  list func(v *apiVersion, titles []string, total int, prev, next string) interface{}
+  decodePage func(data []byte) (apiPage, error)
+}
+
+var apiVersions = []*apiVersion{
+  {
+    Name: "v1", Deprecated: time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), Successor: "v2",
+    page: func(p *Page) interface{} { return newAPIPage(p) },
+    list: func(v *apiVersion, titles []string, total int, prev, next string) interface{} { return titles },
+    decodePage: func(data []byte) (apiPage, error) {
+      var in apiPage
+      err := json.Unmarshal(data, &in)
+      return in, err
+    },
+  },
+  {
+    Name: "v2", listLimit: defaultPageLimit,
+    page: newAPIPageV2,
+    list: newAPIPageList,
+    decodePage: func(data []byte) (apiPage, error) {
+      var in struct {
+        Body string `json:"body"`
+        Minor bool `json:"minor"`
+      }
+      dec := json.NewDecoder(bytes.NewReader(data))
+      dec.DisallowUnknownFields()
+      err := dec.Decode(&in)
+      return apiPage{Body: in.Body, Minor: in.Minor}, err
+    },
+  },
+}
+
+/* Path prefix of the version's resources */
+func (v *apiVersion) prefix() string {
+  return "/api/" + v.Name
+}
+
+/* Register every version's resources on the default mux; handlers see the
+  path with the version's prefix stripped
+*/
+func registerAPI() {
+  for _, v := range apiVersions {
+    v.handle("/pages", func(w http.ResponseWriter, r *http.Request) { apiPagesHandler(w, r, v) })
+    v.handle("/pages/", func(w http.ResponseWriter, r *http.Request) { apiPageHandler(w, r, v) })
+    v.handle("/search", func(w http.ResponseWriter, r *http.Request) { apiSearchHandler(w, r, v) })
+    v.handle("/preview/", apiPreviewHandler)
+    v.handle("/upload/", apiUploadHandler)
+    v.handle("/uploads", func(w http.ResponseWriter, r *http.Request) { apiTusHandler(w, r, v) })
+    v.handle("/uploads/", func(w http.ResponseWriter, r *http.Request) { apiTusHandler(w, r, v) })
+    v.handle("/batch", apiBatchHandler)
+    v.handle("/graph", apiGraphHandler)
+    v.handle("/tree", apiTreeHandler)
+    v.handle("/shortlinks/", apiShortLinkHandler)
+    v.handle("/notifications", apiNotificationsHandler)
+    v.handle("/notifications/", apiNotificationsHandler)
+  }
+  http.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+    writeJSONError(w, http.StatusNotFound, "no such API version or resource")
+  })
+}
+
+func (v *apiVersion) handle(pattern string, h http.HandlerFunc) {
+  http.Handle(v.prefix()+pattern, http.StripPrefix(v.prefix(), v.deprecation(h)))
+}
+
+/* Add the deprecation headers to a deprecated version's responses */
+func (v *apiVersion) deprecation(next http.Handler) http.Handler {
+  if v.Deprecated.IsZero() {
+    return next
+  }
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Deprecation", "@"+strconv.FormatInt(v.Deprecated.Unix(), 10))
+    if !v.Sunset.IsZero() {
+      w.Header().Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+    }
+    if v.Successor != "" {
+      w.Header().Add("Link", "</api/"+v.Successor+r.URL.Path+`>; rel="successor-version"`)
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+/* A page in v2 */
+type apiPageV2 struct {
+  Title string `json:"title"`
+  Body string `json:"body"`
+  Revision int `json:"revision"`
+  Modified time.Time `json:"modified,omitzero"`
+  Stats pageStats `json:"stats"`
+}
+
+func newAPIPageV2(p *Page) interface{} {
+  out := apiPageV2{Title: p.Title, Body: string(p.Body), Revision: p.Revision, Stats: bodyStats(p.Body)}
+  if info, err := store.Stat(p.Title); err == nil {
+    out.Modified = info.Modified
+  }
+  return out
+}
+
+/* A page listing in v2; Prev and Next are the URLs of the pages around it */
+type apiPageList struct {
+  Pages []string `json:"pages"`
+  Total int `json:"total"`
+  Prev string `json:"prev,omitempty"`
+  Next string `json:"next,omitempty"`
+}
+
+func newAPIPageList(v *apiVersion, titles []string, total int, prev, next string) interface{} {
+  out := apiPageList{Pages: titles, Total: total}
+  if prev != "" {
+    out.Prev = v.prefix() + "/pages?" + prev
+  }
+  if next != "" {
+    out.Next = v.prefix() + "/pages?" + next
+  }
+  return out
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+  "crypto/cipher"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Attachments
+  - Files belonging to a page, served at /files/{title}/{name} and uploaded
+    with PUT to the same URL (the request body is the file). They, their
+    thumbnails and the gallery are a 404 to those who can't read the page,
+    and only those who may change the page may change its files
+  - Names are letters, digits, '-' and '_' with at least one extension
+    ("diagram.png"); page titles can't contain dots, so the last part of the
+    path containing one is always the file name
+  - Uploads need the page to exist, count towards the namespace's byte quota,
+    and are limited to maxAttachmentSize. They're scanned for viruses with
+    -virus-scan (virusscan.go). Large files can be sent in parts, resuming
+    after a dropped connection (tus.go)
+  - The type is sniffed from the content rather than taken from the client.
+    Only images that browsers can't run script from are shown inline; every
+    other file is sent as a download (see usercontent.go)
+*/
+type Attachment struct {
+  Page string
+  Name string
+  Type string
+  Size int64
+  Uploaded time.Time
+  Uploader string
+}
+
+type AttachmentStore interface {
+  /* Load and Stat return an error satisfying os.IsNotExist for a missing file */
+  Load(page, name string) ([]byte, Attachment, error)
+  Stat(page, name string) (Attachment, error)
+  Save(a Attachment, data []byte) error
+  Delete(page, name string) error
+  /* Rename fails with errAttachmentExists if newName is taken */
+  Rename(page, name, newName string) error
+  /* Attachments of page, sorted by name */
+  List(page string) ([]Attachment, error)
+}
+
+/* The attachment store used by the wiki */
+var attachments AttachmentStore = newFileAttachments("data/attachments")
+
+/* Largest upload accepted, set with -max-attachment */
+var maxAttachmentSize int64 = 10 << 20
+
+var validAttachmentName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*(?:\.[a-zA-Z0-9_-]+)+$`)
+
+var errAttachmentTooLarge = errors.New("Attachment is too large")
+var errAttachmentExists = errors.New("An attachment with that name already exists")
+
+/* Types served inline; the rest are downloads */
+var inlineTypes = map[string]bool{
+  "image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true,
+}
+
+/* Split /prefix/{title}/{name} into title and name */
+func attachmentPath(path, prefix string) (string, string, bool) {
+  rest := strings.TrimPrefix(path, prefix)
+  i := strings.LastIndex(rest, "/")
+  if i < 0 || !validTitle.MatchString(rest[:i]) || !validAttachmentName.MatchString(rest[i+1:]) {
+    return "", "", false
+  }
+  return rest[:i], rest[i+1:], true
+}
+
+/* URL of an attachment */
+func attachmentURL(page, name string) string {
+  return pageURL("files", page) + "/" + url.PathEscape(name)
+}
+
+/* Handler for /files/{title}/{name} */
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+  page, name, ok := attachmentPath(r.URL.Path, "/files/")
+  if !ok {
+    http.NotFound(w, r)
+    return
+  }
+  switch r.Method {
+  case http.MethodGet, http.MethodHead:
+    if !fileTokenValid(r, page, name) && hideUnreadable(w, r, page) {
+      return
+    }
+    data, a, err := attachments.Load(page, name)
+    if os.IsNotExist(err) {
+      http.NotFound(w, r)
+      return
+    }
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    serveAttachment(w, r, a, data)
+  case http.MethodPut:
+    if err := authorizeWrite(page, currentUser(r)); err != nil {
+      http.Error(w, err.Error(), saveErrorStatus(err))
+      return
+    }
+    data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAttachmentSize))
+    if err != nil {
+      http.Error(w, errAttachmentTooLarge.Error(), http.StatusRequestEntityTooLarge)
+      return
+    }
+    if err := checkAttachment(page, name, int64(len(data))); err != nil {
+      http.Error(w, err.Error(), saveErrorStatus(err))
+      return
+    }
+    a := newAttachment(page, name, data, requestAuthor(r))
+    if data, err = processUpload(&a, data); err != nil {
+      http.Error(w, err.Error(), saveErrorStatus(err))
+      return
+    }
+    if err := attachments.Save(a, data); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    auditActivity("file-uploaded", a.Uploader, a.Page, a.Name)
+    w.WriteHeader(http.StatusNoContent)
+  default:
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+var errNoSuchPage = errors.New("Page does not exist")
+
+/* File extensions for the image types an editor upload may have */
+var uploadExtensions = map[string]string{
+  "image/png": ".png", "image/jpeg": ".jpg", "image/gif": ".gif", "image/webp": ".webp",
+}
+
+/* POST /api/v1/upload/{title}, for images pasted or dropped into the editor
+  - The request body is the image; ?name= picks the file name, otherwise one
+    is made up from the time
+  - Returns {"name", "url", "markup"}, markup being what to insert in the page
+*/
+func apiUploadHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  title := strings.TrimPrefix(r.URL.Path, "/upload/")
+  if !validTitle.MatchString(title) {
+    writeJSONError(w, http.StatusNotFound, "invalid page title")
+    return
+  }
+  if err := authorizeWrite(title, currentUser(r)); err != nil {
+    writeJSONError(w, saveErrorStatus(err), err.Error())
+    return
+  }
+  data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAttachmentSize))
+  if err != nil {
+    writeJSONError(w, http.StatusRequestEntityTooLarge, errAttachmentTooLarge.Error())
+    return
+  }
+  a := newAttachment(title, r.FormValue("name"), data, requestAuthor(r))
+  ext, ok := uploadExtensions[a.Type]
+  if !ok {
+    writeJSONError(w, http.StatusUnsupportedMediaType, "only PNG, JPEG, GIF and WebP images can be pasted")
+    return
+  }
+  if a.Name == "" {
+    suffix, err := randomID()
+    if err != nil {
+      writeJSONError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    a.Name = "pasted-" + a.Uploaded.Format("20060102-150405") + "-" + suffix[:6] + ext
+  }
+  if !validAttachmentName.MatchString(a.Name) {
+    writeJSONError(w, http.StatusBadRequest, errBadAttachmentName.Error())
+    return
+  }
+  if err := checkAttachment(title, a.Name, a.Size); err != nil {
+    writeJSONError(w, saveErrorStatus(err), err.Error())
+    return
+  }
+  if data, err = processUpload(&a, data); err != nil {
+    writeJSONError(w, saveErrorStatus(err), err.Error())
+    return
+  }
+  if err := attachments.Save(a, data); err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  auditActivity("file-uploaded", a.Uploader, a.Page, a.Name)
+  writeJSON(w, http.StatusCreated, map[string]string{
+    "name": a.Name, "url": attachmentURL(title, a.Name), "markup": fileMarkup(title, a.Name),
+  })
+}
+
+/* Check that an upload of size bytes can be stored as name on page */
+func checkAttachment(page, name string, size int64) error {
+  if size > maxAttachmentSize {
+    return errAttachmentTooLarge
+  }
+  if !pageExists(page) {
+    return errNoSuchPage
+  }
+  return checkAttachmentQuota(page, name, size)
+}
+
+/* What every upload goes through once it's been checked and before it's
+  stored, returning the data to store: the virus scan (virusscan.go), then
+  for images the removal of metadata (imagemeta.go)
+*/
+func processUpload(a *Attachment, data []byte) ([]byte, error) {
+  if err := scanUpload(*a, data); err != nil {
+    return nil, err
+  }
+  data, err := normalizeImage(a.Type, data)
+  if err != nil {
+    return nil, err
+  }
+  a.Size = int64(len(data))
+  return data, nil
+}
+
+func newAttachment(page, name string, data []byte, uploader string) Attachment {
+  return Attachment{
+    Page: page, Name: name, Type: http.DetectContentType(data), Size: int64(len(data)),
+    Uploaded: time.Now().UTC(), Uploader: uploader,
+  }
+}
+
+/* File attachments
+  - dir/{storage name of the page}/.{name}.json holds an attachment's
+    metadata, with the SHA-256 of its content; the content itself is stored
+    once in dir/.blobs/{first two hex digits}/{hash}, however many pages it's
+    attached to (page titles can't contain dots, so .blobs is never a page)
+  - {hash}.json next to the content counts the attachments using it, and the
+    content is removed along with the last one
+  - Content is checked against its hash whenever it is loaded
+  - Attachments stored before content addressing have no hash and keep their
+    file at dir/{storage name of the page}/{name}
+  - Files are encrypted along with the pages when -encrypt is on, but not
+    compressed, as most attachments already are. Whether content is
+    encrypted is recorded with it, as it's shared by uploads made either side
+    of switching encryption on
+*/
+type fileAttachments struct {
+  dir string
+  mu sync.Mutex
+  aead cipher.AEAD
+}
+
+/* Metadata as stored, recording where the content is */
+type attachmentMeta struct {
+  Attachment
+  Hash string `json:",omitempty"`
+  Encrypted bool `json:",omitempty"`
+}
+
+/* Reference count of stored content */
+type blobRefs struct {
+  Refs int
+  Encrypted bool `json:",omitempty"`
+}
+
+func newFileAttachments(dir string) *fileAttachments {
+  return &fileAttachments{dir: dir}
+}
+
+func (s *fileAttachments) paths(page, name string) (string, string) {
+  dir := filepath.Join(s.dir, storageName(page))
+  return filepath.Join(dir, name), filepath.Join(dir, "."+name+".json")
+}
+
+func (s *fileAttachments) blobPaths(hash string) (string, string) {
+  path := filepath.Join(s.dir, ".blobs", hash[:2], hash)
+  return path, path + ".json"
+}
+
+func (s *fileAttachments) meta(path string) (attachmentMeta, error) {
+  var m attachmentMeta
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return m, err
+  }
+  return m, json.Unmarshal(data, &m)
+}
+
+func (s *fileAttachments) refs(hash string) (blobRefs, error) {
+  var r blobRefs
+  _, refsPath := s.blobPaths(hash)
+  data, err := ioutil.ReadFile(refsPath)
+  if err != nil {
+    return r, err
+  }
+  return r, json.Unmarshal(data, &r)
+}
+
+func (s *fileAttachments) writeMeta(path string, m attachmentMeta) error {
+  data, err := json.Marshal(m)
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(path, data, 0600)
+}
+
+func (s *fileAttachments) Stat(page, name string) (Attachment, error) {
+  _, metaPath := s.paths(page, name)
+  m, err := s.meta(metaPath)
+  return m.Attachment, err
+}
+
+func (s *fileAttachments) Load(page, name string) ([]byte, Attachment, error) {
+  path, metaPath := s.paths(page, name)
+  m, err := s.meta(metaPath)
+  if err != nil {
+    return nil, Attachment{}, err
+  }
+  encrypted := m.Encrypted
+  if m.Hash != "" {
+    r, err := s.refs(m.Hash)
+    if err != nil {
+      return nil, Attachment{}, err
+    }
+    path, _ = s.blobPaths(m.Hash)
+    encrypted = r.Encrypted
+  }
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, Attachment{}, err
+  }
+  if encrypted {
+    // Only decrypt: an attachment may well start with the gzip magic itself
+    if data, err = (&fileCodec{aead: s.aead}).decrypt(data); err != nil {
+      return nil, Attachment{}, err
+    }
+  }
+  if sum := sha256.Sum256(data); m.Hash != "" && hex.EncodeToString(sum[:]) != m.Hash {
+    flagCorrupt(path)
+    return nil, Attachment{}, errCorrupt
+  }
+  return data, m.Attachment, nil
+}
+
+/* Take a reference to data's content, storing it if it's new */
+func (s *fileAttachments) addRef(data []byte) (string, error) {
+  sum := sha256.Sum256(data)
+  hash := hex.EncodeToString(sum[:])
+  path, refsPath := s.blobPaths(hash)
+  r, err := s.refs(hash)
+  if os.IsNotExist(err) {
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+      return "", err
+    }
+    r = blobRefs{Encrypted: s.aead != nil}
+    if r.Encrypted {
+      if data, err = (&fileCodec{aead: s.aead}).encrypt(data); err != nil {
+        return "", err
+      }
+    }
+    if err := ioutil.WriteFile(path, data, 0600); err != nil {
+      return "", err
+    }
+  } else if err != nil {
+    return "", err
+  }
+  r.Refs++
+  refs, err := json.Marshal(r)
+  if err != nil {
+    return "", err
+  }
+  return hash, ioutil.WriteFile(refsPath, refs, 0600)
+}
+
+/* Drop the reference m held, removing the content if it was the last one */
+func (s *fileAttachments) dropRef(page string, m attachmentMeta) error {
+  if m.Hash == "" {
+    path, _ := s.paths(page, m.Name)
+    return os.Remove(path)
+  }
+  path, refsPath := s.blobPaths(m.Hash)
+  r, err := s.refs(m.Hash)
+  if err != nil {
+    return err
+  }
+  if r.Refs--; r.Refs > 0 {
+    refs, err := json.Marshal(r)
+    if err != nil {
+      return err
+    }
+    return ioutil.WriteFile(refsPath, refs, 0600)
+  }
+  if err := os.Remove(path); err != nil {
+    return err
+  }
+  return os.Remove(refsPath)
+}
+
+func (s *fileAttachments) Save(a Attachment, data []byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  _, metaPath := s.paths(a.Page, a.Name)
+  if err := os.MkdirAll(filepath.Dir(metaPath), 0700); err != nil {
+    return err
+  }
+  old, oldErr := s.meta(metaPath)
+  hash, err := s.addRef(data)
+  if err != nil {
+    return err
+  }
+  // Metadata last: a file without it isn't listed, so a half written upload doesn't show
+  if err := s.writeMeta(metaPath, attachmentMeta{Attachment: a, Hash: hash}); err != nil {
+    return err
+  }
+  if oldErr == nil {
+    return s.dropRef(a.Page, old)
+  }
+  return nil
+}
+
+func (s *fileAttachments) Delete(page, name string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  _, metaPath := s.paths(page, name)
+  m, err := s.meta(metaPath)
+  if err != nil {
+    return err
+  }
+  if err := os.Remove(metaPath); err != nil {
+    return err
+  }
+  return s.dropRef(page, m)
+}
+
+func (s *fileAttachments) Rename(page, name, newName string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  path, metaPath := s.paths(page, name)
+  newPath, newMetaPath := s.paths(page, newName)
+  m, err := s.meta(metaPath)
+  if err != nil {
+    return err
+  }
+  if _, err := os.Stat(newMetaPath); err == nil {
+    return errAttachmentExists
+  }
+  m.Name = newName
+  if m.Hash != "" {
+    // The content stays where it is
+    if err := s.writeMeta(newMetaPath, m); err != nil {
+      return err
+    }
+    return os.Remove(metaPath)
+  }
+  if err := os.Rename(path, newPath); err != nil {
+    return err
+  }
+  if err := s.writeMeta(newMetaPath, m); err != nil {
+    os.Rename(newPath, path)
+    return err
+  }
+  return os.Remove(metaPath)
+}
+
+func (s *fileAttachments) List(page string) ([]Attachment, error) {
+  files, err := filepath.Glob(filepath.Join(s.dir, storageName(page), ".*.json"))
+  if err != nil {
+    return nil, err
+  }
+  list := []Attachment{}
+  for _, f := range files {
+    m, err := s.meta(f)
+    if err != nil || m.Page != page {
+      continue // not one of ours
+    }
+    list = append(list, m.Attachment)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+  return list, nil
+}
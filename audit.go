@@ -0,0 +1,85 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "log"
+  "os"
+  "sync"
+  "time"
+)
+
+/* Audit log
+  - Security events (sign ins, failed sign ins, lockouts) are appended to
+    data/audit.log, one JSON object per line, so they can be grepped or fed
+    to other tools
+  - Changes to pages and their files are logged too, for the activity
+    stream (see activity.go); the admin page shows the newest of the others
+*/
+type auditEntry struct {
+  Time time.Time
+  Event string
+  User string `json:",omitempty"`
+  IP string `json:",omitempty"`
+  Page string `json:",omitempty"`
+  Detail string `json:",omitempty"`
+}
+
+var auditLog = struct {
+  sync.Mutex
+  path string
+}{path: "data/audit.log"}
+
+/* Append an entry; failing to write it is logged rather than failing the request */
+func audit(event, user, ip, detail string) {
+  appendAudit(auditEntry{Time: time.Now().UTC(), Event: event, User: user, IP: ip, Detail: detail})
+}
+
+func appendAudit(e auditEntry) {
+  line, err := json.Marshal(e)
+  if err != nil {
+    log.Printf("audit: %v", err)
+    return
+  }
+  auditLog.Lock()
+  defer auditLog.Unlock()
+  f, err := os.OpenFile(auditLog.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+  if err != nil {
+    log.Printf("audit: %v", err)
+    return
+  }
+  defer f.Close()
+  if _, err := f.Write(append(line, '\n')); err != nil {
+    log.Printf("audit: %v", err)
+  }
+}
+
+/* The newest n entries that keep lets through, newest first */
+func recentAudit(n int, keep func(auditEntry) bool) ([]auditEntry, error) {
+  auditLog.Lock()
+  defer auditLog.Unlock()
+  f, err := os.Open(auditLog.path)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  ring := make([]auditEntry, 0, n)
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    var e auditEntry
+    if json.Unmarshal(scanner.Bytes(), &e) != nil || !keep(e) {
+      continue
+    }
+    if len(ring) == n {
+      ring = ring[1:]
+    }
+    ring = append(ring, e)
+  }
+  for i, j := 0, len(ring)-1; i < j; i, j = i+1, j-1 {
+    ring[i], ring[j] = ring[j], ring[i]
+  }
+  return ring, scanner.Err()
+}
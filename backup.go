@@ -0,0 +1,140 @@
+package main
+
+import (
+  "archive/zip"
+  "bytes"
+  "context"
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "time"
+)
+
+/* Backups
+  - The backup job writes every page, as {title}.txt, every attachment, as
+    _files/{title}/{name}, and each page's metadata, as _meta/{title}.json,
+    to a zip in data/backups/
+  - Only the pages as they stand are kept, not their history
+  - With -encrypt the whole zip is encrypted with the wiki's key, as the
+    pages are, so it can only be restored by a wiki with that key
+  - The zip can be loaded back with an import job on the admin page
+  - The newest -backup-keep zips are kept and older ones deleted
+*/
+var backupDir = "data/backups"
+var backupKeep = 7
+
+/* Where attachments and metadata go in a backup zip; titles can't start
+  with _files or _meta
+*/
+const backupFiles = "_files/"
+const backupMeta = "_meta/"
+
+/* Encrypts backups when encryption is on (set by configureStorage) */
+var backupCodec = &fileCodec{}
+
+/* The backup job */
+func backupJob(ctx context.Context, j *Job) (string, error) {
+  if err := os.MkdirAll(backupDir, 0700); err != nil {
+    return "", err
+  }
+  name := filepath.Join(backupDir, "wiki-"+time.Now().UTC().Format("20060102-150405")+".zip")
+  tmp := name + ".tmp"
+  pages, files, err := writeBackup(ctx, tmp)
+  if err != nil {
+    os.Remove(tmp)
+    return "", err
+  }
+  if err := os.Rename(tmp, name); err != nil {
+    os.Remove(tmp)
+    return "", err
+  }
+  pruneBackups()
+  return "saved " + strconv.Itoa(pages) + " pages and " + strconv.Itoa(files) + " attachments to " + name, nil
+}
+
+func writeBackup(ctx context.Context, path string) (pages, files int, err error) {
+  var buf bytes.Buffer
+  zw := zip.NewWriter(&buf)
+  titles, err := listPages()
+  if err != nil {
+    return 0, 0, err
+  }
+  metas, err := pageMeta.All()
+  if err != nil {
+    return 0, 0, err
+  }
+  for _, title := range titles {
+    if err := ctx.Err(); err != nil {
+      return 0, 0, err
+    }
+    body, err := store.Load(title)
+    if err != nil {
+      return 0, 0, err
+    }
+    if err := writeZipEntry(zw, title+".txt", body, time.Time{}); err != nil {
+      return 0, 0, err
+    }
+    if m, ok := metas[title]; ok {
+      data, err := json.Marshal(m)
+      if err != nil {
+        return 0, 0, err
+      }
+      if err := writeZipEntry(zw, backupMeta+title+".json", data, time.Time{}); err != nil {
+        return 0, 0, err
+      }
+    }
+    pages++
+  }
+  for _, title := range titles {
+    list, err := attachments.List(title)
+    if err != nil {
+      return 0, 0, err
+    }
+    for _, a := range list {
+      data, _, err := attachments.Load(title, a.Name)
+      if err != nil {
+        return 0, 0, err
+      }
+      if err := writeZipEntry(zw, backupFiles+title+"/"+a.Name, data, a.Uploaded); err != nil {
+        return 0, 0, err
+      }
+      files++
+    }
+  }
+  if err := zw.Close(); err != nil {
+    return 0, 0, err
+  }
+  data, err := backupCodec.encrypt(buf.Bytes())
+  if err != nil {
+    return 0, 0, err
+  }
+  return pages, files, ioutil.WriteFile(path, data, 0600)
+}
+
+func writeZipEntry(zw *zip.Writer, name string, data []byte, modified time.Time) error {
+  if modified.IsZero() {
+    modified = time.Now()
+  }
+  w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+  if err != nil {
+    return err
+  }
+  _, err = w.Write(data)
+  return err
+}
+
+/* Delete all but the newest backupKeep backups */
+func pruneBackups() {
+  if backupKeep <= 0 {
+    return
+  }
+  names, _ := filepath.Glob(filepath.Join(backupDir, "wiki-*.zip"))
+  sort.Strings(names) // the names sort by time
+  for len(names) > backupKeep {
+    os.Remove(names[0])
+    names = names[1:]
+  }
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+  "net/http"
+  "strings"
+  "time"
+)
+
+/* One line of the blame view and the revision that introduced it
+  - Revision is nil for lines of a page saved before history existed that no
+    revision accounts for
+  - Earlier is set for lines that are older than blame looks, from Revision
+    or one before it
+*/
+type blameLine struct {
+  Line string
+  Revision *Revision
+  Earlier bool
+}
+
+/* How many revisions blame walks, as each one is a diff */
+const maxBlameRevisions = 500
+
+/* Attribute each line of body to the revision that introduced it
+  - Walks the history oldest first, diffing each revision against the one
+    before: lines that survive keep their revision, the rest get the new one
+  - Only the newest maxBlameRevisions are walked; what's left of the one
+    before them is put down to that one, as Earlier
+  - Finally diffs the latest revision against body itself, in case the page
+    was changed without going through the history
+*/
+func blame(title string, body []byte) ([]blameLine, error) {
+  revs, err := history.Revisions(title)
+  if err != nil {
+    return nil, err
+  }
+  var lines []string
+  var owners []*Revision
+  var earliest *Revision
+  if len(revs) > maxBlameRevisions {
+    earliest = &revs[len(revs)-maxBlameRevisions-1]
+    text, err := history.LoadRevision(title, earliest.Number)
+    if err != nil {
+      return nil, err
+    }
+    lines = splitLines(string(text))
+    owners = make([]*Revision, len(lines))
+    for i := range owners {
+      owners[i] = earliest
+    }
+    revs = revs[len(revs)-maxBlameRevisions:]
+  }
+  step := func(next []string, rev *Revision) {
+    match := matchLines(lines, next)
+    nextOwners := make([]*Revision, len(next))
+    for i := range nextOwners {
+      nextOwners[i] = rev
+    }
+    for i, j := range match {
+      if j >= 0 {
+        nextOwners[j] = owners[i]
+      }
+    }
+    lines, owners = next, nextOwners
+  }
+  for i := range revs {
+    text, err := history.LoadRevision(title, revs[i].Number)
+    if err != nil {
+      return nil, err
+    }
+    step(splitLines(string(text)), &revs[i])
+  }
+  step(splitLines(string(body)), nil)
+
+  out := make([]blameLine, len(lines))
+  for i := range lines {
+    out[i] = blameLine{Line: strings.TrimRight(lines[i], "\r\n"), Revision: owners[i], Earlier: earliest != nil && owners[i] == earliest}
+  }
+  return out, nil
+}
+
+/* Data for the blame page */
+type blameData struct {
+  Title string
+  Lines []blameLine
+  Zone *time.Location
+}
+
+/* Blame view at /blame/{title} */
+func blameHandler(w http.ResponseWriter, r *http.Request, title string) {
+  p, err := loadPage(title)
+  if pageCorrupt(w, err) {
+    return
+  }
+  if err != nil {
+    if redirectRenamed(w, r, "blame", title) {
+      return
+    }
+    http.NotFound(w, r)
+    return
+  }
+  p, _, ok := checkReadable(w, r, p)
+  if !ok {
+    return
+  }
+  lines, err := blame(title, p.Body)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  renderTemplate(w, "blame", &blameData{Title: title, Lines: lines, Zone: viewerZone(r)})
+}
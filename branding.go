@@ -0,0 +1,187 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sync"
+)
+
+/* Site branding
+  - Admins set the site title, logo and favicon from /admin, instead of
+    editing the templates
+  - Kept in data/branding: site.json for the settings, and the images as
+    logo and favicon next to it. Loaded at start, served from memory
+  - Only PNG, JPEG, GIF, WebP and ICO images are accepted; SVG can carry
+    script, so it isn't
+*/
+type siteBranding struct {
+  Title string
+  LogoType string `json:",omitempty"`
+  FaviconType string `json:",omitempty"`
+}
+
+var branding = struct {
+  sync.RWMutex
+  dir string
+  site siteBranding
+  images map[string][]byte
+}{dir: "data/branding", site: siteBranding{Title: "Golang Tutorial"}, images: map[string][]byte{}}
+
+/* Largest logo or favicon accepted */
+const maxBrandingImage = 1 << 20
+
+var errBadImage = errors.New("Image must be a PNG, JPEG, GIF, WebP or ICO file")
+
+var brandingTypes = map[string]bool{
+  "image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true,
+  "image/x-icon": true, "image/vnd.microsoft.icon": true,
+}
+
+/* Read the saved branding; nothing saved yet keeps the defaults */
+func loadBranding() error {
+  branding.Lock()
+  defer branding.Unlock()
+  data, err := ioutil.ReadFile(filepath.Join(branding.dir, "site.json"))
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  if err := json.Unmarshal(data, &branding.site); err != nil {
+    return err
+  }
+  for _, name := range []string{"logo", "favicon"} {
+    img, err := ioutil.ReadFile(filepath.Join(branding.dir, name))
+    if err == nil {
+      branding.images[name] = img
+    } else if !os.IsNotExist(err) {
+      return err
+    }
+  }
+  return nil
+}
+
+/* Write the settings and images; the caller holds the lock */
+func writeBranding() error {
+  if err := os.MkdirAll(branding.dir, 0700); err != nil {
+    return err
+  }
+  for _, name := range []string{"logo", "favicon"} {
+    path := filepath.Join(branding.dir, name)
+    if img, ok := branding.images[name]; ok {
+      if err := ioutil.WriteFile(path, img, 0600); err != nil {
+        return err
+      }
+    } else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+  data, err := json.MarshalIndent(branding.site, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(filepath.Join(branding.dir, "site.json"), data, 0600); err != nil {
+    return err
+  }
+  settingsChanged("branding")
+  return nil
+}
+
+/* Current branding, for the templates */
+func siteInfo() siteBranding {
+  branding.RLock()
+  defer branding.RUnlock()
+  return branding.site
+}
+
+/* Image from an upload field, with its type; nil if the field was left empty */
+func brandingImage(r *http.Request, field string) ([]byte, string, error) {
+  f, _, err := r.FormFile(field)
+  if err == http.ErrMissingFile {
+    return nil, "", nil
+  }
+  if err != nil {
+    return nil, "", err
+  }
+  defer f.Close()
+  img, err := ioutil.ReadAll(f)
+  if err != nil {
+    return nil, "", err
+  }
+  typ := http.DetectContentType(img)
+  if len(img) >= 4 && string(img[:4]) == "\x00\x00\x01\x00" {
+    typ = "image/x-icon" // DetectContentType doesn't know ICO
+  }
+  if !brandingTypes[typ] {
+    return nil, "", errBadImage
+  }
+  return img, typ, nil
+}
+
+/* POST /admin/branding, from the form on the admin page */
+func brandingHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  r.Body = http.MaxBytesReader(w, r.Body, 2*maxBrandingImage+4096)
+  if err := r.ParseMultipartForm(2*maxBrandingImage + 4096); err != nil {
+    http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+    return
+  }
+  logo, logoType, err := brandingImage(r, "logo")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  favicon, faviconType, err := brandingImage(r, "favicon")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  branding.Lock()
+  defer branding.Unlock()
+  if title := r.FormValue("title"); title != "" {
+    branding.site.Title = title
+  }
+  if logo != nil {
+    branding.images["logo"], branding.site.LogoType = logo, logoType
+  } else if r.FormValue("remove_logo") != "" {
+    delete(branding.images, "logo")
+    branding.site.LogoType = ""
+  }
+  if favicon != nil {
+    branding.images["favicon"], branding.site.FaviconType = favicon, faviconType
+  } else if r.FormValue("remove_favicon") != "" {
+    delete(branding.images, "favicon")
+    branding.site.FaviconType = ""
+  }
+  if err := writeBranding(); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+/* The logo at /branding/logo and the favicon at /branding/favicon */
+func brandingImageHandler(w http.ResponseWriter, r *http.Request) {
+  name := filepath.Base(r.URL.Path)
+  branding.RLock()
+  img, ok := branding.images[name]
+  typ := branding.site.LogoType
+  if name == "favicon" {
+    typ = branding.site.FaviconType
+  }
+  branding.RUnlock()
+  if !ok {
+    http.NotFound(w, r)
+    return
+  }
+  w.Header().Set("Content-Type", typ)
+  w.Write(img)
+}
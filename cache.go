@@ -0,0 +1,158 @@
+package main
+
+import (
+  "errors"
+  "log"
+  "strconv"
+  "sync"
+  "time"
+)
+
+/* Page cache in Redis (-cache=redis)
+  - Sits in front of the real store. Bodies are cached in Redis, shared by
+    every instance, and in a small in-process map in front of that
+  - A save or delete removes the Redis entry and publishes the title on
+    wiki:invalidate; each instance listens and drops its local copy, so views
+    stay consistent behind a load balancer without reading the store each time
+  - If the subscription drops, an instance can't know what it missed, so it
+    clears its local cache and skips it until it has resubscribed
+  - Redis holds the bodies as plain text, even with -encrypt
+*/
+type cachedStore struct {
+  PageStore
+  redis *redisClient
+  ttl time.Duration
+  mu sync.Mutex
+  local map[string][]byte
+  subscribed bool
+}
+
+/* Same, for stores that can apply batches atomically */
+type atomicCachedStore struct {
+  *cachedStore
+}
+
+const cacheChannel = "wiki:invalidate"
+
+/* How long pages stay in Redis, and how many each instance keeps locally */
+var cacheTTL = 10 * time.Minute
+var localCacheSize = 1000
+
+/* Wrap the store in the cache if one is configured */
+func configureCache(kind, redisAddr string) error {
+  switch kind {
+  case "none":
+    return nil
+  case "redis":
+    if redisAddr == "" {
+      return errors.New("the redis cache needs -redis-addr")
+    }
+    store = newCachedStore(store, newRedisClient(redisAddr), cacheTTL)
+    return nil
+  }
+  return errors.New("unknown cache " + kind)
+}
+
+func newCachedStore(inner PageStore, redis *redisClient, ttl time.Duration) PageStore {
+  c := &cachedStore{PageStore: inner, redis: redis, ttl: ttl, local: map[string][]byte{}}
+  go c.listen()
+  if _, ok := inner.(atomicStore); ok {
+    return &atomicCachedStore{c}
+  }
+  return c
+}
+
+func (c *cachedStore) key(title string) string {
+  return "wiki:page:" + title
+}
+
+func (c *cachedStore) Load(title string) ([]byte, error) {
+  c.mu.Lock()
+  body, ok := c.local[title]
+  c.mu.Unlock()
+  if ok {
+    return body, nil
+  }
+  if v, err := c.redis.do("GET", c.key(title)); err == nil {
+    body = []byte(v.(string))
+    c.remember(title, body)
+    return body, nil
+  }
+  body, err := c.PageStore.Load(title)
+  if err != nil {
+    return nil, err
+  }
+  c.redis.do("SET", c.key(title), string(body), "EX", strconv.Itoa(int(c.ttl.Seconds())))
+  c.remember(title, body)
+  return body, nil
+}
+
+/* Keep body locally, if the subscription is up to tell us when it changes */
+func (c *cachedStore) remember(title string, body []byte) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if !c.subscribed {
+    return
+  }
+  if len(c.local) >= localCacheSize {
+    for k := range c.local { // evict something; any entry will do
+      delete(c.local, k)
+      break
+    }
+  }
+  c.local[title] = body
+}
+
+func (c *cachedStore) Save(title string, body []byte) error {
+  err := c.PageStore.Save(title, body)
+  c.invalidate(title)
+  return err
+}
+
+func (c *cachedStore) Delete(title string) error {
+  err := c.PageStore.Delete(title)
+  c.invalidate(title)
+  return err
+}
+
+func (a *atomicCachedStore) Apply(ops []storeOp) error {
+  err := a.PageStore.(atomicStore).Apply(ops)
+  for _, op := range ops {
+    a.invalidate(op.Title)
+  }
+  return err
+}
+
+/* Drop title here, in Redis, and on every other instance */
+func (c *cachedStore) invalidate(title string) {
+  c.forget(title)
+  if _, err := c.redis.do("DEL", c.key(title)); err != nil {
+    log.Printf("cache: %v", err)
+  }
+  if _, err := c.redis.do("PUBLISH", cacheChannel, title); err != nil {
+    log.Printf("cache: %v", err)
+  }
+}
+
+func (c *cachedStore) forget(title string) {
+  c.mu.Lock()
+  delete(c.local, title)
+  c.mu.Unlock()
+}
+
+/* Follow invalidations from other instances, resubscribing if the connection drops */
+func (c *cachedStore) listen() {
+  for {
+    err := c.redis.subscribe(cacheChannel, func() {
+      c.mu.Lock()
+      c.subscribed = true
+      c.mu.Unlock()
+    }, c.forget)
+    c.mu.Lock()
+    c.subscribed = false
+    c.local = map[string][]byte{}
+    c.mu.Unlock()
+    log.Printf("cache: lost invalidation subscription: %v", err)
+    time.Sleep(time.Second)
+  }
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "sync"
+  "time"
+)
+
+/* Checksums and scrubbing
+  - Pages, revisions and proposals are stored with the SHA-256 of their
+    body (see compress.go), and attachments are stored by the SHA-256 of
+    their content (see attachments.go); every read checks it
+  - A page, revision or attachment that doesn't match is an error rather
+    than shown, and is written to the audit log and listed on the admin page
+  - The scrub job reads everything to find corrupt entries before readers
+    do. A corrupt page is put back from the newest revision that reads
+    soundly, with the corrupt file kept in data/quarantine/ for inspection;
+    revisions and attachments can only be flagged. Run it regularly with
+    -cron scrub=@weekly
+  - A scrub clears the problems it no longer finds
+*/
+var errCorrupt = errors.New("stored content is corrupted: it doesn't match its checksum")
+
+var quarantineDir = "data/quarantine"
+
+type integrityProblem struct {
+  What string // the file, or what a scrub found
+  Found time.Time
+  seen time.Time // last found
+}
+
+var integrity = struct {
+  sync.Mutex
+  m map[string]*integrityProblem
+}{m: map[string]*integrityProblem{}}
+
+/* Record that what is corrupt, auditing it the first time */
+func flagCorrupt(what string) {
+  now := time.Now().UTC()
+  integrity.Lock()
+  p, seen := integrity.m[what]
+  if !seen {
+    p = &integrityProblem{What: what, Found: now}
+    integrity.m[what] = p
+  }
+  p.seen = now
+  integrity.Unlock()
+  if !seen {
+    log.Printf("integrity: %s is corrupt", what)
+    audit("corruption", "", "", what)
+  }
+}
+
+func clearCorrupt(what string) {
+  integrity.Lock()
+  delete(integrity.m, what)
+  integrity.Unlock()
+}
+
+/* The problems found, oldest first */
+func integrityList() []integrityProblem {
+  integrity.Lock()
+  defer integrity.Unlock()
+  list := []integrityProblem{}
+  for _, p := range integrity.m {
+    list = append(list, *p)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Found.Before(list[j].Found) })
+  return list
+}
+
+/* Flag what the scrub found, unless the codec already flagged the file */
+func flagFound(what string, err error) {
+  if !errors.Is(err, errCorrupt) {
+    flagCorrupt(what + ": " + err.Error())
+  }
+}
+
+func isCorrupt(err error) bool {
+  return errors.Is(err, errCorrupt) || errors.Is(err, errDecrypt) || errors.Is(err, errBadDelta)
+}
+
+/* Answer a page whose stored copy is corrupt with a 500, rather than
+  treating it as missing; returns whether it did
+*/
+func pageCorrupt(w http.ResponseWriter, err error) bool {
+  if !isCorrupt(err) {
+    return false
+  }
+  http.Error(w, "This page's stored copy is corrupted. An admin can put it back from its history by running a scrub.", http.StatusInternalServerError)
+  return true
+}
+
+/* The scrub job */
+func scrubJob(ctx context.Context, j *Job) (string, error) {
+  start := time.Now().UTC()
+  var pages, revisions, files, bad, restored int
+  titles, err := listPages()
+  if err != nil {
+    return "", err
+  }
+  for _, title := range titles {
+    if err := ctx.Err(); err != nil {
+      return "", err
+    }
+    pages++
+    _, err := store.Load(title)
+    switch {
+    case isCorrupt(err):
+      bad++
+      if n, rerr := restorePage(title); rerr != nil {
+        flagFound("page "+title, err)
+        flagCorrupt("page " + title + " can't be restored: " + rerr.Error())
+      } else {
+        restored++
+        audit("page-restored", "", "", title+" from revision "+strconv.Itoa(n))
+      }
+    case err != nil && !os.IsNotExist(err):
+      return "", err
+    }
+  }
+
+  historyTitles, err := history.Titles()
+  if err != nil {
+    return "", err
+  }
+  for _, title := range historyTitles {
+    revs, err := history.Revisions(title)
+    if err != nil {
+      return "", err
+    }
+    for _, rev := range revs {
+      if err := ctx.Err(); err != nil {
+        return "", err
+      }
+      revisions++
+      _, err := history.LoadRevision(title, rev.Number)
+      switch {
+      case isCorrupt(err):
+        bad++
+        flagFound("revision "+strconv.Itoa(rev.Number)+" of "+title, err)
+      case err != nil && !os.IsNotExist(err):
+        return "", err
+      }
+    }
+  }
+
+  for _, title := range titles {
+    list, err := attachments.List(title)
+    if err != nil {
+      return "", err
+    }
+    for _, a := range list {
+      if err := ctx.Err(); err != nil {
+        return "", err
+      }
+      files++
+      _, _, err := attachments.Load(title, a.Name)
+      switch {
+      case isCorrupt(err):
+        bad++
+        flagFound("attachment "+a.Name+" of "+title, err)
+      case err != nil && !os.IsNotExist(err):
+        return "", err
+      }
+    }
+  }
+
+  // Anything found before this scrub that it didn't find again is sound now
+  integrity.Lock()
+  for what, p := range integrity.m {
+    if p.seen.Before(start) {
+      delete(integrity.m, what)
+    }
+  }
+  integrity.Unlock()
+  result := "checked " + strconv.Itoa(pages) + " pages, " + strconv.Itoa(revisions) + " revisions and " +
+    strconv.Itoa(files) + " attachments: " + strconv.Itoa(bad) + " corrupt"
+  if restored > 0 {
+    result += ", " + strconv.Itoa(restored) + " pages restored from history"
+  }
+  return result, nil
+}
+
+/* Put a corrupt page back from its newest revision that reads soundly,
+  returning the revision; in the file store the corrupt file is kept in
+  quarantineDir first
+*/
+func restorePage(title string) (int, error) {
+  revs, err := history.Revisions(title)
+  if err != nil {
+    return 0, err
+  }
+  for i := len(revs) - 1; i >= 0; i-- {
+    body, err := history.LoadRevision(title, revs[i].Number)
+    if err != nil {
+      continue
+    }
+    if fs, ok := store.(*fileStore); ok {
+      path := fs.filename(title)
+      if err := quarantine(path); err != nil {
+        return 0, err
+      }
+      defer clearCorrupt(path)
+    }
+    return revs[i].Number, store.Save(title, body)
+  }
+  return 0, errors.New("no revision of it reads soundly")
+}
+
+/* Copy a corrupt file into quarantineDir, stamped with the time */
+func quarantine(path string) error {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return err
+  }
+  if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+    return err
+  }
+  name := filepath.Base(path) + "." + time.Now().UTC().Format("20060102-150405")
+  return ioutil.WriteFile(filepath.Join(quarantineDir, name), data, 0600)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+  "html/template"
+  "strings"
+)
+
+/* Sidebar, header and footer pages
+  - _Header, _Sidebar and _Footer are ordinary pages whose rendered bodies are
+    shown around every page view, so navigation can be edited in the wiki
+  - A namespace can have its own: Projects/_Sidebar is used for the pages
+    under Projects, and the nearest one up the title wins, down to the top
+    level _Sidebar
+*/
+
+/* The rendered special page name for title, "" if there is none */
+func chromeFor(title, name string) template.HTML {
+  parts := strings.Split(title, "/")
+  for i := len(parts) - 1; i >= 0; i-- {
+    special := strings.Join(append(parts[:i:i], name), "/")
+    if body, err := store.Load(special); err == nil {
+      return renderBody(body)
+    }
+  }
+  return ""
+}
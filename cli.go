@@ -0,0 +1,303 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "os/exec"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+/* wiki cli, for editing pages of a running wiki from a terminal
+  - wiki cli edit Title fetches the page into $VISUAL or $EDITOR (vi if
+    neither is set), shows what changed once the editor exits, and saves it
+    back if asked to. A page that doesn't exist yet starts empty
+  - wiki cli get Title prints a page, wiki cli diff Title file shows how file
+    differs from it, and wiki cli push Title file saves file as the page
+  - Works through the JSON API: -url is the wiki (WIKI_URL, or
+    http://localhost:8080) and -token an API token made at /account/tokens
+    (WIKI_TOKEN)
+  - edit only saves over the version it fetched. If someone saved the page
+    in the meantime it says so and keeps the edited file, to diff and push
+    by hand; push saves whatever the page holds by then
+  - Linked or copied as wiki-cli, the binary runs this without the cli
+*/
+type cliClient struct {
+  base string
+  token string
+}
+
+var cliUsage = `usage: wiki cli [-url URL] [-token TOKEN] command
+  get Title           print the page
+  edit [-minor] Title edit the page in $EDITOR and save it
+  diff Title file     show how file differs from the page
+  push [-minor] Title file
+                      save file as the page`
+
+func cliMain(args []string) int {
+  flags := flag.NewFlagSet("cli", flag.ExitOnError)
+  flags.Usage = func() { fmt.Fprintln(os.Stderr, cliUsage) }
+  base := flags.String("url", envOr("WIKI_URL", "http://localhost:8080"), "address of the wiki")
+  token := flags.String("token", os.Getenv("WIKI_TOKEN"), "API token to act with")
+  flags.Parse(args)
+  if flags.NArg() == 0 {
+    flags.Usage()
+    return 2
+  }
+  c := &cliClient{base: strings.TrimSuffix(*base, "/"), token: *token}
+  cmd := flag.NewFlagSet(flags.Arg(0), flag.ExitOnError)
+  cmd.Usage = flags.Usage
+  minor := cmd.Bool("minor", false, "mark the change as a minor edit")
+  cmd.Parse(flags.Args()[1:])
+  var err error
+  switch n := cmd.NArg(); {
+  case flags.Arg(0) == "get" && n == 1:
+    var body string
+    if body, _, err = c.get(cmd.Arg(0)); err == nil {
+      fmt.Print(body)
+    }
+  case flags.Arg(0) == "edit" && n == 1:
+    err = c.edit(cmd.Arg(0), *minor, bufio.NewReader(os.Stdin))
+  case flags.Arg(0) == "diff" && n == 2:
+    err = c.diff(cmd.Arg(0), cmd.Arg(1))
+  case flags.Arg(0) == "push" && n == 2:
+    var data []byte
+    if data, err = ioutil.ReadFile(cmd.Arg(1)); err == nil {
+      var rev int
+      if rev, err = c.put(cmd.Arg(0), string(data), *minor, nil); err == nil {
+        fmt.Printf("saved %s as revision %d\n", cmd.Arg(0), rev)
+      }
+    }
+  default:
+    flags.Usage()
+    return 2
+  }
+  if err != nil {
+    fmt.Fprintln(os.Stderr, "wiki cli:", err)
+    return 1
+  }
+  return 0
+}
+
+func envOr(name, def string) string {
+  if v := os.Getenv(name); v != "" {
+    return v
+  }
+  return def
+}
+
+var errCLINotFound = errors.New("no such page")
+var errCLIChanged = errors.New("the page was changed on the wiki since it was fetched")
+
+/* Send a request to the API, decoding a JSON response into out */
+func (c *cliClient) do(method, path string, header http.Header, body io.Reader, out interface{}) (*http.Response, error) {
+  req, err := http.NewRequest(method, c.base+path, body)
+  if err != nil {
+    return nil, err
+  }
+  for k, v := range header {
+    req.Header[k] = v
+  }
+  if c.token != "" {
+    req.Header.Set("Authorization", "Bearer "+c.token)
+  }
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  switch resp.StatusCode {
+  case http.StatusOK:
+    return resp, json.NewDecoder(resp.Body).Decode(out)
+  case http.StatusNotFound:
+    return nil, errCLINotFound
+  case http.StatusPreconditionFailed:
+    return nil, errCLIChanged
+  }
+  var e struct {
+    Error string `json:"error"`
+  }
+  data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+  if json.Unmarshal(data, &e) != nil || e.Error == "" {
+    e.Error = strings.TrimSpace(string(data))
+  }
+  return nil, errors.New(resp.Status + ": " + e.Error)
+}
+
+/* The page's body and ETag */
+func (c *cliClient) get(title string) (string, string, error) {
+  p, etag, err := c.page(title)
+  if err != nil {
+    return "", "", err
+  }
+  return p.Body, etag, nil
+}
+
+func (c *cliClient) page(title string) (*apiPageV2, string, error) {
+  var p apiPageV2
+  resp, err := c.do(http.MethodGet, "/api/v2"+pageURL("pages", title), nil, nil, &p)
+  if err != nil {
+    return nil, "", err
+  }
+  return &p, resp.Header.Get("ETag"), nil
+}
+
+/* Every title, sorted */
+func (c *cliClient) titles() ([]string, error) {
+  var titles []string
+  for offset := 0; ; offset += maxPageLimit {
+    var list apiPageList
+    if _, err := c.do(http.MethodGet, "/api/v2/pages?limit="+strconv.Itoa(maxPageLimit)+"&offset="+strconv.Itoa(offset), nil, nil, &list); err != nil {
+      return nil, err
+    }
+    titles = append(titles, list.Pages...)
+    if list.Next == "" {
+      return titles, nil
+    }
+  }
+}
+
+/* Save body as title, with the conditions in header, returning the new revision */
+func (c *cliClient) put(title, body string, minor bool, header http.Header) (int, error) {
+  data, err := json.Marshal(map[string]interface{}{"body": body, "minor": minor})
+  if err != nil {
+    return 0, err
+  }
+  if header == nil {
+    header = http.Header{}
+  }
+  header.Set("Content-Type", "application/json")
+  var p apiPageV2
+  if _, err := c.do(http.MethodPut, "/api/v2"+pageURL("pages", title), header, strings.NewReader(string(data)), &p); err != nil {
+    return 0, err
+  }
+  return p.Revision, nil
+}
+
+func (c *cliClient) diff(title, file string) error {
+  data, err := ioutil.ReadFile(file)
+  if err != nil {
+    return err
+  }
+  body, _, err := c.get(title)
+  if err != nil && err != errCLINotFound {
+    return err
+  }
+  printDiff(os.Stdout, body, string(data))
+  return nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+/* Edit title in the user's editor, asking on in whether to save */
+func (c *cliClient) edit(title string, minor bool, in *bufio.Reader) error {
+  body, etag, err := c.get(title)
+  header := http.Header{"If-Match": {etag}}
+  if err == errCLINotFound {
+    body, header = "", http.Header{"If-None-Match": {"*"}}
+    fmt.Printf("%s doesn't exist yet; it will be created\n", title)
+  } else if err != nil {
+    return err
+  }
+  f, err := ioutil.TempFile("", "wiki-"+unsafeFileChars.ReplaceAllString(title, "-")+"-*.txt")
+  if err != nil {
+    return err
+  }
+  path := f.Name()
+  _, err = f.WriteString(body)
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  if err != nil {
+    os.Remove(path)
+    return err
+  }
+  for {
+    if err := runEditor(path); err != nil {
+      return fmt.Errorf("%v (the text is in %s)", err, path)
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+      return err
+    }
+    if string(data) == body {
+      fmt.Println("no changes")
+      return os.Remove(path)
+    }
+    printDiff(os.Stdout, body, string(data))
+    fmt.Print("save this? [y]es, [e]dit again, [n]o: ")
+    answer, err := in.ReadString('\n')
+    if err != nil && answer == "" {
+      return fmt.Errorf("%v (the text is in %s)", err, path)
+    }
+    switch strings.ToLower(strings.TrimSpace(answer)) {
+    case "y", "yes":
+      rev, err := c.put(title, string(data), minor, header)
+      if err == errCLIChanged {
+        return fmt.Errorf("%v; the edited text is in %s, see wiki cli diff and push", err, path)
+      }
+      if err != nil {
+        return fmt.Errorf("%v (the text is in %s)", err, path)
+      }
+      fmt.Printf("saved %s as revision %d\n", title, rev)
+      return os.Remove(path)
+    case "e", "edit":
+      continue
+    default:
+      fmt.Println("not saved")
+      return os.Remove(path)
+    }
+  }
+}
+
+/* Run the user's editor on path, waiting for it to exit */
+func runEditor(path string) error {
+  editor := envOr("VISUAL", envOr("EDITOR", "vi"))
+  args := strings.Fields(editor) // so "code --wait" works
+  if len(args) == 0 {
+    return errors.New("no editor")
+  }
+  cmd := exec.Command(args[0], append(args[1:], path)...)
+  cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+  return cmd.Run()
+}
+
+/* Lines either side of a change that a diff shows */
+const diffContext = 3
+
+/* Print the lines that differ between a and b, with some around them */
+func printDiff(w io.Writer, a, b string) {
+  lines := diffLines(a, b)
+  show := make([]bool, len(lines))
+  for i, l := range lines {
+    if l.Op == " " {
+      continue
+    }
+    for j := max(0, i-diffContext); j <= min(len(lines)-1, i+diffContext); j++ {
+      show[j] = true
+    }
+  }
+  line, gap := 0, false
+  for i, l := range lines {
+    if l.Op != "+" {
+      line++
+    }
+    if !show[i] {
+      gap = true
+      continue
+    }
+    if gap || i == 0 {
+      fmt.Fprintln(w, "@@ line "+strconv.Itoa(max(line, 1))+" @@")
+      gap = false
+    }
+    fmt.Fprintln(w, l.Op+l.Text)
+  }
+}
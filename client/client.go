@@ -0,0 +1,395 @@
+/* Package client talks to a wiki's JSON API (version 2) for other Go programs
+  - New(baseURL, token) gives a Client acting as the owner of an API token
+    (made at /account/tokens on the wiki)
+  - Requests that fail on the network, or get a 409, 429, 502, 503 or 504, are
+    retried after a pause that doubles each time, or the Retry-After the wiki
+    asks for; SavePage sends an Idempotency-Key so a retried save is only
+    saved once
+  - Errors from the wiki come back as *Error with its status code and message
+  - The wiki has no full text search yet, so there's no Search
+*/
+package client
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+type Client struct {
+  BaseURL string // e.g. https://wiki.example.com, without the /api part
+  Token string // sent as a bearer token; empty for anonymous reads
+  HTTPClient *http.Client // http.DefaultClient when nil
+  MaxRetries int // retries after the first attempt
+  RetryWait time.Duration // pause before the first retry
+}
+
+func New(baseURL, token string) *Client {
+  return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token, MaxRetries: 3, RetryWait: 500 * time.Millisecond}
+}
+
+/* A page as the API returns it */
+type Page struct {
+  Title string `json:"title"`
+  Body string `json:"body"`
+  Revision int `json:"revision"`
+  Modified time.Time `json:"modified"`
+  Stats struct {
+    Words int `json:"words"`
+    Chars int `json:"chars"`
+    ReadingMinutes int `json:"reading_minutes"`
+  } `json:"stats"`
+  ETag string `json:"-"` // for SaveOptions.IfMatch
+}
+
+/* An error response from the wiki */
+type Error struct {
+  StatusCode int
+  Message string
+}
+
+func (e *Error) Error() string {
+  return "wiki: " + strconv.Itoa(e.StatusCode) + " " + e.Message
+}
+
+/* Whether err is the wiki saying the page doesn't exist */
+func IsNotFound(err error) bool {
+  var e *Error
+  return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+/* Whether err is a save refused because the page changed since its ETag */
+func IsConflict(err error) bool {
+  var e *Error
+  return errors.As(err, &e) && e.StatusCode == http.StatusPreconditionFailed
+}
+
+func (c *Client) GetPage(ctx context.Context, title string) (*Page, error) {
+  var p Page
+  resp, err := c.do(ctx, http.MethodGet, "/api/v2/pages/"+escapeTitle(title), nil, nil, &p)
+  if err != nil {
+    return nil, err
+  }
+  p.ETag = resp.Header.Get("ETag")
+  return &p, nil
+}
+
+type SaveOptions struct {
+  Minor bool
+  IfMatch string // only save over the version with this ETag; "*" for any existing page
+  IfNoneMatch bool // only create the page, never overwrite one
+}
+
+/* Save body as title, returning the page as saved; opts may be nil */
+func (c *Client) SavePage(ctx context.Context, title, body string, opts *SaveOptions) (*Page, error) {
+  if opts == nil {
+    opts = &SaveOptions{}
+  }
+  in, err := json.Marshal(map[string]interface{}{"body": body, "minor": opts.Minor})
+  if err != nil {
+    return nil, err
+  }
+  key, err := randomKey()
+  if err != nil {
+    return nil, err
+  }
+  header := http.Header{"Idempotency-Key": {key}}
+  if opts.IfMatch != "" {
+    header.Set("If-Match", opts.IfMatch)
+  }
+  if opts.IfNoneMatch {
+    header.Set("If-None-Match", "*")
+  }
+  var p Page
+  resp, err := c.do(ctx, http.MethodPut, "/api/v2/pages/"+escapeTitle(title), header, in, &p)
+  if err != nil {
+    return nil, err
+  }
+  p.ETag = resp.Header.Get("ETag")
+  return &p, nil
+}
+
+type ListOptions struct {
+  Limit int // 0 for the wiki's default of 100
+  Offset int
+  Sort string // "title" (the default) or "modified"
+  Desc bool
+}
+
+type PageList struct {
+  Pages []string `json:"pages"`
+  Total int `json:"total"`
+  Next string `json:"next"` // empty on the last page
+}
+
+/* One page of titles; opts may be nil */
+func (c *Client) ListPages(ctx context.Context, opts *ListOptions) (*PageList, error) {
+  q := url.Values{}
+  if opts != nil {
+    if opts.Limit > 0 {
+      q.Set("limit", strconv.Itoa(opts.Limit))
+    }
+    if opts.Offset > 0 {
+      q.Set("offset", strconv.Itoa(opts.Offset))
+    }
+    if opts.Sort != "" {
+      q.Set("sort", opts.Sort)
+    }
+    if opts.Desc {
+      q.Set("order", "desc")
+    }
+  }
+  path := "/api/v2/pages"
+  if len(q) > 0 {
+    path += "?" + q.Encode()
+  }
+  var list PageList
+  if _, err := c.do(ctx, http.MethodGet, path, nil, nil, &list); err != nil {
+    return nil, err
+  }
+  return &list, nil
+}
+
+/* Every title, following the listing from page to page */
+func (c *Client) AllPages(ctx context.Context) ([]string, error) {
+  var titles []string
+  for opts := (&ListOptions{Limit: 1000}); ; opts.Offset += opts.Limit {
+    list, err := c.ListPages(ctx, opts)
+    if err != nil {
+      return nil, err
+    }
+    titles = append(titles, list.Pages...)
+    if list.Next == "" {
+      return titles, nil
+    }
+  }
+}
+
+/* A page change, as sent by the wiki's /events stream */
+type Event struct {
+  Type string `json:"type"` // "save", "delete", "publish" or "expire"
+  Title string `json:"title"`
+  Time time.Time `json:"time"`
+  Minor bool `json:"minor"`
+}
+
+type WatchOptions struct {
+  Namespace string // only pages in this namespace
+  HideMinor bool
+}
+
+/* Call fn for every page change until ctx is done or fn returns an error,
+  reconnecting when the stream drops; changes made while it's reconnecting
+  are missed. opts may be nil
+*/
+func (c *Client) Watch(ctx context.Context, opts *WatchOptions, fn func(Event) error) error {
+  q := url.Values{}
+  if opts != nil {
+    if opts.Namespace != "" {
+      q.Set("namespace", opts.Namespace)
+    }
+    if opts.HideMinor {
+      q.Set("minor", "hide")
+    }
+  }
+  path := "/events"
+  if len(q) > 0 {
+    path += "?" + q.Encode()
+  }
+  wait := c.RetryWait
+  for {
+    connected, err := c.watchOnce(ctx, path, fn)
+    if ctx.Err() != nil {
+      return ctx.Err()
+    }
+    if stop, ok := err.(stopError); ok {
+      return stop.err
+    }
+    if e, ok := err.(*Error); ok && !retryable(e.StatusCode) {
+      return err
+    }
+    if connected {
+      wait = c.RetryWait
+    }
+    if err := sleep(ctx, wait); err != nil {
+      return err
+    }
+    wait = min(2*wait, time.Minute)
+  }
+}
+
+/* An error from fn, which ends Watch rather than reconnecting */
+type stopError struct {
+  err error
+}
+
+func (e stopError) Error() string {
+  return e.err.Error()
+}
+
+/* Read the stream once, returning whether it connected */
+func (c *Client) watchOnce(ctx context.Context, path string, fn func(Event) error) (bool, error) {
+  req, err := c.request(ctx, http.MethodGet, path, nil, nil)
+  if err != nil {
+    return false, err
+  }
+  req.Header.Set("Accept", "text/event-stream")
+  resp, err := c.httpClient().Do(req)
+  if err != nil {
+    return false, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return false, readError(resp)
+  }
+  sc := bufio.NewScanner(resp.Body)
+  for sc.Scan() {
+    data, ok := strings.CutPrefix(sc.Text(), "data: ")
+    if !ok {
+      continue // event names, keepalive comments and blank lines
+    }
+    var ev Event
+    if err := json.Unmarshal([]byte(data), &ev); err != nil {
+      return true, err
+    }
+    if err := fn(ev); err != nil {
+      return true, stopError{err}
+    }
+  }
+  if err := sc.Err(); err != nil {
+    return true, err
+  }
+  return true, io.ErrUnexpectedEOF
+}
+
+/* Send a request, retrying as described above, and decode a JSON response into out */
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte, out interface{}) (*http.Response, error) {
+  wait := c.RetryWait
+  for attempt := 0; ; attempt++ {
+    req, err := c.request(ctx, method, path, header, body)
+    if err != nil {
+      return nil, err
+    }
+    resp, err := c.httpClient().Do(req)
+    if err == nil {
+      if resp.StatusCode < 300 {
+        defer resp.Body.Close()
+        if out != nil {
+          if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+            return nil, err
+          }
+        }
+        return resp, nil
+      }
+      err = readError(resp)
+      resp.Body.Close()
+      if !retryable(resp.StatusCode) {
+        return nil, err
+      }
+      if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+        wait = max(wait, time.Duration(secs)*time.Second)
+      }
+    }
+    if ctx.Err() != nil {
+      return nil, ctx.Err()
+    }
+    if attempt >= c.MaxRetries {
+      return nil, err
+    }
+    if err := sleep(ctx, wait); err != nil {
+      return nil, err
+    }
+    wait *= 2
+  }
+}
+
+func (c *Client) request(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Request, error) {
+  var r io.Reader
+  if body != nil {
+    r = bytes.NewReader(body)
+  }
+  req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, r)
+  if err != nil {
+    return nil, err
+  }
+  for k, v := range header {
+    req.Header[k] = v
+  }
+  if body != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+  if c.Token != "" {
+    req.Header.Set("Authorization", "Bearer "+c.Token)
+  }
+  return req, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+  if c.HTTPClient != nil {
+    return c.HTTPClient
+  }
+  return http.DefaultClient
+}
+
+/* Statuses worth trying again: too many requests, the wiki down or in
+  maintenance, and 409, which the wiki sends while an earlier attempt with
+  the same Idempotency-Key is still running
+*/
+func retryable(status int) bool {
+  switch status {
+  case http.StatusConflict, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+    return true
+  }
+  return false
+}
+
+func readError(resp *http.Response) error {
+  data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+  var body struct {
+    Error string `json:"error"`
+  }
+  msg := strings.TrimSpace(string(data))
+  if json.Unmarshal(data, &body) == nil && body.Error != "" {
+    msg = body.Error
+  }
+  return &Error{StatusCode: resp.StatusCode, Message: msg}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+  t := time.NewTimer(d)
+  defer t.Stop()
+  select {
+  case <-ctx.Done():
+    return ctx.Err()
+  case <-t.C:
+    return nil
+  }
+}
+
+/* Escape each part of a title, keeping the slashes of nested titles */
+func escapeTitle(title string) string {
+  parts := strings.Split(title, "/")
+  for i := range parts {
+    parts[i] = url.PathEscape(parts[i])
+  }
+  return strings.Join(parts, "/")
+}
+
+func randomKey() (string, error) {
+  b := make([]byte, 16)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "mime/multipart"
+  "net/http"
+  "net/textproto"
+  "net/url"
+  "os"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "unicode/utf16"
+)
+
+/* Dropbox and Google Drive backends
+  - -store dropbox or -store gdrive keeps the pages as Title.txt files, with
+    subpages in folders, in the folder -store-folder of a Dropbox or Google
+    Drive account, so the notes are on every machine that syncs it. Edits
+    made to the files there show up in the wiki (as changes by nobody, with
+    no history) within cloudRefresh
+  - Only the pages: history, accounts and attachments are still files under
+    data/. Compression and encryption don't apply, the files are left for
+    other programs to read
+  - Credentials come from the environment. For Dropbox, an app's
+    WIKI_DROPBOX_APP_KEY, WIKI_DROPBOX_APP_SECRET and a
+    WIKI_DROPBOX_REFRESH_TOKEN, or a WIKI_DROPBOX_TOKEN access token; for
+    Drive, an OAuth client's WIKI_GDRIVE_CLIENT_ID, WIKI_GDRIVE_CLIENT_SECRET
+    and a WIKI_GDRIVE_REFRESH_TOKEN with the drive.file scope, or a
+    WIKI_GDRIVE_TOKEN
+  - Dropbox ignores case in names, so titles differing only in case are one
+    file there. Deleted pages go to the Drive trash, and Dropbox keeps them
+    among its deleted files
+*/
+var cloudFolder = "wiki"
+var cloudRefresh = 30 * time.Second
+
+/* A page's file in the drive */
+type cloudFile struct {
+  ID string // Dropbox's id:... or Drive's file id
+  Rev string // changes with every change to the file
+  Size int64
+  Modified time.Time
+}
+
+/* What the backends do; titles are pages, not file names */
+type cloudDrive interface {
+  /* Every page file under the folder, by title */
+  list() (map[string]cloudFile, error)
+  download(f cloudFile) ([]byte, error)
+  /* Write body as title, replacing old if it's set */
+  upload(title string, body []byte, old *cloudFile) (cloudFile, error)
+  remove(f cloudFile) error
+}
+
+/* A PageStore on a cloudDrive, keeping a listing of the files for up to
+  cloudRefresh and the text of each page until its file changes, since
+  every request would otherwise wait on the drive's API
+*/
+type cloudStore struct {
+  drive cloudDrive
+  mu sync.Mutex
+  files map[string]cloudFile
+  listed time.Time
+  bodies map[string]cloudBody
+}
+
+type cloudBody struct {
+  rev string
+  data []byte
+}
+
+func newCloudStore(kind string) (*cloudStore, error) {
+  s := &cloudStore{bodies: map[string]cloudBody{}}
+  folder := strings.Trim(cloudFolder, "/")
+  if folder == "" {
+    return nil, errors.New("-store-folder can't be the top of the drive")
+  }
+  switch kind {
+  case "dropbox":
+    tok, err := oauthFromEnv("WIKI_DROPBOX", "APP_KEY", "APP_SECRET", "https://api.dropboxapi.com/oauth2/token")
+    if err != nil {
+      return nil, err
+    }
+    s.drive = &dropboxDrive{token: tok, folder: "/" + folder}
+  case "gdrive":
+    tok, err := oauthFromEnv("WIKI_GDRIVE", "CLIENT_ID", "CLIENT_SECRET", "https://oauth2.googleapis.com/token")
+    if err != nil {
+      return nil, err
+    }
+    s.drive = &googleDrive{token: tok, folder: folder}
+  }
+  if _, err := s.index(); err != nil {
+    return nil, fmt.Errorf("%s: %v", kind, err)
+  }
+  return s, nil
+}
+
+/* The listing, fetched again if it's older than cloudRefresh; s.mu is held */
+func (s *cloudStore) index() (map[string]cloudFile, error) {
+  if s.files != nil && time.Since(s.listed) < cloudRefresh {
+    return s.files, nil
+  }
+  files, err := s.drive.list()
+  if err != nil {
+    return nil, err
+  }
+  for title, b := range s.bodies {
+    if files[title].Rev != b.rev {
+      delete(s.bodies, title)
+    }
+  }
+  s.files, s.listed = files, time.Now()
+  return files, nil
+}
+
+func (s *cloudStore) Load(title string) ([]byte, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  files, err := s.index()
+  if err != nil {
+    return nil, err
+  }
+  f, ok := files[title]
+  if !ok {
+    return nil, os.ErrNotExist
+  }
+  if b, ok := s.bodies[title]; ok && b.rev == f.Rev {
+    return append([]byte(nil), b.data...), nil
+  }
+  data, err := s.drive.download(f)
+  if err != nil {
+    return nil, err
+  }
+  s.bodies[title] = cloudBody{f.Rev, data}
+  return append([]byte(nil), data...), nil
+}
+
+func (s *cloudStore) Stat(title string) (PageInfo, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  files, err := s.index()
+  if err != nil {
+    return PageInfo{}, err
+  }
+  f, ok := files[title]
+  if !ok {
+    return PageInfo{}, os.ErrNotExist
+  }
+  return PageInfo{Title: title, Size: f.Size, Modified: f.Modified}, nil
+}
+
+func (s *cloudStore) Save(title string, body []byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  files, err := s.index()
+  if err != nil {
+    return err
+  }
+  var old *cloudFile
+  if f, ok := files[title]; ok {
+    old = &f
+  }
+  f, err := s.drive.upload(title, body, old)
+  if err != nil {
+    return err
+  }
+  files[title] = f
+  s.bodies[title] = cloudBody{f.Rev, append([]byte(nil), body...)}
+  return nil
+}
+
+func (s *cloudStore) Delete(title string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  files, err := s.index()
+  if err != nil {
+    return err
+  }
+  f, ok := files[title]
+  if !ok {
+    return os.ErrNotExist
+  }
+  if err := s.drive.remove(f); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  delete(files, title)
+  delete(s.bodies, title)
+  return nil
+}
+
+func (s *cloudStore) List() ([]string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  files, err := s.index()
+  if err != nil {
+    return nil, err
+  }
+  titles := []string{}
+  for title := range files {
+    titles = append(titles, title)
+  }
+  sort.Strings(titles)
+  return titles, nil
+}
+
+/* The title for a file name under the folder, if it's a page */
+func cloudTitle(name string) (string, bool) {
+  title, ok := strings.CutSuffix(name, ".txt")
+  return title, ok && validTitle.MatchString(title)
+}
+
+/* An OAuth access token, renewed with a refresh token when it runs out */
+type oauthToken struct {
+  mu sync.Mutex
+  url, clientID, clientSecret, refresh string
+  access string
+  expires time.Time // zero for a token that doesn't run out
+}
+
+/* The token from prefix_TOKEN, or prefix_{id}, prefix_{secret} and prefix_REFRESH_TOKEN */
+func oauthFromEnv(prefix, id, secret, tokenURL string) (*oauthToken, error) {
+  t := &oauthToken{url: tokenURL, access: os.Getenv(prefix + "_TOKEN"),
+    clientID: os.Getenv(prefix + "_" + id), clientSecret: os.Getenv(prefix + "_" + secret), refresh: os.Getenv(prefix + "_REFRESH_TOKEN")}
+  if t.refresh != "" && (t.clientID == "" || t.clientSecret == "") {
+    return nil, errors.New(prefix + "_REFRESH_TOKEN needs " + prefix + "_" + id + " and " + prefix + "_" + secret)
+  }
+  if t.refresh == "" && t.access == "" {
+    return nil, errors.New("no credentials: set " + prefix + "_REFRESH_TOKEN or " + prefix + "_TOKEN")
+  }
+  return t, nil
+}
+
+/* The access token, renewed first if it's about to run out or renew is set */
+func (t *oauthToken) get(renew bool) (string, error) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if t.refresh == "" || (!renew && t.access != "" && time.Until(t.expires) > time.Minute) {
+    return t.access, nil
+  }
+  resp, err := http.PostForm(t.url, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {t.refresh},
+    "client_id": {t.clientID}, "client_secret": {t.clientSecret}})
+  if err != nil {
+    return "", err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return "", cloudResponseError(resp)
+  }
+  var out struct {
+    AccessToken string `json:"access_token"`
+    ExpiresIn int `json:"expires_in"`
+  }
+  if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+    return "", err
+  }
+  t.access, t.expires = out.AccessToken, time.Now().Add(time.Duration(out.ExpiresIn)*time.Second)
+  return t.access, nil
+}
+
+/* An error response from a drive's API */
+type cloudError struct {
+  status int
+  msg string
+}
+
+func (e *cloudError) Error() string {
+  return strconv.Itoa(e.status) + " " + e.msg
+}
+
+func cloudResponseError(resp *http.Response) error {
+  data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+  return &cloudError{resp.StatusCode, strings.TrimSpace(string(data))}
+}
+
+/* Send a request with the token, once more with a renewed one if it's
+  turned down, returning the body of a 2xx response
+*/
+func cloudCall(t *oauthToken, method, u string, header http.Header, body []byte) ([]byte, error) {
+  for renew := false; ; renew = true {
+    access, err := t.get(renew)
+    if err != nil {
+      return nil, err
+    }
+    req, err := http.NewRequest(method, u, bytes.NewReader(body))
+    if err != nil {
+      return nil, err
+    }
+    for k, v := range header {
+      req.Header[k] = v
+    }
+    req.Header.Set("Authorization", "Bearer "+access)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      return nil, err
+    }
+    if resp.StatusCode == http.StatusUnauthorized && !renew && t.refresh != "" {
+      resp.Body.Close()
+      continue
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+      return nil, cloudResponseError(resp)
+    }
+    return ioutil.ReadAll(resp.Body)
+  }
+}
+
+/* Dropbox, through its HTTP API (version 2) */
+type dropboxDrive struct {
+  token *oauthToken
+  folder string // /wiki
+}
+
+/* A file's metadata as Dropbox gives it */
+type dropboxFile struct {
+  Tag string `json:".tag"`
+  ID string `json:"id"`
+  Path string `json:"path_display"`
+  Rev string `json:"rev"`
+  Size int64 `json:"size"`
+  Modified time.Time `json:"server_modified"`
+}
+
+/* Call an endpoint that takes and gives JSON */
+func (d *dropboxDrive) rpc(endpoint string, in, out interface{}) error {
+  body, err := json.Marshal(in)
+  if err != nil {
+    return err
+  }
+  data, err := cloudCall(d.token, http.MethodPost, "https://api.dropboxapi.com/2/"+endpoint,
+    http.Header{"Content-Type": {"application/json"}}, body)
+  if err != nil {
+    return dropboxNotFound(err)
+  }
+  if out == nil {
+    return nil
+  }
+  return json.Unmarshal(data, out)
+}
+
+/* The not found errors as os.ErrNotExist */
+func dropboxNotFound(err error) error {
+  var e *cloudError
+  if errors.As(err, &e) && e.status == http.StatusConflict && strings.Contains(e.msg, "not_found") {
+    return os.ErrNotExist
+  }
+  return err
+}
+
+/* JSON for the Dropbox-API-Arg header, which must be ASCII */
+func dropboxArg(v interface{}) string {
+  data, _ := json.Marshal(v)
+  var b strings.Builder
+  for _, r := range string(data) {
+    if r < 0x80 {
+      b.WriteRune(r)
+      continue
+    }
+    for _, u := range utf16.Encode([]rune{r}) {
+      fmt.Fprintf(&b, `\u%04x`, u)
+    }
+  }
+  return b.String()
+}
+
+func (d *dropboxDrive) list() (map[string]cloudFile, error) {
+  files := map[string]cloudFile{}
+  var page struct {
+    Entries []dropboxFile `json:"entries"`
+    Cursor string `json:"cursor"`
+    HasMore bool `json:"has_more"`
+  }
+  err := d.rpc("files/list_folder", map[string]interface{}{"path": d.folder, "recursive": true}, &page)
+  if os.IsNotExist(err) {
+    return files, nil // made by the first upload
+  }
+  for ; err == nil; err = d.rpc("files/list_folder/continue", map[string]string{"cursor": page.Cursor}, &page) {
+    for _, e := range page.Entries {
+      if e.Tag != "file" || len(e.Path) <= len(d.folder) || !strings.EqualFold(e.Path[:len(d.folder)+1], d.folder+"/") {
+        continue
+      }
+      if title, ok := cloudTitle(e.Path[len(d.folder)+1:]); ok {
+        files[title] = cloudFile{ID: e.ID, Rev: e.Rev, Size: e.Size, Modified: e.Modified}
+      }
+    }
+    if !page.HasMore {
+      return files, nil
+    }
+  }
+  return nil, err
+}
+
+func (d *dropboxDrive) download(f cloudFile) ([]byte, error) {
+  data, err := cloudCall(d.token, http.MethodPost, "https://content.dropboxapi.com/2/files/download",
+    http.Header{"Dropbox-API-Arg": {dropboxArg(map[string]string{"path": f.ID})}}, nil)
+  return data, dropboxNotFound(err)
+}
+
+func (d *dropboxDrive) upload(title string, body []byte, old *cloudFile) (cloudFile, error) {
+  arg := dropboxArg(map[string]interface{}{"path": d.folder + "/" + title + ".txt", "mode": "overwrite", "mute": true})
+  data, err := cloudCall(d.token, http.MethodPost, "https://content.dropboxapi.com/2/files/upload",
+    http.Header{"Dropbox-API-Arg": {arg}, "Content-Type": {"application/octet-stream"}}, body)
+  if err != nil {
+    return cloudFile{}, err
+  }
+  var e dropboxFile
+  if err := json.Unmarshal(data, &e); err != nil {
+    return cloudFile{}, err
+  }
+  return cloudFile{ID: e.ID, Rev: e.Rev, Size: e.Size, Modified: e.Modified}, nil
+}
+
+func (d *dropboxDrive) remove(f cloudFile) error {
+  return d.rpc("files/delete_v2", map[string]string{"path": f.ID}, nil)
+}
+
+/* Google Drive, through its HTTP API (version 3). Drive goes by ids rather
+  than paths, so the ids of the folders are kept as they're found
+*/
+type googleDrive struct {
+  token *oauthToken
+  folder string // name of a folder at the top of My Drive
+  mu sync.Mutex
+  folders map[string]string // "" for the folder itself, then Projects, Projects/2024 ...
+}
+
+const driveAPI = "https://www.googleapis.com/drive/v3/files"
+const driveFolderType = "application/vnd.google-apps.folder"
+const driveFields = "id,name,mimeType,size,modifiedTime,version"
+
+/* A file's metadata as Drive gives it */
+type driveFile struct {
+  ID string `json:"id"`
+  Name string `json:"name"`
+  MimeType string `json:"mimeType"`
+  Size int64 `json:"size,string"`
+  Modified time.Time `json:"modifiedTime"`
+  Version string `json:"version"`
+}
+
+func (d *googleDrive) cloudFile(f driveFile) cloudFile {
+  return cloudFile{ID: f.ID, Rev: f.Version, Size: f.Size, Modified: f.Modified}
+}
+
+/* The files matching a Drive search */
+func (d *googleDrive) search(q string) ([]driveFile, error) {
+  var all []driveFile
+  token := ""
+  for {
+    v := url.Values{"q": {q}, "fields": {"nextPageToken,files(" + driveFields + ")"}, "pageSize": {"1000"}}
+    if token != "" {
+      v.Set("pageToken", token)
+    }
+    data, err := cloudCall(d.token, http.MethodGet, driveAPI+"?"+v.Encode(), nil, nil)
+    if err != nil {
+      return nil, err
+    }
+    var page struct {
+      Files []driveFile `json:"files"`
+      NextPageToken string `json:"nextPageToken"`
+    }
+    if err := json.Unmarshal(data, &page); err != nil {
+      return nil, err
+    }
+    all = append(all, page.Files...)
+    if token = page.NextPageToken; token == "" {
+      return all, nil
+    }
+  }
+}
+
+/* A quoted string for a Drive search */
+func driveQuote(s string) string {
+  return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+/* Make a folder named name in parent, returning its id */
+func (d *googleDrive) mkdir(name, parent string) (string, error) {
+  body, _ := json.Marshal(map[string]interface{}{"name": name, "mimeType": driveFolderType, "parents": []string{parent}})
+  data, err := cloudCall(d.token, http.MethodPost, driveAPI+"?fields=id", http.Header{"Content-Type": {"application/json"}}, body)
+  if err != nil {
+    return "", err
+  }
+  var f driveFile
+  return f.ID, json.Unmarshal(data, &f)
+}
+
+/* The id of the folder dir ("" for the wiki's), made if it's missing; d.mu is held */
+func (d *googleDrive) folderID(dir string) (string, error) {
+  if id, ok := d.folders[dir]; ok {
+    return id, nil
+  }
+  parent, name := "", dir
+  if i := strings.LastIndex(dir, "/"); i >= 0 {
+    parent, name = dir[:i], dir[i+1:]
+  }
+  parentID, err := d.folderID(parent)
+  if err != nil {
+    return "", err
+  }
+  id, err := d.mkdir(name, parentID)
+  if err != nil {
+    return "", err
+  }
+  d.folders[dir] = id
+  return id, nil
+}
+
+func (d *googleDrive) list() (map[string]cloudFile, error) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  top, err := d.search("name = " + driveQuote(d.folder) + " and mimeType = '" + driveFolderType + "' and 'root' in parents and trashed = false")
+  if err != nil {
+    return nil, err
+  }
+  d.folders = map[string]string{}
+  if len(top) == 0 {
+    id, err := d.mkdir(d.folder, "root")
+    if err != nil {
+      return nil, err
+    }
+    d.folders[""] = id
+    return map[string]cloudFile{}, nil
+  }
+  d.folders[""] = top[0].ID
+  files := map[string]cloudFile{}
+  for queue := []string{""}; len(queue) > 0; queue = queue[1:] {
+    dir := queue[0]
+    found, err := d.search(driveQuote(d.folders[dir]) + " in parents and trashed = false")
+    if err != nil {
+      return nil, err
+    }
+    for _, f := range found {
+      name := path.Join(dir, f.Name)
+      if f.MimeType == driveFolderType {
+        if _, seen := d.folders[name]; !seen {
+          d.folders[name] = f.ID
+          queue = append(queue, name)
+        }
+      } else if title, ok := cloudTitle(name); ok {
+        files[title] = d.cloudFile(f)
+      }
+    }
+  }
+  return files, nil
+}
+
+func (d *googleDrive) download(f cloudFile) ([]byte, error) {
+  data, err := cloudCall(d.token, http.MethodGet, driveAPI+"/"+url.PathEscape(f.ID)+"?alt=media", nil, nil)
+  var e *cloudError
+  if errors.As(err, &e) && e.status == http.StatusNotFound {
+    return nil, os.ErrNotExist
+  }
+  return data, err
+}
+
+func (d *googleDrive) upload(title string, body []byte, old *cloudFile) (cloudFile, error) {
+  var data []byte
+  var err error
+  if old != nil {
+    data, err = cloudCall(d.token, http.MethodPatch, "https://www.googleapis.com/upload/drive/v3/files/"+url.PathEscape(old.ID)+"?uploadType=media&fields="+driveFields,
+      http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, body)
+  } else {
+    var parent string
+    d.mu.Lock()
+    parent, err = d.folderID(path.Dir("/" + title)[1:])
+    d.mu.Unlock()
+    if err != nil {
+      return cloudFile{}, err
+    }
+    // Metadata and content together, as multipart/related
+    var buf bytes.Buffer
+    mw := multipart.NewWriter(&buf)
+    meta, _ := json.Marshal(map[string]interface{}{"name": path.Base(title) + ".txt", "parents": []string{parent}, "mimeType": "text/plain"})
+    part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+    part.Write(meta)
+    part, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+    part.Write(body)
+    mw.Close()
+    data, err = cloudCall(d.token, http.MethodPost, "https://www.googleapis.com/upload/drive/v3/files?uploadType=multipart&fields="+driveFields,
+      http.Header{"Content-Type": {"multipart/related; boundary=" + mw.Boundary()}}, buf.Bytes())
+  }
+  if err != nil {
+    return cloudFile{}, err
+  }
+  var f driveFile
+  if err := json.Unmarshal(data, &f); err != nil {
+    return cloudFile{}, err
+  }
+  return d.cloudFile(f), nil
+}
+
+/* Move the file to the trash */
+func (d *googleDrive) remove(f cloudFile) error {
+  _, err := cloudCall(d.token, http.MethodPatch, driveAPI+"/"+url.PathEscape(f.ID),
+    http.Header{"Content-Type": {"application/json"}}, []byte(`{"trashed":true}`))
+  var e *cloudError
+  if errors.As(err, &e) && e.status == http.StatusNotFound {
+    return os.ErrNotExist
+  }
+  return err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+  "errors"
+  "log"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Running several instances
+  - Several instances can serve one wiki behind a load balancer when they
+    share the data directory (on a network file system) and a Redis server:
+    start each with -cluster redis and -redis-addr. Sign ins have to be
+    shared too, so -cluster needs -sessions redis, or -sessions cookie with
+    the same -session-key everywhere; add -cache redis for the page cache,
+    which invalidates across instances itself (see cache.go)
+  - Writes to a page hold its lock (see lockPage), which -cluster makes a
+    Redis lock every instance respects. Saves of a page on two instances
+    then happen one after the other, so revision numbers can't collide and
+    an If-Match or the merge of a stale edit sees what's really the latest
+  - An instance that changes accounts, groups, API tokens, features,
+    redirects, short links, interwiki prefixes or branding announces it on
+    wiki:settings, and the others read that file again
+  - Background jobs and scheduled tasks (jobs.go, cron.go) aren't shared:
+    give -cron to one instance and start jobs from its admin page only.
+    Sign in lockouts and API quotas are counted per instance
+*/
+var clusterRedis *redisClient
+
+var instanceID string
+
+const settingsChannel = "wiki:settings"
+
+/* How long a page lock is held at most, in case its instance dies holding
+  it, and how long a save waits for one
+*/
+const lockLease = 30 * time.Second
+const lockWait = 10 * time.Second
+
+var errPageLocked = errors.New("the page is being saved elsewhere; try again in a moment")
+
+/* Set up -cluster, after the sessions */
+func configureCluster(kind, redisAddr, sessionKind, sessionKey string) error {
+  switch kind {
+  case "none":
+    return nil
+  case "redis":
+  default:
+    return errors.New("unknown cluster mode " + kind)
+  }
+  if redisAddr == "" {
+    return errors.New("-cluster redis needs -redis-addr")
+  }
+  if sessionKind == "memory" || (sessionKind == "cookie" && sessionKey == "") {
+    return errors.New("-cluster needs sign ins every instance can see: -sessions redis, or -sessions cookie with a -session-key")
+  }
+  id, err := randomID()
+  if err != nil {
+    return err
+  }
+  instanceID, clusterRedis = id[:12], newRedisClient(redisAddr)
+  go listenSettings()
+  return nil
+}
+
+/* A page's lock in this process; users counts who holds or waits for it,
+  so it can be dropped when nobody does
+*/
+type pageLock struct {
+  mu sync.Mutex
+  users int
+}
+
+var pageLocks = struct {
+  sync.Mutex
+  m map[string]*pageLock
+}{m: map[string]*pageLock{}}
+
+/* Take title's write lock, returning the function that releases it
+  - Fails with errPageLocked if another instance holds the Redis lock for
+    longer than lockWait
+*/
+func lockPage(title string) (func(), error) {
+  pageLocks.Lock()
+  l := pageLocks.m[title]
+  if l == nil {
+    l = &pageLock{}
+    pageLocks.m[title] = l
+  }
+  l.users++
+  pageLocks.Unlock()
+  l.mu.Lock()
+  release := func() {
+    l.mu.Unlock()
+    pageLocks.Lock()
+    if l.users--; l.users == 0 {
+      delete(pageLocks.m, title)
+    }
+    pageLocks.Unlock()
+  }
+  if clusterRedis == nil {
+    return release, nil
+  }
+  key := "wiki:lock:" + title
+  token, err := randomID()
+  if err != nil {
+    release()
+    return nil, err
+  }
+  deadline := time.Now().Add(lockWait)
+  for wait := 10 * time.Millisecond; ; wait = min(2*wait, 500*time.Millisecond) {
+    _, err := clusterRedis.do("SET", key, token, "NX", "PX", strconv.FormatInt(lockLease.Milliseconds(), 10))
+    if err == nil {
+      break
+    }
+    if err != errRedisNil {
+      release()
+      return nil, err
+    }
+    if time.Now().After(deadline) {
+      release()
+      return nil, errPageLocked
+    }
+    time.Sleep(wait)
+  }
+  return func() {
+    // Only delete the lock if it's still ours, not one taken after the lease ran out
+    _, err := clusterRedis.do("EVAL", `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`, "1", key, token)
+    if err != nil {
+      log.Printf("cluster: releasing %s: %v", key, err)
+    }
+    release()
+  }, nil
+}
+
+/* Take the locks of several pages, in order so two callers can't each hold
+  one the other wants
+*/
+func lockPages(titles []string) (func(), error) {
+  sorted := append([]string(nil), titles...)
+  sort.Strings(sorted)
+  var unlocks []func()
+  unlockAll := func() {
+    for i := len(unlocks) - 1; i >= 0; i-- {
+      unlocks[i]()
+    }
+  }
+  for i, title := range sorted {
+    if i > 0 && title == sorted[i-1] {
+      continue
+    }
+    unlock, err := lockPage(title)
+    if err != nil {
+      unlockAll()
+      return nil, err
+    }
+    unlocks = append(unlocks, unlock)
+  }
+  return unlockAll, nil
+}
+
+/* What each settings name announced on wiki:settings reads again */
+var settingsLoaders = map[string]func() error{
+  "users": users.load,
+  "groups": loadGroups,
+  "tokens": loadTokens,
+  "features": loadFeatures,
+  "redirects": loadRedirects,
+  "shortlinks": loadShortLinks,
+  "interwiki": loadInterwiki,
+  "branding": loadBranding,
+}
+
+/* Tell the other instances that the settings called name were written */
+func settingsChanged(name string) {
+  if clusterRedis == nil {
+    return
+  }
+  if _, err := clusterRedis.do("PUBLISH", settingsChannel, instanceID+" "+name); err != nil {
+    log.Printf("cluster: %v", err)
+  }
+}
+
+/* Read settings again as other instances announce them, resubscribing if
+  the connection drops; as changes may have been missed meanwhile, it reads
+  them all on resubscribing
+*/
+func listenSettings() {
+  first := true
+  for {
+    err := clusterRedis.subscribe(settingsChannel, func() {
+      if !first {
+        for name := range settingsLoaders {
+          reloadSettings(name)
+        }
+      }
+      first = false
+    }, func(msg string) {
+      from, name, _ := strings.Cut(msg, " ")
+      if from != instanceID {
+        reloadSettings(name)
+      }
+    })
+    log.Printf("cluster: lost settings subscription: %v", err)
+    time.Sleep(time.Second)
+  }
+}
+
+func reloadSettings(name string) {
+  if load := settingsLoaders[name]; load != nil {
+    if err := load(); err != nil {
+      log.Printf("cluster: reading %s again: %v", name, err)
+    }
+  }
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "strings"
+  "sync"
+  "unicode/utf16"
+)
+
+/* Collaborative editing over a WebSocket at /ws/collab/{title}
+  - Operational transformation with the server as the single source of order
+    (the Jupiter approach): each edit is a collabOp against a numbered revision,
+    the server transforms it past anything the client hadn't seen yet, applies
+    it, and broadcasts it to every editor, the sender included as its ack
+  - A client has at most one op in flight and sends the next once it sees its
+    ack, which keeps the client side small (see static/edit.js)
+  - Positions count UTF-16 code units, as JavaScript strings do
+  - The shared text lives in memory while anyone has the page open; saving is
+    still done with the edit form, which holds the merged text
+  - Only those who could save the page may join (see collabAccess), and every
+    op is checked again, so a page protected meanwhile stops taking them
+  - Clients acknowledge the ops they've applied, and the history is kept only
+    back to the oldest revision one of them hasn't acknowledged, and for no
+    more than maxCollabHistory ops. A client further behind than that is
+    disconnected and catches up by reconnecting
+
+  Messages, all JSON:
+    server -> client  {"type": "init", "rev": 3, "text": "...", "id": 7}
+    client -> server  {"rev": 3, "op": {"pos": 0, "del": 1, "ins": "x"}}
+    server -> client  {"type": "op", "rev": 4, "op": {...}, "from": 7}
+    client -> server  {"rev": 4}    acknowledges revision 4
+*/
+const maxCollabHistory = 1000
+
+/* Replace del code units at pos with ins */
+type collabOp struct {
+  Pos int `json:"pos"`
+  Del int `json:"del"`
+  Ins string `json:"ins"`
+}
+
+/* Transform a so it applies after b, where both were made against the same text
+  - aFirst decides which op's insert goes first when the two touch the same
+    spot; the server gives priority to the op it already applied, and the client
+    to the op arriving from the server, so both ends agree
+  - When the ranges overlap, both deletions happen and the inserts end up next
+    to each other. The op that starts first takes over the other's inserted
+    text, so the result can still be a single replace
+  - Must match transform() in static/edit.js exactly
+*/
+func transformOp(a, b collabOp, aFirst bool) collabOp {
+  aStart, aEnd := a.Pos, a.Pos+a.Del
+  bStart, bEnd := b.Pos, b.Pos+b.Del
+  bLen := utf16Len(b.Ins)
+  switch {
+  case aEnd <= bStart && bEnd <= aStart: // inserts at the same place
+    if aFirst {
+      return a
+    }
+    return collabOp{Pos: a.Pos + bLen, Del: a.Del, Ins: a.Ins}
+  case aEnd <= bStart:
+    return a
+  case aStart >= bEnd:
+    return collabOp{Pos: a.Pos + bLen - b.Del, Del: a.Del, Ins: a.Ins}
+  case aStart < bStart || (aStart == bStart && aFirst):
+    return collabOp{Pos: aStart, Del: bStart - aStart + bLen + max(0, aEnd-bEnd), Ins: a.Ins + b.Ins}
+  default:
+    return collabOp{Pos: bStart + bLen, Del: max(0, aEnd-bEnd), Ins: a.Ins}
+  }
+}
+
+func utf16Len(s string) int {
+  return len(utf16.Encode([]rune(s)))
+}
+
+/* One page being edited together */
+type collabDoc struct {
+  title string
+  mu sync.Mutex
+  text []uint16
+  rev int
+  base int // revision the history starts from
+  history []collabOp // history[i] produced revision base+i+1
+  clients map[*collabClient]bool
+  nextID int
+}
+
+type collabClient struct {
+  id int
+  seen int // latest revision the client has acknowledged
+  ws *wsConn
+  send chan []byte
+}
+
+/* Open documents by title */
+var collabDocs = struct {
+  sync.Mutex
+  docs map[string]*collabDoc
+}{docs: map[string]*collabDoc{}}
+
+/* Join the document for title, starting it from the saved page if nobody has it open */
+func joinCollab(title string, ws *wsConn) (*collabDoc, *collabClient, []byte) {
+  collabDocs.Lock()
+  defer collabDocs.Unlock()
+  doc := collabDocs.docs[title]
+  if doc == nil {
+    var body []byte
+    if p, err := loadPage(title); err == nil {
+      body = p.Body
+    }
+    doc = &collabDoc{title: title, text: utf16.Encode([]rune(string(body))), clients: map[*collabClient]bool{}}
+    collabDocs.docs[title] = doc
+  }
+  doc.mu.Lock()
+  defer doc.mu.Unlock()
+  doc.nextID++
+  c := &collabClient{id: doc.nextID, seen: doc.rev, ws: ws, send: make(chan []byte, 64)}
+  doc.clients[c] = true
+  init, _ := json.Marshal(map[string]interface{}{
+    "type": "init", "rev": doc.rev, "text": string(utf16.Decode(doc.text)), "id": c.id,
+  })
+  return doc, c, init
+}
+
+/* Leave a document, forgetting it once the last editor has gone */
+func (doc *collabDoc) leave(c *collabClient) {
+  collabDocs.Lock()
+  defer collabDocs.Unlock()
+  doc.mu.Lock()
+  defer doc.mu.Unlock()
+  delete(doc.clients, c)
+  close(c.send)
+  if len(doc.clients) == 0 {
+    delete(collabDocs.docs, doc.title)
+  }
+}
+
+/* Apply an op a client made against revision rev and broadcast the result */
+func (doc *collabDoc) submit(c *collabClient, rev int, op collabOp) error {
+  doc.mu.Lock()
+  defer doc.mu.Unlock()
+  if rev < doc.base || rev < c.seen || rev > doc.rev {
+    return errors.New("bad revision")
+  }
+  c.seen = rev
+  for _, past := range doc.history[rev-doc.base:] {
+    op = transformOp(op, past, false)
+  }
+  if op.Pos < 0 || op.Del < 0 || op.Pos+op.Del > len(doc.text) {
+    return errors.New("op out of range")
+  }
+  ins := utf16.Encode([]rune(op.Ins))
+  if int64(len(doc.text)-op.Del+len(ins)) > maxBodySize {
+    return errBodyTooLarge
+  }
+  text := make([]uint16, 0, len(doc.text)-op.Del+len(ins))
+  text = append(text, doc.text[:op.Pos]...)
+  text = append(text, ins...)
+  doc.text = append(text, doc.text[op.Pos+op.Del:]...)
+  doc.history = append(doc.history, op)
+  doc.rev++
+  msg, _ := json.Marshal(map[string]interface{}{"type": "op", "rev": doc.rev, "op": op, "from": c.id})
+  for other := range doc.clients {
+    select {
+    case other.send <- msg:
+    default:
+      other.ws.Close() // too far behind to catch up; it will reconnect
+    }
+  }
+  doc.trim()
+  return nil
+}
+
+/* Note that c has applied everything up to revision rev */
+func (doc *collabDoc) ack(c *collabClient, rev int) error {
+  doc.mu.Lock()
+  defer doc.mu.Unlock()
+  if rev < c.seen || rev > doc.rev {
+    return errors.New("bad revision")
+  }
+  c.seen = rev
+  doc.trim()
+  return nil
+}
+
+/* Drop the ops every client has acknowledged, and any past maxCollabHistory */
+func (doc *collabDoc) trim() {
+  keep := doc.rev
+  for c := range doc.clients {
+    keep = min(keep, c.seen)
+  }
+  keep = max(keep, doc.rev-maxCollabHistory)
+  if keep > doc.base {
+    doc.history = doc.history[keep-doc.base:]
+    doc.base = keep
+  }
+}
+
+/* Whether u, nil when not signed in, may edit title together with others:
+  http.StatusOK, or the status to refuse them with
+  - Changes to a page under review go through the edit form as proposals,
+    so there's no editing it live
+*/
+func collabAccess(title string, u *User) (int, error) {
+  switch err := authorizeSave(title, u); err {
+  case nil:
+    return http.StatusOK, nil
+  case errNoSuchPage, errProtected, errNeedsReview:
+    return saveErrorStatus(err), nil
+  default:
+    return 0, err
+  }
+}
+
+/* Handler for /ws/collab/{title} */
+func collabSocketHandler(w http.ResponseWriter, r *http.Request) {
+  title := strings.TrimPrefix(r.URL.Path, "/ws/collab/")
+  if !validTitle.MatchString(title) {
+    http.NotFound(w, r)
+    return
+  }
+  u := currentUser(r)
+  if status, err := collabAccess(title, u); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  } else if status != http.StatusOK {
+    http.Error(w, http.StatusText(status), status)
+    return
+  }
+  ws, err := wsUpgrade(w, r, 2*maxBodySize+4096)
+  if err != nil {
+    return
+  }
+  defer ws.Close()
+  doc, c, init := joinCollab(title, ws)
+  defer doc.leave(c)
+  if err := ws.WriteMessage(init); err != nil {
+    return
+  }
+  go func() {
+    for msg := range c.send {
+      if ws.WriteMessage(msg) != nil {
+        ws.Close()
+      }
+    }
+  }()
+  for {
+    data, err := ws.ReadMessage()
+    if err != nil {
+      return
+    }
+    var in struct {
+      Rev int `json:"rev"`
+      Op *collabOp `json:"op"`
+    }
+    if json.Unmarshal(data, &in) != nil {
+      return
+    }
+    if in.Op == nil {
+      err = doc.ack(c, in.Rev)
+    } else if err = authorizeSave(title, u); err == nil {
+      err = doc.submit(c, in.Rev, *in.Op)
+    }
+    if err != nil {
+      return // the client resyncs by reconnecting
+    }
+  }
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+/* History compaction
+  - The compact-history job rewrites old revisions in the file history as
+    deltas: {n}.delta instead of {n}.txt, holding the lines revision n
+    shares with the next revision and the ones it doesn't. The latest
+    revision is always kept whole, so viewing a page never reads a delta
+  - A chain of deltas is cut off with a whole revision every maxDeltaChain,
+    so loading an old revision reads at most that many files
+  - A revision is only stored as a delta if that makes it a quarter smaller
+  - It also removes stray files, like the body of a revision whose
+    metadata is gone after a deletion was interrupted
+  - The job's result on the admin page gives the size of the history before
+    and after
+*/
+const maxDeltaChain = 16
+
+/* Lines past common start and end that are diffed line by line; beyond
+  this the changed middle is stored as it is, to bound the diff's memory
+*/
+const maxDeltaDiff = 1000
+
+type compactStats struct {
+  Before, After int64 // bytes in the history
+  Encoded int // revisions turned into deltas
+  Expanded int // deltas made whole again
+  Removed int // stray files deleted
+}
+
+/* History stores that can compact themselves */
+type compactor interface {
+  Compact(ctx context.Context) (compactStats, error)
+}
+
+var errBadDelta = errors.New("corrupt revision delta")
+
+/* The compact-history job */
+func compactHistoryJob(ctx context.Context, j *Job) (string, error) {
+  c, ok := history.(compactor)
+  if !ok {
+    return "nothing to do: the history is kept in memory", nil
+  }
+  st, err := c.Compact(ctx)
+  if err != nil {
+    return "", err
+  }
+  return fmt.Sprintf("history was %s, now %s; %d revisions stored as deltas, %d stored whole again, %d stray files removed",
+    sizeText(st.Before), sizeText(st.After), st.Encoded, st.Expanded, st.Removed), nil
+}
+
+/* "12.5 KB" for 12800 */
+func sizeText(n int64) string {
+  const unit = 1024
+  if n < unit {
+    return strconv.FormatInt(n, 10) + " bytes"
+  }
+  div, exp := int64(unit), 0
+  for m := n / unit; m >= unit; m /= unit {
+    div *= unit
+    exp++
+  }
+  return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "B"
+}
+
+/* A delta giving target from base, the body of revision baseNumber:
+    delta {baseNumber}
+    c {first line} {lines}   lines copied from base
+    i {bytes}                followed by that many bytes of new text
+*/
+func makeDelta(target, base []byte, baseNumber int) []byte {
+  x, y := splitLines(string(target)), splitLines(string(base))
+  prefix := 0
+  for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+    prefix++
+  }
+  suffix := 0
+  for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+    suffix++
+  }
+  // match[i] is the line of base that line i of target copies, or -1
+  match := make([]int, len(x))
+  for i := range match {
+    switch {
+    case i < prefix:
+      match[i] = i
+    case i >= len(x)-suffix:
+      match[i] = i - len(x) + len(y)
+    default:
+      match[i] = -1
+    }
+  }
+  xm, ym := x[prefix:len(x)-suffix], y[prefix:len(y)-suffix]
+  if len(xm)+len(ym) <= maxDeltaDiff {
+    for i, m := range matchLines(xm, ym) {
+      if m >= 0 {
+        match[prefix+i] = prefix + m
+      }
+    }
+  }
+
+  var out bytes.Buffer
+  out.WriteString("delta " + strconv.Itoa(baseNumber) + "\n")
+  for i := 0; i < len(x); {
+    j := i + 1
+    if match[i] < 0 {
+      for j < len(x) && match[j] < 0 {
+        j++
+      }
+      text := strings.Join(x[i:j], "")
+      out.WriteString("i " + strconv.Itoa(len(text)) + "\n" + text)
+    } else {
+      for j < len(x) && match[j] == match[j-1]+1 {
+        j++
+      }
+      out.WriteString("c " + strconv.Itoa(match[i]) + " " + strconv.Itoa(j-i) + "\n")
+    }
+    i = j
+  }
+  return out.Bytes()
+}
+
+/* The revision a delta is against */
+func deltaBase(delta []byte) (int, error) {
+  line, _, _ := bytes.Cut(delta, []byte("\n"))
+  n, err := strconv.Atoi(strings.TrimPrefix(string(line), "delta "))
+  if err != nil || !bytes.HasPrefix(line, []byte("delta ")) {
+    return 0, errBadDelta
+  }
+  return n, nil
+}
+
+/* The text delta gives when applied to base */
+func applyDelta(delta, base []byte) ([]byte, error) {
+  y := splitLines(string(base))
+  _, rest, _ := bytes.Cut(delta, []byte("\n"))
+  var out bytes.Buffer
+  for len(rest) > 0 {
+    var line []byte
+    var ok bool
+    if line, rest, ok = bytes.Cut(rest, []byte("\n")); !ok {
+      return nil, errBadDelta
+    }
+    f := strings.Fields(string(line))
+    switch {
+    case len(f) == 3 && f[0] == "c":
+      from, err1 := strconv.Atoi(f[1])
+      n, err2 := strconv.Atoi(f[2])
+      if err1 != nil || err2 != nil || from < 0 || n < 0 || from+n > len(y) {
+        return nil, errBadDelta
+      }
+      for _, l := range y[from : from+n] {
+        out.WriteString(l)
+      }
+    case len(f) == 2 && f[0] == "i":
+      n, err := strconv.Atoi(f[1])
+      if err != nil || n < 0 || n > len(rest) {
+        return nil, errBadDelta
+      }
+      out.Write(rest[:n])
+      rest = rest[n:]
+    default:
+      return nil, errBadDelta
+    }
+  }
+  return out.Bytes(), nil
+}
+
+/* Revision n's body in dir, whole or from its delta */
+func (h *fileHistory) loadRevision(dir string, n, depth int) ([]byte, error) {
+  name := filepath.Join(dir, strconv.Itoa(n))
+  body, err := h.codec.read(name + ".txt")
+  if !os.IsNotExist(err) {
+    return body, err
+  }
+  delta, derr := h.codec.read(name + ".delta")
+  if os.IsNotExist(derr) {
+    // Compaction may have just made it whole again
+    return h.codec.read(name + ".txt")
+  }
+  if derr != nil {
+    return nil, derr
+  }
+  if depth > maxDeltaChain {
+    return nil, errBadDelta
+  }
+  base, err := deltaBase(delta)
+  if err != nil {
+    return nil, err
+  }
+  baseBody, err := h.loadRevision(dir, base, depth+1)
+  if err != nil {
+    return nil, err
+  }
+  return applyDelta(delta, baseBody)
+}
+
+/* The revision revision n's delta is against, 0 if it is stored whole */
+func (h *fileHistory) storedBase(dir string, n int) int {
+  delta, err := h.codec.read(filepath.Join(dir, strconv.Itoa(n)+".delta"))
+  if err != nil {
+    return 0
+  }
+  if _, err := os.Stat(filepath.Join(dir, strconv.Itoa(n)+".txt")); err == nil {
+    return 0 // the whole body wins
+  }
+  base, _ := deltaBase(delta)
+  return base
+}
+
+/* Store revision n in dir whole, if it is a delta; the caller holds mu */
+func (h *fileHistory) expandRevision(dir string, n int) error {
+  name := filepath.Join(dir, strconv.Itoa(n))
+  if _, err := os.Stat(name + ".delta"); err != nil {
+    return nil
+  }
+  body, err := h.loadRevision(dir, n, 0)
+  if err != nil {
+    return err
+  }
+  if err := h.codec.write(name+".txt", body); err != nil {
+    return err
+  }
+  return os.Remove(name + ".delta")
+}
+
+func (h *fileHistory) Compact(ctx context.Context) (compactStats, error) {
+  var st compactStats
+  var err error
+  if st.Before, err = dirSize(h.dir); err != nil {
+    return st, err
+  }
+  titles, err := h.Titles()
+  if err != nil {
+    return st, err
+  }
+  for _, title := range titles {
+    if err := ctx.Err(); err != nil {
+      return st, err
+    }
+    h.mu.Lock()
+    err := h.compactPage(title, &st)
+    h.mu.Unlock()
+    if err != nil {
+      return st, fmt.Errorf("%s: %v", title, err)
+    }
+  }
+  st.After, err = dirSize(h.dir)
+  return st, err
+}
+
+func (h *fileHistory) compactPage(title string, st *compactStats) error {
+  dir := h.pageDir(title)
+  revs, err := h.Revisions(title)
+  if err != nil {
+    return err
+  }
+  known := map[string]bool{}
+  for _, rev := range revs {
+    known[strconv.Itoa(rev.Number)] = true
+  }
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return err
+  }
+  for _, e := range entries {
+    n, ext, _ := strings.Cut(e.Name(), ".")
+    stray := strings.HasSuffix(e.Name(), ".tmp") || ((ext == "txt" || ext == "delta") && !known[n])
+    if ext == "delta" && known[n] {
+      if _, err := os.Stat(filepath.Join(dir, n+".txt")); err == nil {
+        stray = true // left over from making it whole again
+      }
+    }
+    if stray {
+      if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+        return err
+      }
+      st.Removed++
+    }
+  }
+  if len(revs) == 0 {
+    return nil
+  }
+
+  latest := revs[len(revs)-1].Number
+  if err := h.expandRevision(dir, latest); err != nil {
+    return err
+  }
+  newer, err := h.loadRevision(dir, latest, 0)
+  if err != nil {
+    return err
+  }
+  depth := 0
+  for i := len(revs) - 2; i >= 0; i-- {
+    n, base := revs[i].Number, revs[i+1].Number
+    name := filepath.Join(dir, strconv.Itoa(n))
+    body, err := h.loadRevision(dir, n, 0)
+    if err != nil {
+      return err
+    }
+    stored := h.storedBase(dir, n)
+    var delta []byte
+    if stored != base && depth < maxDeltaChain {
+      delta = makeDelta(body, newer, base)
+    }
+    switch {
+    case stored == base && depth < maxDeltaChain:
+      depth++
+    case delta != nil && len(delta) < len(body)*3/4:
+      if err := h.codec.write(name+".delta", delta); err != nil {
+        return err
+      }
+      if err := os.Remove(name + ".txt"); err != nil && !os.IsNotExist(err) {
+        return err
+      }
+      if stored == 0 {
+        st.Encoded++
+      }
+      depth++
+    default:
+      if stored != 0 {
+        if err := h.expandRevision(dir, n); err != nil {
+          return err
+        }
+        st.Expanded++
+      }
+      depth = 0
+    }
+    newer = body
+  }
+  return nil
+}
+
+/* Bytes in the files under dir */
+func dirSize(dir string) (int64, error) {
+  var size int64
+  err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+    if os.IsNotExist(err) {
+      return nil
+    }
+    if err != nil || d.IsDir() {
+      return err
+    }
+    info, err := d.Info()
+    if err == nil {
+      size += info.Size()
+    }
+    return err
+  })
+  return size, err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "io"
+  "io/ioutil"
+  "os"
+  "strings"
+)
+
+/* Encoding of stored files
+  - The file backends write page bodies and revisions through a fileCodec,
+    which can gzip them (-compress=gzip) and then encrypt them
+    (-encrypt, see loadEncryptionKey)
+  - Reads sniff the content instead of trusting the settings, so files written
+    before compression or encryption was switched on still load. Page bodies
+    can't start with any of the magic bytes since validateBody rejects control
+    characters
+  - zstd would need a third party package; its magic is recognised so such a
+    file gives a clear error rather than garbage
+  - Under any compression and encryption the body starts with checksumMagic
+    and its SHA-256, checked on every read (see checksum.go); files written
+    before checksums were added have neither and are read as they are
+  - Files are written to a temporary file and renamed into place, so a read
+    never sees one half written
+*/
+type fileCodec struct {
+  compress bool
+  aead cipher.AEAD // nil when encryption is off
+  noChecksum bool // writes files as before checksums, to go back to that version (see schema.go)
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+/* Encrypted files are the magic, a 12 byte nonce, then the AES-GCM sealed content */
+var encryptedMagic = []byte{0x00, 'W', 'K', 'E', '1'}
+
+/* Checksummed content is the magic, the SHA-256 of the body, then the body */
+var checksumMagic = []byte{0x00, 'W', 'K', 'S', '1'}
+
+const checksumHeader = 5 + sha256.Size
+
+var errZstdUnsupported = errors.New("zstd compressed files are not supported")
+var errNoKey = errors.New("file is encrypted but no encryption key is configured")
+var errDecrypt = errors.New("can't decrypt file: wrong key or corrupted")
+
+/* Read a stored file, decrypting and decompressing it as needed */
+func (c *fileCodec) read(path string) ([]byte, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  body, err := c.decode(data)
+  if err == errCorrupt {
+    flagCorrupt(path)
+  }
+  return body, err
+}
+
+func (c *fileCodec) decode(data []byte) ([]byte, error) {
+  data, err := c.decrypt(data)
+  if err != nil {
+    return nil, err
+  }
+  switch {
+  case bytes.HasPrefix(data, gzipMagic):
+    zr, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+      return nil, errCorrupt
+    }
+    defer zr.Close()
+    if data, err = ioutil.ReadAll(zr); err != nil {
+      return nil, errCorrupt
+    }
+  case bytes.HasPrefix(data, zstdMagic):
+    return nil, errZstdUnsupported
+  }
+  if !bytes.HasPrefix(data, checksumMagic) {
+    return data, nil
+  }
+  if len(data) < checksumHeader {
+    return nil, errCorrupt
+  }
+  body := data[checksumHeader:]
+  if sum := sha256.Sum256(body); !bytes.Equal(sum[:], data[len(checksumMagic):checksumHeader]) {
+    return nil, errCorrupt
+  }
+  return body, nil
+}
+
+/* Undo the encryption part of encode, leaving anything else as it is */
+func (c *fileCodec) decrypt(data []byte) ([]byte, error) {
+  if !bytes.HasPrefix(data, encryptedMagic) {
+    return data, nil
+  }
+  if c.aead == nil {
+    return nil, errNoKey
+  }
+  data = data[len(encryptedMagic):]
+  ns := c.aead.NonceSize()
+  if len(data) < ns {
+    return nil, errors.New("encrypted file is truncated")
+  }
+  plain, err := c.aead.Open(nil, data[:ns], data[ns:], nil)
+  if err != nil {
+    return nil, errDecrypt
+  }
+  return plain, nil
+}
+
+/* Write a stored file, 0600 so it's only readable and writable by the current user */
+func (c *fileCodec) write(path string, body []byte) error {
+  data, err := c.encode(body)
+  if err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+    return err
+  }
+  return os.Rename(path+".tmp", path)
+}
+
+func (c *fileCodec) encode(body []byte) ([]byte, error) {
+  if !c.noChecksum {
+    sum := sha256.Sum256(body)
+    body = append(append(append([]byte{}, checksumMagic...), sum[:]...), body...)
+  }
+  if c.compress {
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    zw.Write(body)
+    if err := zw.Close(); err != nil {
+      return nil, err
+    }
+    body = buf.Bytes()
+  }
+  return c.encrypt(body)
+}
+
+/* Encrypt data if encryption is on, leaving anything else as it is */
+func (c *fileCodec) encrypt(data []byte) ([]byte, error) {
+  if c.aead == nil {
+    return data, nil
+  }
+  nonce := make([]byte, c.aead.NonceSize())
+  if _, err := rand.Read(nonce); err != nil {
+    return nil, err
+  }
+  out := append(append([]byte{}, encryptedMagic...), nonce...)
+  return c.aead.Seal(out, nonce, data, nil), nil
+}
+
+/* Uncompressed size of a stored file
+  - A gzip file ends with the uncompressed size mod 2^32, which is plenty for
+    pages capped by -max-body, so there's no need to decompress it
+  - Encrypted files have to be decrypted to find out, and gzip files are
+    opened to see if they start with a checksum
+*/
+func (c *fileCodec) size(path string) (int64, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return 0, err
+  }
+  defer f.Close()
+  info, err := f.Stat()
+  if err != nil {
+    return 0, err
+  }
+  head := make([]byte, len(encryptedMagic))
+  n, _ := f.ReadAt(head, 0)
+  head = head[:n]
+  switch {
+  case bytes.HasPrefix(head, encryptedMagic):
+    body, err := c.read(path)
+    return int64(len(body)), err
+  case bytes.HasPrefix(head, gzipMagic) && info.Size() >= 18:
+    var tail [4]byte
+    if _, err := f.ReadAt(tail[:], info.Size()-4); err != nil {
+      return 0, err
+    }
+    size := int64(binary.LittleEndian.Uint32(tail[:]))
+    if zr, err := gzip.NewReader(io.NewSectionReader(f, 0, info.Size())); err == nil {
+      start := make([]byte, len(checksumMagic))
+      if _, err := io.ReadFull(zr, start); err == nil && bytes.Equal(start, checksumMagic) {
+        size -= checksumHeader
+      }
+    }
+    return size, nil
+  case bytes.Equal(head, checksumMagic):
+    return info.Size() - checksumHeader, nil
+  }
+  return info.Size(), nil
+}
+
+/* Encryption key for -encrypt
+  - Read from the WIKI_ENCRYPTION_KEY environment variable, or from keyFile
+    (-encryption-key-file) which is how secrets from a KMS or vault agent are
+    usually handed to a process
+  - The key is 32 bytes (AES-256), written as hex or base64
+*/
+func loadEncryptionKey(keyFile string) (cipher.AEAD, error) {
+  text := os.Getenv("WIKI_ENCRYPTION_KEY")
+  if keyFile != "" {
+    data, err := ioutil.ReadFile(keyFile)
+    if err != nil {
+      return nil, err
+    }
+    text = string(data)
+  }
+  text = strings.TrimSpace(text)
+  if text == "" {
+    return nil, errors.New("encryption needs a key in WIKI_ENCRYPTION_KEY or -encryption-key-file")
+  }
+  key, err := hex.DecodeString(text)
+  if err != nil {
+    key, err = base64.StdEncoding.DecodeString(text)
+  }
+  if err != nil || len(key) != 32 {
+    return nil, errors.New("encryption key must be 32 bytes, hex or base64 encoded")
+  }
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+  return cipher.NewGCM(block)
+}
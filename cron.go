@@ -0,0 +1,228 @@
+package main
+
+import (
+  "errors"
+  "log"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Scheduled tasks
+  - -cron kind=schedule queues a job of that kind (see jobs.go) on a
+    schedule, e.g. -cron 'backup=0 3 * * *' or -cron check-links=@weekly;
+    repeat it for more tasks
+  - A schedule is cron's five fields, minute hour day-of-month month
+    day-of-week (0 or 7 is Sunday), each *, a number, a range a-b or a list
+    of those, any with a /step; or one of @hourly, @daily, @weekly, @monthly
+    and @every {duration} of a minute or more
+  - As in cron, when both day fields are given a day matching either will do
+  - Times are in the server's time zone. Runs missed while the wiki was down
+    aren't made up, and a run is skipped if the last one is still queued or
+    running
+  - The admin page lists the tasks with their next run and the last job of
+    their kind, and can run one at once
+*/
+type cronTask struct {
+  Kind string
+  Spec string
+  sched *cronSchedule
+  Next time.Time
+}
+
+var cronTasks struct {
+  sync.Mutex
+  list []*cronTask
+}
+
+/* Parse a -cron flag */
+func addCronTask(s string) error {
+  kind, spec, ok := strings.Cut(s, "=")
+  kind, spec = strings.TrimSpace(kind), strings.TrimSpace(spec)
+  if !ok || kind == "" || spec == "" {
+    return errors.New("want kind=schedule, e.g. backup=@daily")
+  }
+  if jobKinds[kind] == nil {
+    return errors.New("unknown kind of job: " + kind)
+  }
+  if kind == "import" {
+    return errors.New("import jobs need a zip file, so can't be scheduled")
+  }
+  sched, err := parseCron(spec)
+  if err != nil {
+    return err
+  }
+  cronTasks.Lock()
+  cronTasks.list = append(cronTasks.list, &cronTask{Kind: kind, Spec: spec, sched: sched})
+  cronTasks.Unlock()
+  return nil
+}
+
+/* When a task runs: every, or the times matching the fields */
+type cronSchedule struct {
+  every time.Duration
+  minute, hour, dom, month, dow uint64 // bit n set if n matches
+  anyDOM, anyDOW bool
+}
+
+var cronShorthands = map[string]string{
+  "@hourly": "0 * * * *",
+  "@daily": "0 0 * * *",
+  "@weekly": "0 0 * * 0",
+  "@monthly": "0 0 1 * *",
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+  if d, ok := strings.CutPrefix(spec, "@every "); ok {
+    every, err := time.ParseDuration(strings.TrimSpace(d))
+    if err != nil || every < time.Minute {
+      return nil, errors.New("@every takes a duration of a minute or more, e.g. @every 6h")
+    }
+    return &cronSchedule{every: every}, nil
+  }
+  if s, ok := cronShorthands[spec]; ok {
+    spec = s
+  }
+  fields := strings.Fields(spec)
+  if len(fields) != 5 {
+    return nil, errors.New("a schedule has five fields, minute hour day month weekday, e.g. 30 2 * * *")
+  }
+  c := &cronSchedule{anyDOM: fields[2] == "*", anyDOW: fields[4] == "*"}
+  var err error
+  for i, f := range []struct {
+    bits *uint64
+    lo, hi int
+  }{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7}} {
+    if *f.bits, err = parseCronField(fields[i], f.lo, f.hi); err != nil {
+      return nil, err
+    }
+  }
+  if c.dow&(1<<7) != 0 {
+    c.dow |= 1 // 7 is Sunday too
+  }
+  return c, nil
+}
+
+/* One field of a schedule as a bit set */
+func parseCronField(field string, lo, hi int) (uint64, error) {
+  bad := errors.New("bad schedule field " + strconv.Quote(field) + ": want values " + strconv.Itoa(lo) + "-" + strconv.Itoa(hi))
+  var set uint64
+  for _, part := range strings.Split(field, ",") {
+    rng, stepText, hasStep := strings.Cut(part, "/")
+    step := 1
+    if hasStep {
+      n, err := strconv.Atoi(stepText)
+      if err != nil || n < 1 {
+        return 0, bad
+      }
+      step = n
+    }
+    from, to := lo, hi
+    if rng != "*" {
+      a, b, isRange := strings.Cut(rng, "-")
+      var err error
+      if from, err = strconv.Atoi(a); err != nil {
+        return 0, bad
+      }
+      to = from
+      if isRange {
+        if to, err = strconv.Atoi(b); err != nil {
+          return 0, bad
+        }
+      } else if hasStep {
+        to = hi // 5/15 is 5, 20, 35, 50
+      }
+    }
+    if from < lo || to > hi || from > to {
+      return 0, bad
+    }
+    for n := from; n <= to; n += step {
+      set |= 1 << n
+    }
+  }
+  return set, nil
+}
+
+/* The first time after t the schedule matches, or the zero time if there
+  is none in the next few years (say, 30 February)
+*/
+func (c *cronSchedule) next(t time.Time) time.Time {
+  if c.every > 0 {
+    return t.Add(c.every)
+  }
+  t = t.Truncate(time.Minute).Add(time.Minute)
+  limit := t.AddDate(5, 0, 0)
+  for t.Before(limit) {
+    switch {
+    case c.month&(1<<uint(t.Month())) == 0:
+      t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+    case !c.dayMatches(t):
+      t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+    case c.hour&(1<<uint(t.Hour())) == 0:
+      t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+    case c.minute&(1<<uint(t.Minute())) == 0:
+      t = t.Add(time.Minute)
+    default:
+      return t
+    }
+  }
+  return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+  dom := c.dom&(1<<uint(t.Day())) != 0
+  dow := c.dow&(1<<uint(t.Weekday())) != 0
+  if c.anyDOM || c.anyDOW {
+    return dom && dow
+  }
+  return dom || dow
+}
+
+/* Queue each task's job when its time comes, started from main */
+func runCron() {
+  cronTasks.Lock()
+  now := time.Now()
+  for _, t := range cronTasks.list {
+    t.Next = t.sched.next(now)
+  }
+  cronTasks.Unlock()
+  for {
+    now := time.Now()
+    time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+    now = time.Now()
+    cronTasks.Lock()
+    for _, t := range cronTasks.list {
+      if t.Next.IsZero() || now.Before(t.Next) {
+        continue
+      }
+      t.Next = t.sched.next(now)
+      if jobPending(t.Kind) {
+        log.Printf("cron: skipping %s, the last one hasn't finished", t.Kind)
+        continue
+      }
+      if _, err := enqueueJob(t.Kind, nil, "cron"); err != nil {
+        log.Printf("cron: %s: %v", t.Kind, err)
+      }
+    }
+    cronTasks.Unlock()
+  }
+}
+
+/* A scheduled task as the admin page shows it */
+type cronInfo struct {
+  Kind string
+  Spec string
+  Next time.Time
+  Last *Job // the newest job of the kind, however it was started
+}
+
+func cronList() []cronInfo {
+  cronTasks.Lock()
+  defer cronTasks.Unlock()
+  list := []cronInfo{}
+  for _, t := range cronTasks.list {
+    list = append(list, cronInfo{Kind: t.Kind, Spec: t.Spec, Next: t.Next, Last: lastJob(t.Kind)})
+  }
+  return list
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+  "net/http"
+  "strconv"
+)
+
+/* Drafts
+  - "Save as draft" on the edit form makes a page a draft. Signed in users
+    see the latest revision; everyone else keeps seeing the revision that was
+    current when the drafting started (PageMeta.Published), or nothing at all
+    for a page that is new
+  - POST /publish/{title} promotes the latest revision, as does saving from
+    the edit form with "Save and publish". Other saves leave the status be
+  - Retention never prunes a draft's published revision
+*/
+
+/* The banner for a draft, shown to the signed in users who see the latest
+  revision; which revision everyone else sees is decided by authorizeRead
+*/
+func draftBanner(m PageMeta, u *User) string {
+  if !m.Draft || u == nil {
+    return ""
+  }
+  if m.Published == 0 {
+    return "Draft: this page hasn't been published yet."
+  }
+  return "Draft: readers still see revision " + strconv.Itoa(m.Published) + "."
+}
+
+/* Set the draft status from the edit form after saving title
+  - Going from published to draft keeps the revision before this save as the
+    published one
+*/
+func setDraft(title string, m *PageMeta, draft bool) error {
+  if !draft {
+    m.Draft, m.Published = false, 0
+    return nil
+  }
+  if m.Draft {
+    return nil
+  }
+  revs, err := history.Revisions(title)
+  if err != nil {
+    return err
+  }
+  m.Draft, m.Published = true, 0
+  if len(revs) > 1 {
+    m.Published = revs[len(revs)-2].Number
+  }
+  return nil
+}
+
+/* POST /publish/{title}: make the latest revision the one everyone sees */
+func publishHandler(w http.ResponseWriter, r *http.Request, title string) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+pageURL("view", title), http.StatusFound)
+    return
+  }
+  if err := authorizeWrite(title, u); err == errNoSuchPage || err == errProtected {
+    http.Error(w, err.Error(), saveErrorStatus(err))
+    return
+  } else if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if m.Draft {
+    m.Draft, m.Published = false, 0
+    if err := pageMeta.Save(title, m); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    pageEvents.publish("publish", title)
+  }
+  http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+  "html/template"
+  "net/url"
+  "regexp"
+  "strings"
+)
+
+/* Embedded media with [[Embed:url]]
+  - Only YouTube, Vimeo and asciinema are allowed. The URL is parsed down to
+    the video's ID and the player URL built from that, so nothing from the
+    page ends up in the iframe but the ID
+  - Any other host, or a URL that isn't a video, is left as text
+  - The iframe is sandboxed; the hosts are also the only frame sources the
+    default Content-Security-Policy allows
+*/
+var embedID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+/* Player URL for a media page URL, "" if it isn't one we allow */
+func embedURL(raw string) string {
+  u, err := url.Parse(strings.TrimSpace(raw))
+  if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+    return ""
+  }
+  host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+  parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+  var id, player string
+  switch {
+  case host == "youtube.com" || host == "m.youtube.com":
+    id, player = u.Query().Get("v"), "https://www.youtube-nocookie.com/embed/"
+    if len(parts) == 2 && (parts[0] == "embed" || parts[0] == "shorts") {
+      id = parts[1]
+    }
+  case host == "youtu.be" && len(parts) == 1:
+    id, player = parts[0], "https://www.youtube-nocookie.com/embed/"
+  case host == "vimeo.com" && len(parts) == 1:
+    id, player = parts[0], "https://player.vimeo.com/video/"
+  case host == "asciinema.org" && len(parts) == 2 && parts[0] == "a":
+    id, player = parts[1], "https://asciinema.org/a/"
+  }
+  if !embedID.MatchString(id) {
+    return ""
+  }
+  if strings.HasPrefix(player, "https://asciinema.org/") {
+    return player + id + "/iframe"
+  }
+  return player + id
+}
+
+func renderEmbed(arg string) (string, bool) {
+  src := embedURL(arg)
+  if src == "" {
+    return "", false
+  }
+  return `<iframe src="` + template.HTMLEscapeString(src) + `" width="560" height="315" loading="lazy"` +
+    ` sandbox="allow-scripts allow-same-origin allow-presentation allow-popups" referrerpolicy="strict-origin-when-cross-origin"` +
+    ` allow="fullscreen; picture-in-picture" title="Embedded video"></iframe>`, true
+}
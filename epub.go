@@ -0,0 +1,343 @@
+package main
+
+import (
+  "archive/zip"
+  "bytes"
+  "crypto/sha256"
+  "fmt"
+  "hash/crc32"
+  "html"
+  "html/template"
+  "net/http"
+  "net/url"
+  "path"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/* EPUB export at /epub/{title}
+  - Bundles the page and every page under it (Title/...) into an EPUB 3
+    book for e-readers: one chapter per page, in title order, and a table of
+    contents nested as the titles are
+  - Subpages the reader can't see (see visibility.go, schedule.go) are left
+    out, as they are from listings
+  - Images attached to the pages in the book are put in it; other images,
+    and embedded videos, which need the network, become links
+  - Links to the wiki point at -site-url (or the host asked for), since
+    they can't be followed inside the book
+  - /epub?tag={tag} makes a book of the pages with that tag instead (see
+    tags.go), under a table of contents nested by their titles
+*/
+func epubHandler(w http.ResponseWriter, r *http.Request, title string) {
+  p, err := viewPage(title)
+  if pageCorrupt(w, err) {
+    return
+  }
+  if err != nil {
+    if redirectRenamed(w, r, "epub", title) {
+      return
+    }
+    http.NotFound(w, r)
+    return
+  }
+  p, _, ok := checkReadable(w, r, p)
+  if !ok {
+    return
+  }
+  pages := []*Page{p}
+  titles, err := listPages()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  for _, sub := range titles {
+    if !strings.HasPrefix(sub, title+"/") {
+      continue
+    }
+    sp, err := loadPage(sub)
+    if err != nil {
+      continue // deleted since it was listed, or unreadable
+    }
+    if sp, _, status, err := readStatus(r, sp); err == nil && status == http.StatusOK {
+      pages = append(pages, sp)
+    }
+  }
+  writeEPUB(w, r, title, strings.ReplaceAll(title, "/", "-"), pages)
+}
+
+/* Handler for /epub?tag={tag} */
+func epubTagHandler(w http.ResponseWriter, r *http.Request) {
+  tag := strings.ToLower(r.URL.Query().Get("tag"))
+  if !validTag.MatchString(tag) {
+    http.Error(w, errBadTag.Error(), http.StatusBadRequest)
+    return
+  }
+  titles, err := listPages()
+  if err == nil {
+    titles, err = taggedPages(titles, tag)
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  pages := []*Page{}
+  for _, title := range titles {
+    p, err := loadPage(title)
+    if err != nil {
+      continue
+    }
+    if p, _, status, err := readStatus(r, p); err == nil && status == http.StatusOK {
+      pages = append(pages, p)
+    }
+  }
+  if len(pages) == 0 {
+    http.NotFound(w, r)
+    return
+  }
+  writeEPUB(w, r, "Pages tagged "+tag, tag, pages)
+}
+
+/* Send pages as the book name, downloaded as file.epub */
+func writeEPUB(w http.ResponseWriter, r *http.Request, name, file string, pages []*Page) {
+  book, err := buildEPUB(name, pages, siteBase(r))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Type", "application/epub+zip")
+  w.Header().Set("Content-Disposition", `attachment; filename="`+file+`.epub"`)
+  w.Write(book)
+}
+
+/* A page of the book, and the file it's in */
+type epubChapter struct {
+  Title string
+  File string
+}
+
+/* An image put in the book */
+type epubImage struct {
+  ID, File, Type string
+}
+
+var epubImg = regexp.MustCompile(`<img src="([^"]*)" alt="([^"]*)">`)
+var epubIframe = regexp.MustCompile(`<iframe( src="([^"]*)")?[^>]*></iframe>`)
+var epubLocalLink = regexp.MustCompile(`href="/`)
+
+/* The book name of pages, nested under the page called name if it's one
+  of them, and by their own titles otherwise
+*/
+func buildEPUB(name string, pages []*Page, base string) ([]byte, error) {
+  in := map[string]bool{}
+  for _, p := range pages {
+    in[p.Title] = true
+  }
+  var buf bytes.Buffer
+  zw := zip.NewWriter(&buf)
+  // The mimetype comes first, uncompressed and with its sizes in the header,
+  // so readers can sniff it at a fixed offset
+  mimetype := []byte("application/epub+zip")
+  w, err := zw.CreateRaw(&zip.FileHeader{Name: "mimetype", Method: zip.Store, CRC32: crc32.ChecksumIEEE(mimetype),
+    CompressedSize64: uint64(len(mimetype)), UncompressedSize64: uint64(len(mimetype))})
+  if err != nil {
+    return nil, err
+  }
+  w.Write(mimetype)
+  files := map[string][]byte{"META-INF/container.xml": []byte(epubContainer)}
+
+  root := &epubNode{label: name}
+  for _, p := range pages {
+    if p.Title == name {
+      root.page = p
+      continue
+    }
+    n := root
+    for _, part := range strings.Split(strings.TrimPrefix(p.Title, name+"/"), "/") {
+      n = n.child(part)
+    }
+    n.page = p
+  }
+  var nodes []*epubNode
+  root.walk(func(n *epubNode) { nodes = append(nodes, n) })
+
+  var chapters []epubChapter
+  var images []epubImage
+  imageFiles := map[string]string{} // attachment URL -> file in the book
+  var modified time.Time
+  for i, n := range nodes {
+    p := n.page
+    if info, err := store.Stat(p.Title); err == nil && info.Modified.After(modified) {
+      modified = info.Modified
+    }
+    text := string(renderBody(p.Body))
+    text = epubImg.ReplaceAllStringFunc(text, func(tag string) string {
+      m := epubImg.FindStringSubmatch(tag)
+      src, alt := html.UnescapeString(m[1]), m[2]
+      if file, ok := imageFiles[src]; ok {
+        return `<img src="` + file + `" alt="` + alt + `"/>`
+      }
+      page, name, ok := "", "", false
+      if u, err := url.PathUnescape(src); err == nil {
+        page, name, ok = attachmentPath(u, "/files/")
+      }
+      if ok && in[page] {
+        if data, a, err := attachments.Load(page, name); err == nil {
+          file := "images/" + strconv.Itoa(len(images)+1) + strings.ToLower(path.Ext(name))
+          files["OEBPS/"+file] = data
+          images = append(images, epubImage{ID: "img" + strconv.Itoa(len(images)+1), File: file, Type: a.Type})
+          imageFiles[src] = file
+          return `<img src="` + file + `" alt="` + alt + `"/>`
+        }
+      }
+      href := m[1]
+      if strings.HasPrefix(href, "/") {
+        href = base + href
+      }
+      return `<a href="` + href + `">` + alt + `</a>`
+    })
+    text = epubIframe.ReplaceAllStringFunc(text, func(tag string) string {
+      if m := epubIframe.FindStringSubmatch(tag); m[2] != "" {
+        return `<a href="` + m[2] + `">Embedded video</a>`
+      }
+      return ""
+    })
+    text = strings.ReplaceAll(text, "<br>", "<br/>")
+    text = epubLocalLink.ReplaceAllString(text, `href="`+base+`/`)
+    n.file = "c" + strconv.Itoa(i+1) + ".xhtml"
+    c := epubChapter{Title: p.Title, File: n.file}
+    chapters = append(chapters, c)
+    files["OEBPS/"+c.File] = []byte(fmt.Sprintf(epubChapterPage, template.HTMLEscapeString(p.Title), template.HTMLEscapeString(p.Title), text))
+  }
+  files["OEBPS/nav.xhtml"] = []byte(epubNav(root))
+  files["OEBPS/content.opf"] = []byte(epubPackage(name, base, modified, chapters, images))
+
+  names := make([]string, 0, len(files))
+  for name := range files {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    if err := writeZipEntry(zw, name, files[name], modified); err != nil {
+      return nil, err
+    }
+  }
+  if err := zw.Close(); err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubChapterPage = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title></head>
+<body>
+<h1>%s</h1>
+%s
+</body>
+</html>
+`
+
+/* The book's pages as a tree of their titles; a title part with no page
+  of its own (A/B with no A) is just a heading for the pages under it
+*/
+type epubNode struct {
+  label string
+  page *Page
+  file string
+  children []*epubNode
+}
+
+func (n *epubNode) child(label string) *epubNode {
+  for _, c := range n.children {
+    if c.label == label {
+      return c
+    }
+  }
+  c := &epubNode{label: label}
+  n.children = append(n.children, c)
+  return c
+}
+
+/* The nodes with pages, in reading order */
+func (n *epubNode) walk(fn func(*epubNode)) {
+  if n.page != nil {
+    fn(n)
+  }
+  for _, c := range n.children {
+    c.walk(fn)
+  }
+}
+
+/* The node's entry in the table of contents */
+func (n *epubNode) nav(b *strings.Builder) {
+  b.WriteString("<li>")
+  if n.page != nil {
+    b.WriteString(`<a href="` + n.file + `">` + template.HTMLEscapeString(n.label) + "</a>")
+  } else {
+    b.WriteString("<span>" + template.HTMLEscapeString(n.label) + "</span>")
+  }
+  if len(n.children) > 0 {
+    b.WriteString("\n<ol>\n")
+    for _, c := range n.children {
+      c.nav(b)
+    }
+    b.WriteString("</ol>\n")
+  }
+  b.WriteString("</li>\n")
+}
+
+func epubNav(root *epubNode) string {
+  var b strings.Builder
+  b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Contents</title></head>
+<body>
+<nav epub:type="toc"><h1>Contents</h1>
+<ol>
+`)
+  root.nav(&b)
+  b.WriteString("</ol>\n</nav>\n</body>\n</html>\n")
+  return b.String()
+}
+
+func epubPackage(title, base string, modified time.Time, chapters []epubChapter, images []epubImage) string {
+  sum := sha256.Sum256([]byte(base + "/" + title))
+  var manifest, spine strings.Builder
+  manifest.WriteString(`    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>` + "\n")
+  for i, c := range chapters {
+    id := "c" + strconv.Itoa(i+1)
+    manifest.WriteString(`    <item id="` + id + `" href="` + c.File + `" media-type="application/xhtml+xml"/>` + "\n")
+    spine.WriteString(`    <itemref idref="` + id + `"/>` + "\n")
+  }
+  for _, img := range images {
+    manifest.WriteString(`    <item id="` + img.ID + `" href="` + img.File + `" media-type="` + template.HTMLEscapeString(img.Type) + `"/>` + "\n")
+  }
+  return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:sha256:` + fmt.Sprintf("%x", sum[:16]) + `</dc:identifier>
+    <dc:title>` + template.HTMLEscapeString(title) + `</dc:title>
+    <dc:publisher>` + template.HTMLEscapeString(siteInfo().Title) + `</dc:publisher>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">` + modified.UTC().Format("2006-01-02T15:04:05Z") + `</meta>
+  </metadata>
+  <manifest>
+` + manifest.String() + `  </manifest>
+  <spine>
+` + spine.String() + `  </spine>
+</package>
+`
+}
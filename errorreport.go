@@ -0,0 +1,215 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net"
+  "net/http"
+  "net/url"
+  "runtime"
+  "strings"
+  "time"
+)
+
+/* Error reporting
+  - With -sentry-dsn, panics in handlers and responses with a 5xx status are
+    sent to Sentry, or anything else that speaks its store API (GlitchTip,
+    Bugsink...), with the request they happened on
+  - The request's cookies and Authorization header are never sent, and
+    neither is the body
+  - Reports go out in the background; when the sink is slow or down they are
+    dropped rather than queued up, and the request never waits for them
+  - The 503s of maintenance mode are intended and aren't reported
+*/
+type errorSink struct {
+  store string // the project's store endpoint
+  auth string  // X-Sentry-Auth header
+  queue chan []byte
+}
+
+var errorReports *errorSink
+
+var sentryClient = &http.Client{Timeout: 5 * time.Second}
+
+/* Configure the sink from a DSN, https://key@host/project */
+func configureErrorReports(dsn string) error {
+  u, err := url.Parse(dsn)
+  if err != nil || u.User == nil || u.Host == "" {
+    return errors.New("-sentry-dsn: expected https://key@host/project")
+  }
+  path := strings.Trim(u.Path, "/")
+  i := strings.LastIndex(path, "/")
+  prefix, project := "", path
+  if i >= 0 {
+    prefix, project = "/"+path[:i], path[i+1:]
+  }
+  if project == "" {
+    return errors.New("-sentry-dsn: no project")
+  }
+  s := &errorSink{
+    store: u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/store/",
+    auth: "Sentry sentry_version=7, sentry_client=wiki/1.0, sentry_key=" + u.User.Username(),
+    queue: make(chan []byte, 32),
+  }
+  if secret, ok := u.User.Password(); ok {
+    s.auth += ", sentry_secret=" + secret
+  }
+  go s.send()
+  errorReports = s
+  return nil
+}
+
+func (s *errorSink) send() {
+  for body := range s.queue {
+    req, err := http.NewRequest(http.MethodPost, s.store, bytes.NewReader(body))
+    if err != nil {
+      continue
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Sentry-Auth", s.auth)
+    resp, err := sentryClient.Do(req)
+    if err != nil {
+      log.Printf("error report: %v", err)
+      continue
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+      log.Printf("error report: %s", resp.Status)
+    }
+  }
+}
+
+/* Send an event for r; frames is the stack of a panic, nil otherwise */
+func (s *errorSink) report(r *http.Request, level, typ, msg string, frames []map[string]interface{}) {
+  id := make([]byte, 16)
+  rand.Read(id)
+  headers := map[string]string{}
+  for k := range r.Header {
+    if k != "Cookie" && k != "Authorization" {
+      headers[k] = r.Header.Get(k)
+    }
+  }
+  exception := map[string]interface{}{"type": typ, "value": msg}
+  if frames != nil {
+    exception["stacktrace"] = map[string]interface{}{"frames": frames}
+  }
+  event := map[string]interface{}{
+    "event_id": hex.EncodeToString(id),
+    "timestamp": time.Now().UTC().Format(time.RFC3339),
+    "level": level,
+    "platform": "go",
+    "logger": "wiki",
+    "exception": map[string]interface{}{"values": []interface{}{exception}},
+    "request": map[string]interface{}{
+      "url": "http://" + r.Host + r.URL.Path,
+      "method": r.Method,
+      "query_string": r.URL.RawQuery,
+      "headers": headers,
+    },
+    "user": map[string]string{"ip_address": requestAuthor(r)},
+  }
+  if u := currentUser(r); u != nil {
+    event["user"] = map[string]string{"username": u.Name}
+  }
+  data, err := json.Marshal(event)
+  if err != nil {
+    return
+  }
+  select {
+  case s.queue <- data:
+  default: // the sink is behind; drop it
+  }
+}
+
+/* Stack of the panicking goroutine, oldest call first as Sentry wants */
+func panicFrames() []map[string]interface{} {
+  pcs := make([]uintptr, 64)
+  n := runtime.Callers(4, pcs) // skip Callers, panicFrames, the deferred func and gopanic
+  frames := runtime.CallersFrames(pcs[:n])
+  out := []map[string]interface{}{}
+  for {
+    f, more := frames.Next()
+    out = append([]map[string]interface{}{{"function": f.Function, "filename": f.File, "lineno": f.Line}}, out...)
+    if !more {
+      break
+    }
+  }
+  return out
+}
+
+/* Wrapper reporting panics and 5xx responses */
+func reportErrors(next http.Handler) http.Handler {
+  if errorReports == nil {
+    return next
+  }
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    ew := &errorWriter{ResponseWriter: w}
+    defer func() {
+      if v := recover(); v != nil {
+        if v == http.ErrAbortHandler {
+          panic(v)
+        }
+        errorReports.report(r, "fatal", "panic", fmt.Sprint(v), panicFrames())
+        log.Printf("panic serving %s: %v", r.URL.Path, v)
+        if ew.status == 0 {
+          http.Error(ew, "Internal Server Error", http.StatusInternalServerError)
+        }
+        return
+      }
+      if ew.status >= 500 && !(ew.status == http.StatusServiceUnavailable && maintenanceMessage() != "") {
+        msg := strings.TrimSpace(ew.body.String())
+        if msg == "" || strings.HasPrefix(msg, "<") {
+          msg = http.StatusText(ew.status) // a page rather than a message
+        }
+        errorReports.report(r, "error", fmt.Sprintf("HTTP %d", ew.status), msg, nil)
+      }
+    }()
+    next.ServeHTTP(ew, r)
+  })
+}
+
+/* Keeps the status, and the start of the body of an error response for its message */
+type errorWriter struct {
+  http.ResponseWriter
+  status int
+  body bytes.Buffer
+}
+
+func (ew *errorWriter) WriteHeader(status int) {
+  if ew.status == 0 {
+    ew.status = status
+  }
+  ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorWriter) Write(b []byte) (int, error) {
+  if ew.status == 0 {
+    ew.status = http.StatusOK
+  }
+  if ew.status >= 500 && ew.body.Len() < 1024 {
+    ew.body.Write(b[:min(len(b), 1024-ew.body.Len())])
+  }
+  return ew.ResponseWriter.Write(b)
+}
+
+func (ew *errorWriter) Flush() {
+  if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+func (ew *errorWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  hj, ok := ew.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errors.New("hijacking not supported")
+  }
+  return hj.Hijack()
+}
+
+func (ew *errorWriter) Unwrap() http.ResponseWriter { return ew.ResponseWriter }
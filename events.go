@@ -0,0 +1,99 @@
+package main
+
+import (
+  "sync"
+  "time"
+)
+
+/* Page change notifications
+  - Every save and delete is published to pageEvents
+  - Subscribers get a buffered channel; a subscriber that falls behind misses
+    events rather than holding up the save
+  - Those that can't miss any, because what they do with them is kept
+    (notifications, saved searches), subscribe with subscribeDurable: their
+    events queue up for as long as they take, and a save still doesn't wait
+*/
+type PageEvent struct {
+  Type string // "save", "delete", or "publish" and "expire" from the scheduler
+  Title string
+  Time time.Time
+  Minor bool // a save marked as a minor edit
+  Author string // who saved or deleted the page, where it's known
+  Revision int // the revision a save made
+}
+
+type eventHub struct {
+  mu sync.Mutex
+  subs map[chan PageEvent]bool
+  durable []*eventQueue
+}
+
+/* Events waiting for a durable subscriber */
+type eventQueue struct {
+  mu sync.Mutex
+  events []PageEvent
+  ready chan bool // has a value when there are events
+}
+
+var pageEvents = &eventHub{subs: map[chan PageEvent]bool{}}
+
+func (h *eventHub) subscribe() chan PageEvent {
+  ch := make(chan PageEvent, 16)
+  h.mu.Lock()
+  h.subs[ch] = true
+  h.mu.Unlock()
+  return ch
+}
+
+/* A channel that gets every event, however far behind its reader is; for
+  the life of the process
+*/
+func (h *eventHub) subscribeDurable() <-chan PageEvent {
+  q := &eventQueue{ready: make(chan bool, 1)}
+  h.mu.Lock()
+  h.durable = append(h.durable, q)
+  h.mu.Unlock()
+  ch := make(chan PageEvent)
+  go func() {
+    for range q.ready {
+      q.mu.Lock()
+      events := q.events
+      q.events = nil
+      q.mu.Unlock()
+      for _, ev := range events {
+        ch <- ev
+      }
+    }
+  }()
+  return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan PageEvent) {
+  h.mu.Lock()
+  delete(h.subs, ch)
+  h.mu.Unlock()
+}
+
+func (h *eventHub) publish(typ, title string) {
+  h.send(PageEvent{Type: typ, Title: title, Time: time.Now().UTC()})
+}
+
+func (h *eventHub) send(ev PageEvent) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for ch := range h.subs {
+    select {
+    case ch <- ev:
+    default:
+    }
+  }
+  for _, q := range h.durable {
+    q.mu.Lock()
+    q.events = append(q.events, ev)
+    q.mu.Unlock()
+    select {
+    case q.ready <- true:
+    default:
+    }
+  }
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+)
+
+/* Feature flags
+  - Switch experimental features on and off without a new build. Each flag
+    has a default here, can be set at start up with -feature name=on|off, and
+    can be toggled at run time from the admin page
+  - Toggles from the admin page are kept in data/features.json and win over
+    -feature, so they survive a restart
+  - Handlers check featureEnabled(name); templates use {{if feature "name"}}
+*/
+var featureDefaults = map[string]bool{
+  "live-preview": true,   // preview in the editor as you type (/ws/preview)
+  "collab-editing": true, // editing together over /ws/collab
+}
+
+var features = struct {
+  sync.RWMutex
+  path string
+  config map[string]bool // from -feature
+  saved map[string]bool  // from the admin page
+}{path: "data/features.json", config: map[string]bool{}, saved: map[string]bool{}}
+
+/* Whether the named feature is on; unknown names are off */
+func featureEnabled(name string) bool {
+  features.RLock()
+  defer features.RUnlock()
+  if on, ok := features.saved[name]; ok {
+    return on
+  }
+  if on, ok := features.config[name]; ok {
+    return on
+  }
+  return featureDefaults[name]
+}
+
+/* Set a flag from -feature name=on|off */
+func setFeatureFlag(s string) error {
+  name, value, _ := strings.Cut(s, "=")
+  if _, ok := featureDefaults[name]; !ok {
+    return fmt.Errorf("unknown feature %q", name)
+  }
+  switch value {
+  case "on", "true", "1":
+    features.config[name] = true
+  case "off", "false", "0":
+    features.config[name] = false
+  default:
+    return fmt.Errorf("feature %s: want on or off, not %q", name, value)
+  }
+  return nil
+}
+
+/* Read the toggles saved from the admin page */
+func loadFeatures() error {
+  data, err := ioutil.ReadFile(features.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  m := map[string]bool{}
+  if err := json.Unmarshal(data, &m); err != nil {
+    return err
+  }
+  features.Lock()
+  features.saved = m
+  features.Unlock()
+  return nil
+}
+
+/* A flag as the admin page lists it */
+type featureState struct {
+  Name string
+  On bool
+}
+
+func featureList() []featureState {
+  list := []featureState{}
+  for name := range featureDefaults {
+    list = append(list, featureState{name, featureEnabled(name)})
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+  return list
+}
+
+/* POST /admin/features: each known feature is on if its checkbox is ticked */
+func featuresHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  r.ParseForm()
+  m := map[string]bool{}
+  for name := range featureDefaults {
+    m[name] = r.Form.Get(name) != ""
+  }
+  data, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  features.Lock()
+  defer features.Unlock()
+  if err := ioutil.WriteFile(features.path, data, 0600); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  features.saved = m
+  settingsChanged("features")
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+/* Wrap a handler so it's a 404 while feature name is off */
+func requireFeature(name string, fn http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if !featureEnabled(name) {
+      http.NotFound(w, r)
+      return
+    }
+    fn(w, r)
+  }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+  "net/http"
+  "time"
+)
+
+/* Fragments
+  - /fragment/view/{title} is the rendered body of a page and
+    /fragment/history/{title} the table of its revisions, newest first:
+    just the HTML to put inside an element, for updating part of a page
+    instead of loading all of it again
+  - view.js uses them to show a page's new text when it's saved elsewhere, and
+    to load the history when it's opened
+  - The templates are in fragments.html
+  - A page a reader can't see as a whole they can't see here either, and
+    anonymous readers of a draft only get the history up to the revision
+    they're shown
+*/
+func viewFragmentHandler(w http.ResponseWriter, r *http.Request, title string) {
+  p, ok := fragmentPage(w, r, title)
+  if !ok {
+    return
+  }
+  renderFragment(w, "fragment_view", p)
+}
+
+/* Data for the history fragment */
+type historyData struct {
+  Title string
+  Revisions []Revision
+  Zone *time.Location
+}
+
+func historyFragmentHandler(w http.ResponseWriter, r *http.Request, title string) {
+  p, ok := fragmentPage(w, r, title)
+  if !ok {
+    return
+  }
+  revs, err := history.Revisions(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data := historyData{Title: title, Zone: viewerZone(r)}
+  for i := len(revs) - 1; i >= 0; i-- {
+    if revs[i].Number <= p.Revision {
+      data.Revisions = append(data.Revisions, revs[i])
+    }
+  }
+  renderFragment(w, "fragment_history", data)
+}
+
+/* The page as the reader may see it, having answered the request if they can't */
+func fragmentPage(w http.ResponseWriter, r *http.Request, title string) (*Page, bool) {
+  p, err := loadPage(title)
+  if err != nil {
+    http.NotFound(w, r)
+    return nil, false
+  }
+  p, _, ok := checkReadable(w, r, p)
+  return p, ok
+}
+
+func renderFragment(w http.ResponseWriter, name string, data interface{}) {
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  if err := templates.Load().ExecuteTemplate(w, name, data); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+  }
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+/* wiki fsck
+  - Checks the files under data/ and prints each problem it finds; with
+    -repair it fixes what it can. Stop the wiki first, as it works on the
+    files directly
+  - Give it the same -compress, -encrypt and -encryption-key-file as the
+    wiki, so it can read and write them
+  - Revisions have metadata that parses and a body that reads soundly, and
+    there are no stray files in the history
+  - Pages read soundly and match their latest revision
+  - Page metadata parses and belongs to a page, and a draft's published
+    revision exists
+  - Attachments belong to a page and their content exists and matches its
+    hash; the reference count kept with each stored content matches the
+    attachments using it, and content nothing uses is removed
+  - Files fsck can't make sense of are copied to data/quarantine/ before
+    it removes them
+  - Exits with 0 if everything is sound or was repaired, 1 if problems are
+    left, and 2 if it couldn't finish
+*/
+type fsck struct {
+  repair bool
+  found, repaired int
+  fs *fileStore
+  fh *fileHistory
+  fa *fileAttachments
+  fm *fileMeta
+}
+
+func fsckMain(args []string) int {
+  flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+  repair := flags.Bool("repair", false, "fix the problems found, where possible")
+  compression := flags.String("compress", "none", "compression the wiki writes with: none or gzip")
+  encrypt := flags.Bool("encrypt", false, "the data is encrypted with the key in WIKI_ENCRYPTION_KEY")
+  keyFile := flags.String("encryption-key-file", "", "file holding the encryption key (implies -encrypt)")
+  flags.Parse(args)
+  if err := configureStorage("file", *compression, *encrypt, *keyFile); err != nil {
+    fmt.Fprintln(os.Stderr, "fsck:", err)
+    return 2
+  }
+  fm, ok := pageMeta.(*fileMeta)
+  if !ok {
+    fmt.Fprintln(os.Stderr, "fsck: page metadata isn't kept in files")
+    return 2
+  }
+  c := &fsck{repair: *repair, fs: store.(*fileStore), fh: history.(*fileHistory), fa: attachments.(*fileAttachments), fm: fm}
+  for _, check := range []func() error{c.checkHistory, c.checkPages, c.checkMeta, c.checkAttachments} {
+    if err := check(); err != nil {
+      fmt.Fprintln(os.Stderr, "fsck:", err)
+      return 2
+    }
+  }
+  switch {
+  case c.found == 0:
+    fmt.Println("no problems found")
+  case c.repair:
+    fmt.Printf("%d problems found, %d repaired\n", c.found, c.repaired)
+  default:
+    fmt.Printf("%d problems found; run with -repair to fix them\n", c.found)
+  }
+  if c.found > c.repaired {
+    return 1
+  }
+  return 0
+}
+
+/* Report a problem, fixing it with fix when repairing; fix may be nil for
+  problems fsck can't repair
+*/
+func (c *fsck) problem(what string, fix func() error) {
+  c.found++
+  if !c.repair || fix == nil {
+    fmt.Println(what)
+    return
+  }
+  if err := fix(); err != nil {
+    fmt.Printf("%s: can't repair: %v\n", what, err)
+    return
+  }
+  c.repaired++
+  fmt.Println(what + ": repaired")
+}
+
+/* A fix that quarantines a file and removes it */
+func removeFile(path string) func() error {
+  return func() error {
+    if err := quarantine(path); err != nil {
+      return err
+    }
+    return os.Remove(path)
+  }
+}
+
+/* Whether anything is left of title: the page, or its history */
+func (c *fsck) known(title string) bool {
+  if _, err := os.Stat(c.fs.filename(title)); err == nil {
+    return true
+  }
+  revs, err := c.fh.Revisions(title)
+  return err == nil && len(revs) > 0
+}
+
+func (c *fsck) checkPages() error {
+  tmps, err := filepath.Glob(filepath.Join(c.fs.dir, "*.tmp"))
+  if err != nil {
+    return err
+  }
+  for _, f := range tmps {
+    c.problem(f+" is left over from an interrupted save", func() error { return os.Remove(f) })
+  }
+  titles, err := c.fs.List()
+  if err != nil {
+    return err
+  }
+  for _, title := range titles {
+    body, err := c.fs.Load(title)
+    if isCorrupt(err) {
+      c.problem("page "+title+": "+err.Error(), func() error {
+        _, err := restorePage(title)
+        return err
+      })
+      continue
+    }
+    if err != nil {
+      return err
+    }
+    revs, err := c.fh.Revisions(title)
+    if err != nil {
+      return err
+    }
+    var latest []byte
+    if len(revs) > 0 {
+      if latest, err = c.fh.LoadRevision(title, revs[len(revs)-1].Number); err != nil {
+        continue // reported with the history
+      }
+    }
+    if len(revs) == 0 || !bytes.Equal(body, latest) {
+      what := "page " + title + " differs from its latest revision"
+      if len(revs) == 0 {
+        what = "page " + title + " has no history"
+      }
+      c.problem(what, func() error {
+        rev := &Revision{Author: "fsck", Size: int64(len(body))}
+        info, err := c.fs.Stat(title)
+        if err != nil {
+          return err
+        }
+        rev.Time = info.Modified.UTC()
+        return c.fh.AddRevision(title, rev, body)
+      })
+    }
+  }
+  return nil
+}
+
+func (c *fsck) checkHistory() error {
+  titles, err := c.fh.Titles()
+  if err != nil {
+    return err
+  }
+  for _, title := range titles {
+    dir := c.fh.pageDir(title)
+    metas, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil {
+      return err
+    }
+    for _, f := range metas {
+      data, err := ioutil.ReadFile(f)
+      if err != nil {
+        return err
+      }
+      var rev Revision
+      if json.Unmarshal(data, &rev) != nil || strconv.Itoa(rev.Number) != strings.TrimSuffix(filepath.Base(f), ".json") {
+        c.problem(f+" isn't revision metadata", removeFile(f))
+      }
+    }
+    revs, err := c.fh.Revisions(title)
+    if err != nil {
+      return err
+    }
+    known := map[string]bool{}
+    for _, rev := range revs {
+      n := strconv.Itoa(rev.Number)
+      name := filepath.Join(dir, n)
+      _, txtErr := os.Stat(name + ".txt")
+      _, deltaErr := os.Stat(name + ".delta")
+      if txtErr != nil && deltaErr != nil {
+        c.problem("revision "+n+" of "+title+" has no body", func() error { return os.Remove(name + ".json") })
+        continue
+      }
+      known[n] = true
+      if _, err := c.fh.LoadRevision(title, rev.Number); err != nil {
+        c.problem("revision "+n+" of "+title+" can't be read: "+err.Error(), nil)
+      }
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+      return err
+    }
+    for _, e := range entries {
+      path := filepath.Join(dir, e.Name())
+      n, ext, _ := strings.Cut(e.Name(), ".")
+      switch {
+      case ext == "json" && known[n]:
+      case ext == "txt" && known[n]:
+      case ext == "delta" && known[n]:
+        if _, err := os.Stat(filepath.Join(dir, n+".txt")); err == nil {
+          c.problem(path+" is left over from compaction", func() error { return os.Remove(path) })
+        }
+      case strings.HasSuffix(e.Name(), ".tmp"):
+        c.problem(path+" is left over from an interrupted write", func() error { return os.Remove(path) })
+      case ext == "json":
+        // reported above, or just removed
+      default:
+        c.problem(path+" belongs to no revision", removeFile(path))
+      }
+    }
+  }
+  return nil
+}
+
+func (c *fsck) checkMeta() error {
+  files, err := filepath.Glob(filepath.Join(c.fm.dir, "*.json"))
+  if err != nil {
+    return err
+  }
+  for _, f := range files {
+    title, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(f), ".json"))
+    if err != nil || !validTitle.MatchString(title) {
+      c.problem(f+" isn't named for a page", removeFile(f))
+      continue
+    }
+    m, err := c.fm.Load(title)
+    if err != nil {
+      c.problem(f+" can't be read: "+err.Error(), removeFile(f))
+      continue
+    }
+    if !c.known(title) {
+      c.problem("metadata of "+title+" belongs to no page", removeFile(f))
+      continue
+    }
+    if m.Draft && m.Published != 0 {
+      if _, err := c.fh.LoadRevision(title, m.Published); err != nil {
+        c.problem("draft "+title+" is published at revision "+strconv.Itoa(m.Published)+", which can't be read", func() error {
+          // Fall back to the newest earlier revision, or to unpublished
+          revs, err := c.fh.Revisions(title)
+          if err != nil {
+            return err
+          }
+          published := 0
+          for _, rev := range revs {
+            if rev.Number >= m.Published {
+              break
+            }
+            if _, err := c.fh.LoadRevision(title, rev.Number); err == nil {
+              published = rev.Number
+            }
+          }
+          m.Published = published
+          return c.fm.Save(title, m)
+        })
+      }
+    }
+  }
+  return nil
+}
+
+func (c *fsck) checkAttachments() error {
+  dirs, err := os.ReadDir(c.fa.dir)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  used := map[string]int{} // hash -> attachments using it
+  for _, d := range dirs {
+    if !d.IsDir() || d.Name() == ".blobs" {
+      continue
+    }
+    dir := filepath.Join(c.fa.dir, d.Name())
+    title, err := url.PathUnescape(d.Name())
+    if err != nil || !validTitle.MatchString(title) {
+      c.problem(dir+" isn't named for a page", nil)
+      continue
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+      return err
+    }
+    legacy := map[string]bool{} // files kept by attachments without a hash
+    for _, e := range entries {
+      name, isMeta := strings.CutSuffix(e.Name(), ".json")
+      if !isMeta || !strings.HasPrefix(name, ".") {
+        continue
+      }
+      name = name[1:]
+      path, metaPath := c.fa.paths(title, name)
+      m, err := c.fa.meta(metaPath)
+      if err != nil || m.Page != title || m.Name != name {
+        c.problem(metaPath+" isn't attachment metadata", removeFile(metaPath))
+        continue
+      }
+      what := "attachment " + name + " of " + title
+      if !c.known(title) {
+        c.problem(what+" belongs to no page", func() error {
+          os.Remove(path)
+          return os.Remove(metaPath)
+        })
+        continue
+      }
+      if m.Hash == "" {
+        legacy[name] = true
+      } else {
+        path, _ = c.fa.blobPaths(m.Hash)
+      }
+      if _, err := os.Stat(path); err != nil {
+        c.problem(what+" has no content", func() error { return os.Remove(metaPath) })
+        continue
+      }
+      used[m.Hash]++
+      if _, _, err := c.fa.Load(title, name); err != nil {
+        c.problem(what+" can't be read: "+err.Error(), nil)
+      }
+    }
+    for _, e := range entries {
+      if !strings.HasPrefix(e.Name(), ".") && !legacy[e.Name()] {
+        path := filepath.Join(dir, e.Name())
+        c.problem(path+" belongs to no attachment", removeFile(path))
+      }
+    }
+  }
+  return c.checkBlobs(used)
+}
+
+/* Check the stored content against the attachments using it */
+func (c *fsck) checkBlobs(used map[string]int) error {
+  files, err := filepath.Glob(filepath.Join(c.fa.dir, ".blobs", "*", "*"))
+  if err != nil {
+    return err
+  }
+  for _, path := range files {
+    hash := filepath.Base(path)
+    if strings.HasSuffix(hash, ".json") {
+      if _, err := os.Stat(strings.TrimSuffix(path, ".json")); os.IsNotExist(err) {
+        c.problem(path+" counts references to content that is gone", func() error { return os.Remove(path) })
+      }
+      continue
+    }
+    if strings.HasSuffix(hash, ".tmp") {
+      c.problem(path+" is left over from an interrupted upload", func() error { return os.Remove(path) })
+      continue
+    }
+    _, refsPath := c.fa.blobPaths(hash)
+    if used[hash] == 0 {
+      c.problem("content "+hash+" is used by no attachment", func() error {
+        os.Remove(refsPath)
+        return os.Remove(path)
+      })
+      continue
+    }
+    r, err := c.fa.refs(hash)
+    if err == nil && r.Refs == used[hash] {
+      continue
+    }
+    what := "content " + hash + " counts " + strconv.Itoa(r.Refs) + " references, but " + strconv.Itoa(used[hash]) + " attachments use it"
+    c.problem(what, func() error {
+      if err != nil {
+        // The count is lost with whether the content is encrypted, so look
+        data, err := ioutil.ReadFile(path)
+        if err != nil {
+          return err
+        }
+        r.Encrypted = bytes.HasPrefix(data, encryptedMagic)
+      }
+      r.Refs = used[hash]
+      data, err := json.Marshal(r)
+      if err != nil {
+        return err
+      }
+      return ioutil.WriteFile(refsPath, data, 0600)
+    })
+  }
+  return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "time"
+)
+
+/* Attachment gallery at /attachments/{title}
+  - Lists a page's files with thumbnails of the images, and has the forms
+    to upload, rename and delete them
+  - The forms post back to the same URL with action=upload, rename or delete
+*/
+type galleryData struct {
+  Title string
+  Files []Attachment
+  Zone *time.Location
+  Error string
+}
+
+var errBadAttachmentName = errors.New("File names are letters, digits, - and _ with an extension, like diagram.png")
+var errNoSuchAttachment = errors.New("No such attachment")
+
+/* Whether the gallery shows a thumbnail of a */
+func (a Attachment) Thumbnail() bool {
+  return thumbTypes[a.Type]
+}
+
+func galleryHandler(w http.ResponseWriter, r *http.Request, title string) {
+  if !pageExists(title) {
+    http.NotFound(w, r)
+    return
+  }
+  if hideUnreadable(w, r, title) {
+    return
+  }
+  data := &galleryData{Title: title, Zone: viewerZone(r)}
+  status := http.StatusOK
+  if r.Method == http.MethodPost {
+    var err error
+    if status, err = galleryAction(w, r, title); err == nil {
+      http.Redirect(w, r, pageURL("attachments", title), http.StatusSeeOther)
+      return
+    }
+    data.Error = err.Error()
+  }
+  files, err := attachments.List(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data.Files = files
+  w.WriteHeader(status)
+  renderTemplate(w, "attachments", data)
+}
+
+/* Carry out a posted gallery form, returning the status to show any error with */
+func galleryAction(w http.ResponseWriter, r *http.Request, title string) (int, error) {
+  r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+4096)
+  if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+    return http.StatusRequestEntityTooLarge, errAttachmentTooLarge
+  }
+  if err := authorizeWrite(title, currentUser(r)); err != nil {
+    return saveErrorStatus(err), err
+  }
+  name := r.FormValue("name")
+  var err error
+  switch r.FormValue("action") {
+  case "upload":
+    return galleryUpload(r, title, name)
+  case "rename":
+    newName := r.FormValue("new_name")
+    if !validAttachmentName.MatchString(newName) {
+      return http.StatusBadRequest, errBadAttachmentName
+    }
+    err = attachments.Rename(title, name, newName)
+  case "delete":
+    err = attachments.Delete(title, name)
+  default:
+    return http.StatusBadRequest, errors.New("unknown action")
+  }
+  switch {
+  case err == nil:
+    removeThumbnails(title, name)
+    return http.StatusOK, nil
+  case err == errAttachmentExists:
+    return http.StatusConflict, err
+  case os.IsNotExist(err):
+    return http.StatusNotFound, errNoSuchAttachment
+  }
+  return http.StatusInternalServerError, err
+}
+
+/* An upload from the gallery form, named after the file unless a name is given */
+func galleryUpload(r *http.Request, title, name string) (int, error) {
+  f, hdr, err := r.FormFile("file")
+  if err != nil {
+    return http.StatusBadRequest, err
+  }
+  defer f.Close()
+  if name == "" {
+    name = hdr.Filename
+  }
+  if !validAttachmentName.MatchString(name) {
+    return http.StatusBadRequest, errBadAttachmentName
+  }
+  data, err := ioutil.ReadAll(f)
+  if err != nil {
+    return http.StatusBadRequest, err
+  }
+  if err := checkAttachment(title, name, int64(len(data))); err != nil {
+    return saveErrorStatus(err), err
+  }
+  a := newAttachment(title, name, data, requestAuthor(r))
+  if data, err = processUpload(&a, data); err != nil {
+    return saveErrorStatus(err), err
+  }
+  if err := attachments.Save(a, data); err != nil {
+    return http.StatusInternalServerError, err
+  }
+  auditActivity("file-uploaded", a.Uploader, a.Page, a.Name)
+  removeThumbnails(title, name)
+  return http.StatusOK, nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha1"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "log"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Two-way sync with a git repository
+  - -git-remote URL (and -git-branch, main by default) keeps the pages in
+    sync with a branch of a git repository, each page a file Title.txt, with
+    subpages in folders as in a backup. Other files in the repository are
+    left alone
+  - A sync is a git-sync job: it fetches the branch, saves the pages that
+    were changed there as user git, and commits and pushes the pages changed
+    on the wiki since the last sync. One is queued gitSyncDelay after pages
+    change and every -git-sync-interval, to pick up commits made elsewhere
+  - A page changed on both sides since the last sync is merged as an edit
+    conflict is (merge.go); where the changes overlap, the page is saved
+    with both versions between conflict markers, on the wiki and in git, and
+    the job lists it, for someone to sort out by editing it either way. A
+    page deleted on one side and changed on the other is kept
+  - Only pages anyone may read are synced. Changes from git to protected
+    pages, since git can't say who made them, and ones the wiki wouldn't
+    take from the edit form (too large, waiting for review) are skipped and
+    so undone by the next push
+  - Git does the fetching and pushing, so the remote can be anything it
+    can reach with its own credentials: an SSH key, a credential helper.
+    The clone is kept bare in data/git, and the last synced commit in
+    data/git-sync.json
+  - Attachments aren't synced
+*/
+var gitRemote string
+var gitBranch = "main"
+var gitSyncInterval = 5 * time.Minute
+var gitSyncDelay = 30 * time.Second
+
+var gitSync = struct {
+  sync.Mutex
+  dir string
+  statePath string
+}{dir: "data/git", statePath: "data/git-sync.json"}
+
+/* The last sync, as kept in data/git-sync.json */
+type gitSyncState struct {
+  Remote string
+  Branch string
+  Commit string // what the wiki matched, both ways
+}
+
+/* Queue a sync when pages change and every gitSyncInterval, started from main */
+func runGitSync() {
+  ch := pageEvents.subscribe()
+  queue := func() {
+    if jobPending("git-sync") {
+      return
+    }
+    if _, err := enqueueJob("git-sync", nil, "git-sync"); err != nil {
+      log.Printf("git sync: %v", err)
+    }
+  }
+  queue()
+  tick := time.NewTicker(gitSyncInterval)
+  var changed <-chan time.Time
+  for {
+    select {
+    case <-ch:
+      if changed == nil {
+        changed = time.After(gitSyncDelay)
+      }
+    case <-changed:
+      changed = nil
+      queue()
+    case <-tick.C:
+      queue()
+    }
+  }
+}
+
+/* Run git on the clone */
+func git(ctx context.Context, stdin []byte, env []string, args ...string) ([]byte, error) {
+  cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", gitSync.dir}, args...)...)
+  cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+  if stdin != nil {
+    cmd.Stdin = bytes.NewReader(stdin)
+  }
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  out, err := cmd.Output()
+  if err != nil {
+    msg := strings.TrimSpace(stderr.String())
+    if msg == "" {
+      msg = err.Error()
+    }
+    return nil, errors.New("git " + args[0] + ": " + msg)
+  }
+  return out, nil
+}
+
+/* The id git gives data as a file, to compare pages with files unread */
+func gitBlobID(data []byte) string {
+  h := sha1.New()
+  h.Write([]byte("blob " + strconv.Itoa(len(data)) + "\x00"))
+  h.Write(data)
+  return hex.EncodeToString(h.Sum(nil))
+}
+
+/* The pages in commit, title -> blob id; none for "" */
+func gitPages(ctx context.Context, commit string) (map[string]string, error) {
+  pages := map[string]string{}
+  if commit == "" {
+    return pages, nil
+  }
+  out, err := git(ctx, nil, nil, "ls-tree", "-r", "-z", commit)
+  if err != nil {
+    return nil, err
+  }
+  for _, entry := range strings.Split(string(out), "\x00") {
+    // mode type id\tpath
+    info, path, ok := strings.Cut(entry, "\t")
+    f := strings.Fields(info)
+    if !ok || len(f) != 3 || f[1] != "blob" {
+      continue
+    }
+    if title, ok := strings.CutSuffix(path, ".txt"); ok && validTitle.MatchString(title) {
+      pages[title] = f[2]
+    }
+  }
+  return pages, nil
+}
+
+func gitBlob(ctx context.Context, id string) ([]byte, error) {
+  if id == "" {
+    return nil, nil
+  }
+  return git(ctx, nil, nil, "cat-file", "blob", id)
+}
+
+func loadGitSyncState() (gitSyncState, error) {
+  var s gitSyncState
+  data, err := ioutil.ReadFile(gitSync.statePath)
+  if os.IsNotExist(err) {
+    return s, nil
+  }
+  if err != nil {
+    return s, err
+  }
+  return s, json.Unmarshal(data, &s)
+}
+
+func saveGitSyncState(s gitSyncState) error {
+  data, err := json.MarshalIndent(s, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmp := gitSync.statePath + ".tmp"
+  if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmp, gitSync.statePath)
+}
+
+/* Sync the pages with -git-remote, as described above */
+func gitSyncJob(ctx context.Context, j *Job) (string, error) {
+  if gitRemote == "" {
+    return "", errors.New("no -git-remote to sync with")
+  }
+  gitSync.Lock()
+  defer gitSync.Unlock()
+  if _, err := os.Stat(filepath.Join(gitSync.dir, "HEAD")); os.IsNotExist(err) {
+    if _, err := git(ctx, nil, nil, "init", "-q", "--bare"); err != nil {
+      return "", err
+    }
+    if _, err := git(ctx, nil, nil, "remote", "add", "origin", gitRemote); err != nil {
+      return "", err
+    }
+  } else if _, err := git(ctx, nil, nil, "remote", "set-url", "origin", gitRemote); err != nil {
+    return "", err
+  }
+  state, err := loadGitSyncState()
+  if err != nil {
+    return "", err
+  }
+  base := state.Commit
+  if state.Remote != gitRemote || state.Branch != gitBranch {
+    base = "" // a different repository: start over, merging everything
+  }
+  ref := "refs/remotes/origin/" + gitBranch
+  if _, err := git(ctx, nil, nil, "fetch", "-q", "--prune", "origin", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+    return "", err
+  }
+  remote := ""
+  if out, err := git(ctx, nil, nil, "rev-parse", "-q", "--verify", ref+"^{commit}"); err == nil {
+    remote = strings.TrimSpace(string(out))
+  }
+  basePages, err := gitPages(ctx, base)
+  if err != nil {
+    base, basePages = "", map[string]string{} // gone from the remote's history
+  }
+  remotePages, err := gitPages(ctx, remote)
+  if err != nil {
+    return "", err
+  }
+  wikiPages := map[string]string{}
+  titles, err := listPages()
+  if err != nil {
+    return "", err
+  }
+  bodies := map[string][]byte{}
+  for _, title := range titles {
+    if ok, err := pageReadableBy(title, nil); err != nil || !ok {
+      continue
+    }
+    p, err := loadPage(title)
+    if err != nil {
+      continue
+    }
+    bodies[title] = p.Body
+    wikiPages[title] = gitBlobID(p.Body)
+  }
+
+  all := map[string]bool{}
+  for _, m := range []map[string]string{basePages, remotePages, wikiPages} {
+    for title := range m {
+      all[title] = true
+    }
+  }
+  sorted := make([]string, 0, len(all))
+  for title := range all {
+    sorted = append(sorted, title)
+  }
+  sort.Strings(sorted)
+
+  var pulled, pushed, conflicts, skipped []string
+  push := map[string][]byte{} // title -> body for the commit, nil to remove
+  for _, title := range sorted {
+    if err := ctx.Err(); err != nil {
+      return "", err
+    }
+    b, r, w := basePages[title], remotePages[title], wikiPages[title]
+    if w == "" && pageExists(title) {
+      continue // not for everyone to read
+    }
+    switch {
+    case w == r:
+    case w == b:
+      body, err := gitBlob(ctx, r)
+      if err != nil {
+        return "", err
+      }
+      if err := gitApply(title, w, body, r == ""); err == errGitChanged {
+        return "", err
+      } else if err != nil {
+        skipped = append(skipped, title+" ("+err.Error()+")")
+        continue
+      }
+      pulled = append(pulled, title)
+    case r == b:
+      push[title] = bodies[title]
+      pushed = append(pushed, title)
+    case w == "":
+      // Deleted on the wiki, changed in git
+      body, err := gitBlob(ctx, r)
+      if err != nil {
+        return "", err
+      }
+      if err := gitApply(title, w, body, false); err == errGitChanged {
+        return "", err
+      } else if err != nil {
+        skipped = append(skipped, title+" ("+err.Error()+")")
+        continue
+      }
+      pulled = append(pulled, title)
+    case r == "":
+      // Deleted in git, changed on the wiki
+      push[title] = bodies[title]
+      pushed = append(pushed, title)
+    default:
+      baseBody, err := gitBlob(ctx, b)
+      if err != nil {
+        return "", err
+      }
+      theirs, err := gitBlob(ctx, r)
+      if err != nil {
+        return "", err
+      }
+      merged, conflict := merge3(string(baseBody), string(bodies[title]), string(theirs), "wiki", "git")
+      if err := gitApply(title, w, []byte(merged), false); err == errGitChanged {
+        return "", err
+      } else if err != nil {
+        skipped = append(skipped, title+" ("+err.Error()+")")
+        continue
+      }
+      push[title] = []byte(merged)
+      pulled, pushed = append(pulled, title), append(pushed, title)
+      if conflict {
+        conflicts = append(conflicts, title)
+      }
+    }
+  }
+
+  // The wiki now has what's in remote
+  state = gitSyncState{Remote: gitRemote, Branch: gitBranch, Commit: remote}
+  if len(push) > 0 {
+    commit, err := gitCommit(ctx, remote, push)
+    if err != nil {
+      return "", err
+    }
+    if _, err := git(ctx, nil, nil, "push", "-q", "origin", commit+":refs/heads/"+gitBranch); err != nil {
+      // Most likely someone pushed meanwhile: the next sync merges them
+      saveGitSyncState(state)
+      return "", err
+    }
+    state.Commit = commit
+  }
+  if err := saveGitSyncState(state); err != nil {
+    return "", err
+  }
+  result := "pulled " + strconv.Itoa(len(pulled)) + " pages, pushed " + strconv.Itoa(len(pushed))
+  if len(conflicts) > 0 {
+    result += "; conflicts to sort out in " + strings.Join(conflicts, ", ")
+    log.Printf("git sync: conflicting changes in %s", strings.Join(conflicts, ", "))
+  }
+  if len(skipped) > 0 {
+    result += "; skipped " + strings.Join(skipped, ", ")
+  }
+  return result, nil
+}
+
+/* A page saved on the wiki while the sync ran; the job is retried, rather
+  than the next sync taking the wiki's version over git's
+*/
+var errGitChanged = errors.New("a page changed during the sync")
+
+/* Save body as title from git, or delete it, if the page is still the
+  version with blob id was (none for "") when the sync looked
+*/
+func gitApply(title, was string, body []byte, remove bool) error {
+  if err := authorizeWrite(title, nil); err != nil {
+    return err
+  }
+  unlock, err := lockPage(title)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  now := ""
+  if p, err := loadPage(title); err == nil {
+    now = gitBlobID(p.Body)
+  } else if !os.IsNotExist(err) {
+    return err
+  }
+  if now != was {
+    return errGitChanged
+  }
+  if remove {
+    if now == "" {
+      return nil
+    }
+    if err := store.Delete(title); err != nil {
+      return err
+    }
+    pageEvents.publish("delete", title)
+    return nil
+  }
+  p := &Page{Title: title, Body: body}
+  if err := checkSave(p); err != nil {
+    return err
+  }
+  return p.saveLocked("git", false)
+}
+
+/* Commit the pages in changes on top of parent ("" for the first commit),
+  returning the new commit
+*/
+func gitCommit(ctx context.Context, parent string, changes map[string][]byte) (string, error) {
+  index, err := ioutil.TempFile("", "wiki-git-index-")
+  if err != nil {
+    return "", err
+  }
+  index.Close()
+  os.Remove(index.Name()) // git wants to make it itself
+  defer os.Remove(index.Name())
+  env := []string{"GIT_INDEX_FILE=" + index.Name()}
+  if parent != "" {
+    if _, err := git(ctx, nil, env, "read-tree", parent); err != nil {
+      return "", err
+    }
+  }
+  titles := make([]string, 0, len(changes))
+  for title := range changes {
+    titles = append(titles, title)
+  }
+  sort.Strings(titles)
+  for _, title := range titles {
+    path := title + ".txt"
+    if changes[title] == nil {
+      if _, err := git(ctx, nil, env, "update-index", "--force-remove", path); err != nil {
+        return "", err
+      }
+      continue
+    }
+    id, err := git(ctx, changes[title], nil, "hash-object", "-w", "--stdin")
+    if err != nil {
+      return "", err
+    }
+    if _, err := git(ctx, nil, env, "update-index", "--add", "--cacheinfo", "100644", strings.TrimSpace(string(id)), path); err != nil {
+      return "", err
+    }
+  }
+  tree, err := git(ctx, nil, env, "write-tree")
+  if err != nil {
+    return "", err
+  }
+  msg := "Update " + strings.Join(titles, ", ") + " from the wiki"
+  if len(titles) > 5 {
+    msg = "Update " + strconv.Itoa(len(titles)) + " pages from the wiki\n\n" + strings.Join(titles, "\n")
+  }
+  args := []string{"commit-tree", strings.TrimSpace(string(tree)), "-m", msg}
+  if parent != "" {
+    args = append(args, "-p", parent)
+  }
+  host, _ := os.Hostname()
+  who := []string{"GIT_AUTHOR_NAME=wiki", "GIT_AUTHOR_EMAIL=wiki@" + host, "GIT_COMMITTER_NAME=wiki", "GIT_COMMITTER_EMAIL=wiki@" + host}
+  commit, err := git(ctx, nil, who, args...)
+  if err != nil {
+    return "", err
+  }
+  return strings.TrimSpace(string(commit)), nil
+}
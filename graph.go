@@ -0,0 +1,168 @@
+package main
+
+import (
+  "net/http"
+  "net/url"
+  "sort"
+  "strings"
+)
+
+/* Link graph
+  - GET /api/{version}/graph returns the pages and the links between them as
+    {"nodes": [...], "edges": [...]}, for tools that draw the wiki's
+    structure or load it into a graph database
+  - Pages link to each other with URLs: a /view/, /print/ or /raw/ URL on the
+    wiki's own host (-site-url, or the host the request came to), or one of
+    its short links (shortlink.go). Links to renamed pages count as links to
+    where they went. Showing another page's attachment with [[File:...]] is
+    an edge too, of kind "file" rather than "link"
+  - Each edge has the number of times the link is made. Links to pages that
+    don't exist are kept, the missing pages being nodes with "exists": false,
+    which is what's still to be written
+  - Only the pages the caller can read are included, and links between them
+*/
+type graphNode struct {
+  ID string `json:"id"`
+  URL string `json:"url"`
+  Exists bool `json:"exists"`
+}
+
+type graphEdge struct {
+  Source string `json:"source"`
+  Target string `json:"target"`
+  Kind string `json:"kind"`
+  Count int `json:"count"`
+}
+
+type linkGraph struct {
+  Nodes []graphNode `json:"nodes"`
+  Edges []graphEdge `json:"edges"`
+}
+
+/* Paths on the wiki that show a page */
+var pageLinkPrefixes = []string{"/view/", "/print/", "/raw/"}
+
+/* The page a URL in a page's text links to, if it's one of the wiki's */
+func linkedPage(raw, host string) (string, bool) {
+  u, err := url.Parse(raw)
+  if err != nil || !strings.EqualFold(u.Host, host) {
+    return "", false
+  }
+  title := ""
+  if id, ok := strings.CutPrefix(u.Path, "/s/"); ok {
+    shortLinks.RLock()
+    title = shortLinks.to[id]
+    shortLinks.RUnlock()
+  } else {
+    for _, prefix := range pageLinkPrefixes {
+      if t, ok := strings.CutPrefix(u.Path, prefix); ok {
+        title = t
+        break
+      }
+    }
+  }
+  if !validTitle.MatchString(title) {
+    return "", false
+  }
+  if to, ok := renamedTo(title); ok {
+    title = to
+  }
+  return title, true
+}
+
+/* The links from a page's text, as counts by kind and target */
+func pageLinks(body, host string) map[[2]string]int {
+  links := map[[2]string]int{}
+  for _, raw := range bareURL.FindAllString(body, -1) {
+    if title, ok := linkedPage(trimURL(raw), host); ok {
+      links[[2]string{"link", title}]++
+    }
+  }
+  for _, m := range directive.FindAllStringSubmatch(body, -1) {
+    if m[1] != "File" {
+      continue
+    }
+    if page, _, ok := attachmentPath("/"+m[2], "/"); ok {
+      links[[2]string{"file", page}]++
+    }
+  }
+  return links
+}
+
+/* The graph of the pages u can read */
+func buildLinkGraph(host string, u *User) (*linkGraph, error) {
+  all, err := listPages()
+  if err != nil {
+    return nil, err
+  }
+  titles, err := visiblePages(all, u)
+  if err != nil {
+    return nil, err
+  }
+  exists := map[string]bool{}
+  for _, t := range all {
+    exists[t] = true
+  }
+  readable := map[string]bool{}
+  g := &linkGraph{Nodes: []graphNode{}, Edges: []graphEdge{}}
+  for _, t := range titles {
+    readable[t] = true
+    g.Nodes = append(g.Nodes, graphNode{ID: t, URL: pageURL("view", t), Exists: true})
+  }
+  missing := map[string]bool{}
+  for _, source := range titles {
+    // Links as the version u sees has them, not a draft's
+    p, err := loadPage(source)
+    if err == nil {
+      p, _, err = authorizeRead(p, u, "")
+    }
+    if err != nil || p == nil {
+      continue
+    }
+    for key, n := range pageLinks(string(p.Body), host) {
+      target := key[1]
+      switch {
+      case target == source:
+        continue
+      case !exists[target]:
+        missing[target] = true
+      case !readable[target]:
+        continue
+      }
+      g.Edges = append(g.Edges, graphEdge{Source: source, Target: target, Kind: key[0], Count: n})
+    }
+  }
+  for t := range missing {
+    g.Nodes = append(g.Nodes, graphNode{ID: t, URL: pageURL("view", t)})
+  }
+  sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+  sort.Slice(g.Edges, func(i, j int) bool {
+    a, b := g.Edges[i], g.Edges[j]
+    if a.Source != b.Source {
+      return a.Source < b.Source
+    }
+    if a.Target != b.Target {
+      return a.Target < b.Target
+    }
+    return a.Kind < b.Kind
+  })
+  return g, nil
+}
+
+/* GET /api/{version}/graph */
+func apiGraphHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  host := r.Host
+  if base, err := url.Parse(siteBase(r)); err == nil {
+    host = base.Host
+  }
+  g, err := buildLinkGraph(host, currentUser(r))
+  if err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  writeJSON(w, http.StatusOK, g)
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/* GraphQL API at /graphql
+  - A small subset of GraphQL, enough for front-ends to fetch exactly the fields
+    they need in one round trip:
+      query { page(title: "FrontPage") { title body modified } pages { title size } }
+      mutation { savePage(title: "A", body: "...", minor: true) { title } }
+  - Supports queries, mutations, aliases, arguments, variables ($name) and
+    __typename. Fragments and directives are rejected with an error
+  - Accepts POST {"query": "...", "variables": {...}} or GET ?query=...
+  - Answers {"data": ..., "errors": [{"message": ...}]} as the spec describes
+  - Pages read as they would on the view page (see authorizeRead): someone
+    not signed in gets a draft's published revision, and no page that isn't
+    published yet or has expired and gone
+  - A page's revisions go up to the revision read, as on the history page,
+    and its links are to the pages the reader can read, as in the link graph
+  - pages(tag: "runbook") lists only the pages with that tag (see tags.go)
+  - A POST body is capped as for a PUT to the REST API
+*/
+
+/* A field of a GraphQL object type
+  - Type names an object type in gqlTypes, or is "" for scalars
+  - List marks fields returning a slice of Type
+*/
+type gqlField struct {
+  Type string
+  List bool
+  Resolve func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error)
+}
+
+/* Schema: object type name to its fields */
+var gqlTypes = map[string]map[string]gqlField{
+  "Query": {
+    "page": {Type: "Page", Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      title, _ := args["title"].(string)
+      p, err := loadPage(title)
+      if os.IsNotExist(err) {
+        return nil, nil
+      }
+      if err != nil {
+        return nil, err
+      }
+      // The version the user may read, or nothing
+      p, _, err = authorizeRead(p, ex.user, "")
+      if p == nil {
+        return nil, err
+      }
+      return p, nil
+    }},
+    "pages": {Type: "Page", List: true, Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      titles, err := listPages()
+      if err == nil {
+        titles, err = visiblePages(titles, ex.user)
+      }
+      if tag, _ := args["tag"].(string); err == nil && tag != "" {
+        titles, err = taggedPages(titles, strings.ToLower(tag))
+      }
+      if err != nil {
+        return nil, err
+      }
+      pages := []interface{}{}
+      for _, title := range titles {
+        p, err := loadPage(title)
+        if err != nil {
+          continue // deleted since listing
+        }
+        if p, _, err = authorizeRead(p, ex.user, ""); err != nil {
+          return nil, err
+        }
+        if p != nil {
+          pages = append(pages, p)
+        }
+      }
+      return pages, nil
+    }},
+  },
+  "Mutation": {
+    "savePage": {Type: "Page", Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      title, _ := args["title"].(string)
+      body, _ := args["body"].(string)
+      if !validTitle.MatchString(title) {
+        return nil, errors.New("invalid page title")
+      }
+      p := &Page{Title: title, Body: []byte(body)}
+      if err := authorizeSave(title, ex.user); err != nil {
+        return nil, err
+      }
+      if err := checkSave(p); err != nil {
+        return nil, err
+      }
+      minor, _ := args["minor"].(bool)
+      return p, p.save(ex.author, minor)
+    }},
+    "deletePage": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      title, _ := args["title"].(string)
+      if !pageExists(title) {
+        return false, nil
+      }
+      if err := authorizeWrite(title, ex.user); err != nil {
+        return false, err
+      }
+      return true, deletePage(title, ex.author)
+    }},
+  },
+  "Page": {
+    "title": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      return src.(*Page).Title, nil
+    }},
+    "body": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      return string(src.(*Page).Body), nil
+    }},
+    "namespace": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      return namespaceOf(src.(*Page).Title), nil
+    }},
+    "tags": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      m, err := pageMeta.Load(src.(*Page).Title)
+      if err != nil {
+        return nil, err
+      }
+      return append([]string{}, m.Tags...), nil
+    }},
+    "size": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      return len(src.(*Page).Body), nil
+    }},
+    "modified": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      info, err := store.Stat(src.(*Page).Title)
+      if err != nil {
+        return nil, nil
+      }
+      return info.Modified.UTC().Format(time.RFC3339), nil
+    }},
+    "revisions": {Type: "Revision", List: true, Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      p := src.(*Page)
+      revs, err := history.Revisions(p.Title)
+      if err != nil {
+        return nil, err
+      }
+      out := []interface{}{}
+      for i := len(revs) - 1; i >= 0; i-- {
+        if revs[i].Number <= p.Revision {
+          out = append(out, revs[i])
+        }
+      }
+      return out, nil
+    }},
+    "links": {Type: "Page", List: true, Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      p := src.(*Page)
+      titles := []string{}
+      for key := range pageLinks(string(p.Body), ex.host) {
+        if key[0] == "link" && key[1] != p.Title {
+          titles = append(titles, key[1])
+        }
+      }
+      sort.Strings(titles)
+      out := []interface{}{}
+      for _, title := range titles {
+        target, err := loadPage(title)
+        if err != nil {
+          continue // not written yet
+        }
+        if target, _, err = authorizeRead(target, ex.user, ""); err != nil {
+          return nil, err
+        }
+        if target != nil {
+          out = append(out, target)
+        }
+      }
+      return out, nil
+    }},
+  },
+  "Revision": {
+    "number": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      return src.(Revision).Number, nil
+    }},
+    "author": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      return src.(Revision).Author, nil
+    }},
+    "time": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      return src.(Revision).Time.UTC().Format(time.RFC3339), nil
+    }},
+    "minor": {Resolve: func(ex *gqlExecutor, src interface{}, args map[string]interface{}) (interface{}, error) {
+      return src.(Revision).Minor, nil
+    }},
+  },
+}
+
+/* Handler for /graphql */
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+  var req struct {
+    Query string `json:"query"`
+    Variables map[string]interface{} `json:"variables"`
+    OperationName string `json:"operationName"`
+  }
+  switch r.Method {
+  case http.MethodGet:
+    req.Query = r.URL.Query().Get("query")
+    req.OperationName = r.URL.Query().Get("operationName")
+    if v := r.URL.Query().Get("variables"); v != "" {
+      if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+        writeJSON(w, http.StatusBadRequest, gqlErrorResponse(err))
+        return
+      }
+    }
+  case http.MethodPost:
+    data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 6*maxBodySize+4096))
+    if err != nil {
+      writeJSON(w, http.StatusRequestEntityTooLarge, gqlErrorResponse(errBodyTooLarge))
+      return
+    }
+    if err := json.Unmarshal(data, &req); err != nil {
+      writeJSON(w, http.StatusBadRequest, gqlErrorResponse(err))
+      return
+    }
+  default:
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  doc, err := gqlParse(req.Query)
+  if err != nil {
+    writeJSON(w, http.StatusBadRequest, gqlErrorResponse(err))
+    return
+  }
+  op, err := doc.operation(req.OperationName)
+  if err != nil {
+    writeJSON(w, http.StatusBadRequest, gqlErrorResponse(err))
+    return
+  }
+  // GET must not change anything
+  if op.Kind == "mutation" && r.Method != http.MethodPost {
+    writeJSON(w, http.StatusMethodNotAllowed, gqlErrorResponse(errors.New("mutations must be sent with POST")))
+    return
+  }
+  if msg := maintenanceMessage(); op.Kind == "mutation" && msg != "" {
+    writeJSON(w, http.StatusServiceUnavailable, gqlErrorResponse(errors.New(msg)))
+    return
+  }
+  ex := &gqlExecutor{author: requestAuthor(r), user: currentUser(r), host: r.Host, vars: req.Variables}
+  if base, err := url.Parse(siteBase(r)); err == nil {
+    ex.host = base.Host
+  }
+  root := "Query"
+  if op.Kind == "mutation" {
+    root = "Mutation"
+  }
+  data := ex.object(root, nil, op.Selections)
+  resp := map[string]interface{}{"data": data}
+  if len(ex.errors) > 0 {
+    resp["errors"] = ex.errors
+  }
+  writeJSON(w, http.StatusOK, resp)
+}
+
+func gqlErrorResponse(err error) map[string]interface{} {
+  return map[string]interface{}{"errors": []map[string]string{{"message": err.Error()}}}
+}
+
+/* Executes a parsed operation against gqlTypes, collecting field errors */
+type gqlExecutor struct {
+  author string
+  user *User // nil when not signed in
+  host string // the wiki's, for telling its links from others
+  vars map[string]interface{}
+  errors []map[string]string
+}
+
+/* Resolve a selection set on an object of type typ */
+func (ex *gqlExecutor) object(typ string, src interface{}, sels []*gqlSelection) *gqlObject {
+  out := &gqlObject{}
+  for _, sel := range sels {
+    key := sel.Name
+    if sel.Alias != "" {
+      key = sel.Alias
+    }
+    if sel.Name == "__typename" {
+      out.set(key, typ)
+      continue
+    }
+    f, ok := gqlTypes[typ][sel.Name]
+    if !ok {
+      ex.fail(fmt.Errorf("Cannot query field %q on type %q", sel.Name, typ))
+      out.set(key, nil)
+      continue
+    }
+    args, err := ex.args(sel.Args)
+    if err != nil {
+      ex.fail(err)
+      out.set(key, nil)
+      continue
+    }
+    v, err := f.Resolve(ex, src, args)
+    if err != nil {
+      ex.fail(fmt.Errorf("%s: %v", key, err))
+      out.set(key, nil)
+      continue
+    }
+    out.set(key, ex.complete(f, v, sel))
+  }
+  return out
+}
+
+/* Turn a resolved value into output, descending into object types */
+func (ex *gqlExecutor) complete(f gqlField, v interface{}, sel *gqlSelection) interface{} {
+  if v == nil || f.Type == "" {
+    if f.Type == "" && len(sel.Selections) > 0 {
+      ex.fail(fmt.Errorf("Field %q is a scalar and can't have a selection", sel.Name))
+      return nil
+    }
+    return v
+  }
+  if len(sel.Selections) == 0 {
+    ex.fail(fmt.Errorf("Field %q of type %q needs a selection", sel.Name, f.Type))
+    return nil
+  }
+  if f.List {
+    list := []interface{}{}
+    for _, item := range v.([]interface{}) {
+      list = append(list, ex.object(f.Type, item, sel.Selections))
+    }
+    return list
+  }
+  return ex.object(f.Type, v, sel.Selections)
+}
+
+/* Argument values with variables substituted */
+func (ex *gqlExecutor) args(in map[string]interface{}) (map[string]interface{}, error) {
+  out := map[string]interface{}{}
+  for k, v := range in {
+    if ref, ok := v.(gqlVariable); ok {
+      val, ok := ex.vars[string(ref)]
+      if !ok {
+        return nil, fmt.Errorf("Variable $%s is not defined", string(ref))
+      }
+      v = val
+    }
+    out[k] = v
+  }
+  return out, nil
+}
+
+func (ex *gqlExecutor) fail(err error) {
+  ex.errors = append(ex.errors, map[string]string{"message": err.Error()})
+}
+
+/* JSON object that keeps its keys in selection order, as GraphQL responses should */
+type gqlObject struct {
+  keys []string
+  values []interface{}
+}
+
+func (o *gqlObject) set(key string, v interface{}) {
+  o.keys = append(o.keys, key)
+  o.values = append(o.values, v)
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+  var buf bytes.Buffer
+  buf.WriteByte('{')
+  for i, k := range o.keys {
+    if i > 0 {
+      buf.WriteByte(',')
+    }
+    kb, _ := json.Marshal(k)
+    buf.Write(kb)
+    buf.WriteByte(':')
+    vb, err := json.Marshal(o.values[i])
+    if err != nil {
+      return nil, err
+    }
+    buf.Write(vb)
+  }
+  buf.WriteByte('}')
+  return buf.Bytes(), nil
+}
+
+/* Parsed document */
+type gqlDocument struct {
+  Operations []*gqlOperation
+}
+
+type gqlOperation struct {
+  Kind string // "query" or "mutation"
+  Name string
+  Selections []*gqlSelection
+}
+
+type gqlSelection struct {
+  Alias string
+  Name string
+  Args map[string]interface{}
+  Selections []*gqlSelection
+}
+
+/* Reference to a variable in an argument */
+type gqlVariable string
+
+/* Pick the operation to run, by name when the document has more than one */
+func (d *gqlDocument) operation(name string) (*gqlOperation, error) {
+  if name == "" {
+    if len(d.Operations) != 1 {
+      return nil, errors.New("operationName is required for a document with several operations")
+    }
+    return d.Operations[0], nil
+  }
+  for _, op := range d.Operations {
+    if op.Name == name {
+      return op, nil
+    }
+  }
+  return nil, fmt.Errorf("Unknown operation %q", name)
+}
+
+/* Recursive descent parser over the tokens from gqlLex */
+type gqlParser struct {
+  toks []gqlToken
+  pos int
+}
+
+type gqlToken struct {
+  kind byte // 'n' name, 's' string, 'i' int, 'f' float, or the punctuator itself
+  text string
+}
+
+func gqlParse(src string) (*gqlDocument, error) {
+  toks, err := gqlLex(src)
+  if err != nil {
+    return nil, err
+  }
+  p := &gqlParser{toks: toks}
+  doc := &gqlDocument{}
+  for !p.done() {
+    op, err := p.operation()
+    if err != nil {
+      return nil, err
+    }
+    doc.Operations = append(doc.Operations, op)
+  }
+  if len(doc.Operations) == 0 {
+    return nil, errors.New("Document has no operations")
+  }
+  return doc, nil
+}
+
+func (p *gqlParser) done() bool { return p.pos >= len(p.toks) }
+
+func (p *gqlParser) peek() gqlToken {
+  if p.done() {
+    return gqlToken{kind: 0}
+  }
+  return p.toks[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+  t := p.peek()
+  p.pos++
+  return t
+}
+
+func (p *gqlParser) expect(kind byte) (gqlToken, error) {
+  t := p.next()
+  if t.kind != kind {
+    if t.kind == 0 {
+      return t, fmt.Errorf("Syntax error: expected %q, found end of document", string(kind))
+    }
+    return t, fmt.Errorf("Syntax error: expected %q, found %q", string(kind), t.text)
+  }
+  return t, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+  op := &gqlOperation{Kind: "query"}
+  if t := p.peek(); t.kind == 'n' {
+    switch t.text {
+    case "query", "mutation":
+      op.Kind = t.text
+    case "fragment", "subscription":
+      return nil, fmt.Errorf("%s is not supported", t.text)
+    default:
+      return nil, fmt.Errorf("Syntax error: unexpected %q", t.text)
+    }
+    p.next()
+    if p.peek().kind == 'n' {
+      op.Name = p.next().text
+    }
+    if p.peek().kind == '(' {
+      if err := p.skipVariableDefinitions(); err != nil {
+        return nil, err
+      }
+    }
+  }
+  sels, err := p.selectionSet()
+  if err != nil {
+    return nil, err
+  }
+  op.Selections = sels
+  return op, nil
+}
+
+/* Variable types aren't checked, so ($title: String!, ...) is skipped over */
+func (p *gqlParser) skipVariableDefinitions() error {
+  depth := 0
+  for !p.done() {
+    t := p.next()
+    switch t.kind {
+    case '(':
+      depth++
+    case ')':
+      depth--
+      if depth == 0 {
+        return nil
+      }
+    }
+  }
+  return errors.New("Syntax error: unterminated variable definitions")
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+  if _, err := p.expect('{'); err != nil {
+    return nil, err
+  }
+  sels := []*gqlSelection{}
+  for p.peek().kind != '}' {
+    if p.peek().kind == '.' {
+      return nil, errors.New("Fragments are not supported")
+    }
+    if p.peek().kind == '@' {
+      return nil, errors.New("Directives are not supported")
+    }
+    t, err := p.expect('n')
+    if err != nil {
+      return nil, err
+    }
+    sel := &gqlSelection{Name: t.text}
+    if p.peek().kind == ':' {
+      p.next()
+      t, err := p.expect('n')
+      if err != nil {
+        return nil, err
+      }
+      sel.Alias, sel.Name = sel.Name, t.text
+    }
+    if p.peek().kind == '(' {
+      if sel.Args, err = p.arguments(); err != nil {
+        return nil, err
+      }
+    }
+    if p.peek().kind == '{' {
+      if sel.Selections, err = p.selectionSet(); err != nil {
+        return nil, err
+      }
+    }
+    sels = append(sels, sel)
+  }
+  p.next()
+  return sels, nil
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+  p.next()
+  args := map[string]interface{}{}
+  for p.peek().kind != ')' {
+    name, err := p.expect('n')
+    if err != nil {
+      return nil, err
+    }
+    if _, err := p.expect(':'); err != nil {
+      return nil, err
+    }
+    v, err := p.value()
+    if err != nil {
+      return nil, err
+    }
+    args[name.text] = v
+  }
+  p.next()
+  return args, nil
+}
+
+func (p *gqlParser) value() (interface{}, error) {
+  t := p.next()
+  switch t.kind {
+  case '$':
+    name, err := p.expect('n')
+    return gqlVariable(name.text), err
+  case 's':
+    return t.text, nil
+  case 'i':
+    return strconv.Atoi(t.text)
+  case 'f':
+    return strconv.ParseFloat(t.text, 64)
+  case 'n':
+    switch t.text {
+    case "true":
+      return true, nil
+    case "false":
+      return false, nil
+    case "null":
+      return nil, nil
+    }
+    return t.text, nil // enum value
+  case '[':
+    list := []interface{}{}
+    for p.peek().kind != ']' {
+      if p.done() {
+        return nil, errors.New("Syntax error: unterminated list")
+      }
+      v, err := p.value()
+      if err != nil {
+        return nil, err
+      }
+      list = append(list, v)
+    }
+    p.next()
+    return list, nil
+  }
+  return nil, fmt.Errorf("Syntax error: unexpected %q", t.text)
+}
+
+/* Split a document into tokens
+  - Commas and whitespace are insignificant in GraphQL, # starts a comment
+*/
+func gqlLex(src string) ([]gqlToken, error) {
+  toks := []gqlToken{}
+  for i := 0; i < len(src); {
+    c := src[i]
+    switch {
+    case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+      i++
+    case c == '#':
+      for i < len(src) && src[i] != '\n' {
+        i++
+      }
+    case strings.IndexByte("{}():$!=[]@", c) >= 0:
+      toks = append(toks, gqlToken{kind: c, text: string(c)})
+      i++
+    case c == '.':
+      if !strings.HasPrefix(src[i:], "...") {
+        return nil, errors.New("Syntax error: unexpected '.'")
+      }
+      toks = append(toks, gqlToken{kind: '.', text: "..."})
+      i += 3
+    case c == '"':
+      j := i + 1
+      for j < len(src) && src[j] != '"' {
+        if src[j] == '\\' {
+          j++
+        }
+        j++
+      }
+      if j >= len(src) {
+        return nil, errors.New("Syntax error: unterminated string")
+      }
+      // GraphQL string escapes are a subset of JSON's
+      var s string
+      if err := json.Unmarshal([]byte(src[i:j+1]), &s); err != nil {
+        return nil, errors.New("Syntax error: invalid string")
+      }
+      toks = append(toks, gqlToken{kind: 's', text: s})
+      i = j + 1
+    case c == '-' || (c >= '0' && c <= '9'):
+      j := i + 1
+      kind := byte('i')
+      for j < len(src) && strings.IndexByte("0123456789.eE+-", src[j]) >= 0 {
+        if strings.IndexByte(".eE", src[j]) >= 0 {
+          kind = 'f'
+        }
+        j++
+      }
+      toks = append(toks, gqlToken{kind: kind, text: src[i:j]})
+      i = j
+    case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+      j := i + 1
+      for j < len(src) && (src[j] == '_' || (src[j]|0x20 >= 'a' && src[j]|0x20 <= 'z') || (src[j] >= '0' && src[j] <= '9')) {
+        j++
+      }
+      toks = append(toks, gqlToken{kind: 'n', text: src[i:j]})
+      i = j
+    default:
+      return nil, fmt.Errorf("Syntax error: unexpected character %q", c)
+    }
+  }
+  return toks, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "regexp"
+  "sort"
+  "sync"
+)
+
+/* Groups
+  - Named sets of users, so a page can be made readable by a team instead
+    of one person (visibility "group", see visibility.go); adding someone to
+    the group gives them every page shared with it
+  - Admins create and delete groups and change their members on the admin page
+  - Kept in data/groups.json as name -> member names. Deleting a group
+    leaves its pages to admins until they're given another
+*/
+var groups = struct {
+  sync.RWMutex
+  path string
+  members map[string][]string
+}{path: "data/groups.json", members: map[string][]string{}}
+
+var validGroupName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+func loadGroups() error {
+  data, err := ioutil.ReadFile(groups.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  m := map[string][]string{}
+  if err := json.Unmarshal(data, &m); err != nil {
+    return err
+  }
+  groups.Lock()
+  groups.members = m
+  groups.Unlock()
+  return nil
+}
+
+/* Whether u, nil when not signed in, is in the named group */
+func inGroup(u *User, name string) bool {
+  if u == nil {
+    return false
+  }
+  groups.RLock()
+  defer groups.RUnlock()
+  for _, member := range groups.members[name] {
+    if member == u.Name {
+      return true
+    }
+  }
+  return false
+}
+
+/* A group as the admin page lists it */
+type groupInfo struct {
+  Name string
+  Members []string
+}
+
+func groupList() []groupInfo {
+  groups.RLock()
+  defer groups.RUnlock()
+  list := []groupInfo{}
+  for name, members := range groups.members {
+    list = append(list, groupInfo{name, members})
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+  return list
+}
+
+/* Apply fn to a copy of the groups and save it */
+func updateGroups(fn func(m map[string][]string) error) error {
+  groups.Lock()
+  defer groups.Unlock()
+  m := map[string][]string{}
+  for name, members := range groups.members {
+    m[name] = append([]string(nil), members...)
+  }
+  if err := fn(m); err != nil {
+    return err
+  }
+  data, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(groups.path, data, 0600); err != nil {
+    return err
+  }
+  groups.members = m
+  settingsChanged("groups")
+  return nil
+}
+
+var errNoSuchGroup = errors.New("no such group")
+
+/* POST /admin/groups
+  - action=create or delete with name
+  - action=add or remove with name and user
+*/
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  name, user := r.FormValue("name"), r.FormValue("user")
+  err := updateGroups(func(m map[string][]string) error {
+    members, exists := m[name]
+    switch r.FormValue("action") {
+    case "create":
+      if !validGroupName.MatchString(name) {
+        return errors.New("group names are letters, digits, '-' and '_'")
+      }
+      if exists {
+        return errors.New("there is already a group " + name)
+      }
+      m[name] = []string{}
+    case "delete":
+      if !exists {
+        return errNoSuchGroup
+      }
+      delete(m, name)
+    case "add":
+      if !exists {
+        return errNoSuchGroup
+      }
+      if users.get(user) == nil {
+        return errors.New("no such user " + user)
+      }
+      for _, member := range members {
+        if member == user {
+          return nil
+        }
+      }
+      m[name] = append(members, user)
+      sort.Strings(m[name])
+    case "remove":
+      if !exists {
+        return errNoSuchGroup
+      }
+      kept := []string{}
+      for _, member := range members {
+        if member != user {
+          kept = append(kept, member)
+        }
+      }
+      m[name] = kept
+    default:
+      return errors.New("unknown action")
+    }
+    return nil
+  })
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "strconv"
+)
+
+/* gRPC service for the page store
+  - Implements the Wiki service in proto/wiki.proto on its own listener
+    (-grpc-addr), alongside the HTTP site
+  - gRPC is HTTP/2 with length-prefixed protobuf messages and the status in the
+    trailers. net/http speaks unencrypted HTTP/2 (h2c) when asked to, and our
+    messages are simple enough to encode by hand, so no generated code is needed
+  - Compressed messages aren't supported; clients must not enable compression
+*/
+
+/* Status codes from the gRPC spec */
+const (
+  grpcOK = 0
+  grpcInvalidArgument = 3
+  grpcNotFound = 5
+  grpcPermissionDenied = 7
+  grpcResourceExhausted = 8
+  grpcUnimplemented = 12
+  grpcInternal = 13
+  grpcUnavailable = 14
+)
+
+/* Error carrying a gRPC status code */
+type grpcError struct {
+  code int
+  msg string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+/* gRPC status for an error from authorizeSave or checkSave */
+func grpcSaveError(err error) error {
+  if err == errNoSuchPage {
+    return &grpcError{grpcNotFound, "page not found"}
+  }
+  if err == errBodyTooLarge || err == errQuotaExceeded {
+    return &grpcError{grpcResourceExhausted, err.Error()}
+  }
+  if err == errNeedsReview || err == errProtected {
+    return &grpcError{grpcPermissionDenied, err.Error()}
+  }
+  return &grpcError{grpcInvalidArgument, err.Error()}
+}
+
+/* Start the gRPC server on addr; runs until the process exits */
+func serveGRPC(addr string) {
+  var protocols http.Protocols
+  protocols.SetUnencryptedHTTP2(true)
+  srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(grpcHandler), Protocols: &protocols}
+  log.Fatal(srv.ListenAndServe())
+}
+
+/* Dispatches /wiki.Wiki/{Method} calls */
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost || r.ProtoMajor != 2 {
+    http.Error(w, "gRPC requires HTTP/2 POST", http.StatusBadRequest)
+    return
+  }
+  w.Header().Set("Content-Type", "application/grpc")
+  w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+  req, err := grpcReadMessage(r.Body)
+  if err != nil {
+    grpcFinish(w, &grpcError{grpcInvalidArgument, err.Error()})
+    return
+  }
+  switch r.URL.Path {
+  case "/wiki.Wiki/Get":
+    grpcFinish(w, grpcGet(w, req))
+  case "/wiki.Wiki/Put":
+    if msg := maintenanceMessage(); msg != "" {
+      grpcFinish(w, &grpcError{grpcUnavailable, msg})
+      return
+    }
+    grpcFinish(w, grpcPut(w, req, requestAuthor(r)))
+  case "/wiki.Wiki/List":
+    grpcFinish(w, grpcList(w, req))
+  case "/wiki.Wiki/Watch":
+    grpcFinish(w, grpcWatch(w, r, req))
+  default:
+    grpcFinish(w, &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path})
+  }
+}
+
+func grpcGet(w http.ResponseWriter, req []byte) error {
+  fields, err := protoDecode(req)
+  if err != nil {
+    return &grpcError{grpcInvalidArgument, err.Error()}
+  }
+  title := string(fields[1])
+  if !validTitle.MatchString(title) {
+    return &grpcError{grpcInvalidArgument, "invalid page title"}
+  }
+  p, err := loadPage(title)
+  if os.IsNotExist(err) {
+    return &grpcError{grpcNotFound, "page not found"}
+  }
+  if err != nil {
+    return err
+  }
+  // No accounts over gRPC, so only what anyone may read
+  p, _, err = authorizeRead(p, nil, "")
+  if err != nil {
+    return err
+  }
+  if p == nil {
+    return &grpcError{grpcNotFound, "page not found"}
+  }
+  return grpcWriteMessage(w, protoPage(p))
+}
+
+func grpcPut(w http.ResponseWriter, req []byte, author string) error {
+  fields, err := protoDecode(req)
+  if err != nil {
+    return &grpcError{grpcInvalidArgument, err.Error()}
+  }
+  p := &Page{Title: string(fields[1]), Body: fields[2]}
+  if !validTitle.MatchString(p.Title) {
+    return &grpcError{grpcInvalidArgument, "invalid page title"}
+  }
+  // Calls carry no session, so this is never an admin
+  if err := authorizeSave(p.Title, nil); err != nil {
+    return grpcSaveError(err)
+  }
+  if err := checkSave(p); err != nil {
+    return grpcSaveError(err)
+  }
+  if err := p.save(author, false); err != nil {
+    return err
+  }
+  return grpcWriteMessage(w, protoPage(p))
+}
+
+func grpcList(w http.ResponseWriter, req []byte) error {
+  fields, err := protoDecode(req)
+  if err != nil {
+    return &grpcError{grpcInvalidArgument, err.Error()}
+  }
+  titles, err := listPages()
+  if err == nil {
+    titles, err = visiblePages(titles, nil)
+  }
+  if err != nil {
+    return err
+  }
+  var out []byte
+  for _, title := range titles {
+    if ns, ok := fields[1]; ok && namespaceOf(title) != string(ns) {
+      continue
+    }
+    out = protoAppendBytes(out, 1, []byte(title))
+  }
+  return grpcWriteMessage(w, out)
+}
+
+/* Streams PageEvents until the client cancels the call, leaving out the
+  pages an anonymous reader can't see, as gRPC calls aren't signed in
+*/
+func grpcWatch(w http.ResponseWriter, r *http.Request, req []byte) error {
+  fields, err := protoDecode(req)
+  if err != nil {
+    return &grpcError{grpcInvalidArgument, err.Error()}
+  }
+  ch := pageEvents.subscribe()
+  defer pageEvents.unsubscribe(ch)
+  w.WriteHeader(http.StatusOK)
+  w.(http.Flusher).Flush()
+  for {
+    select {
+    case <-r.Context().Done():
+      return nil
+    case ev := <-ch:
+      if ns, ok := fields[1]; ok && namespaceOf(ev.Title) != string(ns) {
+        continue
+      }
+      if ok, _ := pageReadableBy(ev.Title, nil); !ok {
+        continue
+      }
+      var out []byte
+      out = protoAppendBytes(out, 1, []byte(ev.Type))
+      out = protoAppendBytes(out, 2, []byte(ev.Title))
+      out = protoAppendVarint(out, 3, uint64(ev.Time.Unix()))
+      if err := grpcWriteMessage(w, out); err != nil {
+        return nil // client went away
+      }
+      w.(http.Flusher).Flush()
+    }
+  }
+}
+
+/* Page message */
+func protoPage(p *Page) []byte {
+  var out []byte
+  out = protoAppendBytes(out, 1, []byte(p.Title))
+  out = protoAppendBytes(out, 2, p.Body)
+  if info, err := store.Stat(p.Title); err == nil {
+    out = protoAppendVarint(out, 3, uint64(info.Modified.Unix()))
+  }
+  return out
+}
+
+/* Set the status trailers that end every call */
+func grpcFinish(w http.ResponseWriter, err error) {
+  code, msg := grpcOK, ""
+  if err != nil {
+    code, msg = grpcInternal, err.Error()
+    if ge, ok := err.(*grpcError); ok {
+      code = ge.code
+    }
+  }
+  w.Header().Set("Grpc-Status", strconv.Itoa(code))
+  if msg != "" {
+    w.Header().Set("Grpc-Message", msg)
+  }
+}
+
+/* Read one length-prefixed message: 1 byte compressed flag, 4 byte big endian length */
+func grpcReadMessage(r io.Reader) ([]byte, error) {
+  var hdr [5]byte
+  if _, err := io.ReadFull(r, hdr[:]); err != nil {
+    return nil, errors.New("missing request message")
+  }
+  if hdr[0] != 0 {
+    return nil, errors.New("compressed messages are not supported")
+  }
+  n := binary.BigEndian.Uint32(hdr[1:])
+  if int64(n) > 2*maxBodySize+4096 {
+    return nil, errors.New("request message too large")
+  }
+  msg := make([]byte, n)
+  _, err := io.ReadFull(r, msg)
+  io.Copy(ioutil.Discard, r)
+  return msg, err
+}
+
+func grpcWriteMessage(w io.Writer, msg []byte) error {
+  var hdr [5]byte
+  binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+  if _, err := w.Write(hdr[:]); err != nil {
+    return err
+  }
+  _, err := w.Write(msg)
+  return err
+}
+
+/* Protobuf wire format, just the parts our messages use
+  - A field is a varint key (number << 3 | wire type) followed by its value
+  - Wire type 0 is a varint, 2 is length-delimited (strings, bytes)
+*/
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+  b = binary.AppendUvarint(b, uint64(field)<<3|0)
+  return binary.AppendUvarint(b, v)
+}
+
+func protoAppendBytes(b []byte, field int, v []byte) []byte {
+  b = binary.AppendUvarint(b, uint64(field)<<3|2)
+  b = binary.AppendUvarint(b, uint64(len(v)))
+  return append(b, v...)
+}
+
+/* Decode a message into its length-delimited fields by number
+  - Varint fields are skipped since no request message has one
+  - A repeated field keeps its last value, which is fine for our requests
+*/
+func protoDecode(b []byte) (map[int][]byte, error) {
+  fields := map[int][]byte{}
+  for len(b) > 0 {
+    key, n := binary.Uvarint(b)
+    if n <= 0 {
+      return nil, errors.New("bad protobuf field key")
+    }
+    b = b[n:]
+    field, wire := int(key>>3), key&7
+    switch wire {
+    case 0:
+      _, n := binary.Uvarint(b)
+      if n <= 0 {
+        return nil, errors.New("bad protobuf varint")
+      }
+      b = b[n:]
+    case 2:
+      l, n := binary.Uvarint(b)
+      if n <= 0 || uint64(len(b)-n) < l {
+        return nil, errors.New("bad protobuf length")
+      }
+      fields[field] = b[n : n+int(l)]
+      b = b[n+int(l):]
+    default:
+      return nil, fmt.Errorf("unsupported protobuf wire type %d", wire)
+    }
+  }
+  return fields, nil
+}
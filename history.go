@@ -0,0 +1,270 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Revision history
+  - Every save records a Revision with the full body, numbered from 1 per page
+  - Deleting a page leaves its history in place
+*/
+type Revision struct {
+  Number int
+  Author string
+  Time time.Time
+  Size int64
+  Minor bool
+}
+
+type RevisionStore interface {
+  /* Store body as the next revision of title, setting rev.Number */
+  AddRevision(title string, rev *Revision, body []byte) error
+  /* Revisions of title, oldest first; none for a page without history */
+  Revisions(title string) ([]Revision, error)
+  /* Number of the latest revision of title, 0 if it has none */
+  Latest(title string) (int, error)
+  /* Revision n of title, without its body; os.ErrNotExist if it has none */
+  Revision(title string, n int) (Revision, error)
+  LoadRevision(title string, n int) ([]byte, error)
+  DeleteRevision(title string, n int) error
+  /* Titles that have any history, including deleted pages */
+  Titles() ([]string, error)
+}
+
+/* The history store used by the wiki */
+var history RevisionStore = newFileHistory("data/history")
+
+/* Number of the latest revision of title, 0 if it has none */
+func latestRevision(title string) int {
+  n, err := history.Latest(title)
+  if err != nil {
+    return 0
+  }
+  return n
+}
+
+/* Record a save of title in the history
+  - Pages saved before history existed have their old body recorded first, as
+    an anonymous revision, so it can still be used as a merge base
+*/
+func recordRevision(title string, old []byte, body []byte, author string, minor bool) (int, error) {
+  if old != nil && latestRevision(title) == 0 {
+    seed := &Revision{Time: time.Now().UTC(), Size: int64(len(old))}
+    if info, err := store.Stat(title); err == nil {
+      seed.Time = info.Modified
+    }
+    if err := history.AddRevision(title, seed, old); err != nil {
+      return 0, err
+    }
+  }
+  rev := &Revision{Author: author, Time: time.Now().UTC(), Size: int64(len(body)), Minor: minor}
+  if err := history.AddRevision(title, rev, body); err != nil {
+    return 0, err
+  }
+  auditActivity("page-saved", author, title, "")
+  return rev.Number, nil
+}
+
+/* Who made a request, for the history: the signed in user, or the client's
+  IP address for anonymous edits
+*/
+func requestAuthor(r *http.Request) string {
+  if u := currentUser(r); u != nil {
+    return u.Name
+  }
+  return clientIP(r)
+}
+
+/* The client's IP address
+  - Over a Unix socket the peer is the local proxy, which only processes
+    allowed to open the socket can be, so the address it forwards is used
+*/
+func clientIP(r *http.Request) string {
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+      hops := strings.Split(fwd, ",")
+      return strings.TrimSpace(hops[len(hops)-1])
+    }
+    return r.RemoteAddr
+  }
+  return host
+}
+
+/* File history
+  - dir/{storage name}/{n}.txt holds the body of revision n, {n}.json its
+    Revision; once compacted, an old revision's body is {n}.delta instead
+    (see compact.go)
+  - mu makes numbering safe when two saves of a page race
+  - codec compresses and encrypts revision bodies, as for fileStore
+*/
+type fileHistory struct {
+  dir string
+  mu sync.Mutex
+  codec *fileCodec
+}
+
+func newFileHistory(dir string) *fileHistory {
+  return &fileHistory{dir: dir, codec: &fileCodec{}}
+}
+
+func (h *fileHistory) pageDir(title string) string {
+  return filepath.Join(h.dir, storageName(title))
+}
+
+func (h *fileHistory) AddRevision(title string, rev *Revision, body []byte) error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  dir := h.pageDir(title)
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  latest, err := h.Latest(title)
+  if err != nil {
+    return err
+  }
+  rev.Number = latest + 1
+  meta, err := json.Marshal(rev)
+  if err != nil {
+    return err
+  }
+  n := strconv.Itoa(rev.Number)
+  if err := h.codec.write(filepath.Join(dir, n+".txt"), body); err != nil {
+    return err
+  }
+  return ioutil.WriteFile(filepath.Join(dir, n+".json"), meta, 0600)
+}
+
+func (h *fileHistory) Revisions(title string) ([]Revision, error) {
+  files, err := filepath.Glob(filepath.Join(h.pageDir(title), "*.json"))
+  if err != nil {
+    return nil, err
+  }
+  revs := []Revision{}
+  for _, f := range files {
+    data, err := ioutil.ReadFile(f)
+    if err != nil {
+      return nil, err
+    }
+    var rev Revision
+    if err := json.Unmarshal(data, &rev); err != nil {
+      continue // not one of ours
+    }
+    if strconv.Itoa(rev.Number) != strings.TrimSuffix(filepath.Base(f), ".json") {
+      continue
+    }
+    revs = append(revs, rev)
+  }
+  sort.Slice(revs, func(i, j int) bool { return revs[i].Number < revs[j].Number })
+  return revs, nil
+}
+
+/* Only the names are listed; the highest numbered {n}.json that's one of
+  ours is the only one read
+*/
+func (h *fileHistory) Latest(title string) (int, error) {
+  d, err := os.Open(h.pageDir(title))
+  if os.IsNotExist(err) {
+    return 0, nil
+  }
+  if err != nil {
+    return 0, err
+  }
+  names, err := d.Readdirnames(-1)
+  d.Close()
+  if err != nil {
+    return 0, err
+  }
+  numbers := []int{}
+  for _, name := range names {
+    if n, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil && strconv.Itoa(n)+".json" == name {
+      numbers = append(numbers, n)
+    }
+  }
+  sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+  for _, n := range numbers {
+    data, err := ioutil.ReadFile(filepath.Join(h.pageDir(title), strconv.Itoa(n)+".json"))
+    if err != nil {
+      return 0, err
+    }
+    var rev Revision
+    if json.Unmarshal(data, &rev) == nil && rev.Number == n {
+      return n, nil
+    }
+  }
+  return 0, nil
+}
+
+func (h *fileHistory) Revision(title string, n int) (Revision, error) {
+  var rev Revision
+  data, err := ioutil.ReadFile(filepath.Join(h.pageDir(title), strconv.Itoa(n)+".json"))
+  if err != nil {
+    return rev, err
+  }
+  if json.Unmarshal(data, &rev) != nil || rev.Number != n {
+    return Revision{}, os.ErrNotExist
+  }
+  return rev, nil
+}
+
+func (h *fileHistory) LoadRevision(title string, n int) ([]byte, error) {
+  return h.loadRevision(h.pageDir(title), n, 0)
+}
+
+func (h *fileHistory) DeleteRevision(title string, n int) error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  dir := h.pageDir(title)
+  // The revision before may be a delta against this one
+  revs, err := h.Revisions(title)
+  if err != nil {
+    return err
+  }
+  for i, rev := range revs {
+    if rev.Number == n && i > 0 && h.storedBase(dir, revs[i-1].Number) == n {
+      if err := h.expandRevision(dir, revs[i-1].Number); err != nil {
+        return err
+      }
+    }
+  }
+  base := filepath.Join(dir, strconv.Itoa(n))
+  // Metadata first: a revision without it isn't listed, so a half deleted one disappears
+  if err := os.Remove(base + ".json"); err != nil {
+    return err
+  }
+  err = os.Remove(base + ".txt")
+  if derr := os.Remove(base + ".delta"); derr == nil {
+    return nil
+  }
+  return err
+}
+
+func (h *fileHistory) Titles() ([]string, error) {
+  dirs, err := ioutil.ReadDir(h.dir)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  titles := []string{}
+  for _, d := range dirs {
+    title, err := url.PathUnescape(d.Name())
+    if err != nil || !d.IsDir() || !validTitle.MatchString(title) {
+      continue
+    }
+    titles = append(titles, title)
+  }
+  return titles, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+  "net/http"
+  "os"
+  "sort"
+  "time"
+)
+
+/* Home page
+  - / redirects to the page named by -home, FrontPage unless changed
+  - -home dashboard shows a dashboard at / instead: the latest changes from
+    the history, and the signed in user's starred pages
+  - Pages are starred and unstarred with POST /star/{title}
+*/
+var homePage = "FrontPage"
+
+/* How many changes the dashboard lists */
+const recentChangesLimit = 20
+
+/* A revision of one page, for the recent changes list */
+type recentChange struct {
+  Title string
+  *Revision
+}
+
+type dashboardData struct {
+  Changes []recentChange
+  User *User
+  HideMinor bool
+  Stale bool // whether there is a stale page report
+  Unread int // the user's unread notifications
+  Zone *time.Location
+}
+
+/* The latest n revisions across the pages u can read, newest first, leaving
+  out minor edits if hideMinor is set
+  - Anyone not signed in sees a draft's history only up to the revision it
+    was published at, as they see the page (see readableVersion)
+  - A page's revisions are read newest first, stopping after n or at one
+    older than all of the n kept so far, so long histories aren't read through
+*/
+func recentChanges(n int, hideMinor bool, u *User) ([]recentChange, error) {
+  titles, err := history.Titles()
+  if err == nil {
+    titles, err = visiblePages(titles, u)
+  }
+  if err != nil {
+    return nil, err
+  }
+  metas, err := pageMeta.All()
+  if err != nil {
+    return nil, err
+  }
+  changes := []recentChange{}
+  for _, title := range titles {
+    latest, err := history.Latest(title)
+    if err != nil {
+      return nil, err
+    }
+    if m := metas[title]; m.Draft && u == nil {
+      latest = min(latest, m.Published)
+    }
+    full := len(changes) == n
+    var oldest time.Time
+    if full {
+      oldest = changes[n-1].Time
+    }
+    found := 0
+    for i := latest; i > 0 && found < n; i-- {
+      rev, err := history.Revision(title, i)
+      if os.IsNotExist(err) {
+        continue // removed by the retention policy
+      }
+      if err != nil {
+        return nil, err
+      }
+      if full && !rev.Time.After(oldest) {
+        break
+      }
+      if hideMinor && rev.Minor {
+        continue
+      }
+      changes = append(changes, recentChange{Title: title, Revision: &rev})
+      found++
+    }
+    sort.Slice(changes, func(i, j int) bool { return changes[i].Time.After(changes[j].Time) })
+    if len(changes) > n {
+      changes = changes[:n]
+    }
+  }
+  return changes, nil
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+  if r.URL.Path != "/" {
+    http.NotFound(w, r)
+    return
+  }
+  hideMinor := r.URL.Query().Get("minor") == "hide"
+  u := currentUser(r)
+  prefs := prefsOf(u)
+  changes, err := recentChanges(prefs.perPage(recentChangesLimit), hideMinor, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data := &dashboardData{Changes: changes, User: u, HideMinor: hideMinor, Stale: staleDays > 0, Zone: viewerZone(r)}
+  if u != nil {
+    list, _ := notificationsOf(u.Name)
+    data.Unread = unreadCount(list)
+  }
+  renderTemplate(w, "home", data)
+}
+
+/* Star a page for the signed in user, or unstar it if it already is */
+func starHandler(w http.ResponseWriter, r *http.Request, title string) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+pageURL("view", title), http.StatusFound)
+    return
+  }
+  err := users.update(u.Name, func(u *User) {
+    for i, t := range u.Starred {
+      if t == title {
+        u.Starred = append(u.Starred[:i], u.Starred[i+1:]...)
+        return
+      }
+    }
+    u.Starred = append(u.Starred, title)
+    sort.Strings(u.Starred)
+  })
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Idempotency keys
+  - A PUT or POST to /api/ may carry an Idempotency-Key header. The first
+    request with a key runs as usual and its response is kept for
+    idempotencyTTL; a retry with the same key gets that response again,
+    marked Idempotent-Replayed: true, instead of saving another revision
+  - Keys belong to the caller (see apiCaller), so two clients can't collide
+  - A key sent again with a different method, path or body is a 422, and
+    one whose first request is still running is a 409
+  - 5xx responses aren't kept, so a request that failed on the server can be
+    retried with the same key; nor are responses over idempotencyMaxBody
+  - Kept in memory, so they are per instance and gone on a restart
+  - At most maxIdempotentPerCaller responses are kept for a caller and
+    maxIdempotentResponses in all; past that the oldest finished ones are
+    dropped to make room, and if every one is still running the request is
+    turned away with a 429
+*/
+const idempotencyTTL = 24 * time.Hour
+const idempotencyMaxBody = 1 << 20
+const maxIdempotencyKey = 255
+const maxIdempotentPerCaller = 100
+const maxIdempotentResponses = 1000
+
+type idempotentResponse struct {
+  caller string
+  created time.Time
+  fingerprint [32]byte // of the method, path and body
+  done bool // false while the first request runs
+  expires time.Time
+  status int
+  header http.Header
+  body []byte
+}
+
+var idempotency = struct {
+  sync.Mutex
+  m map[string]*idempotentResponse // caller + "\x00" + key
+}{m: map[string]*idempotentResponse{}}
+
+/* Response headers worth replaying; the rest are per response */
+var replayedHeaders = []string{"Content-Type", "ETag", "Location", "Link", "X-Total-Count"}
+
+/* Wrapper answering retried API writes from the first response */
+func idempotentWrites(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    key := r.Header.Get("Idempotency-Key")
+    if key == "" || !strings.HasPrefix(r.URL.Path, "/api/") || (r.Method != http.MethodPut && r.Method != http.MethodPost) {
+      next.ServeHTTP(w, r)
+      return
+    }
+    if len(key) > maxIdempotencyKey {
+      writeJSONError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+      return
+    }
+    caller, _, err := apiCaller(r)
+    if err != nil {
+      writeJSONError(w, http.StatusUnauthorized, err.Error())
+      return
+    }
+    // Read as much of the body as any handler would take, leaving the rest
+    // for the handler to reject
+    limit := max(maxAttachmentSize, 3*maxBodySize) + 1
+    body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit))
+    if err != nil {
+      writeJSONError(w, http.StatusBadRequest, err.Error())
+      return
+    }
+    r.Body = struct {
+      io.Reader
+      io.Closer
+    }{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+    h := sha256.New()
+    io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+    h.Write(body)
+    var fingerprint [32]byte
+    h.Sum(fingerprint[:0])
+
+    id := caller + "\x00" + key
+    idempotency.Lock()
+    now := time.Now()
+    mine := 0
+    for k, e := range idempotency.m {
+      if e.done && now.After(e.expires) {
+        delete(idempotency.m, k)
+      } else if e.caller == caller {
+        mine++
+      }
+    }
+    e := idempotency.m[id]
+    switch {
+    case e != nil && e.fingerprint != fingerprint:
+      idempotency.Unlock()
+      writeJSONError(w, http.StatusUnprocessableEntity, "this Idempotency-Key was used for a different request")
+      return
+    case e != nil && !e.done:
+      idempotency.Unlock()
+      writeJSONError(w, http.StatusConflict, "a request with this Idempotency-Key is still being processed")
+      return
+    case e != nil:
+      idempotency.Unlock()
+      for k, v := range e.header {
+        w.Header()[k] = v
+      }
+      w.Header().Set("Idempotent-Replayed", "true")
+      w.WriteHeader(e.status)
+      w.Write(e.body)
+      return
+    }
+    for ; mine >= maxIdempotentPerCaller; mine-- {
+      if !dropOldestIdempotent(caller) {
+        idempotency.Unlock()
+        writeJSONError(w, http.StatusTooManyRequests, "too many requests with an Idempotency-Key still being processed")
+        return
+      }
+    }
+    for len(idempotency.m) >= maxIdempotentResponses {
+      if !dropOldestIdempotent("") {
+        idempotency.Unlock()
+        writeJSONError(w, http.StatusTooManyRequests, "too many requests with an Idempotency-Key still being processed")
+        return
+      }
+    }
+    e = &idempotentResponse{caller: caller, created: now, fingerprint: fingerprint}
+    idempotency.m[id] = e
+    idempotency.Unlock()
+
+    rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+    keep := false
+    defer func() {
+      idempotency.Lock()
+      defer idempotency.Unlock()
+      if !keep {
+        delete(idempotency.m, id)
+        return
+      }
+      e.done, e.expires, e.status, e.body = true, time.Now().Add(idempotencyTTL), rec.status, rec.body.Bytes()
+      e.header = http.Header{}
+      for _, k := range replayedHeaders {
+        if v := rec.Header().Values(k); len(v) > 0 {
+          e.header[http.CanonicalHeaderKey(k)] = v
+        }
+      }
+    }()
+    next.ServeHTTP(rec, r)
+    keep = rec.status < 500 && !rec.tooBig
+  })
+}
+
+/* Drop the oldest finished response of caller, or of anyone if caller is "";
+  false if there is none. The lock must be held
+*/
+func dropOldestIdempotent(caller string) bool {
+  oldest := ""
+  for k, e := range idempotency.m {
+    if e.done && (caller == "" || e.caller == caller) && (oldest == "" || e.created.Before(idempotency.m[oldest].created)) {
+      oldest = k
+    }
+  }
+  if oldest == "" {
+    return false
+  }
+  delete(idempotency.m, oldest)
+  return true
+}
+
+/* ResponseWriter keeping a copy of what is written, up to idempotencyMaxBody */
+type recordingWriter struct {
+  http.ResponseWriter
+  status int
+  wrote bool
+  body bytes.Buffer
+  tooBig bool
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+  if !rw.wrote {
+    rw.wrote = true
+    rw.status = status
+  }
+  rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+  rw.wrote = true
+  if !rw.tooBig {
+    if rw.body.Len()+len(b) > idempotencyMaxBody {
+      rw.tooBig = true
+      rw.body.Reset()
+    } else {
+      rw.body.Write(b)
+    }
+  }
+  return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
@@ -0,0 +1,351 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "image"
+  "image/draw"
+  "image/gif"
+  "image/jpeg"
+  "image/png"
+)
+
+/* Image metadata on upload
+  - Uploaded JPEG, PNG and WebP images lose their metadata before they're
+    stored: EXIF, with the camera, time and often the GPS position of the
+    photo, XMP, IPTC, comments and text chunks, and the extra images phones
+    put after a JPEG. This is done without re-encoding, so nothing else about
+    the image changes; the colour profile stays, and so does the EXIF
+    orientation, as the only tag left, so photos aren't shown on their side.
+    -strip-image-metadata=false stores images as they're uploaded
+  - -image-reencode goes further, decoding each image and encoding it again,
+    so what's stored and served is only ever what Go's encoders wrote, not
+    whatever an attacker crafted for some other program's image parser.
+    Photos are turned the right way up first, and lose their colour
+    profiles. PNG, JPEG and GIF can be decoded with the standard library;
+    WebP can't, so it isn't accepted while this is on
+  - An image that can't be read is refused
+*/
+var stripImageMetadata = true
+var reencodeImages = false
+
+var errUnreadableImage = errors.New("The image couldn't be read")
+var errImageTooLarge = errors.New("The image has too many pixels")
+var errImageType = errors.New("Only PNG, JPEG and GIF images can be uploaded")
+
+/* The image as it should be stored */
+func normalizeImage(typ string, data []byte) ([]byte, error) {
+  if reencodeImages {
+    switch typ {
+    case "image/jpeg", "image/png", "image/gif":
+      return reencodeImage(typ, data)
+    case "image/webp":
+      return nil, errImageType
+    }
+    return data, nil
+  }
+  if !stripImageMetadata {
+    return data, nil
+  }
+  var out []byte
+  var ok bool
+  switch typ {
+  case "image/jpeg":
+    out, ok = stripJPEG(data)
+  case "image/png":
+    out, ok = stripPNG(data)
+  case "image/webp":
+    out, ok = stripWebP(data)
+  default:
+    return data, nil
+  }
+  if !ok {
+    return nil, errUnreadableImage
+  }
+  return out, nil
+}
+
+/* Copy a JPEG, leaving out the segments that hold metadata
+  - APP0 (JFIF), APP14 (Adobe) and ICC profiles in APP2 stay, being about
+    how to show the image; the other APPn segments and comments go
+  - Whatever follows the end of the image goes too
+*/
+func stripJPEG(data []byte) ([]byte, bool) {
+  if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+    return nil, false
+  }
+  out := []byte{0xFF, 0xD8}
+  orientation := 1
+  wroteOrientation := false
+  for i := 2; ; {
+    if i+1 >= len(data) || data[i] != 0xFF {
+      return nil, false
+    }
+    for i+1 < len(data) && data[i+1] == 0xFF {
+      i++ // fill bytes
+    }
+    marker := data[i+1]
+    if marker == 0xD9 {
+      return append(out, 0xFF, 0xD9), true
+    }
+    if marker == 0x01 || marker >= 0xD0 && marker <= 0xD7 {
+      out = append(out, 0xFF, marker)
+      i += 2
+      continue
+    }
+    if i+4 > len(data) {
+      return nil, false
+    }
+    end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+    if end > len(data) || end < i+4 {
+      return nil, false
+    }
+    segment, payload := data[i:end], data[i+4:end]
+    keep := true
+    switch {
+    case marker == 0xE1:
+      if o := exifOrientation(payload); o != 0 {
+        orientation = o
+      }
+      keep = false
+    case marker == 0xE2:
+      keep = bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+    case marker >= 0xE3 && marker <= 0xED, marker == 0xEF, marker == 0xFE:
+      keep = false
+    }
+    // The orientation goes back in before the first segment that isn't APP0
+    if !wroteOrientation && marker != 0xE0 && keep {
+      if orientation != 1 {
+        out = append(out, orientationSegment(orientation)...)
+      }
+      wroteOrientation = true
+    }
+    if keep {
+      out = append(out, segment...)
+    }
+    i = end
+    if marker != 0xDA {
+      continue
+    }
+    // Start of scan: the entropy coded data runs to the next marker that
+    // isn't a stuffed 0xFF or a restart
+    for i < len(data) {
+      if data[i] == 0xFF && i+1 < len(data) {
+        next := data[i+1]
+        if next != 0x00 && !(next >= 0xD0 && next <= 0xD7) && next != 0xFF {
+          break
+        }
+        out = append(out, 0xFF, next)
+        i += 2
+        continue
+      }
+      out = append(out, data[i])
+      i++
+    }
+    if i >= len(data) {
+      return nil, false
+    }
+  }
+}
+
+/* The orientation tag of an APP1 Exif segment, 0 if it has none */
+func exifOrientation(payload []byte) int {
+  tiff, ok := bytes.CutPrefix(payload, []byte("Exif\x00\x00"))
+  if !ok || len(tiff) < 8 {
+    return 0
+  }
+  var order binary.ByteOrder
+  switch string(tiff[:2]) {
+  case "II":
+    order = binary.LittleEndian
+  case "MM":
+    order = binary.BigEndian
+  default:
+    return 0
+  }
+  ifd := int(order.Uint32(tiff[4:]))
+  if ifd+2 > len(tiff) || ifd < 8 {
+    return 0
+  }
+  n := int(order.Uint16(tiff[ifd:]))
+  for e := ifd + 2; e+12 <= len(tiff) && n > 0; e, n = e+12, n-1 {
+    if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 {
+      if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+        return o
+      }
+    }
+  }
+  return 0
+}
+
+/* An APP1 Exif segment with nothing but the orientation */
+func orientationSegment(orientation int) []byte {
+  tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, // header, IFD at 8
+    0, 1, // one entry
+    0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // orientation, SHORT
+    0, 0, 0, 0} // no next IFD
+  payload := append([]byte("Exif\x00\x00"), tiff...)
+  seg := []byte{0xFF, 0xE1, 0, 0}
+  binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+  return append(seg, payload...)
+}
+
+/* Copy a PNG without its EXIF, text and time chunks */
+func stripPNG(data []byte) ([]byte, bool) {
+  const sig = "\x89PNG\r\n\x1a\n"
+  if !bytes.HasPrefix(data, []byte(sig)) {
+    return nil, false
+  }
+  out := []byte(sig)
+  for i := len(sig); ; {
+    if i+8 > len(data) {
+      return nil, false
+    }
+    end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+    if end > len(data) || end < i+12 {
+      return nil, false
+    }
+    switch typ := string(data[i+4 : i+8]); typ {
+    case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+    default:
+      out = append(out, data[i:end]...)
+      if typ == "IEND" {
+        return out, true
+      }
+    }
+    i = end
+  }
+}
+
+/* Copy a WebP without its EXIF and XMP chunks */
+func stripWebP(data []byte) ([]byte, bool) {
+  if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+    return nil, false
+  }
+  riffEnd := 8 + int(binary.LittleEndian.Uint32(data[4:]))
+  if riffEnd > len(data) {
+    return nil, false
+  }
+  out := append([]byte(nil), data[:12]...)
+  for i := 12; i < riffEnd; {
+    if i+8 > riffEnd {
+      return nil, false
+    }
+    size := int(binary.LittleEndian.Uint32(data[i+4:]))
+    end := i + 8 + size + size%2
+    if end > riffEnd || size < 0 {
+      return nil, false
+    }
+    switch fourCC := string(data[i : i+4]); fourCC {
+    case "EXIF", "XMP ":
+    case "VP8X":
+      chunk := append([]byte(nil), data[i:end]...)
+      if len(chunk) > 8 {
+        chunk[8] &^= 0x08 | 0x04 // the EXIF and XMP flags
+      }
+      out = append(out, chunk...)
+    default:
+      out = append(out, data[i:end]...)
+    }
+    i = end
+  }
+  binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+  return out, true
+}
+
+/* Decode and encode the image again, as described above */
+func reencodeImage(typ string, data []byte) ([]byte, error) {
+  cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+  if err != nil {
+    return nil, errUnreadableImage
+  }
+  if int64(cfg.Width)*int64(cfg.Height) > maxThumbSourcePixels {
+    return nil, errImageTooLarge
+  }
+  var buf bytes.Buffer
+  switch typ {
+  case "image/gif":
+    g, err := gif.DecodeAll(bytes.NewReader(data))
+    if err != nil {
+      return nil, errUnreadableImage
+    }
+    err = gif.EncodeAll(&buf, g)
+  case "image/png":
+    img, err := png.Decode(bytes.NewReader(data))
+    if err != nil {
+      return nil, errUnreadableImage
+    }
+    err = png.Encode(&buf, img)
+  case "image/jpeg":
+    img, err := jpeg.Decode(bytes.NewReader(data))
+    if err != nil {
+      return nil, errUnreadableImage
+    }
+    if o := jpegOrientation(data); o > 1 {
+      img = orient(img, o)
+    }
+    err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+  }
+  if err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+/* The EXIF orientation of a JPEG, 0 if it has none */
+func jpegOrientation(data []byte) int {
+  for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+    marker := data[i+1]
+    if marker == 0xDA || marker == 0xD9 {
+      break
+    }
+    end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+    if end > len(data) {
+      break
+    }
+    if marker == 0xE1 {
+      if o := exifOrientation(data[i+4 : end]); o != 0 {
+        return o
+      }
+    }
+    i = end
+  }
+  return 0
+}
+
+/* img turned the right way up for an EXIF orientation of 2 to 8 */
+func orient(img image.Image, o int) image.Image {
+  b := img.Bounds()
+  src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+  draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+  w, h := b.Dx(), b.Dy()
+  dw, dh := w, h
+  if o >= 5 {
+    dw, dh = h, w // a quarter turn
+  }
+  dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+  for y := 0; y < h; y++ {
+    for x := 0; x < w; x++ {
+      var dx, dy int
+      switch o {
+      case 2:
+        dx, dy = w-1-x, y
+      case 3:
+        dx, dy = w-1-x, h-1-y
+      case 4:
+        dx, dy = x, h-1-y
+      case 5:
+        dx, dy = y, x
+      case 6:
+        dx, dy = h-1-y, x
+      case 7:
+        dx, dy = h-1-y, w-1-x
+      case 8:
+        dx, dy = y, w-1-x
+      }
+      dst.SetNRGBA(dx, dy, src.NRGBAAt(x, y))
+    }
+  }
+  return dst
+}
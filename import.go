@@ -0,0 +1,228 @@
+package main
+
+import (
+  "archive/zip"
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+/* Bulk import
+  - An admin uploads a zip of .txt files on the admin page and an import job
+    saves each as a page, titled by its path in the zip without .txt, as
+    -seed does for a directory
+  - Pages that already exist are left alone unless overwrite is ticked, in
+    which case each gets a new revision. Either way the usual checks apply
+    (size, quota, review), and a page that fails them is reported and skipped
+  - Entries under _files/{title}/ are put back as that page's attachments,
+    and _meta/{title}.json as the metadata of the page if it was imported,
+    so a backup (see backup.go) can be restored this way. An encrypted
+    backup is decrypted with the wiki's key
+  - A draft's published revision isn't in the backup, so a restored draft
+    has none and stays hidden from readers until it's published again
+  - The zip waits in data/jobs/ until the job is done
+*/
+const maxImportSize = 64 << 20
+
+var importDir = "data/jobs"
+
+/* Save the zip in r's form for an import job, returning the job's arguments */
+func saveImportUpload(w http.ResponseWriter, r *http.Request) (map[string]string, error) {
+  r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+  f, _, err := r.FormFile("zip")
+  if err != nil {
+    return nil, errors.New("choose a zip file of pages to import")
+  }
+  defer f.Close()
+  if err := os.MkdirAll(importDir, 0700); err != nil {
+    return nil, err
+  }
+  id, err := randomID()
+  if err != nil {
+    return nil, err
+  }
+  path := filepath.Join(importDir, id+".zip")
+  out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+  if err != nil {
+    return nil, err
+  }
+  _, err = io.Copy(out, f)
+  if cerr := out.Close(); err == nil {
+    err = cerr
+  }
+  if err == nil {
+    if _, err = openImport(path); err == errNoKey || err == errDecrypt {
+      err = errors.New("that backup is encrypted with a key this wiki doesn't have")
+    } else if err != nil {
+      err = errors.New("that isn't a zip file")
+    }
+  }
+  if err != nil {
+    os.Remove(path)
+    return nil, err
+  }
+  args := map[string]string{"file": path}
+  if r.FormValue("overwrite") != "" {
+    args["overwrite"] = "on"
+  }
+  return args, nil
+}
+
+/* The zip at path, decrypted first if it's an encrypted backup */
+func openImport(path string) (*zip.Reader, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  if data, err = backupCodec.decrypt(data); err != nil {
+    return nil, err
+  }
+  return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+/* The import job */
+func importJob(ctx context.Context, j *Job) (string, error) {
+  zr, err := openImport(j.Args["file"])
+  if err != nil {
+    return "", err
+  }
+  author := j.By
+  if author == "" {
+    author = "import"
+  }
+  imported, skipped, restored := 0, 0, 0
+  var failed []string
+  var files []*zip.File
+  // Each page's metadata, whichever order the zip has them in
+  metas := map[string]*zip.File{}
+  for _, f := range zr.File {
+    if strings.HasPrefix(f.Name, backupMeta) && strings.HasSuffix(f.Name, ".json") {
+      metas[strings.TrimSuffix(f.Name[len(backupMeta):], ".json")] = f
+    }
+  }
+  for _, f := range zr.File {
+    if err := ctx.Err(); err != nil {
+      return "", err
+    }
+    if strings.HasPrefix(f.Name, backupFiles) && !f.FileInfo().IsDir() {
+      files = append(files, f)
+      continue
+    }
+    if f.FileInfo().IsDir() || !strings.HasSuffix(f.Name, ".txt") {
+      continue
+    }
+    title := strings.TrimSuffix(f.Name, ".txt")
+    if !validTitle.MatchString(title) {
+      failed = append(failed, f.Name+": not a valid title")
+      continue
+    }
+    if pageExists(title) && j.Args["overwrite"] == "" {
+      skipped++
+      continue
+    }
+    body, err := readZipEntry(f, maxBodySize, errBodyTooLarge)
+    if err == nil {
+      p := &Page{Title: title, Body: body}
+      // The admin who started it, so -review holds protected pages back
+      if err = authorizeSave(title, users.get(j.By)); err == nil {
+        err = checkSave(p)
+      }
+      if err == nil {
+        err = p.save(author, false)
+      }
+    }
+    if f := metas[title]; err == nil && f != nil {
+      err = importMeta(title, f)
+    }
+    if err != nil {
+      failed = append(failed, title+": "+err.Error())
+      continue
+    }
+    imported++
+  }
+  // After the pages, which attachments need to exist
+  for _, f := range files {
+    if err := ctx.Err(); err != nil {
+      return "", err
+    }
+    page, name := "", f.Name
+    if i := strings.LastIndex(f.Name, "/"); i >= len(backupFiles) {
+      page, name = f.Name[len(backupFiles):i], f.Name[i+1:]
+    }
+    if !validTitle.MatchString(page) || !validAttachmentName.MatchString(name) {
+      failed = append(failed, f.Name+": not a valid attachment")
+      continue
+    }
+    if _, err := attachments.Stat(page, name); err == nil && j.Args["overwrite"] == "" {
+      continue
+    }
+    err := checkAttachment(page, name, int64(f.UncompressedSize64))
+    var data []byte
+    if err == nil {
+      data, err = readZipEntry(f, maxAttachmentSize, errAttachmentTooLarge)
+    }
+    a := newAttachment(page, name, data, author)
+    if err == nil {
+      data, err = processUpload(&a, data)
+    }
+    if err == nil {
+      err = attachments.Save(a, data)
+    }
+    if err != nil {
+      failed = append(failed, f.Name+": "+err.Error())
+      continue
+    }
+    restored++
+  }
+  result := "imported " + strconv.Itoa(imported) + " pages, skipped " + strconv.Itoa(skipped) + " that exist"
+  if restored > 0 {
+    result += ", restored " + strconv.Itoa(restored) + " attachments"
+  }
+  if len(failed) > 0 {
+    result += "; not imported: " + strings.Join(failed, "; ")
+  }
+  return result, nil
+}
+
+/* Put back title's metadata from a backup's _meta/{title}.json */
+func importMeta(title string, f *zip.File) error {
+  data, err := readZipEntry(f, 1<<20, errors.New("its metadata is too large"))
+  if err != nil {
+    return err
+  }
+  var m PageMeta
+  if err := json.Unmarshal(data, &m); err != nil {
+    return errors.New("its metadata isn't valid: " + err.Error())
+  }
+  if m.Draft {
+    m.Published = 0
+  }
+  return pageMeta.Save(title, m)
+}
+
+/* The contents of f, or tooBig if it is over limit bytes, found without
+  reading it all
+*/
+func readZipEntry(f *zip.File, limit int64, tooBig error) ([]byte, error) {
+  rc, err := f.Open()
+  if err != nil {
+    return nil, err
+  }
+  defer rc.Close()
+  body, err := ioutil.ReadAll(io.LimitReader(rc, limit+1))
+  if err != nil {
+    return nil, err
+  }
+  if int64(len(body)) > limit {
+    return nil, tooBig
+  }
+  return body, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+)
+
+/* Interwiki links
+  - [[prefix:Target]] links to Target on another site, [[prefix:Target|text]]
+    with its own text. Prefixes are case insensitive
+  - The mapping of prefixes to URLs is edited on /admin and kept in
+    data/interwiki.json. $1 in a URL is replaced by the target, escaped but
+    keeping its slashes, or the target is appended if there is no $1
+  - Prefixes can't be the name of a directive like File
+*/
+var interwiki = struct {
+  sync.RWMutex
+  path string
+  m map[string]string
+}{path: "data/interwiki.json", m: map[string]string{
+  "wikipedia": "https://en.wikipedia.org/wiki/$1",
+  "godoc": "https://pkg.go.dev/$1",
+}}
+
+var validPrefix = regexp.MustCompile(`^[a-zA-Z]+$`)
+
+/* Read the saved mapping; none saved keeps the defaults */
+func loadInterwiki() error {
+  data, err := ioutil.ReadFile(interwiki.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  m := map[string]string{}
+  if err := json.Unmarshal(data, &m); err != nil {
+    return err
+  }
+  interwiki.Lock()
+  interwiki.m = m
+  interwiki.Unlock()
+  return nil
+}
+
+/* [[prefix:Target|text]] as a link, if prefix is known */
+func renderInterwiki(prefix, arg string) (string, bool) {
+  interwiki.RLock()
+  base, ok := interwiki.m[strings.ToLower(prefix)]
+  interwiki.RUnlock()
+  if !ok {
+    return "", false
+  }
+  target, text, hasText := strings.Cut(arg, "|")
+  target = strings.TrimSpace(target)
+  if !hasText {
+    text = prefix + ":" + target
+  }
+  if target == "" {
+    return "", false
+  }
+  parts := strings.Split(target, "/")
+  for j := range parts {
+    parts[j] = url.PathEscape(parts[j])
+  }
+  escaped := strings.Join(parts, "/")
+  href := base + escaped
+  if strings.Contains(base, "$1") {
+    href = strings.Replace(base, "$1", escaped, -1)
+  }
+  return externalLink(href, strings.TrimSpace(text)), true
+}
+
+/* The mapping as "prefix url" lines, for the admin form */
+func interwikiText() string {
+  interwiki.RLock()
+  defer interwiki.RUnlock()
+  lines := []string{}
+  for p, u := range interwiki.m {
+    lines = append(lines, p+" "+u)
+  }
+  sort.Strings(lines)
+  return strings.Join(lines, "\n")
+}
+
+/* Parse "prefix url" lines from the admin form */
+func parseInterwiki(text string) (map[string]string, error) {
+  m := map[string]string{}
+  for _, line := range strings.Split(text, "\n") {
+    fields := strings.Fields(line)
+    if len(fields) == 0 {
+      continue
+    }
+    if len(fields) != 2 || !validPrefix.MatchString(fields[0]) {
+      return nil, errors.New("each line must be a prefix of letters, a space and a URL: " + line)
+    }
+    prefix := strings.ToLower(fields[0])
+    for name := range directives {
+      if strings.EqualFold(name, prefix) {
+        return nil, errors.New(prefix + " is reserved")
+      }
+    }
+    u, err := url.Parse(fields[1])
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+      return nil, errors.New("not a web URL: " + fields[1])
+    }
+    m[prefix] = fields[1]
+  }
+  return m, nil
+}
+
+/* POST /admin/interwiki, from the form on the admin page */
+func interwikiHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  m, err := parseInterwiki(r.FormValue("interwiki"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  data, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  interwiki.Lock()
+  defer interwiki.Unlock()
+  if err := ioutil.WriteFile(interwiki.path, data, 0600); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  interwiki.m = m
+  settingsChanged("interwiki")
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
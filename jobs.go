@@ -0,0 +1,355 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "sync"
+  "time"
+)
+
+/* Background jobs
+  - Work that takes longer than a request should, like checking every link
+    or importing a zip of pages, is queued as a job and run by a pool of
+    -job-workers goroutines
+  - Jobs are kept in data/jobs.json, so queued ones survive a restart, and
+    one that was running when the wiki stopped is queued again
+  - A job that fails is tried again after jobBackoff, doubling each time, up
+    to jobAttempts tries; after that it stays failed until an admin retries it
+  - The admin page lists the newest jobs and starts new ones
+*/
+type Job struct {
+  ID string
+  Kind string
+  Args map[string]string `json:",omitempty"`
+  By string `json:",omitempty"` // who started it
+  State string // queued, running, done, failed or cancelled
+  Attempts int
+  Created time.Time
+  RunAt time.Time `json:",omitzero"` // not before this, for retries
+  Started time.Time `json:",omitzero"`
+  Finished time.Time `json:",omitzero"`
+  Result string `json:",omitempty"`
+  Error string `json:",omitempty"`
+}
+
+const (
+  jobQueued = "queued"
+  jobRunning = "running"
+  jobDone = "done"
+  jobFailed = "failed"
+  jobCancelled = "cancelled"
+)
+
+/* The work for a kind of job, returning a summary for the admin page */
+type jobFunc func(ctx context.Context, j *Job) (string, error)
+
+var jobKinds = map[string]jobFunc{
+  "backup": backupJob,
+  "check-links": checkLinksJob,
+  "compact-history": compactHistoryJob,
+  "git-sync": gitSyncJob,
+  "import": importJob,
+  "prune-history": pruneHistoryJob,
+  "scrub": scrubJob,
+}
+
+var jobWorkers = 2
+const jobAttempts = 3
+const jobBackoff = 30 * time.Second
+const jobTimeout = time.Hour
+const jobPoll = 5 * time.Second
+const jobKeep = 200 // finished jobs kept in the list
+
+var jobs = struct {
+  sync.Mutex
+  path string
+  list []*Job // oldest first
+  wake chan struct{}
+}{path: "data/jobs.json", wake: make(chan struct{}, 1)}
+
+var errNoSuchJob = errors.New("no such job")
+
+/* Read the saved jobs, queueing again any that were running */
+func loadJobs() error {
+  data, err := ioutil.ReadFile(jobs.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  var list []*Job
+  if err := json.Unmarshal(data, &list); err != nil {
+    return err
+  }
+  jobs.Lock()
+  defer jobs.Unlock()
+  for _, j := range list {
+    if j.State == jobRunning {
+      j.State = jobQueued
+    }
+  }
+  jobs.list = list
+  return nil
+}
+
+/* Write the jobs out, dropping the oldest finished ones past jobKeep; the
+  caller holds the lock
+*/
+func saveJobs() error {
+  finished := 0
+  for _, j := range jobs.list {
+    if j.State != jobQueued && j.State != jobRunning {
+      finished++
+    }
+  }
+  kept := jobs.list[:0]
+  for _, j := range jobs.list {
+    if finished > jobKeep && j.State != jobQueued && j.State != jobRunning {
+      finished--
+      removeJobFiles(j)
+      continue
+    }
+    kept = append(kept, j)
+  }
+  jobs.list = kept
+  data, err := json.MarshalIndent(jobs.list, "", "  ")
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(jobs.path, data, 0600)
+}
+
+/* Delete the files a job was given, like an uploaded zip */
+func removeJobFiles(j *Job) {
+  if f := j.Args["file"]; f != "" {
+    os.Remove(f)
+  }
+}
+
+func findJob(id string) *Job {
+  for _, j := range jobs.list {
+    if j.ID == id {
+      return j
+    }
+  }
+  return nil
+}
+
+/* Queue a job of kind, started by user by */
+func enqueueJob(kind string, args map[string]string, by string) (*Job, error) {
+  if jobKinds[kind] == nil {
+    return nil, errors.New("unknown kind of job: " + kind)
+  }
+  id, err := randomID()
+  if err != nil {
+    return nil, err
+  }
+  j := &Job{ID: id[:12], Kind: kind, Args: args, By: by, State: jobQueued, Created: time.Now().UTC()}
+  jobs.Lock()
+  jobs.list = append(jobs.list, j)
+  err = saveJobs()
+  jobs.Unlock()
+  if err != nil {
+    return nil, err
+  }
+  wakeJobWorker()
+  return j, nil
+}
+
+func wakeJobWorker() {
+  select {
+  case jobs.wake <- struct{}{}:
+  default:
+  }
+}
+
+/* Start the worker pool, from main */
+func startJobWorkers() {
+  for i := 0; i < max(1, jobWorkers); i++ {
+    go runJobWorker()
+  }
+}
+
+func runJobWorker() {
+  for {
+    j := claimJob()
+    if j == nil {
+      select {
+      case <-jobs.wake:
+      case <-time.After(jobPoll):
+      }
+      continue
+    }
+    result, err := runJob(j)
+    finishJob(j.ID, result, err)
+  }
+}
+
+/* Take the oldest job that is due and mark it running; nil if none is.
+  Returns a copy, so the worker can read it without the lock
+*/
+func claimJob() *Job {
+  jobs.Lock()
+  defer jobs.Unlock()
+  now := time.Now()
+  for _, j := range jobs.list {
+    if j.State != jobQueued || now.Before(j.RunAt) {
+      continue
+    }
+    j.State, j.Started, j.Finished = jobRunning, now.UTC(), time.Time{}
+    j.Attempts++
+    if err := saveJobs(); err != nil {
+      log.Printf("jobs: %v", err)
+    }
+    c := *j
+    return &c
+  }
+  return nil
+}
+
+/* Run j, turning a panic into an error so one bad job can't stop a worker */
+func runJob(j *Job) (result string, err error) {
+  defer func() {
+    if p := recover(); p != nil {
+      err = fmt.Errorf("panic: %v", p)
+    }
+  }()
+  ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+  defer cancel()
+  return jobKinds[j.Kind](ctx, j)
+}
+
+/* Record how a run of job id went, queueing it again if it failed and has
+  tries left
+*/
+func finishJob(id, result string, err error) {
+  jobs.Lock()
+  defer jobs.Unlock()
+  j := findJob(id)
+  if j == nil {
+    return
+  }
+  now := time.Now().UTC()
+  j.Result, j.Finished = result, now
+  switch {
+  case err == nil:
+    j.State, j.Error = jobDone, ""
+    removeJobFiles(j)
+  case j.Attempts < jobAttempts:
+    j.State, j.Error = jobQueued, err.Error()
+    j.RunAt = now.Add(jobBackoff << (j.Attempts - 1))
+  default:
+    j.State, j.Error = jobFailed, err.Error()
+    log.Printf("job %s (%s) failed: %v", j.ID, j.Kind, err)
+  }
+  if err := saveJobs(); err != nil {
+    log.Printf("jobs: %v", err)
+  }
+}
+
+/* Whether a job of kind is queued or running */
+func jobPending(kind string) bool {
+  jobs.Lock()
+  defer jobs.Unlock()
+  for _, j := range jobs.list {
+    if j.Kind == kind && (j.State == jobQueued || j.State == jobRunning) {
+      return true
+    }
+  }
+  return false
+}
+
+/* A copy of the newest job of kind, nil if there is none */
+func lastJob(kind string) *Job {
+  jobs.Lock()
+  defer jobs.Unlock()
+  for i := len(jobs.list) - 1; i >= 0; i-- {
+    if jobs.list[i].Kind == kind {
+      c := *jobs.list[i]
+      return &c
+    }
+  }
+  return nil
+}
+
+/* The newest n jobs, newest first, as copies */
+func jobList(n int) []Job {
+  jobs.Lock()
+  defer jobs.Unlock()
+  list := []Job{}
+  for i := len(jobs.list) - 1; i >= 0 && len(list) < n; i-- {
+    list = append(list, *jobs.list[i])
+  }
+  return list
+}
+
+/* POST /admin/jobs
+  - action=start with kind runs a job: backup, check-links, compact-history,
+    prune-history, scrub, or import with a zip file of .txt pages (and
+    overwrite to replace existing pages)
+  - action=retry with id queues a failed or cancelled job again, and
+    action=cancel with id cancels a queued one
+*/
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  u := currentUser(r)
+  by := ""
+  if u != nil {
+    by = u.Name
+  }
+  var err error
+  switch r.FormValue("action") {
+  case "start":
+    kind := r.FormValue("kind")
+    args := map[string]string{}
+    if kind == "import" {
+      args, err = saveImportUpload(w, r)
+      if err != nil {
+        break
+      }
+    }
+    var j *Job
+    if j, err = enqueueJob(kind, args, by); err != nil {
+      removeJobFiles(&Job{Args: args})
+    } else {
+      audit("job-started", by, clientIP(r), j.Kind+" "+j.ID)
+    }
+  case "retry", "cancel":
+    action := r.FormValue("action")
+    jobs.Lock()
+    j := findJob(r.FormValue("id"))
+    switch {
+    case j == nil:
+      err = errNoSuchJob
+    case action == "retry" && (j.State == jobFailed || j.State == jobCancelled):
+      j.State, j.Attempts, j.RunAt, j.Error = jobQueued, 0, time.Time{}, ""
+      err = saveJobs()
+    case action == "cancel" && j.State == jobQueued:
+      j.State, j.Finished = jobCancelled, time.Now().UTC()
+      err = saveJobs()
+    default:
+      err = errors.New("the job is " + j.State)
+    }
+    jobs.Unlock()
+    if err == nil && action == "retry" {
+      wakeJobWorker()
+    }
+  default:
+    err = errors.New("unknown action")
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "net"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "syscall"
+  "time"
+)
+
+/* Link checking
+  - The check-links job asks every http and https URL in the pages for its
+    headers (falling back to GET where HEAD isn't allowed) and reports the
+    ones that fail or answer 4xx or 5xx, with the pages they are on
+  - Anyone who can edit can put a URL in a page, so the checker refuses to
+    connect to loopback, private and link-local addresses
+  - linkCheckers URLs are checked at a time, each given linkCheckTimeout
+*/
+const linkCheckers = 4
+const linkCheckTimeout = 10 * time.Second
+const linkCheckReport = 50 // broken links listed in the result
+
+var errPrivateAddress = errors.New("refusing to connect to a private address")
+
+var linkClient = &http.Client{
+  Timeout: linkCheckTimeout,
+  Transport: &http.Transport{
+    Proxy: http.ProxyFromEnvironment,
+    DialContext: (&net.Dialer{Timeout: linkCheckTimeout, Control: publicOnly}).DialContext,
+    TLSHandshakeTimeout: linkCheckTimeout,
+  },
+}
+
+/* Dialer check letting connections through only to public addresses */
+func publicOnly(network, address string, c syscall.RawConn) error {
+  host, _, err := net.SplitHostPort(address)
+  if err != nil {
+    return err
+  }
+  ip := net.ParseIP(host)
+  if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+    return errPrivateAddress
+  }
+  return nil
+}
+
+/* The check-links job */
+func checkLinksJob(ctx context.Context, j *Job) (string, error) {
+  titles, err := listPages()
+  if err != nil {
+    return "", err
+  }
+  on := map[string][]string{} // URL -> pages it is on
+  for _, title := range titles {
+    body, err := store.Load(title)
+    if err != nil {
+      return "", err
+    }
+    for _, u := range bareURL.FindAllString(string(body), -1) {
+      u = trimURL(u)
+      if list := on[u]; len(list) == 0 || list[len(list)-1] != title {
+        on[u] = append(list, title)
+      }
+    }
+  }
+
+  var mu sync.Mutex
+  broken := map[string]string{} // URL -> what went wrong
+  urls := make(chan string)
+  var wg sync.WaitGroup
+  for i := 0; i < linkCheckers; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for u := range urls {
+        if problem := checkLink(ctx, u); problem != "" {
+          mu.Lock()
+          broken[u] = problem
+          mu.Unlock()
+        }
+      }
+    }()
+  }
+  for u := range on {
+    if ctx.Err() != nil {
+      break
+    }
+    urls <- u
+  }
+  close(urls)
+  wg.Wait()
+  if err := ctx.Err(); err != nil {
+    return "", err
+  }
+
+  list := make([]string, 0, len(broken))
+  for u := range broken {
+    list = append(list, u)
+  }
+  sort.Strings(list)
+  result := "checked " + strconv.Itoa(len(on)) + " links on " + strconv.Itoa(len(titles)) + " pages, " + strconv.Itoa(len(list)) + " broken"
+  for i, u := range list {
+    if i == linkCheckReport {
+      result += "; and " + strconv.Itoa(len(list)-i) + " more"
+      break
+    }
+    result += "; " + u + " (" + broken[u] + ") on " + strings.Join(on[u], ", ")
+  }
+  return result, nil
+}
+
+/* What is wrong with the link u, "" if nothing is */
+func checkLink(ctx context.Context, u string) string {
+  status, err := fetchStatus(ctx, http.MethodHead, u)
+  if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+    status, err = fetchStatus(ctx, http.MethodGet, u)
+  }
+  switch {
+  case err != nil:
+    if errors.Is(err, errPrivateAddress) {
+      return errPrivateAddress.Error()
+    }
+    return err.Error()
+  case status >= 400:
+    return strconv.Itoa(status) + " " + http.StatusText(status)
+  }
+  return ""
+}
+
+func fetchStatus(ctx context.Context, method, u string) (int, error) {
+  req, err := http.NewRequestWithContext(ctx, method, u, nil)
+  if err != nil {
+    return 0, err
+  }
+  req.Header.Set("User-Agent", "wiki link checker")
+  resp, err := linkClient.Do(req)
+  if err != nil {
+    return 0, err
+  }
+  resp.Body.Close()
+  return resp.StatusCode, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+  "bytes"
+  "html/template"
+  "net/http"
+  "net/url"
+  "regexp"
+  "strings"
+)
+
+/* External links
+  - http and https URLs in page text become links
+  - Every link off the wiki gets rel=externalRel (nofollow noopener by
+    default), and target=_blank with -external-new-tab
+  - With -link-warning, links to hosts not in -trusted-domains go through
+    /leave?to=..., which says where the link goes and lets the reader
+    decide; it never redirects by itself. A trusted domain covers its subdomains
+*/
+var externalRel = "nofollow noopener"
+var externalNewTab bool
+var linkWarning bool
+var trustedDomains []string
+
+var bareURL = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+/* HTML for a link off the wiki */
+func externalLink(href, text string) string {
+  target := href
+  if linkWarning && !trustedLink(href) {
+    target = "/leave?to=" + url.QueryEscape(href)
+  }
+  var b strings.Builder
+  b.WriteString(`<a href="` + template.HTMLEscapeString(target) + `"`)
+  if externalRel != "" {
+    b.WriteString(` rel="` + template.HTMLEscapeString(externalRel) + `"`)
+  }
+  if externalNewTab {
+    b.WriteString(` target="_blank"`)
+  }
+  b.WriteString(`>` + template.HTMLEscapeString(text) + `</a>`)
+  return b.String()
+}
+
+/* Whether href points at a trusted domain */
+func trustedLink(href string) bool {
+  u, err := url.Parse(href)
+  if err != nil {
+    return false
+  }
+  host := strings.ToLower(u.Hostname())
+  for _, d := range trustedDomains {
+    if host == d || strings.HasSuffix(host, "."+d) {
+      return true
+    }
+  }
+  return false
+}
+
+/* Write text escaped, turning the URLs in it into links */
+func writeLinkedText(buf *bytes.Buffer, text string) {
+  last := 0
+  for _, m := range bareURL.FindAllStringIndex(text, -1) {
+    end := m[0] + len(trimURL(text[m[0]:m[1]]))
+    buf.WriteString(template.HTMLEscapeString(text[last:m[0]]))
+    buf.WriteString(externalLink(text[m[0]:end], text[m[0]:end]))
+    last = end
+  }
+  buf.WriteString(template.HTMLEscapeString(text[last:]))
+}
+
+/* A URL matched by bareURL without the punctuation after it, which usually
+  ends the sentence rather than the URL
+*/
+func trimURL(s string) string {
+  return strings.TrimRight(s, ".,;:!?)'")
+}
+
+type leaveData struct {
+  To string
+  Host string
+}
+
+/* The warning page at /leave?to=url */
+func leaveHandler(w http.ResponseWriter, r *http.Request) {
+  to := r.FormValue("to")
+  u, err := url.Parse(to)
+  if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    http.Error(w, "not a web link", http.StatusBadRequest)
+    return
+  }
+  renderTemplate(w, "leave", &leaveData{To: to, Host: u.Hostname()})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+  "errors"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+)
+
+/* Where the wiki listens, from -listen
+  - host:port, as before; ":8080" is the default
+  - unix:/path/wiki.sock for a Unix domain socket, so a local proxy can reach
+    the wiki without it opening a port. A stale socket file is removed first;
+    the socket is made group read/write for the proxy's group
+  - systemd takes the socket systemd passes in with socket activation
+    (LISTEN_FDS, the first one is fd 3), so the wiki needn't bind anything itself
+*/
+func listen(spec string) (net.Listener, error) {
+  switch {
+  case spec == "systemd":
+    return systemdListener()
+  case strings.HasPrefix(spec, "unix:"):
+    path := strings.TrimPrefix(spec, "unix:")
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+      return nil, err
+    }
+    ln, err := net.Listen("unix", path)
+    if err != nil {
+      return nil, err
+    }
+    if err := os.Chmod(path, 0660); err != nil {
+      ln.Close()
+      return nil, err
+    }
+    return ln, nil
+  }
+  return net.Listen("tcp", spec)
+}
+
+/* First socket passed in by systemd, per sd_listen_fds(3) */
+func systemdListener() (net.Listener, error) {
+  pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+  n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+  if pid != os.Getpid() || n < 1 {
+    return nil, errors.New("-listen systemd: no socket passed in (is the .socket unit enabled?)")
+  }
+  // Children shouldn't think the sockets are theirs
+  os.Unsetenv("LISTEN_PID")
+  os.Unsetenv("LISTEN_FDS")
+  os.Unsetenv("LISTEN_FDNAMES")
+  f := os.NewFile(3, "systemd socket")
+  defer f.Close()
+  return net.FileListener(f)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+  "errors"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+/* Paging and sorting for page listings
+  - Both /pages and GET /api/v1/pages take ?limit=&offset=&sort=&order=
+  - sort is title (the default) or modified, order is asc or desc
+  - /pages shows defaultPageLimit titles at a time, or the user's results per
+    page; the API returns every
+    title unless a limit is given, so existing clients keep working
+  - tag= lists only the pages with that tag (see tags.go)
+*/
+type listQuery struct {
+  Limit int
+  Offset int
+  Sort string
+  Desc bool
+  Tag string
+}
+
+const defaultPageLimit = 100
+const maxPageLimit = 1000
+
+/* Read a listQuery from URL parameters, using limit when none is given */
+func parseListQuery(v url.Values, limit int) (listQuery, error) {
+  q := listQuery{Limit: limit, Sort: v.Get("sort"), Tag: strings.ToLower(v.Get("tag"))}
+  if s := v.Get("limit"); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < 1 || n > maxPageLimit {
+      return q, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageLimit))
+    }
+    q.Limit = n
+  }
+  if s := v.Get("offset"); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < 0 {
+      return q, errors.New("offset must be a number of pages")
+    }
+    q.Offset = n
+  }
+  switch q.Sort {
+  case "", "title":
+    q.Sort = "title"
+  case "modified":
+  default:
+    return q, errors.New("sort must be title or modified")
+  }
+  switch v.Get("order") {
+  case "", "asc":
+  case "desc":
+    q.Desc = true
+  default:
+    return q, errors.New("order must be asc or desc")
+  }
+  if q.Tag != "" && !validTag.MatchString(q.Tag) {
+    return q, errBadTag
+  }
+  return q, nil
+}
+
+/* One page of titles for q, and how many pages there are in all, counting
+  only those u can read as they stand now (see visiblePages)
+*/
+func queryPages(q listQuery, u *User) ([]string, int, error) {
+  titles, err := listPages()
+  if err == nil {
+    titles, err = visiblePages(titles, u)
+  }
+  if err == nil && q.Tag != "" {
+    titles, err = taggedPages(titles, q.Tag)
+  }
+  if err != nil {
+    return nil, 0, err
+  }
+  if q.Sort == "modified" {
+    modified := make(map[string]int64, len(titles))
+    for _, t := range titles {
+      if info, err := store.Stat(t); err == nil {
+        modified[t] = info.Modified.UnixNano()
+      }
+    }
+    // Stable, so pages modified at the same time stay in title order
+    sort.SliceStable(titles, func(i, j int) bool {
+      return modified[titles[i]] < modified[titles[j]]
+    })
+  }
+  if q.Desc {
+    for i, j := 0, len(titles)-1; i < j; i, j = i+1, j-1 {
+      titles[i], titles[j] = titles[j], titles[i]
+    }
+  }
+  total := len(titles)
+  start := min(q.Offset, total)
+  end := total
+  if q.Limit > 0 {
+    end = min(start+q.Limit, total)
+  }
+  return titles[start:end], total, nil
+}
+
+/* The same query at another offset, as URL parameters */
+func (q listQuery) at(offset int) string {
+  v := url.Values{}
+  if q.Limit > 0 {
+    v.Set("limit", strconv.Itoa(q.Limit))
+  }
+  v.Set("offset", strconv.Itoa(offset))
+  if q.Sort != "title" {
+    v.Set("sort", q.Sort)
+  }
+  if q.Desc {
+    v.Set("order", "desc")
+  }
+  if q.Tag != "" {
+    v.Set("tag", q.Tag)
+  }
+  return v.Encode()
+}
+
+/* Query strings for the previous and next pages, "" where there isn't one */
+func (q listQuery) neighbours(total int) (prev, next string) {
+  if q.Offset > 0 {
+    prev = q.at(max(0, q.Offset-q.Limit))
+  }
+  if q.Limit > 0 && q.Offset+q.Limit < total {
+    next = q.at(q.Offset + q.Limit)
+  }
+  return prev, next
+}
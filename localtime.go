@@ -0,0 +1,121 @@
+package main
+
+import (
+  "html/template"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+/* Times in the reader's time zone
+  - Times are stored in UTC and only put in a zone when they are shown
+  - The zone is the one in the reader's preferences (prefs.go), else the one
+    static/timezone.js reports from the browser in the wiki_tz cookie, else
+    the server's
+  - {{when $.Zone .Time}} shows a time as "3 hours ago" or "in 2 days", with
+    the date and time in the zone as its tooltip; times more than a month
+    away show the date instead
+  - Datetime inputs, like a page's schedule, are read and filled in in the
+    reader's zone too
+*/
+const zoneCookie = "wiki_tz"
+
+/* Loaded time zones, as time.LoadLocation reads a file each time */
+var zones sync.Map // name -> *time.Location
+
+/* The named zone, false if there is no such zone */
+func loadZone(name string) (*time.Location, bool) {
+  if loc, ok := zones.Load(name); ok {
+    return loc.(*time.Location), true
+  }
+  if name == "" || name == "Local" {
+    return nil, false
+  }
+  loc, err := time.LoadLocation(name)
+  if err != nil {
+    return nil, false
+  }
+  zones.Store(name, loc)
+  return loc, true
+}
+
+/* The zone to show the reader of r times in, never nil */
+func viewerZone(r *http.Request) *time.Location {
+  if loc, ok := loadZone(prefsOf(currentUser(r)).TimeZone); ok {
+    return loc
+  }
+  if c, err := r.Cookie(zoneCookie); err == nil {
+    if loc, ok := loadZone(c.Value); ok {
+      return loc
+    }
+  }
+  return time.Local
+}
+
+/* A <time> element for t, relative to now, see the top of the file */
+func when(loc *time.Location, t time.Time) template.HTML {
+  if t.IsZero() {
+    return ""
+  }
+  if loc == nil {
+    loc = time.Local
+  }
+  t = t.In(loc)
+  text := relativeTime(time.Since(t))
+  if text == "" {
+    text = t.Format("2006-01-02")
+  }
+  return template.HTML(`<time datetime="` + t.UTC().Format(time.RFC3339) + `" title="` +
+    template.HTMLEscapeString(t.Format("2006-01-02 15:04 MST")) + `">` + text + `</time>`)
+}
+
+/* "3 hours ago" for d = 3h, "in 2 days" for d = -48h; "" beyond a month */
+func relativeTime(d time.Duration) string {
+  future := d < 0
+  if future {
+    d = -d
+  }
+  var n int
+  var unit string
+  switch {
+  case d < time.Minute:
+    return "just now"
+  case d < time.Hour:
+    n, unit = int(d/time.Minute), "minute"
+  case d < 24*time.Hour:
+    n, unit = int(d/time.Hour), "hour"
+  case d < 31*24*time.Hour:
+    n, unit = int(d/(24*time.Hour)), "day"
+  default:
+    return ""
+  }
+  s := strconv.Itoa(n) + " " + unit
+  if n != 1 {
+    s += "s"
+  }
+  if future {
+    return "in " + s
+  }
+  return s + " ago"
+}
+
+/* Format for datetime-local inputs */
+const scheduleInput = "2006-01-02T15:04"
+
+/* t for a datetime-local input in loc, "" when unset */
+func inputTime(loc *time.Location, t time.Time) string {
+  if t.IsZero() {
+    return ""
+  }
+  if loc == nil {
+    loc = time.Local
+  }
+  return t.In(loc).Format(scheduleInput)
+}
+
+/* A datetime-local input's value, read in loc and returned in UTC */
+func parseInputTime(s string, loc *time.Location) (time.Time, error) {
+  t, err := time.ParseInLocation(scheduleInput, s, loc)
+  return t.UTC(), err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Slowing down password guessing
+  - Failed sign ins are counted per account and per client IP address. After
+    -login-attempts failures in a row an account is locked for a second, then
+    twice as long after each further failure, up to -login-max-lockout
+  - An address gets four times as many tries, so people behind one NAT
+    don't lock each other out as quickly
+  - A locked account or address is turned away before its password is
+    checked. Signing in clears the account's count, not the address's, and
+    counts are forgotten an hour after the last failure
+  - Counts are kept in memory and start again on a restart
+  - Failures and lockouts are written to the audit log (audit.go)
+*/
+var loginAttempts = 5
+var loginMaxLockout = 15 * time.Minute
+
+const loginForget = time.Hour
+
+var errLockedOut = errors.New("Too many failed sign ins: wait a while and try again")
+
+type loginFailures struct {
+  count int
+  last time.Time
+  until time.Time
+}
+
+var loginLimit = struct {
+  sync.Mutex
+  m map[string]*loginFailures // "user:{name}" or "ip:{address}"
+}{m: map[string]*loginFailures{}}
+
+/* How long until name may try to sign in again from ip, 0 if it may now */
+func loginWait(name, ip string) time.Duration {
+  if loginAttempts <= 0 {
+    return 0
+  }
+  loginLimit.Lock()
+  defer loginLimit.Unlock()
+  now := time.Now()
+  wait := time.Duration(0)
+  for _, key := range []string{"user:" + name, "ip:" + ip} {
+    if f := loginLimit.m[key]; f != nil && f.until.After(now) {
+      wait = max(wait, f.until.Sub(now))
+    }
+  }
+  return wait
+}
+
+/* Count a failed sign in as name from ip, for reason */
+func loginFailed(name, ip, reason string) {
+  audit("login-failed", name, ip, reason)
+  if loginAttempts <= 0 {
+    return
+  }
+  loginLimit.Lock()
+  defer loginLimit.Unlock()
+  now := time.Now()
+  for key, f := range loginLimit.m {
+    if now.Sub(f.last) > loginForget && now.After(f.until) {
+      delete(loginLimit.m, key)
+    }
+  }
+  for _, key := range []string{"user:" + name, "ip:" + ip} {
+    f := loginLimit.m[key]
+    if f == nil {
+      f = &loginFailures{}
+      loginLimit.m[key] = f
+    }
+    f.count++
+    f.last = now
+    allowed := loginAttempts
+    if strings.HasPrefix(key, "ip:") {
+      allowed *= 4
+    }
+    if over := f.count - allowed + 1; over > 0 {
+      lock := loginMaxLockout
+      if over <= 30 && time.Second<<(over-1) < lock {
+        lock = time.Second << (over - 1)
+      }
+      f.until = now.Add(lock)
+      audit("locked-out", name, ip, key+" for "+lock.String()+" after "+strconv.Itoa(f.count)+" failures")
+    }
+  }
+}
+
+/* Clear the failures for name after it signs in */
+func loginSucceeded(name string) {
+  loginLimit.Lock()
+  defer loginLimit.Unlock()
+  delete(loginLimit.m, "user:"+name)
+}
+
+/* Turn away a sign in while name or ip is locked out, reporting whether it did */
+func loginLocked(w http.ResponseWriter, name, ip string) bool {
+  wait := loginWait(name, ip)
+  if wait <= 0 {
+    return false
+  }
+  secs := int((wait + time.Second - 1) / time.Second)
+  w.Header().Set("Retry-After", strconv.Itoa(secs))
+  return true
+}
+
+/* A lockout as the admin page lists it */
+type lockout struct {
+  Key string
+  Failures int
+  Until time.Time
+}
+
+func lockoutList() []lockout {
+  loginLimit.Lock()
+  defer loginLimit.Unlock()
+  list := []lockout{}
+  now := time.Now()
+  for key, f := range loginLimit.m {
+    if f.until.After(now) {
+      list = append(list, lockout{key, f.count, f.until})
+    }
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+  return list
+}
+
+/* POST /admin/lockouts with key: forget the failures for an account or address */
+func lockoutsHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  key := r.FormValue("key")
+  loginLimit.Lock()
+  delete(loginLimit.m, key)
+  loginLimit.Unlock()
+  by := ""
+  if u := currentUser(r); u != nil {
+    by = u.Name
+  }
+  audit("unlocked", by, clientIP(r), key)
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
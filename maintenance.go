@@ -0,0 +1,76 @@
+package main
+
+import (
+  "net/http"
+  "strings"
+  "sync"
+)
+
+/* Maintenance mode
+  - Switched on and off from the admin page while the wiki runs. Pages can
+    still be read, but anything that would change them gets a 503 with the
+    admin's message, and every page shows it as a banner
+  - Signing in and out and the admin pages keep working, so it can be
+    switched off again. GraphQL queries work, mutations don't
+  - Not kept across restarts: a wiki that starts is out of maintenance
+*/
+var maintenance struct {
+  sync.RWMutex
+  on bool
+  message string
+}
+
+const defaultMaintenanceMessage = "The wiki is down for maintenance. You can read pages, but not change them until it's over."
+
+/* The maintenance banner, "" when the wiki isn't in maintenance; "maintenance" in the templates */
+func maintenanceMessage() string {
+  maintenance.RLock()
+  defer maintenance.RUnlock()
+  if !maintenance.on {
+    return ""
+  }
+  if maintenance.message == "" {
+    return defaultMaintenanceMessage
+  }
+  return maintenance.message
+}
+
+/* Paths that keep taking writes during maintenance */
+var maintenanceExempt = []string{"/login", "/logout", "/account", "/admin", "/graphql"}
+
+/* Wrapper turning away writes during maintenance */
+func maintenanceGate(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    msg := maintenanceMessage()
+    if msg == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions || r.Method == "PROPFIND" {
+      next.ServeHTTP(w, r)
+      return
+    }
+    for _, p := range maintenanceExempt {
+      if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+        next.ServeHTTP(w, r)
+        return
+      }
+    }
+    w.Header().Set("Retry-After", "300")
+    if strings.HasPrefix(r.URL.Path, "/api/") {
+      writeJSONError(w, http.StatusServiceUnavailable, msg)
+      return
+    }
+    w.WriteHeader(http.StatusServiceUnavailable)
+    renderTemplate(w, "maintenance", msg)
+  })
+}
+
+/* POST /admin/maintenance: on=1 starts maintenance with message, anything else ends it */
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  maintenance.Lock()
+  maintenance.on = r.FormValue("on") != ""
+  maintenance.message = strings.TrimSpace(r.FormValue("message"))
+  maintenance.Unlock()
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
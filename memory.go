@@ -0,0 +1,219 @@
+package main
+
+import (
+  "io/fs"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Memory backend
+  - -store memory keeps the pages and their history in RAM and nothing on
+    disk, for demos and trying things out: every restart starts afresh
+  - -seed dir loads the .txt files under dir as pages at start up (with any
+    backend), which with memory gives a populated wiki with no setup at all:
+      wiki -store memory -seed examples/
+  - Compression and encryption don't apply, there's nothing at rest. Other
+    data such as accounts and attachments are still files under data/
+*/
+type memoryStore struct {
+  mu sync.RWMutex
+  pages map[string]memoryPage
+}
+
+type memoryPage struct {
+  body []byte
+  modified time.Time
+}
+
+func newMemoryStore() *memoryStore {
+  return &memoryStore{pages: map[string]memoryPage{}}
+}
+
+func (s *memoryStore) Load(title string) ([]byte, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  p, ok := s.pages[title]
+  if !ok {
+    return nil, os.ErrNotExist
+  }
+  return append([]byte(nil), p.body...), nil
+}
+
+func (s *memoryStore) Stat(title string) (PageInfo, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  p, ok := s.pages[title]
+  if !ok {
+    return PageInfo{}, os.ErrNotExist
+  }
+  return PageInfo{Title: title, Size: int64(len(p.body)), Modified: p.modified}, nil
+}
+
+func (s *memoryStore) Save(title string, body []byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.pages[title] = memoryPage{append([]byte(nil), body...), time.Now()}
+  return nil
+}
+
+func (s *memoryStore) Delete(title string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if _, ok := s.pages[title]; !ok {
+    return os.ErrNotExist
+  }
+  delete(s.pages, title)
+  return nil
+}
+
+func (s *memoryStore) List() ([]string, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  titles := []string{}
+  for title := range s.pages {
+    titles = append(titles, title)
+  }
+  sort.Strings(titles)
+  return titles, nil
+}
+
+/* Nothing can fail half way, so every batch is atomic */
+func (s *memoryStore) Apply(ops []storeOp) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  now := time.Now()
+  for _, op := range ops {
+    if op.Delete {
+      delete(s.pages, op.Title)
+    } else {
+      s.pages[op.Title] = memoryPage{append([]byte(nil), op.Body...), now}
+    }
+  }
+  return nil
+}
+
+/* History to go with memoryStore */
+type memoryHistory struct {
+  mu sync.RWMutex
+  revs map[string][]memoryRevision
+}
+
+type memoryRevision struct {
+  Revision
+  body []byte
+}
+
+func newMemoryHistory() *memoryHistory {
+  return &memoryHistory{revs: map[string][]memoryRevision{}}
+}
+
+func (h *memoryHistory) AddRevision(title string, rev *Revision, body []byte) error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  revs := h.revs[title]
+  rev.Number = 1
+  if len(revs) > 0 {
+    rev.Number = revs[len(revs)-1].Number + 1
+  }
+  h.revs[title] = append(revs, memoryRevision{*rev, append([]byte(nil), body...)})
+  return nil
+}
+
+func (h *memoryHistory) Revisions(title string) ([]Revision, error) {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  out := []Revision{}
+  for _, r := range h.revs[title] {
+    out = append(out, r.Revision)
+  }
+  return out, nil
+}
+
+func (h *memoryHistory) Latest(title string) (int, error) {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  revs := h.revs[title]
+  if len(revs) == 0 {
+    return 0, nil
+  }
+  return revs[len(revs)-1].Number, nil
+}
+
+func (h *memoryHistory) Revision(title string, n int) (Revision, error) {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  for _, r := range h.revs[title] {
+    if r.Number == n {
+      return r.Revision, nil
+    }
+  }
+  return Revision{}, os.ErrNotExist
+}
+
+func (h *memoryHistory) LoadRevision(title string, n int) ([]byte, error) {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  for _, r := range h.revs[title] {
+    if r.Number == n {
+      return append([]byte(nil), r.body...), nil
+    }
+  }
+  return nil, os.ErrNotExist
+}
+
+func (h *memoryHistory) DeleteRevision(title string, n int) error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  revs := h.revs[title]
+  for i, r := range revs {
+    if r.Number == n {
+      h.revs[title] = append(revs[:i:i], revs[i+1:]...)
+      return nil
+    }
+  }
+  return os.ErrNotExist
+}
+
+func (h *memoryHistory) Titles() ([]string, error) {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  titles := []string{}
+  for title := range h.revs {
+    titles = append(titles, title)
+  }
+  return titles, nil
+}
+
+/* Load dir/Title.txt (and dir/Namespace/Title.txt) as pages, leaving pages
+  that already exist alone; returns how many were added
+*/
+func seedPages(dir string) (int, error) {
+  n := 0
+  err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+    if err != nil || d.IsDir() || filepath.Ext(path) != ".txt" {
+      return err
+    }
+    rel, err := filepath.Rel(dir, path)
+    if err != nil {
+      return err
+    }
+    title := strings.TrimSuffix(filepath.ToSlash(rel), ".txt")
+    if !validTitle.MatchString(title) || pageExists(title) {
+      return nil
+    }
+    body, err := os.ReadFile(path)
+    if err != nil {
+      return err
+    }
+    if err := (&Page{Title: title, Body: body}).save("seed", false); err != nil {
+      return err
+    }
+    n++
+    return nil
+  })
+  return n, err
+}
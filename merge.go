@@ -0,0 +1,152 @@
+package main
+
+import (
+  "strings"
+)
+
+/* Line based diff and three-way merge */
+
+/* Split text into lines, each keeping its newline, so joining them gives the text back */
+func splitLines(text string) []string {
+  lines := strings.SplitAfter(text, "\n")
+  if lines[len(lines)-1] == "" {
+    lines = lines[:len(lines)-1]
+  }
+  return lines
+}
+
+/* The most edits matchLines looks for between two texts. Past it, the lines
+  between what they have in common at the start and the end are all taken as
+  changed, which merge3 makes one conflict; it keeps the work to
+  O((n+m)·maxDiffEdits) and the memory to O(maxDiffEdits²) however big the
+  texts are
+*/
+const maxDiffEdits = 1000
+
+/* Longest common subsequence of a and b with Myers' O(ND) algorithm
+  - Returns match, where match[i] is the index in b of the line paired with a[i],
+    or -1 if a[i] was deleted
+*/
+func matchLines(a, b []string) []int {
+  match := make([]int, len(a))
+  for i := range match {
+    match[i] = -1
+  }
+  // Lines the same at the start and the end pair up without a search
+  pre := 0
+  for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+    match[pre] = pre
+    pre++
+  }
+  suf := 0
+  for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+    match[len(a)-1-suf] = len(b) - 1 - suf
+    suf++
+  }
+  a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+  n, m := len(a), len(b)
+  most := min(n+m, maxDiffEdits)
+  offset := most + 1
+  // v[offset+k] is the furthest x reached on diagonal k; trace[d] is the part
+  // of v step d looks at, diagonals -d-1 to d+1, from before it
+  v := make([]int, 2*offset+1)
+  trace := [][]int{}
+  done := false
+  for d := 0; d <= most && !done; d++ {
+    trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+    for k := -d; k <= d; k += 2 {
+      var x int
+      if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+        x = v[offset+k+1] // down: a line inserted from b
+      } else {
+        x = v[offset+k-1] + 1 // right: a line of a deleted
+      }
+      y := x - k
+      for x < n && y < m && a[x] == b[y] {
+        x, y = x+1, y+1
+      }
+      v[offset+k] = x
+      if x >= n && y >= m {
+        done = true
+        break
+      }
+    }
+  }
+  if !done {
+    return match
+  }
+
+  // Walk back from the end, pairing up the lines on each diagonal run
+  x, y := n, m
+  for d := len(trace) - 1; d >= 0; d-- {
+    v := trace[d]
+    at := func(k int) int { return v[k+d+1] }
+    k := x - y
+    prevK := k - 1
+    if k == -d || (k != d && at(k-1) < at(k+1)) {
+      prevK = k + 1
+    }
+    prevX := at(prevK)
+    prevY := prevX - prevK
+    for x > prevX && y > prevY {
+      x, y = x-1, y-1
+      match[pre+x] = pre + y
+    }
+    x, y = prevX, prevY
+  }
+  return match
+}
+
+/* Three-way merge of two edits of base
+  - Regions where only one side changed take that side's change; regions both
+    sides changed the same way are taken once
+  - Where both sides changed the same region differently, both versions are
+    kept between conflict markers and conflict is returned true
+*/
+func merge3(base, mine, theirs string, mineLabel, theirsLabel string) (string, bool) {
+  b, x, y := splitLines(base), splitLines(mine), splitLines(theirs)
+  mx, my := matchLines(b, x), matchLines(b, y)
+  var out strings.Builder
+  conflict := false
+  i, j, k := 0, 0, 0
+  for i < len(b) || j < len(x) || k < len(y) {
+    if i < len(b) && mx[i] == j && my[i] == k {
+      out.WriteString(b[i])
+      i, j, k = i+1, j+1, k+1
+      continue
+    }
+    // Find the next base line both sides kept, the end of this changed region
+    l := i
+    for l < len(b) && (mx[l] < j || my[l] < k) {
+      l++
+    }
+    je, ke := len(x), len(y)
+    if l < len(b) {
+      je, ke = mx[l], my[l]
+    }
+    bc, xc, yc := strings.Join(b[i:l], ""), strings.Join(x[j:je], ""), strings.Join(y[k:ke], "")
+    switch {
+    case xc == bc:
+      out.WriteString(yc)
+    case yc == bc || xc == yc:
+      out.WriteString(xc)
+    default:
+      conflict = true
+      out.WriteString("<<<<<<< " + mineLabel + "\n")
+      out.WriteString(withNewline(xc))
+      out.WriteString("=======\n")
+      out.WriteString(withNewline(yc))
+      out.WriteString(">>>>>>> " + theirsLabel + "\n")
+    }
+    i, j, k = l, je, ke
+  }
+  return out.String(), conflict
+}
+
+/* Text with a trailing newline, so conflict markers start on their own line */
+func withNewline(s string) string {
+  if s != "" && !strings.HasSuffix(s, "\n") {
+    return s + "\n"
+  }
+  return s
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Page metadata
+  - Settings kept alongside a page rather than in its body, like its
+    publishing schedule, draft status, protection, visibility, sharing and tags
+  - A page without any has the zero PageMeta
+*/
+type PageMeta struct {
+  PublishAt time.Time // not visible before, if set
+  ExpiresAt time.Time // outdated after, if set
+  ExpiryGone bool     // expired pages are a 410 rather than shown with a banner
+  Draft bool          // see drafts.go
+  Published int       // revision readers see while it's a draft, 0 for none
+  Protected bool      // see review.go
+  Visibility string   // see visibility.go
+  Owner string        // who may read it when it's visible to its owner only
+  Group string        // who may read it when it's visible to a group
+  Shares []Share `json:",omitempty"`
+  Verified time.Time `json:",omitzero"` // marked as still current, see stale.go
+  Tags []string `json:",omitempty"` // see tags.go
+}
+
+func (m PageMeta) isZero() bool {
+  return m.PublishAt.IsZero() && m.ExpiresAt.IsZero() && !m.ExpiryGone && !m.Draft &&
+    m.Published == 0 && !m.Protected && m.Visibility == "" && m.Owner == "" && m.Group == "" && len(m.Shares) == 0 && m.Verified.IsZero() &&
+    len(m.Tags) == 0
+}
+
+type MetaStore interface {
+  Load(title string) (PageMeta, error)
+  Save(title string, m PageMeta) error
+  /* Every page with metadata */
+  All() (map[string]PageMeta, error)
+}
+
+var pageMeta MetaStore = newFileMeta("data/meta")
+
+/* File metadata
+  - dir/{storage name}.json per page; saving the zero PageMeta removes it
+*/
+type fileMeta struct {
+  dir string
+  mu sync.Mutex
+}
+
+func newFileMeta(dir string) *fileMeta {
+  return &fileMeta{dir: dir}
+}
+
+func (s *fileMeta) filename(title string) string {
+  return filepath.Join(s.dir, storageName(title)+".json")
+}
+
+func (s *fileMeta) Load(title string) (PageMeta, error) {
+  var m PageMeta
+  data, err := ioutil.ReadFile(s.filename(title))
+  if os.IsNotExist(err) {
+    return m, nil
+  }
+  if err != nil {
+    return m, err
+  }
+  return m, json.Unmarshal(data, &m)
+}
+
+func (s *fileMeta) Save(title string, m PageMeta) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if m.isZero() {
+    err := os.Remove(s.filename(title))
+    if os.IsNotExist(err) {
+      return nil
+    }
+    return err
+  }
+  if err := os.MkdirAll(s.dir, 0700); err != nil {
+    return err
+  }
+  data, err := json.Marshal(m)
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(s.filename(title), data, 0600)
+}
+
+func (s *fileMeta) All() (map[string]PageMeta, error) {
+  files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+  if err != nil {
+    return nil, err
+  }
+  all := map[string]PageMeta{}
+  for _, f := range files {
+    title, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(f), ".json"))
+    if err != nil || !validTitle.MatchString(title) {
+      continue
+    }
+    if m, err := s.Load(title); err == nil {
+      all[title] = m
+    }
+  }
+  return all, nil
+}
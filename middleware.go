@@ -0,0 +1,184 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/* Security headers
+  - The wiki shows user generated content, so every response carries headers
+    limiting what a page can do if something slips through the escaping
+  - Each can be changed with its flag; an empty value leaves the header out
+  - HSTS is only sent when -hsts-max-age is set, since it only makes sense
+    once the site is served over HTTPS
+*/
+var contentSecurityPolicy = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; " +
+  "img-src 'self' data:; frame-src https://www.youtube-nocookie.com https://player.vimeo.com https://asciinema.org; " +
+  "object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+var frameOptions = "DENY"
+var referrerPolicy = "strict-origin-when-cross-origin"
+var hstsMaxAge int
+
+/* Wrapper adding the security headers to every response */
+func securityHeaders(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    h := w.Header()
+    if contentSecurityPolicy != "" {
+      h.Set("Content-Security-Policy", contentSecurityPolicy)
+    }
+    if frameOptions != "" {
+      h.Set("X-Frame-Options", frameOptions)
+    }
+    if referrerPolicy != "" {
+      h.Set("Referrer-Policy", referrerPolicy)
+    }
+    h.Set("X-Content-Type-Options", "nosniff")
+    if hstsMaxAge > 0 {
+      h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(hstsMaxAge)+"; includeSubDomains")
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+/* Cache headers
+  - Each response is put in a class by its path, and each class has its own
+    Cache-Control and Surrogate-Control (for a CDN in front, which strips it)
+  - Both are set per class, e.g. -cache-control 'static=public, max-age=86400'
+    or -surrogate-control 'view=max-age=300'; an empty value leaves it out
+  - Only successful GET and HEAD responses get them, so a CDN never holds on
+    to an error page or the redirect from a page that doesn't exist yet
+*/
+var cacheControl = cachePolicy{
+  "view": "no-cache",
+  "raw": "no-cache",
+  "static": "public, max-age=3600",
+  "api": "no-cache",
+  "files": "no-cache",
+}
+var surrogateControl = cachePolicy{}
+
+/* Header values by class, filled from repeated class=value flags */
+type cachePolicy map[string]string
+
+func (p cachePolicy) String() string {
+  return fmt.Sprint(map[string]string(p))
+}
+
+func (p cachePolicy) Set(s string) error {
+  class, value, ok := strings.Cut(s, "=")
+  if !ok || cacheClass("/"+class+"/") != class {
+    return errors.New("want view, raw, static, api or files, then =value")
+  }
+  p[class] = value
+  return nil
+}
+
+/* The class for a path, "" for responses that get no cache headers */
+func cacheClass(path string) string {
+  switch {
+  case strings.HasPrefix(path, "/view/"), strings.HasPrefix(path, "/print/"):
+    return "view"
+  case strings.HasPrefix(path, "/raw/"):
+    return "raw"
+  case strings.HasPrefix(path, "/static/"):
+    return "static"
+  case strings.HasPrefix(path, "/api/"):
+    return "api"
+  case strings.HasPrefix(path, "/files/"), strings.HasPrefix(path, "/thumb/"):
+    return "files"
+  }
+  return ""
+}
+
+/* Wrapper adding the cache headers for the request's class */
+func cacheHeaders(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    class := cacheClass(r.URL.Path)
+    if class == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+      next.ServeHTTP(w, r)
+      return
+    }
+    next.ServeHTTP(&cacheWriter{ResponseWriter: w, class: class}, r)
+  })
+}
+
+/* Adds the headers when the status is written, unless the handler set its own */
+type cacheWriter struct {
+  http.ResponseWriter
+  class string
+  wrote bool
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+  if !cw.wrote {
+    cw.wrote = true
+    h := cw.Header()
+    if status < 300 || status == http.StatusNotModified {
+      if v := cacheControl[cw.class]; v != "" && h.Get("Cache-Control") == "" {
+        h.Set("Cache-Control", v)
+      }
+      if v := surrogateControl[cw.class]; v != "" && h.Get("Surrogate-Control") == "" {
+        h.Set("Surrogate-Control", v)
+      }
+    }
+  }
+  cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+  if !cw.wrote {
+    cw.WriteHeader(http.StatusOK)
+  }
+  return cw.ResponseWriter.Write(b)
+}
+
+func (cw *cacheWriter) Flush() {
+  if !cw.wrote {
+    cw.WriteHeader(http.StatusOK)
+  }
+  if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+/* Request timeout
+  - Handlers get requestTimeout to answer, after which the client gets a 503
+    and the request's context is cancelled; 0 turns it off
+  - The event stream and WebSockets are left out, they're meant to stay open,
+    and so are large pages that are streamed (see stream.go) and the parts
+    of resumable uploads (tus.go)
+  - Calls to Redis give up within the timeout too (see backendTimeout), so a
+    handler stuck on one doesn't hang on much past its 503
+*/
+var requestTimeout = 30 * time.Second
+
+var untimedPaths = []string{"/events", "/ws/"}
+
+const timeoutMessage = `<!DOCTYPE html><title>Timed out</title><h1>The wiki took too long to answer</h1><p>Please try again in a moment.</p>`
+
+func withTimeout(next http.Handler) http.Handler {
+  if requestTimeout <= 0 {
+    return next
+  }
+  timed := http.TimeoutHandler(next, requestTimeout, timeoutMessage)
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    for _, p := range untimedPaths {
+      if strings.HasPrefix(r.URL.Path, p) {
+        next.ServeHTTP(w, r)
+        return
+      }
+    }
+    if streamedRequest(r) || tusChunk(r) {
+      next.ServeHTTP(w, r)
+      return
+    }
+    timed.ServeHTTP(w, r)
+  })
+}
+
@@ -0,0 +1,283 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+)
+
+/* wiki migrate
+  - Copies every page with its revisions, attachments and metadata from one
+    backend to another: wiki migrate -from data -to /srv/wiki/data
+  - The file store is the only backend that outlives the process, so
+    today that means from one data directory to another, which is how to
+    switch compression or encryption on or off, or change the key, for
+    data already stored. -compress, -encrypt and -encryption-key-file are
+    for the target as they are for the wiki; the source is read with
+    -from-encryption-key-file, or WIKI_ENCRYPTION_KEY if that's set
+  - Revisions keep their numbers, authors and times, and pages and
+    attachments their modification and upload times. Compacted revisions
+    are stored whole in the target; run compact-history there afterwards
+  - Prints a line per page as it goes. Pages done are recorded in
+    migrate-progress.json in the target, so an interrupted migration picks
+    up where it stopped when run again with the same -from; the file is
+    removed once everything is copied
+  - The target is in the latest data format (see schema.go), whatever
+    version the source is at
+  - Users, groups, tokens and the other settings in data/*.json aren't
+    part of a backend: copy them over by hand
+*/
+type backend struct {
+  pages PageStore
+  history RevisionStore
+  attachments AttachmentStore
+  meta MetaStore
+}
+
+/* The file backend under dir, laid out as the wiki lays out data/ */
+func openFileBackend(dir string, codec *fileCodec) *backend {
+  fs, fh, fa := newFileStore(dir), newFileHistory(filepath.Join(dir, "history")), newFileAttachments(filepath.Join(dir, "attachments"))
+  fs.codec, fh.codec, fa.aead = codec, codec, codec.aead
+  return &backend{pages: fs, history: fh, attachments: fa, meta: newFileMeta(filepath.Join(dir, "meta"))}
+}
+
+/* History stores that can take a revision with its number as it is */
+type revisionImporter interface {
+  ImportRevision(title string, rev Revision, body []byte) error
+}
+
+/* Store body as revision rev.Number, replacing any revision with that number */
+func (h *fileHistory) ImportRevision(title string, rev Revision, body []byte) error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  dir := h.pageDir(title)
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  meta, err := json.Marshal(rev)
+  if err != nil {
+    return err
+  }
+  name := filepath.Join(dir, strconv.Itoa(rev.Number))
+  if err := h.codec.write(name+".txt", body); err != nil {
+    return err
+  }
+  if err := os.Remove(name + ".delta"); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return ioutil.WriteFile(name+".json", meta, 0600)
+}
+
+/* Pages already copied into a target */
+type migrateProgress struct {
+  From string
+  Done []string
+}
+
+const migrateProgressFile = "migrate-progress.json"
+
+func migrateMain(args []string) int {
+  flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+  from := flags.String("from", "data", "data directory to copy from")
+  to := flags.String("to", "", "data directory to copy to")
+  fromKeyFile := flags.String("from-encryption-key-file", "", "file holding the key the source is encrypted with")
+  compression := flags.String("compress", "none", "compression for the target: none or gzip")
+  encrypt := flags.Bool("encrypt", false, "encrypt the target with the key in WIKI_ENCRYPTION_KEY")
+  keyFile := flags.String("encryption-key-file", "", "file holding the key to encrypt the target with (implies -encrypt)")
+  flags.Parse(args)
+  if err := migrate(*from, *to, *fromKeyFile, *compression, *encrypt, *keyFile); err != nil {
+    fmt.Fprintln(os.Stderr, "migrate:", err)
+    return 1
+  }
+  return 0
+}
+
+func migrate(from, to, fromKeyFile, compression string, encrypt bool, keyFile string) error {
+  if to == "" {
+    return errors.New("-to is required")
+  }
+  absFrom, err := filepath.Abs(from)
+  if err != nil {
+    return err
+  }
+  absTo, err := filepath.Abs(to)
+  if err != nil {
+    return err
+  }
+  if absFrom == absTo {
+    return errors.New("-from and -to are the same directory")
+  }
+  if _, err := os.Stat(absFrom); err != nil {
+    return err
+  }
+  srcCodec, dstCodec := &fileCodec{}, &fileCodec{}
+  if fromKeyFile != "" || os.Getenv("WIKI_ENCRYPTION_KEY") != "" {
+    if srcCodec.aead, err = loadEncryptionKey(fromKeyFile); err != nil {
+      return err
+    }
+  }
+  switch compression {
+  case "none":
+  case "gzip":
+    dstCodec.compress = true
+  default:
+    return errors.New("unknown compression " + compression)
+  }
+  if encrypt || keyFile != "" {
+    if dstCodec.aead, err = loadEncryptionKey(keyFile); err != nil {
+      return err
+    }
+  }
+  src, dst := openFileBackend(absFrom, srcCodec), openFileBackend(absTo, dstCodec)
+  if _, ok := dst.history.(revisionImporter); !ok {
+    return errors.New("the target's history can't take revisions with their numbers")
+  }
+
+  progressPath := filepath.Join(absTo, migrateProgressFile)
+  progress := migrateProgress{From: absFrom}
+  data, err := ioutil.ReadFile(progressPath)
+  switch {
+  case err == nil:
+    if err := json.Unmarshal(data, &progress); err != nil {
+      return err
+    }
+    if progress.From != absFrom {
+      return errors.New("the target has a migration from " + progress.From + " in progress; finish that first")
+    }
+  case os.IsNotExist(err):
+    if pages, err := dst.pages.List(); err != nil && !os.IsNotExist(err) {
+      return err
+    } else if len(pages) > 0 {
+      return errors.New(absTo + " already holds pages: migrate into a new directory")
+    }
+    if err := os.MkdirAll(absTo, 0700); err != nil {
+      return err
+    }
+  default:
+    return err
+  }
+  done := map[string]bool{}
+  for _, title := range progress.Done {
+    done[title] = true
+  }
+
+  titles, err := migrateTitles(src)
+  if err != nil {
+    return err
+  }
+  var revisions, files int
+  for i, title := range titles {
+    if done[title] {
+      continue
+    }
+    r, f, err := migratePage(src, dst, title)
+    if err != nil {
+      return fmt.Errorf("%s: %v", title, err)
+    }
+    revisions, files = revisions+r, files+f
+    progress.Done = append(progress.Done, title)
+    data, err := json.Marshal(progress)
+    if err != nil {
+      return err
+    }
+    if err := ioutil.WriteFile(progressPath, data, 0600); err != nil {
+      return err
+    }
+    fmt.Printf("[%d/%d] %s: %d revisions, %d attachments\n", i+1, len(titles), title, r, f)
+  }
+  // Everything was written in the current format
+  if err := saveSchemaVersion(filepath.Join(absTo, filepath.Base(schemaPath)), len(schemaMigrations)); err != nil {
+    return err
+  }
+  fmt.Printf("copied %d pages, %d revisions and %d attachments to %s\n", len(titles)-len(done), revisions, files, absTo)
+  if err := os.Remove(progressPath); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return nil
+}
+
+/* Every title with a page or history in b, sorted */
+func migrateTitles(b *backend) ([]string, error) {
+  pages, err := b.pages.List()
+  if err != nil {
+    return nil, err
+  }
+  withHistory, err := b.history.Titles()
+  if err != nil {
+    return nil, err
+  }
+  seen := map[string]bool{}
+  titles := []string{}
+  for _, title := range append(pages, withHistory...) {
+    if !seen[title] {
+      seen[title] = true
+      titles = append(titles, title)
+    }
+  }
+  sort.Strings(titles)
+  return titles, nil
+}
+
+/* Copy title's revisions, attachments, metadata and then the page itself,
+  returning the revisions and attachments copied. Doing it again gives the
+  same result, so a page interrupted part way is simply copied again
+*/
+func migratePage(src, dst *backend, title string) (int, int, error) {
+  revs, err := src.history.Revisions(title)
+  if err != nil {
+    return 0, 0, err
+  }
+  importer := dst.history.(revisionImporter)
+  for _, rev := range revs {
+    body, err := src.history.LoadRevision(title, rev.Number)
+    if err != nil {
+      return 0, 0, fmt.Errorf("revision %d: %v", rev.Number, err)
+    }
+    if err := importer.ImportRevision(title, rev, body); err != nil {
+      return 0, 0, err
+    }
+  }
+  list, err := src.attachments.List(title)
+  if err != nil {
+    return 0, 0, err
+  }
+  for _, a := range list {
+    data, stored, err := src.attachments.Load(title, a.Name)
+    if err != nil {
+      return 0, 0, fmt.Errorf("attachment %s: %v", a.Name, err)
+    }
+    if err := dst.attachments.Save(stored, data); err != nil {
+      return 0, 0, err
+    }
+  }
+  m, err := src.meta.Load(title)
+  if err != nil {
+    return 0, 0, err
+  }
+  if err := dst.meta.Save(title, m); err != nil {
+    return 0, 0, err
+  }
+  body, err := src.pages.Load(title)
+  if os.IsNotExist(err) {
+    return len(revs), len(list), nil // deleted, with its history kept
+  }
+  if err != nil {
+    return 0, 0, err
+  }
+  if err := dst.pages.Save(title, body); err != nil {
+    return 0, 0, err
+  }
+  // Keep when it was last changed, which staleness and listings go by
+  if info, err := src.pages.Stat(title); err == nil {
+    if fs, ok := dst.pages.(*fileStore); ok {
+      os.Chtimes(fs.filename(title), info.Modified, info.Modified)
+    }
+  }
+  return len(revs), len(list), nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Notifications
+  - Each user has a list of notifications in data/notifications/{name}.json,
+    newest first and up to maxNotifications, each read or unread. A user is
+    told when:
+    - someone else saves or deletes a page they've starred
+    - a save adds @name for them to a page they can read
+    Saves marked as minor edits don't tell anyone
+    - with -review, someone proposes a change (admins are told), or approves
+      or rejects theirs
+  - /notifications lists them and marks them read. The home page shows how
+    many are unread
+  - For polling, GET /api/{version}/notifications lists them (?unread=1 for
+    only the unread ones), GET /api/{version}/notifications/count returns
+    {"unread": n} for a bell, and POST /api/{version}/notifications/read
+    with {"ids": [...]} or {"all": true} marks them read
+*/
+type Notification struct {
+  ID int `json:"id"`
+  Kind string `json:"kind"` // "change", "mention" or "review"
+  Page string `json:"page"`
+  URL string `json:"url"`
+  By string `json:"by,omitempty"`
+  Message string `json:"message"`
+  Time time.Time `json:"time"`
+  Read bool `json:"read"`
+}
+
+const maxNotifications = 100
+
+var notifications = struct {
+  sync.Mutex
+  dir string
+}{dir: "data/notifications"}
+
+func notificationsPath(name string) string {
+  return filepath.Join(notifications.dir, url.PathEscape(name)+".json")
+}
+
+/* The user's notifications, newest first; the caller holds the lock */
+func loadNotifications(name string) ([]Notification, error) {
+  data, err := ioutil.ReadFile(notificationsPath(name))
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  var list []Notification
+  return list, json.Unmarshal(data, &list)
+}
+
+func saveNotifications(name string, list []Notification) error {
+  data, err := json.MarshalIndent(list, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := os.MkdirAll(notifications.dir, 0700); err != nil {
+    return err
+  }
+  return ioutil.WriteFile(notificationsPath(name), data, 0600)
+}
+
+/* The user's notifications, newest first */
+func notificationsOf(name string) ([]Notification, error) {
+  notifications.Lock()
+  defer notifications.Unlock()
+  return loadNotifications(name)
+}
+
+func unreadCount(list []Notification) int {
+  n := 0
+  for _, no := range list {
+    if !no.Read {
+      n++
+    }
+  }
+  return n
+}
+
+/* Tell user about something on page; users that don't exist aren't told */
+func notify(user, kind, page, by, message string) {
+  if users.get(user) == nil {
+    return
+  }
+  no := Notification{Kind: kind, Page: page, URL: pageURL("view", page), By: by, Message: message, Time: time.Now().UTC()}
+  if kind == "review" {
+    no.URL = pageURL("review", page)
+  }
+  notifications.Lock()
+  defer notifications.Unlock()
+  list, err := loadNotifications(user)
+  if err == nil {
+    for _, old := range list {
+      no.ID = max(no.ID, old.ID)
+    }
+    no.ID++
+    list = append([]Notification{no}, list...)
+    list = list[:min(len(list), maxNotifications)]
+    err = saveNotifications(user, list)
+  }
+  if err != nil {
+    log.Printf("notify %s: %v", user, err)
+  }
+}
+
+/* Mark the user's notifications with ids read, or all of them */
+func markRead(user string, ids []int, all bool) error {
+  notifications.Lock()
+  defer notifications.Unlock()
+  list, err := loadNotifications(user)
+  if err != nil {
+    return err
+  }
+  for i := range list {
+    for _, id := range ids {
+      if list[i].ID == id {
+        list[i].Read = true
+      }
+    }
+    if all {
+      list[i].Read = true
+    }
+  }
+  return saveNotifications(user, list)
+}
+
+/* Tell users about saves and deletes, but not minor edits (run from main) */
+func watchNotifications() {
+  ch := pageEvents.subscribeDurable()
+  for ev := range ch {
+    if ev.Type == "delete" || ev.Type == "save" && !ev.Minor {
+      notifyChange(ev)
+    }
+  }
+}
+
+func notifyChange(ev PageEvent) {
+  by := ev.Author
+  if by == "" {
+    by = "someone"
+  }
+  verb := "saved"
+  if ev.Type == "delete" {
+    verb = "deleted"
+  }
+  told := map[string]bool{ev.Author: true}
+  for _, u := range users.all() {
+    if told[u.Name] || !hasTitle(u.Starred, ev.Title) {
+      continue
+    }
+    if ok, _ := pageReadableBy(ev.Title, u); ok {
+      told[u.Name] = true
+      notify(u.Name, "change", ev.Title, ev.Author, by+" "+verb+" "+ev.Title)
+    }
+  }
+  if ev.Type != "save" || ev.Revision == 0 {
+    return
+  }
+  body, err := history.LoadRevision(ev.Title, ev.Revision)
+  if err != nil {
+    return
+  }
+  var old []byte
+  if ev.Revision > 1 {
+    old, _ = history.LoadRevision(ev.Title, ev.Revision-1)
+  }
+  before := mentions(string(old))
+  for name := range mentions(string(body)) {
+    if told[name] || before[name] {
+      continue
+    }
+    u := users.get(name)
+    if ok, _ := pageReadableBy(ev.Title, u); ok {
+      notify(name, "mention", ev.Title, ev.Author, by+" mentioned you on "+ev.Title)
+    }
+  }
+}
+
+/* @name, not inside a word or an email address */
+var mention = regexp.MustCompile(`(?:^|[^\w@.])@([a-zA-Z0-9][a-zA-Z0-9_.-]{0,31})`)
+
+/* The users text mentions */
+func mentions(text string) map[string]bool {
+  found := map[string]bool{}
+  for _, m := range mention.FindAllStringSubmatch(text, -1) {
+    // A sentence may end just after the name
+    for _, name := range []string{m[1], strings.TrimRight(m[1], ".-")} {
+      if users.get(name) != nil {
+        found[name] = true
+        break
+      }
+    }
+  }
+  return found
+}
+
+/* Data for the notifications page */
+type notificationsData struct {
+  Notifications []Notification
+  Unread int
+  Zone *time.Location
+}
+
+/* /notifications; POST id marks one read, POST all marks them all read */
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next=/notifications", http.StatusFound)
+    return
+  }
+  if r.Method == http.MethodPost {
+    id, _ := strconv.Atoi(r.FormValue("id"))
+    if err := markRead(u.Name, []int{id}, r.FormValue("all") != ""); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+    return
+  }
+  list, err := notificationsOf(u.Name)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  renderTemplate(w, "notifications", &notificationsData{Notifications: list, Unread: unreadCount(list), Zone: viewerZone(r)})
+}
+
+/* /api/{version}/notifications, /notifications/count and /notifications/read */
+func apiNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+  u := currentUser(r)
+  if u == nil {
+    writeJSONError(w, http.StatusUnauthorized, "sign in or use an API token to see your notifications")
+    return
+  }
+  switch r.URL.Path {
+  case "/notifications", "/notifications/count":
+    if r.Method != http.MethodGet {
+      writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+      return
+    }
+    list, err := notificationsOf(u.Name)
+    if err != nil {
+      writeJSONError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    if r.URL.Path == "/notifications/count" {
+      writeJSON(w, http.StatusOK, map[string]int{"unread": unreadCount(list)})
+      return
+    }
+    out := []Notification{}
+    for _, no := range list {
+      if !no.Read || r.FormValue("unread") == "" {
+        out = append(out, no)
+      }
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"unread": unreadCount(list), "notifications": out})
+  case "/notifications/read":
+    if r.Method != http.MethodPost {
+      writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+      return
+    }
+    var in struct {
+      IDs []int `json:"ids"`
+      All bool `json:"all"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+      writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+      return
+    }
+    if err := markRead(u.Name, in.IDs, in.All); err != nil {
+      writeJSONError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    w.WriteHeader(http.StatusNoContent)
+  default:
+    writeJSONError(w, http.StatusNotFound, "no such resource")
+  }
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "html/template"
+  "io"
+  "net/http"
+  "net/url"
+  "regexp"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* oEmbed
+  - A line holding nothing but a URL that matches a provider's pattern is
+    shown as that provider's embed
+  - Providers are set with -oembed pattern=endpoint, e.g.
+      -oembed 'https://vimeo.com/*=https://vimeo.com/api/oembed.json'
+    where * in the pattern matches anything
+  - Rendering never waits on a provider: a URL that hasn't been looked up yet
+    is shown as a link while the lookup runs in the background, and the embed
+    appears on a later view. Answers (and failures) are cached
+  - Provider HTML runs in a sandboxed iframe with no access to the wiki. It
+    usually loads scripts and images from the provider, which -csp then has
+    to allow
+*/
+type oembedProvider struct {
+  pattern *regexp.Regexp
+  endpoint string
+}
+
+type oembedProviders []oembedProvider
+
+var oembed oembedProviders
+
+func (p *oembedProviders) String() string {
+  return fmt.Sprint(len(*p), " providers")
+}
+
+func (p *oembedProviders) Set(s string) error {
+  pattern, endpoint, ok := strings.Cut(s, "=")
+  u, err := url.Parse(endpoint)
+  if !ok || err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+    return errors.New("want pattern=endpoint URL")
+  }
+  re := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+  *p = append(*p, oembedProvider{pattern: regexp.MustCompile(re), endpoint: endpoint})
+  return nil
+}
+
+/* The parts of a provider's answer we use */
+type oembedResult struct {
+  Type string `json:"type"`
+  Title string `json:"title"`
+  URL string `json:"url"`
+  HTML string `json:"html"`
+  Width int `json:"width"`
+  Height int `json:"height"`
+  CacheAge json.Number `json:"cache_age"`
+}
+
+type oembedEntry struct {
+  result *oembedResult // nil if the lookup failed
+  expires time.Time
+}
+
+var oembedCache = struct {
+  sync.Mutex
+  entries map[string]oembedEntry
+  pending map[string]bool
+}{entries: map[string]oembedEntry{}, pending: map[string]bool{}}
+
+const oembedTTL = 24 * time.Hour
+const oembedFailureTTL = 10 * time.Minute
+const oembedCacheSize = 10000
+
+var oembedClient = &http.Client{Timeout: 5 * time.Second}
+
+/* Render line as an embed if it is a bare URL from a provider */
+func renderOEmbed(line string) (string, bool) {
+  link := strings.TrimSpace(line)
+  if len(oembed) == 0 || strings.ContainsAny(link, " \t") {
+    return "", false
+  }
+  var provider *oembedProvider
+  for i := range oembed {
+    if oembed[i].pattern.MatchString(link) {
+      provider = &oembed[i]
+      break
+    }
+  }
+  if provider == nil {
+    return "", false
+  }
+  res := lookupOEmbed(provider, link)
+  switch {
+  case res == nil:
+    return externalLink(link, link), true
+  case res.Type == "photo" && strings.HasPrefix(res.URL, "https://"):
+    return `<img src="` + template.HTMLEscapeString(res.URL) + `" alt="` + template.HTMLEscapeString(res.Title) + `"><br>` +
+      externalLink(link, link), true
+  case res.HTML != "":
+    width, height := res.Width, res.Height
+    if width <= 0 || width > 1000 {
+      width = 560
+    }
+    if height <= 0 || height > 1000 {
+      height = 315
+    }
+    return fmt.Sprintf(`<iframe sandbox="allow-scripts allow-popups" width="%d" height="%d" loading="lazy" title="%s" srcdoc="%s"></iframe>`,
+      width, height, template.HTMLEscapeString(res.Title), template.HTMLEscapeString(res.HTML)), true
+  }
+  title := res.Title
+  if title == "" {
+    title = link
+  }
+  return externalLink(link, title), true
+}
+
+/* The cached answer for link, nil if there isn't one yet; starts a lookup if needed */
+func lookupOEmbed(p *oembedProvider, link string) *oembedResult {
+  oembedCache.Lock()
+  defer oembedCache.Unlock()
+  e, ok := oembedCache.entries[link]
+  if ok && time.Now().Before(e.expires) {
+    return e.result
+  }
+  if !oembedCache.pending[link] {
+    oembedCache.pending[link] = true
+    go fetchOEmbed(p, link)
+  }
+  return e.result // a stale answer is better than none while it refreshes
+}
+
+func fetchOEmbed(p *oembedProvider, link string) {
+  res, err := requestOEmbed(p.endpoint, link)
+  entry := oembedEntry{result: res, expires: time.Now().Add(oembedTTL)}
+  if err != nil {
+    entry = oembedEntry{expires: time.Now().Add(oembedFailureTTL)}
+  } else if age, err := res.CacheAge.Int64(); err == nil && age > 0 {
+    entry.expires = time.Now().Add(min(time.Duration(age)*time.Second, 7*oembedTTL))
+  }
+  oembedCache.Lock()
+  defer oembedCache.Unlock()
+  delete(oembedCache.pending, link)
+  if len(oembedCache.entries) >= oembedCacheSize {
+    oembedCache.entries = map[string]oembedEntry{}
+  }
+  oembedCache.entries[link] = entry
+}
+
+func requestOEmbed(endpoint, link string) (*oembedResult, error) {
+  u, _ := url.Parse(endpoint)
+  q := u.Query()
+  q.Set("url", link)
+  q.Set("format", "json")
+  q.Set("maxwidth", "560")
+  u.RawQuery = q.Encode()
+  resp, err := oembedClient.Get(u.String())
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return nil, errors.New("oembed: " + resp.Status)
+  }
+  var res oembedResult
+  if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+    return nil, err
+  }
+  return &res, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+  "net/http"
+  "strings"
+  "time"
+)
+
+/* OpenGraph and Twitter card tags for the view page, so a link shared in a
+  chat app unfurls with the page's title, first paragraph and an image
+  - The image is the first image attached to the page, by upload time
+  - Both want absolute URLs: siteURL (-site-url) when set, as it must be
+    behind a proxy, otherwise the scheme and host of the request
+*/
+var siteURL string
+
+type pageCard struct {
+  Title string
+  Description string
+  URL string
+  Image string
+}
+
+const cardDescriptionLength = 200
+
+/* The scheme and host links to the wiki start with */
+func siteBase(r *http.Request) string {
+  if siteURL != "" {
+    return strings.TrimSuffix(siteURL, "/")
+  }
+  if r.TLS != nil {
+    return "https://" + r.Host
+  }
+  return "http://" + r.Host
+}
+
+func pageCardFor(r *http.Request, p *Page) pageCard {
+  base := siteBase(r)
+  c := pageCard{
+    Title: p.Title, Description: firstParagraph(p.Body, cardDescriptionLength),
+    URL: base + pageURL("view", p.Title),
+  }
+  files, _ := attachments.List(p.Title)
+  var first time.Time
+  for _, a := range files {
+    if inlineTypes[a.Type] && (c.Image == "" || a.Uploaded.Before(first)) {
+      c.Image, first = base+attachmentURL(p.Title, a.Name), a.Uploaded
+    }
+  }
+  return c
+}
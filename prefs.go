@@ -0,0 +1,126 @@
+package main
+
+import (
+  "errors"
+  "html/template"
+  "net/http"
+  "net/url"
+  "strconv"
+)
+
+/* Per-user preferences
+  - Kept with the account in data/users.json and set at /account/preferences
+  - The editor font and size style the edit page's text box
+  - Times are shown in the user's time zone rather than the server's, see
+    localtime.go
+  - Results per page sets how many titles /pages shows and how many recent
+    changes the dashboard lists; ?limit= on /pages still overrides it
+  - Anyone not signed in, or who hasn't chosen, gets the defaults
+*/
+type Preferences struct {
+  EditorFont string `json:",omitempty"` // one of editorFonts, "" for monospace
+  EditorSize int `json:",omitempty"` // pixels, 0 for the browser's default
+  TimeZone string `json:",omitempty"` // IANA name, "" for the server's zone
+  PerPage int `json:",omitempty"` // 0 for each page's own default
+}
+
+var editorFonts = []string{"monospace", "sans-serif", "serif"}
+
+const minEditorSize, maxEditorSize = 10, 32
+const minPerPage, maxPerPage = 10, 500
+
+/* The preferences of u, which may be nil for someone not signed in */
+func prefsOf(u *User) Preferences {
+  if u == nil {
+    return Preferences{}
+  }
+  return u.Prefs
+}
+
+/* Style for the edit page's text box */
+func (p Preferences) EditorStyle() template.CSS {
+  font := "monospace"
+  if p.EditorFont != "" {
+    font = p.EditorFont
+  }
+  style := "font-family: " + font
+  if p.EditorSize > 0 {
+    style += "; font-size: " + strconv.Itoa(p.EditorSize) + "px"
+  }
+  return template.CSS(style)
+}
+
+/* Results per page, def if the user hasn't chosen */
+func (p Preferences) perPage(def int) int {
+  if p.PerPage > 0 {
+    return p.PerPage
+  }
+  return def
+}
+
+/* Read preferences from the settings form, checking each */
+func parsePreferences(v url.Values) (Preferences, error) {
+  var p Preferences
+  if font := v.Get("editor_font"); font != "" && font != "monospace" {
+    ok := false
+    for _, f := range editorFonts {
+      ok = ok || f == font
+    }
+    if !ok {
+      return p, errors.New("Unknown editor font " + font)
+    }
+    p.EditorFont = font
+  }
+  if s := v.Get("editor_size"); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < minEditorSize || n > maxEditorSize {
+      return p, errors.New("The editor font size must be between " + strconv.Itoa(minEditorSize) + " and " + strconv.Itoa(maxEditorSize))
+    }
+    p.EditorSize = n
+  }
+  if tz := v.Get("time_zone"); tz != "" {
+    if _, ok := loadZone(tz); !ok {
+      return p, errors.New("Unknown time zone " + tz + ", use a name like Europe/Berlin or UTC")
+    }
+    p.TimeZone = tz
+  }
+  if s := v.Get("per_page"); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < minPerPage || n > maxPerPage {
+      return p, errors.New("Results per page must be between " + strconv.Itoa(minPerPage) + " and " + strconv.Itoa(maxPerPage))
+    }
+    p.PerPage = n
+  }
+  return p, nil
+}
+
+/* Data for the preferences page */
+type prefsData struct {
+  Prefs Preferences
+  Fonts []string
+  Saved bool
+  Error string
+}
+
+/* Preferences at /account/preferences; POST saves the form */
+func prefsHandler(w http.ResponseWriter, r *http.Request) {
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+    return
+  }
+  data := &prefsData{Prefs: u.Prefs, Fonts: editorFonts, Saved: r.FormValue("saved") != ""}
+  if r.Method == http.MethodPost {
+    p, err := parsePreferences(r.PostForm)
+    if err == nil {
+      err = users.update(u.Name, func(u *User) { u.Prefs = p })
+    }
+    if err == nil {
+      http.Redirect(w, r, "/account/preferences?saved=1", http.StatusSeeOther)
+      return
+    }
+    data.Saved, data.Error = false, err.Error()
+    w.WriteHeader(http.StatusBadRequest)
+  }
+  renderTemplate(w, "preferences", data)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+  "net/http"
+)
+
+/* Live preview over a WebSocket at /ws/preview
+  - The edit page sends the whole textarea as a message each time it changes
+  - Each message is answered with the body rendered the way the view page would
+    show it, so the preview updates without polling
+*/
+func previewSocketHandler(w http.ResponseWriter, r *http.Request) {
+  ws, err := wsUpgrade(w, r, maxBodySize)
+  if err != nil {
+    return // wsUpgrade has already responded
+  }
+  defer ws.Close()
+  for {
+    msg, err := ws.ReadMessage()
+    if err != nil {
+      return
+    }
+    if err := ws.WriteMessage([]byte(renderBody(msg))); err != nil {
+      return
+    }
+  }
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+)
+
+/* Protected pages
+  - Only admins can save, rename or delete a protected page, whichever way
+    they go about it; everyone else gets errProtected (see authorizeWrite)
+  - With -review, edits from the edit form become proposals instead, which
+    only an admin can approve (see review.go)
+*/
+var errProtected = errors.New("this page is protected: only admins can change it")
+
+/* POST /protect/{title}, admins only: protected=1 protects the page, else unprotects it */
+func protectHandler(w http.ResponseWriter, r *http.Request, title string) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  m, err := pageMeta.Load(title)
+  if err == nil {
+    m.Protected = r.FormValue("protected") != ""
+    err = pageMeta.Save(title, m)
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
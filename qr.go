@@ -0,0 +1,409 @@
+package main
+
+import (
+  "errors"
+  "html/template"
+  "strconv"
+  "strings"
+)
+
+/* QR codes
+  - Just enough of ISO/IEC 18004 to show an otpauth:// link for two-factor
+    enrollment (see twofactor.go): byte mode, error correction level M,
+    versions 1 to 10, so up to 213 bytes
+  - The mask is picked by the standard's penalty score
+  - qrSVG draws the code as inline SVG, which needs nothing from the CSP
+*/
+type qrCode struct {
+  size int
+  modules [][]bool // [row][column], true for dark
+  function [][]bool // finder, timing, alignment and format modules
+}
+
+/* Layout of a version at level M: data codewords per block, in two groups,
+  and error correction codewords per block
+*/
+type qrVersion struct {
+  blocks1, data1 int
+  blocks2, data2 int
+  ec int
+  align []int
+}
+
+var qrVersions = []qrVersion{
+  1: {1, 16, 0, 0, 10, nil},
+  2: {1, 28, 0, 0, 16, []int{6, 18}},
+  3: {1, 44, 0, 0, 26, []int{6, 22}},
+  4: {2, 32, 0, 0, 18, []int{6, 26}},
+  5: {2, 43, 0, 0, 24, []int{6, 30}},
+  6: {4, 27, 0, 0, 16, []int{6, 34}},
+  7: {4, 31, 0, 0, 18, []int{6, 22, 38}},
+  8: {2, 38, 2, 39, 22, []int{6, 24, 42}},
+  9: {3, 36, 2, 37, 22, []int{6, 26, 46}},
+  10: {4, 43, 1, 44, 26, []int{6, 28, 50}},
+}
+
+func (v qrVersion) dataCodewords() int { return v.blocks1*v.data1 + v.blocks2*v.data2 }
+
+var errQRTooLong = errors.New("too much data for a QR code")
+
+/* Encode data in the smallest version it fits */
+func newQRCode(data []byte) (*qrCode, error) {
+  version := 0
+  for v := 1; v < len(qrVersions); v++ {
+    countBits := 8
+    if v >= 10 {
+      countBits = 16
+    }
+    if 4+countBits+8*len(data) <= 8*qrVersions[v].dataCodewords() {
+      version = v
+      break
+    }
+  }
+  if version == 0 {
+    return nil, errQRTooLong
+  }
+  codewords := qrCodewords(data, version)
+  q := &qrCode{size: 17 + 4*version}
+  q.modules = make([][]bool, q.size)
+  q.function = make([][]bool, q.size)
+  for i := range q.modules {
+    q.modules[i] = make([]bool, q.size)
+    q.function[i] = make([]bool, q.size)
+  }
+  q.drawFunctionPatterns(version)
+  q.drawCodewords(codewords)
+  best, bestPenalty := 0, -1
+  for mask := 0; mask < 8; mask++ {
+    q.applyMask(mask)
+    q.drawFormat(mask)
+    if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+      best, bestPenalty = mask, p
+    }
+    q.applyMask(mask) // masks are XOR, so this undoes it
+  }
+  q.applyMask(best)
+  q.drawFormat(best)
+  return q, nil
+}
+
+/* The data bits with padding and error correction, interleaved */
+func qrCodewords(data []byte, version int) []byte {
+  v := qrVersions[version]
+  var bits qrBits
+  bits.append(4, 4) // byte mode
+  if version >= 10 {
+    bits.append(len(data), 16)
+  } else {
+    bits.append(len(data), 8)
+  }
+  for _, b := range data {
+    bits.append(int(b), 8)
+  }
+  capacity := 8 * v.dataCodewords()
+  bits.append(0, min(4, capacity-bits.n))
+  bits.append(0, (8-bits.n%8)%8)
+  for pad := 0xEC; bits.n < capacity; pad ^= 0xEC ^ 0x11 {
+    bits.append(pad, 8)
+  }
+
+  var blocks, ecs [][]byte
+  rest := bits.bytes
+  for i := 0; i < v.blocks1+v.blocks2; i++ {
+    n := v.data1
+    if i >= v.blocks1 {
+      n = v.data2
+    }
+    blocks = append(blocks, rest[:n])
+    ecs = append(ecs, reedSolomon(rest[:n], v.ec))
+    rest = rest[n:]
+  }
+  var out []byte
+  for i := 0; i < max(v.data1, v.data2); i++ {
+    for _, b := range blocks {
+      if i < len(b) {
+        out = append(out, b[i])
+      }
+    }
+  }
+  for i := 0; i < v.ec; i++ {
+    for _, ec := range ecs {
+      out = append(out, ec[i])
+    }
+  }
+  return out
+}
+
+/* Bits appended most significant first */
+type qrBits struct {
+  bytes []byte
+  n int
+}
+
+func (b *qrBits) append(value, count int) {
+  for i := count - 1; i >= 0; i-- {
+    if b.n%8 == 0 {
+      b.bytes = append(b.bytes, 0)
+    }
+    if value>>i&1 == 1 {
+      b.bytes[b.n/8] |= 0x80 >> (b.n % 8)
+    }
+    b.n++
+  }
+}
+
+/* Error correction codewords for data, over GF(256) with the polynomial 0x11D */
+func reedSolomon(data []byte, n int) []byte {
+  gen := []byte{1}
+  root := byte(1)
+  for i := 0; i < n; i++ {
+    next := make([]byte, len(gen)+1)
+    for j, c := range gen {
+      next[j] ^= c
+      next[j+1] ^= gfMul(c, root)
+    }
+    gen = next
+    root = gfMul(root, 2)
+  }
+  rem := make([]byte, n)
+  for _, b := range data {
+    factor := b ^ rem[0]
+    copy(rem, rem[1:])
+    rem[n-1] = 0
+    for j := 0; j < n; j++ {
+      rem[j] ^= gfMul(gen[j+1], factor)
+    }
+  }
+  return rem
+}
+
+func gfMul(x, y byte) byte {
+  var z byte
+  for i := 7; i >= 0; i-- {
+    hi := z & 0x80
+    z <<= 1
+    if hi != 0 {
+      z ^= 0x1D
+    }
+    if y>>i&1 == 1 {
+      z ^= x
+    }
+  }
+  return z
+}
+
+func (q *qrCode) set(row, col int, dark bool) {
+  q.modules[row][col] = dark
+  q.function[row][col] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+  for i := 0; i < q.size; i++ {
+    q.set(6, i, i%2 == 0)
+    q.set(i, 6, i%2 == 0)
+  }
+  for _, c := range [][2]int{{3, 3}, {3, q.size - 4}, {q.size - 4, 3}} {
+    for dr := -4; dr <= 4; dr++ {
+      for dc := -4; dc <= 4; dc++ {
+        r, col := c[0]+dr, c[1]+dc
+        if r < 0 || r >= q.size || col < 0 || col >= q.size {
+          continue
+        }
+        d := max(abs(dr), abs(dc))
+        q.set(r, col, d != 2 && d != 4)
+      }
+    }
+  }
+  align := qrVersions[version].align
+  for i, r := range align {
+    for j, c := range align {
+      last := len(align) - 1
+      if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+        continue // the finders are there
+      }
+      for dr := -2; dr <= 2; dr++ {
+        for dc := -2; dc <= 2; dc++ {
+          q.set(r+dr, c+dc, max(abs(dr), abs(dc)) != 1)
+        }
+      }
+    }
+  }
+  q.drawFormat(0) // reserves the space, drawn for real once the mask is known
+  if version >= 7 {
+    rem := version
+    for i := 0; i < 12; i++ {
+      rem = rem<<1 ^ (rem>>11)*0x1F25
+    }
+    bits := version<<12 | rem
+    for i := 0; i < 18; i++ {
+      dark := bits>>i&1 == 1
+      a, b := q.size-11+i%3, i/3
+      q.set(b, a, dark)
+      q.set(a, b, dark)
+    }
+  }
+}
+
+/* Format bits for level M and mask, both copies, and the dark module */
+func (q *qrCode) drawFormat(mask int) {
+  data := 0<<3 | mask // level M is 00
+  rem := data
+  for i := 0; i < 10; i++ {
+    rem = rem<<1 ^ (rem>>9)*0x537
+  }
+  bits := (data<<10 | rem) ^ 0x5412
+  bit := func(i int) bool { return bits>>i&1 == 1 }
+  for i := 0; i <= 5; i++ {
+    q.set(i, 8, bit(i))
+  }
+  q.set(7, 8, bit(6))
+  q.set(8, 8, bit(7))
+  q.set(8, 7, bit(8))
+  for i := 9; i < 15; i++ {
+    q.set(8, 14-i, bit(i))
+  }
+  for i := 0; i < 8; i++ {
+    q.set(8, q.size-1-i, bit(i))
+  }
+  for i := 8; i < 15; i++ {
+    q.set(q.size-15+i, 8, bit(i))
+  }
+  q.set(q.size-8, 8, true)
+}
+
+/* Place the codewords in the zigzag order, two columns at a time from the bottom right */
+func (q *qrCode) drawCodewords(data []byte) {
+  i := 0
+  for right := q.size - 1; right >= 1; right -= 2 {
+    if right == 6 {
+      right = 5 // skip the timing column
+    }
+    upward := (right+1)&2 == 0
+    for vert := 0; vert < q.size; vert++ {
+      row := vert
+      if upward {
+        row = q.size - 1 - vert
+      }
+      for j := 0; j < 2; j++ {
+        col := right - j
+        if q.function[row][col] || i >= len(data)*8 {
+          continue
+        }
+        q.modules[row][col] = data[i/8]>>(7-i%8)&1 == 1
+        i++
+      }
+    }
+  }
+}
+
+func (q *qrCode) applyMask(mask int) {
+  for r := 0; r < q.size; r++ {
+    for c := 0; c < q.size; c++ {
+      var flip bool
+      switch mask {
+      case 0:
+        flip = (r+c)%2 == 0
+      case 1:
+        flip = r%2 == 0
+      case 2:
+        flip = c%3 == 0
+      case 3:
+        flip = (r+c)%3 == 0
+      case 4:
+        flip = (r/2+c/3)%2 == 0
+      case 5:
+        flip = r*c%2+r*c%3 == 0
+      case 6:
+        flip = (r*c%2+r*c%3)%2 == 0
+      case 7:
+        flip = ((r+c)%2+r*c%3)%2 == 0
+      }
+      if flip && !q.function[r][c] {
+        q.modules[r][c] = !q.modules[r][c]
+      }
+    }
+  }
+}
+
+/* The standard's penalty score: long runs, 2x2 blocks, finder lookalikes
+  and an uneven balance of dark and light
+*/
+func (q *qrCode) penalty() int {
+  n := q.size
+  at := func(r, c int, transpose bool) bool {
+    if transpose {
+      return q.modules[c][r]
+    }
+    return q.modules[r][c]
+  }
+  score := 0
+  for _, t := range []bool{false, true} {
+    for r := 0; r < n; r++ {
+      run := 1
+      var line strings.Builder
+      for c := 0; c < n; c++ {
+        if at(r, c, t) {
+          line.WriteByte('1')
+        } else {
+          line.WriteByte('0')
+        }
+        if c > 0 && at(r, c, t) == at(r, c-1, t) {
+          run++
+          continue
+        }
+        if run >= 5 {
+          score += run - 2
+        }
+        run = 1
+      }
+      if run >= 5 {
+        score += run - 2
+      }
+      s := "0000" + line.String() + "0000"
+      score += 40 * (strings.Count(s, "10111010000") + strings.Count(s, "00001011101"))
+    }
+  }
+  dark := 0
+  for r := 0; r < n; r++ {
+    for c := 0; c < n; c++ {
+      if q.modules[r][c] {
+        dark++
+      }
+      if r > 0 && c > 0 {
+        v := q.modules[r][c]
+        if q.modules[r-1][c] == v && q.modules[r][c-1] == v && q.modules[r-1][c-1] == v {
+          score += 3
+        }
+      }
+    }
+  }
+  score += abs(dark*20-n*n*10) / (n * n) * 10
+  return score
+}
+
+func abs(x int) int {
+  if x < 0 {
+    return -x
+  }
+  return x
+}
+
+/* The code as an SVG image px pixels wide, with the usual 4 module margin */
+func qrSVG(data string, px int) (template.HTML, error) {
+  q, err := newQRCode([]byte(data))
+  if err != nil {
+    return "", err
+  }
+  var path strings.Builder
+  for r := 0; r < q.size; r++ {
+    for c := 0; c < q.size; c++ {
+      if q.modules[r][c] {
+        path.WriteString("M" + strconv.Itoa(c+4) + "," + strconv.Itoa(r+4) + "h1v1h-1z")
+      }
+    }
+  }
+  dim := strconv.Itoa(q.size + 8)
+  return template.HTML(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 ` + dim + ` ` + dim +
+    `" width="` + strconv.Itoa(px) + `" height="` + strconv.Itoa(px) + `" shape-rendering="crispEdges">` +
+    `<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="` + path.String() + `"/></svg>`), nil
+}
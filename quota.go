@@ -0,0 +1,140 @@
+package main
+
+import (
+  "errors"
+  "sort"
+  "strings"
+)
+
+/* Storage quotas
+  - Each namespace (the first part of a nested title, "" for top level pages)
+    may hold at most quotaPages pages and quotaBytes bytes
+  - Zero means no limit, which is the default
+  - Usage is worked out from the data directory on demand rather than kept in
+    a counter, so it can't drift from what is actually stored
+  - Bytes include the pages' attachments
+*/
+var quotaPages int
+var quotaBytes int64
+
+var errQuotaExceeded = errors.New("Namespace storage quota exceeded")
+
+/* Storage used by one namespace */
+type Usage struct {
+  Namespace string
+  Pages int
+  Bytes int64
+}
+
+/* Namespace a title belongs to, "" for top level pages */
+func namespaceOf(title string) string {
+  i := strings.Index(title, "/")
+  if i < 0 {
+    return ""
+  }
+  return title[:i]
+}
+
+/* Size of a stored page, 0 if it doesn't exist yet */
+func pageSize(title string) int64 {
+  info, err := store.Stat(title)
+  if err != nil {
+    return 0
+  }
+  return info.Size
+}
+
+/* Usage of every namespace that has at least one page */
+func namespaceUsage() (map[string]*Usage, error) {
+  titles, err := listPages()
+  if err != nil {
+    return nil, err
+  }
+  usage := map[string]*Usage{}
+  for _, title := range titles {
+    ns := namespaceOf(title)
+    u := usage[ns]
+    if u == nil {
+      u = &Usage{Namespace: ns}
+      usage[ns] = u
+    }
+    u.Pages++
+    u.Bytes += pageSize(title)
+    files, err := attachments.List(title)
+    if err != nil {
+      return nil, err
+    }
+    for _, a := range files {
+      u.Bytes += a.Size
+    }
+  }
+  return usage, nil
+}
+
+/* Usage sorted by namespace, for display */
+func sortedUsage() ([]*Usage, error) {
+  usage, err := namespaceUsage()
+  if err != nil {
+    return nil, err
+  }
+  list := make([]*Usage, 0, len(usage))
+  for _, u := range usage {
+    list = append(list, u)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Namespace < list[j].Namespace })
+  return list, nil
+}
+
+/* Check that saving size bytes as title keeps its namespace within quota
+  - The page's current size is subtracted first, so overwriting a page only
+    counts the difference and an existing page doesn't count towards the page limit
+*/
+func checkQuota(title string, size int64) error {
+  if quotaPages == 0 && quotaBytes == 0 {
+    return nil
+  }
+  usage, err := namespaceUsage()
+  if err != nil {
+    return err
+  }
+  u := usage[namespaceOf(title)]
+  if u == nil {
+    u = &Usage{}
+  }
+  pages, bytes := u.Pages, u.Bytes
+  if pageExists(title) {
+    pages--
+    bytes -= pageSize(title)
+  }
+  if quotaPages > 0 && pages+1 > quotaPages {
+    return errQuotaExceeded
+  }
+  if quotaBytes > 0 && bytes+size > quotaBytes {
+    return errQuotaExceeded
+  }
+  return nil
+}
+
+/* Check that storing size bytes as attachment name of page keeps its namespace within quota
+  - As with pages, a file being replaced only counts the difference
+*/
+func checkAttachmentQuota(page, name string, size int64) error {
+  if quotaBytes == 0 {
+    return nil
+  }
+  usage, err := namespaceUsage()
+  if err != nil {
+    return err
+  }
+  var bytes int64
+  if u := usage[namespaceOf(page)]; u != nil {
+    bytes = u.Bytes
+  }
+  if a, err := attachments.Stat(page, name); err == nil {
+    bytes -= a.Size
+  }
+  if bytes+size > quotaBytes {
+    return errQuotaExceeded
+  }
+  return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* API rate limits
+  - Requests to /api/ are counted in fixed windows of -api-quota-window, per
+    token for requests with one (see apitoken.go), per user for signed in
+    browsers and per address for everyone else
+  - A token may have its own quota, otherwise it and users get -api-quota;
+    anonymous clients get -api-quota-anon. 0 means no limit
+  - Responses say where the caller stands:
+      X-RateLimit-Limit      requests allowed in the window
+      X-RateLimit-Remaining  requests left in it
+      X-RateLimit-Reset      when the next window starts, in Unix seconds
+    and once the quota is used up requests get a 429 with Retry-After
+  - Counts are kept in memory, so each instance counts its own requests
+*/
+var apiQuota = 5000
+var apiQuotaAnon = 500
+var apiQuotaWindow = time.Hour
+
+var apiCounts = struct {
+  sync.Mutex
+  window time.Time // start of the current window
+  m map[string]int
+}{m: map[string]int{}}
+
+/* Wrapper counting API requests against the caller's quota */
+func apiRateLimit(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !strings.HasPrefix(r.URL.Path, "/api/") {
+      next.ServeHTTP(w, r)
+      return
+    }
+    key, limit, err := apiCaller(r)
+    if err != nil {
+      writeJSONError(w, http.StatusUnauthorized, err.Error())
+      return
+    }
+    if limit <= 0 {
+      next.ServeHTTP(w, r)
+      return
+    }
+    used, reset := countAPIRequest(key)
+    h := w.Header()
+    h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+    h.Set("X-RateLimit-Remaining", strconv.Itoa(max(0, limit-used)))
+    h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+    if used > limit {
+      h.Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+      writeJSONError(w, http.StatusTooManyRequests, "API rate limit of "+strconv.Itoa(limit)+" requests per "+apiQuotaWindow.String()+" exceeded")
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+/* Who is calling the API, as "token:{hash}", "user:{name}" or "ip:{address}",
+  and their quota; err is set for a token that isn't valid
+*/
+func apiCaller(r *http.Request) (key string, limit int, err error) {
+  t, hash, ok, err := requestToken(r)
+  switch {
+  case err != nil:
+    return "", 0, err
+  case ok:
+    if t.Quota != 0 {
+      return "token:" + hash, t.Quota, nil
+    }
+    return "token:" + hash, apiQuota, nil
+  }
+  if u := currentUser(r); u != nil {
+    return "user:" + u.Name, apiQuota, nil
+  }
+  return "ip:" + clientIP(r), apiQuotaAnon, nil
+}
+
+/* Count a request for key, returning how many it has made this window and
+  when the window ends
+*/
+func countAPIRequest(key string) (int, time.Time) {
+  apiCounts.Lock()
+  defer apiCounts.Unlock()
+  start := time.Now().Truncate(apiQuotaWindow)
+  if !start.Equal(apiCounts.window) {
+    apiCounts.window = start
+    apiCounts.m = map[string]int{}
+  }
+  apiCounts.m[key]++
+  return apiCounts.m[key], start.Add(apiQuotaWindow)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+  "crypto/tls"
+  "log"
+  "net"
+  "net/http"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "sync/atomic"
+)
+
+/* HTTP to HTTPS redirects
+  - With -tls-cert and -tls-key the wiki serves HTTPS, and -redirect-addr
+    (e.g. :80) runs a plain HTTP listener next to it that sends every request
+    to the same URL on the HTTPS site with a 301
+  - /.well-known/acme-challenge/{token} is answered from -acme-dir instead,
+    so an ACME client using webroot mode (certbot --webroot) can get and
+    renew the certificate while the wiki is running
+  - httpsPort is left out of the redirect when it's 443
+  - The certificate is read again on a reload (see reload.go), so a renewed
+    one is picked up without a restart
+*/
+var acmeDir string
+
+/* The TLS certificate and the files it came from, from -tls-cert and -tls-key */
+var tlsFiles struct{ cert, key string }
+var certificate atomic.Pointer[tls.Certificate]
+
+func loadCertificate() error {
+  cert, err := tls.LoadX509KeyPair(tlsFiles.cert, tlsFiles.key)
+  if err != nil {
+    return err
+  }
+  certificate.Store(&cert)
+  return nil
+}
+
+/* Serve HTTPS on ln with the current certificate */
+func serveTLS(ln net.Listener, handler http.Handler) error {
+  if err := loadCertificate(); err != nil {
+    return err
+  }
+  srv := &http.Server{Handler: handler, TLSConfig: &tls.Config{
+    GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return certificate.Load(), nil },
+  }}
+  return srv.ServeTLS(ln, "", "")
+}
+
+var acmeToken = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func redirectHandler(httpsPort string) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/"); ok && acmeDir != "" {
+      if !acmeToken.MatchString(token) {
+        http.NotFound(w, r)
+        return
+      }
+      w.Header().Set("Content-Type", "text/plain")
+      http.ServeFile(w, r, filepath.Join(acmeDir, token))
+      return
+    }
+    host := r.Host
+    if h, _, err := net.SplitHostPort(host); err == nil {
+      host = h
+    }
+    if httpsPort != "" && httpsPort != "443" {
+      host = net.JoinHostPort(host, httpsPort)
+    }
+    http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+  })
+}
+
+/* Run the redirect listener on addr, for the HTTPS site listening on listenSpec */
+func serveRedirects(addr, listenSpec string) {
+  _, port, err := net.SplitHostPort(listenSpec)
+  if err != nil {
+    port = "" // a socket: a proxy in front has the public port
+  }
+  log.Fatal(http.ListenAndServe(addr, redirectHandler(port)))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "sync"
+)
+
+/* Redirects from renamed titles
+  - Each rename records old title -> new title in data/redirects.json, and a
+    page that's renamed again has its older titles moved on to the newest,
+    so there's never more than one hop
+  - While no page has the old title, viewing, printing, or reading the raw
+    text, source or blame of it is a 301 to the same thing under the new one,
+    so bookmarks and search results keep working. A page created under the old
+    title takes it back
+  - The view page gives its canonical URL (see pageCardFor), so a page reached
+    through the home page or with a query string is indexed once
+*/
+var redirects = struct {
+  sync.RWMutex
+  path string
+  to map[string]string
+}{path: "data/redirects.json", to: map[string]string{}}
+
+func loadRedirects() error {
+  data, err := ioutil.ReadFile(redirects.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  m := map[string]string{}
+  if err := json.Unmarshal(data, &m); err != nil {
+    return err
+  }
+  redirects.Lock()
+  redirects.to = m
+  redirects.Unlock()
+  return nil
+}
+
+/* Record that by moved the page at from to to */
+func recordRename(from, to, by string) error {
+  redirects.Lock()
+  defer redirects.Unlock()
+  m := map[string]string{}
+  for old, target := range redirects.to {
+    if target == from {
+      target = to
+    }
+    if old != to {
+      m[old] = target
+    }
+  }
+  m[from] = to
+  data, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(redirects.path, data, 0600); err != nil {
+    return err
+  }
+  redirects.to = m
+  settingsChanged("redirects")
+  auditActivity("page-renamed", by, to, from)
+  return nil
+}
+
+/* Where a page missing at title went, if it was renamed */
+func renamedTo(title string) (string, bool) {
+  redirects.RLock()
+  to, ok := redirects.to[title]
+  redirects.RUnlock()
+  return to, ok && !pageExists(title)
+}
+
+/* Send the request on to title's new name under action if it was renamed,
+  keeping the query; reports whether it did
+*/
+func redirectRenamed(w http.ResponseWriter, r *http.Request, action, title string) bool {
+  to, ok := renamedTo(title)
+  if !ok {
+    return false
+  }
+  u := pageURL(action, to)
+  if r.URL.RawQuery != "" {
+    u += "?" + r.URL.RawQuery
+  }
+  http.Redirect(w, r, u, http.StatusMovedPermanently)
+  return true
+}
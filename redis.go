@@ -0,0 +1,188 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "strconv"
+  "sync"
+  "time"
+)
+
+/* Minimal Redis client
+  - Speaks the RESP protocol directly, enough for the commands the wiki uses
+  - Keeps a small pool of idle connections; a connection that errors is dropped
+*/
+type redisClient struct {
+  addr string
+  mu sync.Mutex
+  idle []*redisConn
+}
+
+type redisConn struct {
+  conn net.Conn
+  r *bufio.Reader
+}
+
+/* A nil bulk reply, e.g. GET of a missing key */
+var errRedisNil = errors.New("redis: nil")
+
+func newRedisClient(addr string) *redisClient {
+  return &redisClient{addr: addr}
+}
+
+func (c *redisClient) get() (*redisConn, error) {
+  c.mu.Lock()
+  if n := len(c.idle); n > 0 {
+    rc := c.idle[n-1]
+    c.idle = c.idle[:n-1]
+    c.mu.Unlock()
+    return rc, nil
+  }
+  c.mu.Unlock()
+  conn, err := net.DialTimeout("tcp", c.addr, backendTimeout())
+  if err != nil {
+    return nil, err
+  }
+  return &redisConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *redisClient) put(rc *redisConn) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if len(c.idle) < 8 {
+    c.idle = append(c.idle, rc)
+    return
+  }
+  rc.conn.Close()
+}
+
+/* How long one Redis call may take: 5 seconds, or less if the request timeout is */
+func backendTimeout() time.Duration {
+  if requestTimeout > 0 && requestTimeout < 5*time.Second {
+    return requestTimeout
+  }
+  return 5 * time.Second
+}
+
+/* Run one command, returning a string, int64, []interface{} or nil */
+func (c *redisClient) do(args ...string) (interface{}, error) {
+  rc, err := c.get()
+  if err != nil {
+    return nil, err
+  }
+  rc.conn.SetDeadline(time.Now().Add(backendTimeout()))
+  if err := rc.send(args...); err != nil {
+    rc.conn.Close()
+    return nil, err
+  }
+  reply, err := rc.read()
+  if err != nil {
+    if _, isServerErr := err.(redisError); !isServerErr && err != errRedisNil {
+      rc.conn.Close()
+      return nil, err
+    }
+  }
+  c.put(rc)
+  return reply, err
+}
+
+/* Error reply from the server */
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (rc *redisConn) send(args ...string) error {
+  buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+  for _, a := range args {
+    buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"...)
+    buf = append(buf, a...)
+    buf = append(buf, "\r\n"...)
+  }
+  _, err := rc.conn.Write(buf)
+  return err
+}
+
+func (rc *redisConn) read() (interface{}, error) {
+  line, err := rc.r.ReadString('\n')
+  if err != nil {
+    return nil, err
+  }
+  if len(line) < 3 {
+    return nil, errors.New("redis: short reply")
+  }
+  body := line[1 : len(line)-2]
+  switch line[0] {
+  case '+':
+    return body, nil
+  case '-':
+    return nil, redisError(body)
+  case ':':
+    return strconv.ParseInt(body, 10, 64)
+  case '$':
+    n, err := strconv.Atoi(body)
+    if err != nil {
+      return nil, err
+    }
+    if n < 0 {
+      return nil, errRedisNil
+    }
+    data := make([]byte, n+2)
+    if _, err := io.ReadFull(rc.r, data); err != nil {
+      return nil, err
+    }
+    return string(data[:n]), nil
+  case '*':
+    n, err := strconv.Atoi(body)
+    if err != nil {
+      return nil, err
+    }
+    if n < 0 {
+      return nil, errRedisNil
+    }
+    list := make([]interface{}, n)
+    for i := range list {
+      v, err := rc.read()
+      if err != nil && err != errRedisNil {
+        return nil, err
+      }
+      list[i] = v
+    }
+    return list, nil
+  }
+  return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+/* Subscribe to channel on a connection of its own, calling fn for each message
+  - Blocks until the connection fails, returning the error; ready is called
+    once the subscription is confirmed
+*/
+func (c *redisClient) subscribe(channel string, ready func(), fn func(msg string)) error {
+  conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+  if err := rc.send("SUBSCRIBE", channel); err != nil {
+    return err
+  }
+  if _, err := rc.read(); err != nil {
+    return err
+  }
+  ready()
+  for {
+    reply, err := rc.read()
+    if err != nil {
+      return err
+    }
+    // Pushed messages are ["message", channel, payload]
+    if parts, ok := reply.([]interface{}); ok && len(parts) == 3 && parts[0] == "message" {
+      if msg, ok := parts[2].(string); ok {
+        fn(msg)
+      }
+    }
+  }
+}
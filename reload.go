@@ -0,0 +1,86 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "os"
+  "os/signal"
+  "syscall"
+)
+
+/* Reloading configuration
+  - On SIGHUP, or POST /admin/reload, the templates are parsed again and the
+    accounts, groups, branding, interwiki, redirect, short link and feature
+    files and the TLS certificate are read again, so changes made to them on
+    disk take effect without a restart, and the access log is reopened
+  - Requests already running finish with what they started with. Templates
+    that don't parse leave the old ones in place
+  - Command line flags are read once, at start up; changing those still
+    takes a restart
+*/
+func reloadConfig() error {
+  t, err := parseTemplates()
+  if err != nil {
+    return err
+  }
+  if err := users.load(); err != nil {
+    return err
+  }
+  if err := loadBranding(); err != nil {
+    return err
+  }
+  if err := loadInterwiki(); err != nil {
+    return err
+  }
+  if err := loadRedirects(); err != nil {
+    return err
+  }
+  if err := loadShortLinks(); err != nil {
+    return err
+  }
+  if err := loadGroups(); err != nil {
+    return err
+  }
+  if err := loadTokens(); err != nil {
+    return err
+  }
+  if err := loadFeatures(); err != nil {
+    return err
+  }
+  if err := accessLog.reload(); err != nil {
+    return err
+  }
+  if tlsFiles.cert != "" {
+    if err := loadCertificate(); err != nil {
+      return err
+    }
+  }
+  templates.Store(t)
+  return nil
+}
+
+/* Reload on every SIGHUP, started from main */
+func reloadOnHangup() {
+  ch := make(chan os.Signal, 1)
+  signal.Notify(ch, syscall.SIGHUP)
+  for range ch {
+    if err := reloadConfig(); err != nil {
+      log.Printf("reload: %v", err)
+    } else {
+      log.Printf("reloaded configuration")
+    }
+  }
+}
+
+/* POST /admin/reload */
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  if err := reloadConfig(); err != nil {
+    http.Error(w, "Reload failed: "+err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
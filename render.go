@@ -0,0 +1,201 @@
+package main
+
+import (
+  "bytes"
+  "encoding/csv"
+  "html/template"
+  "path"
+  "regexp"
+  "strings"
+  "unicode/utf8"
+)
+
+/* Render a page body to HTML
+  - The body is plain text: blank lines separate paragraphs and single newlines
+    become line breaks
+  - [[File:Title/name.png]] shows an attachment: images inline, other files
+    as a link, and [[Embed:url]] a video from an allowed site (see embed.go)
+  - A line that is just a URL from an oEmbed provider becomes its embed (see
+    oembed.go), and other URLs become links (see links.go)
+  - ```csv or ```tsv up to a closing ``` is a table (see renderTable)
+  - Everything else is escaped, so user text can never inject markup
+  - Used by the view page and the live preview so the two always agree
+*/
+func renderBody(body []byte) template.HTML {
+  var buf bytes.Buffer
+  renderBlocks(&buf, body, nil)
+  return template.HTML(buf.String())
+}
+
+/* Render body into buf, calling spill (unless nil) after each paragraph and
+  table so that a page being streamed can send what's done (see stream.go)
+*/
+func renderBlocks(buf *bytes.Buffer, body []byte, spill func()) {
+  lines := strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n")
+  start := 0
+  for i := 0; i < len(lines); i++ {
+    comma, ok := tableFences[strings.TrimSpace(lines[i])]
+    if !ok {
+      continue
+    }
+    end := i + 1
+    for end < len(lines) && strings.TrimSpace(lines[end]) != "```" {
+      end++
+    }
+    if end == len(lines) {
+      break // never closed, so it's just text
+    }
+    renderParagraphs(buf, lines[start:i], spill)
+    renderTable(buf, lines[i+1:end], comma)
+    if spill != nil {
+      spill()
+    }
+    i, start = end, end+1
+  }
+  renderParagraphs(buf, lines[start:], spill)
+}
+
+/* Paragraphs of text, separated by blank lines */
+func renderParagraphs(buf *bytes.Buffer, lines []string, spill func()) {
+  for _, para := range strings.Split(strings.Join(lines, "\n"), "\n\n") {
+    para = strings.Trim(para, "\n")
+    if strings.TrimSpace(para) == "" {
+      continue
+    }
+    buf.WriteString("<p>")
+    for i, line := range strings.Split(para, "\n") {
+      if i > 0 {
+        buf.WriteString("<br>\n")
+      }
+      renderLine(buf, line)
+    }
+    buf.WriteString("</p>\n")
+    if spill != nil {
+      spill()
+    }
+  }
+}
+
+/* Fences opening a table block, with the field separator */
+var tableFences = map[string]rune{"```csv": ',', "```tsv": '\t'}
+
+/* A CSV or TSV block as a table, the first row being the header
+  - Tables are sortable by clicking a header (static/sort.js)
+  - Data that doesn't parse is shown as it is
+*/
+func renderTable(buf *bytes.Buffer, lines []string, comma rune) {
+  r := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+  r.Comma, r.FieldsPerRecord, r.LazyQuotes = comma, -1, true
+  rows, err := r.ReadAll()
+  if err != nil || len(rows) == 0 {
+    buf.WriteString("<pre>" + template.HTMLEscapeString(strings.Join(lines, "\n")) + "</pre>\n")
+    return
+  }
+  buf.WriteString(`<table class="sortable">` + "\n<thead><tr>")
+  for _, cell := range rows[0] {
+    buf.WriteString("<th>" + template.HTMLEscapeString(cell) + "</th>")
+  }
+  buf.WriteString("</tr></thead>\n<tbody>\n")
+  for _, row := range rows[1:] {
+    buf.WriteString("<tr>")
+    for _, cell := range row {
+      buf.WriteString("<td>" + template.HTMLEscapeString(cell) + "</td>")
+    }
+    buf.WriteString("</tr>\n")
+  }
+  buf.WriteString("</tbody>\n</table>\n")
+}
+
+/* [[Name:argument]] directives, rendered by the function for Name */
+var directive = regexp.MustCompile(`\[\[([a-zA-Z]+):([^\]]+)\]\]`)
+
+var directives = map[string]func(arg string) (string, bool){
+  "File": renderFileRef,
+  "Embed": renderEmbed,
+}
+
+/* Write one line of text, turning directives into HTML
+  - A name that isn't a directive is tried as an interwiki prefix (see interwiki.go)
+  - A directive that is unknown or whose function rejects its argument is
+    left as text
+*/
+func renderLine(buf *bytes.Buffer, line string) {
+  if html, ok := renderOEmbed(line); ok {
+    buf.WriteString(html)
+    return
+  }
+  last := 0
+  for _, m := range directive.FindAllStringSubmatchIndex(line, -1) {
+    var html string
+    var ok bool
+    if fn := directives[line[m[2]:m[3]]]; fn != nil {
+      html, ok = fn(line[m[4]:m[5]])
+    } else {
+      html, ok = renderInterwiki(line[m[2]:m[3]], line[m[4]:m[5]])
+    }
+    if !ok {
+      continue
+    }
+    writeLinkedText(buf, line[last:m[0]])
+    buf.WriteString(html)
+    last = m[1]
+  }
+  writeLinkedText(buf, line[last:])
+}
+
+/* Image extensions shown inline by [[File:...]] */
+var imageExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true}
+
+/* [[File:Title/name]]: an image, or a link for other files */
+func renderFileRef(arg string) (string, bool) {
+  page, name, ok := attachmentPath("/"+arg, "/")
+  if !ok {
+    return "", false
+  }
+  u := template.HTMLEscapeString(attachmentURL(page, name))
+  if imageExtensions[strings.ToLower(path.Ext(name))] {
+    return `<img src="` + u + `" alt="` + name + `">`, true
+  }
+  return `<a href="` + u + `">` + name + `</a>`, true
+}
+
+/* Markup for an attachment, as the editor inserts it */
+func fileMarkup(page, name string) string {
+  return "[[File:" + page + "/" + name + "]]"
+}
+
+/* Counts shown with a page
+  - Chars counts characters, not bytes; ReadingMinutes assumes
+    wordsPerMinute and rounds up, so any text takes at least a minute
+*/
+type pageStats struct {
+  Words int `json:"words"`
+  Chars int `json:"chars"`
+  ReadingMinutes int `json:"reading_minutes"`
+}
+
+const wordsPerMinute = 200
+
+func bodyStats(body []byte) pageStats {
+  s := pageStats{Words: len(strings.Fields(string(body))), Chars: utf8.RuneCount(body)}
+  s.ReadingMinutes = (s.Words + wordsPerMinute - 1) / wordsPerMinute
+  return s
+}
+
+/* The first paragraph of body as one line of plain text, cut to at most
+  max characters with an ellipsis
+*/
+func firstParagraph(body []byte, max int) string {
+  text := strings.Replace(string(body), "\r\n", "\n", -1)
+  for _, para := range strings.Split(text, "\n\n") {
+    para = strings.Join(strings.Fields(para), " ")
+    if para == "" {
+      continue
+    }
+    if utf8.RuneCountInString(para) > max {
+      para = string([]rune(para)[:max-1]) + "…"
+    }
+    return para
+  }
+  return ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+  "errors"
+  "time"
+)
+
+/* Read replica (-replica-dir)
+  - A copy of the data directory kept up to date by something outside the
+    wiki (rsync -a, file system replication), on a disk closer to or less
+    busy than the primary's. Page views are read from it, everything else,
+    and every write, from the primary
+  - A view first compares when the page was last changed in both; the
+    replica's copy is used if it's at most -replica-max-lag behind, and
+    otherwise, or if it's missing or unreadable, the primary's. So the copy
+    has to keep modification times. With the default of 0 a view never
+    shows an older version than the primary holds
+  - Only the page bodies come from it; history, attachments and metadata
+    are read from the primary
+*/
+var replica PageStore
+
+var replicaMaxLag time.Duration
+
+/* Set up -replica-dir, after the storage */
+func configureReplica(dir string) error {
+  if dir == "" {
+    return nil
+  }
+  fs, ok := store.(*fileStore)
+  if !ok {
+    return errors.New("-replica-dir needs the file store")
+  }
+  r := newFileStore(dir)
+  r.codec = fs.codec
+  replica = r
+  return nil
+}
+
+/* Load a page for viewing, from the replica when it's recent enough */
+func viewPage(title string) (*Page, error) {
+  if replica == nil {
+    return loadPage(title)
+  }
+  ri, err := replica.Stat(title)
+  if err == nil {
+    pi, err := store.Stat(title)
+    if err != nil {
+      return nil, err
+    }
+    if pi.Modified.Sub(ri.Modified) <= replicaMaxLag {
+      if body, err := replica.Load(title); err == nil {
+        return &Page{Title: title, Body: body, Revision: latestRevision(title)}, nil
+      }
+    }
+  }
+  return loadPage(title)
+}
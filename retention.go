@@ -0,0 +1,99 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "log"
+  "strconv"
+  "time"
+)
+
+/* Revision retention
+  - keepRevisions keeps the newest N revisions of each page, keepDays keeps
+    revisions younger than M days; with both set a revision is kept if either
+    would keep it. Zero means no limit, and with neither set nothing is pruned
+  - The latest revision is always kept, it's the page as it stands, and so is
+    the published revision of a draft
+  - pruneHistory runs every pruneInterval in the background, and admins can
+    run it at once as the prune-history job
+*/
+var keepRevisions int
+var keepDays int
+var pruneInterval = time.Hour
+
+/* Whether any retention limit is configured */
+func retentionEnabled() bool {
+  return keepRevisions > 0 || keepDays > 0
+}
+
+/* Revisions of revs (oldest first) that the retention policy drops */
+func expiredRevisions(revs []Revision, now time.Time) []Revision {
+  expired := []Revision{}
+  cutoff := now.AddDate(0, 0, -keepDays)
+  for i, rev := range revs {
+    fromNewest := len(revs) - 1 - i
+    if fromNewest == 0 {
+      break
+    }
+    keptByCount := keepRevisions > 0 && fromNewest < keepRevisions
+    keptByAge := keepDays > 0 && rev.Time.After(cutoff)
+    if !keptByCount && !keptByAge {
+      expired = append(expired, rev)
+    }
+  }
+  return expired
+}
+
+/* Delete every revision the retention policy drops, returning how many went */
+func pruneHistory() (int, error) {
+  titles, err := history.Titles()
+  if err != nil {
+    return 0, err
+  }
+  pruned := 0
+  now := time.Now()
+  for _, title := range titles {
+    revs, err := history.Revisions(title)
+    if err != nil {
+      return pruned, err
+    }
+    m, err := pageMeta.Load(title)
+    if err != nil {
+      return pruned, err
+    }
+    for _, rev := range expiredRevisions(revs, now) {
+      if m.Draft && rev.Number == m.Published {
+        continue
+      }
+      if err := history.DeleteRevision(title, rev.Number); err != nil {
+        return pruned, err
+      }
+      pruned++
+    }
+  }
+  return pruned, nil
+}
+
+/* Background compaction loop, started from main when retention is enabled */
+func runPruner() {
+  for {
+    if n, err := pruneHistory(); err != nil {
+      log.Printf("pruning history: %v", err)
+    } else if n > 0 {
+      log.Printf("pruned %d old revisions", n)
+    }
+    time.Sleep(pruneInterval)
+  }
+}
+
+/* The prune-history job */
+func pruneHistoryJob(ctx context.Context, j *Job) (string, error) {
+  if !retentionEnabled() {
+    return "", errors.New("no retention limit is set: see -keep-revisions and -keep-days")
+  }
+  n, err := pruneHistory()
+  if err != nil {
+    return "", err
+  }
+  return "pruned " + strconv.Itoa(n) + " old revisions", nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Review and approval
+  - With -review, a save to a protected page doesn't change it: it is kept
+    as a proposal, and an admin other than whoever made it reviews the diff
+    at /review/{title} and approves or rejects it. The proposer can withdraw it
+  - Approving saves the proposal as the next revision, authored by whoever
+    proposed it. One made against an older revision is merged with the
+    changes since, and can't be approved if they overlap
+  - Admins protect and unprotect pages from the view page (see protect.go)
+  - Only the edit form can propose; other ways of saving get errNeedsReview
+*/
+var reviewMode bool
+
+var errNeedsReview = errors.New("changes to this page need review: propose them from the edit form")
+
+/* Whether saves to a page with metadata m have to go through review */
+func needsReview(m PageMeta) bool {
+  return reviewMode && m.Protected
+}
+
+/* A change waiting for review */
+type Proposal struct {
+  ID int
+  Base int // revision it was made against
+  Author string
+  Time time.Time
+  Minor bool
+  Body []byte `json:"-"`
+}
+
+type ProposalStore interface {
+  /* Store a proposal for title, setting p.ID */
+  Propose(title string, p *Proposal) error
+  /* Proposals for title, oldest first */
+  Proposals(title string) ([]Proposal, error)
+  Load(title string, id int) (*Proposal, error)
+  Delete(title string, id int) error
+}
+
+var proposals ProposalStore = newFileProposals("data/proposals")
+
+/* File proposals
+  - dir/{storage name}/{id}.txt holds the body, written with the same codec as
+    the history, and {id}.json the rest
+*/
+type fileProposals struct {
+  dir string
+  mu sync.Mutex
+  codec *fileCodec
+}
+
+func newFileProposals(dir string) *fileProposals {
+  return &fileProposals{dir: dir, codec: &fileCodec{}}
+}
+
+func (s *fileProposals) pageDir(title string) string {
+  return filepath.Join(s.dir, storageName(title))
+}
+
+func (s *fileProposals) Propose(title string, p *Proposal) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  dir := s.pageDir(title)
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  existing, err := s.Proposals(title)
+  if err != nil {
+    return err
+  }
+  p.ID = 1
+  if len(existing) > 0 {
+    p.ID = existing[len(existing)-1].ID + 1
+  }
+  meta, err := json.Marshal(p)
+  if err != nil {
+    return err
+  }
+  id := strconv.Itoa(p.ID)
+  if err := s.codec.write(filepath.Join(dir, id+".txt"), p.Body); err != nil {
+    return err
+  }
+  return ioutil.WriteFile(filepath.Join(dir, id+".json"), meta, 0600)
+}
+
+func (s *fileProposals) Proposals(title string) ([]Proposal, error) {
+  files, err := filepath.Glob(filepath.Join(s.pageDir(title), "*.json"))
+  if err != nil {
+    return nil, err
+  }
+  out := []Proposal{}
+  for _, f := range files {
+    data, err := ioutil.ReadFile(f)
+    if err != nil {
+      return nil, err
+    }
+    var p Proposal
+    if err := json.Unmarshal(data, &p); err != nil {
+      return nil, err
+    }
+    out = append(out, p)
+  }
+  sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+  return out, nil
+}
+
+func (s *fileProposals) Load(title string, id int) (*Proposal, error) {
+  base := filepath.Join(s.pageDir(title), strconv.Itoa(id))
+  data, err := ioutil.ReadFile(base + ".json")
+  if err != nil {
+    return nil, err
+  }
+  var p Proposal
+  if err := json.Unmarshal(data, &p); err != nil {
+    return nil, err
+  }
+  if p.Body, err = s.codec.read(base + ".txt"); err != nil {
+    return nil, err
+  }
+  return &p, nil
+}
+
+func (s *fileProposals) Delete(title string, id int) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  base := filepath.Join(s.pageDir(title), strconv.Itoa(id))
+  if err := os.Remove(base + ".json"); err != nil {
+    return err
+  }
+  os.Remove(base + ".txt")
+  os.Remove(s.pageDir(title)) // only goes once it's empty
+  return nil
+}
+
+/* One line of a diff: Op is "+" for added, "-" for removed and " " for kept */
+type diffLine struct {
+  Op string
+  Text string
+}
+
+/* Line diff turning a into b */
+func diffLines(a, b string) []diffLine {
+  x, y := splitLines(a), splitLines(b)
+  match := matchLines(x, y)
+  var out []diffLine
+  j := 0
+  for i, m := range match {
+    if m < 0 {
+      out = append(out, diffLine{"-", strings.TrimRight(x[i], "\r\n")})
+      continue
+    }
+    for ; j < m; j++ {
+      out = append(out, diffLine{"+", strings.TrimRight(y[j], "\r\n")})
+    }
+    out = append(out, diffLine{" ", strings.TrimRight(x[i], "\r\n")})
+    j++
+  }
+  for ; j < len(y); j++ {
+    out = append(out, diffLine{"+", strings.TrimRight(y[j], "\r\n")})
+  }
+  return out
+}
+
+/* A proposal with its diff against the page as it stands */
+type reviewItem struct {
+  Proposal
+  Diff []diffLine
+  Own bool // the reader proposed it, so can't approve it
+  Admin bool // the reader can approve and reject
+}
+
+type reviewData struct {
+  Title string
+  Items []reviewItem
+  Zone *time.Location
+  Error string
+}
+
+/* Store the edit in p as a proposal made against revision base */
+func propose(p *Page, base int, author string, minor bool) error {
+  if err := proposals.Propose(p.Title, &Proposal{Base: base, Author: author, Time: time.Now().UTC(), Minor: minor, Body: p.Body}); err != nil {
+    return err
+  }
+  for _, u := range users.all() {
+    if u.Admin && u.Name != author {
+      notify(u.Name, "review", p.Title, author, author+" proposed a change to "+p.Title)
+    }
+  }
+  return nil
+}
+
+/* /review/{title}: pending proposals, and POST to approve or reject one */
+func reviewHandler(w http.ResponseWriter, r *http.Request, title string) {
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+pageURL("review", title), http.StatusFound)
+    return
+  }
+  if ok, err := pageReadableBy(title, u); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  } else if !ok {
+    http.NotFound(w, r)
+    return
+  }
+  data := &reviewData{Title: title, Zone: viewerZone(r)}
+  status := http.StatusOK
+  if r.Method == http.MethodPost {
+    id, _ := strconv.Atoi(r.FormValue("id"))
+    var err error
+    switch r.FormValue("action") {
+    case "approve":
+      err = approve(title, id, u)
+    case "reject":
+      err = reject(title, id, u)
+    default:
+      err = errors.New("unknown action")
+    }
+    if err == nil {
+      http.Redirect(w, r, pageURL("review", title), http.StatusFound)
+      return
+    }
+    data.Error, status = err.Error(), reviewErrorStatus(err)
+  }
+  current, err := store.Load(title)
+  if err != nil && !os.IsNotExist(err) {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  list, err := proposals.Proposals(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  for _, p := range list {
+    full, err := proposals.Load(title, p.ID)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    data.Items = append(data.Items, reviewItem{Proposal: p, Diff: diffLines(string(current), string(full.Body)), Own: p.Author == u.Name, Admin: u.Admin})
+  }
+  w.WriteHeader(status)
+  renderTemplate(w, "review", data)
+}
+
+var errOwnProposal = errors.New("a proposal has to be approved by someone else")
+var errProposalConflict = errors.New("this proposal overlaps with changes saved since; reject it and propose again")
+
+func reviewErrorStatus(err error) int {
+  switch {
+  case os.IsNotExist(err):
+    return http.StatusNotFound
+  case err == errOwnProposal:
+    return http.StatusForbidden
+  case err == errProposalConflict:
+    return http.StatusConflict
+  }
+  return saveErrorStatus(err)
+}
+
+/* Drop proposal id of title: admins can reject any, others withdraw their own */
+func reject(title string, id int, u *User) error {
+  prop, err := proposals.Load(title, id)
+  if err != nil {
+    return err
+  }
+  if prop.Author != u.Name {
+    if err := authorizeWrite(title, u); err != nil {
+      return err
+    }
+  }
+  if err := proposals.Delete(title, id); err != nil {
+    return err
+  }
+  if prop.Author != u.Name {
+    notify(prop.Author, "review", title, u.Name, u.Name+" rejected your change to "+title)
+  }
+  return nil
+}
+
+/* Save proposal id of title as its next revision, approved by reviewer */
+func approve(title string, id int, reviewer *User) error {
+  prop, err := proposals.Load(title, id)
+  if err != nil {
+    return err
+  }
+  if prop.Author == reviewer.Name {
+    return errOwnProposal
+  }
+  if err := authorizeWrite(title, reviewer); err != nil {
+    return err
+  }
+  p := &Page{Title: title, Body: prop.Body}
+  if _, conflict, err := mergeStale(p, prop.Base); err != nil {
+    return err
+  } else if conflict {
+    return errProposalConflict
+  }
+  // Approval is the review, so only the other checks apply
+  if err := checkSave(p); err != nil {
+    return err
+  }
+  if err := p.save(prop.Author, prop.Minor); err != nil {
+    return err
+  }
+  if err := proposals.Delete(title, id); err != nil {
+    return err
+  }
+  notify(prop.Author, "review", title, reviewer.Name, reviewer.Name+" approved your change to "+title)
+  return nil
+}
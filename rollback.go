@@ -0,0 +1,123 @@
+package main
+
+import (
+  "net/http"
+  "os"
+  "strings"
+  "time"
+)
+
+/* Mass rollback
+  - Reverts every page whose latest revisions are by one author (a user name,
+    or the IP address of anonymous edits) within a time window, to the last
+    revision before them. A page they created is deleted
+  - A page someone else edited since is skipped and listed, so that later
+    work isn't thrown away; those need sorting out by hand
+  - Admins run it from /admin; "preview" lists what would change first
+*/
+type rollbackResult struct {
+  Title string
+  Revision int // reverted to; 0 when the page is deleted
+  Skipped bool // edited by someone else since
+}
+
+type rollbackData struct {
+  Author string
+  From, To time.Time
+  Zone *time.Location
+  DryRun bool
+  Results []rollbackResult
+}
+
+/* Work out, and if apply is set carry out, the rollback of author's edits in [from, to] */
+func rollback(author string, from, to time.Time, by string, apply bool) ([]rollbackResult, error) {
+  titles, err := history.Titles()
+  if err != nil {
+    return nil, err
+  }
+  in := func(rev Revision) bool {
+    return rev.Author == author && !rev.Time.Before(from) && !rev.Time.After(to)
+  }
+  results := []rollbackResult{}
+  for _, title := range titles {
+    revs, err := history.Revisions(title)
+    if err != nil {
+      return results, err
+    }
+    touched := false
+    for _, rev := range revs {
+      touched = touched || in(rev)
+    }
+    if !touched {
+      continue
+    }
+    // Walk back over the trailing run of their revisions
+    i := len(revs)
+    for i > 0 && in(revs[i-1]) {
+      i--
+    }
+    if i == len(revs) {
+      results = append(results, rollbackResult{Title: title, Skipped: true})
+      continue
+    }
+    res := rollbackResult{Title: title}
+    if i > 0 {
+      res.Revision = revs[i-1].Number
+    }
+    if apply {
+      if err := revertTo(title, res.Revision, by); err != nil {
+        return results, err
+      }
+    }
+    results = append(results, res)
+  }
+  return results, nil
+}
+
+/* Make revision n of title the current page again, saved by by; n 0 deletes it */
+func revertTo(title string, n int, by string) error {
+  if n == 0 {
+    err := deletePage(title, by)
+    if os.IsNotExist(err) {
+      return nil // already gone
+    }
+    return err
+  }
+  body, err := history.LoadRevision(title, n)
+  if err != nil {
+    return err
+  }
+  return (&Page{Title: title, Body: body}).save(by, false)
+}
+
+/* POST /admin/rollback with author, from and to (to defaults to now) */
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  loc := viewerZone(r)
+  data := &rollbackData{Author: strings.TrimSpace(r.FormValue("author")), DryRun: r.FormValue("preview") != "", To: time.Now().UTC(), Zone: loc}
+  var err error
+  if data.From, err = parseInputTime(r.FormValue("from"), loc); err != nil {
+    http.Error(w, "Invalid start time", http.StatusUnprocessableEntity)
+    return
+  }
+  if to := r.FormValue("to"); to != "" {
+    if data.To, err = parseInputTime(to, loc); err != nil {
+      http.Error(w, "Invalid end time", http.StatusUnprocessableEntity)
+      return
+    }
+    data.To = data.To.Add(time.Minute - time.Nanosecond) // the whole of that minute
+  }
+  if data.Author == "" {
+    http.Error(w, "Whose edits to roll back?", http.StatusUnprocessableEntity)
+    return
+  }
+  data.Results, err = rollback(data.Author, data.From, data.To, requestAuthor(r), !data.DryRun)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  renderTemplate(w, "rollback", data)
+}
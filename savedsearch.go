@@ -0,0 +1,224 @@
+package main
+
+import (
+  "errors"
+  "log"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+)
+
+/* Saved searches
+  - Signed in users save a search from its results page under a name, and
+    manage them at /account/searches. They're kept with the account in
+    data/users.json, up to maxSavedSearches each
+  - Saved searches are listed beside every page the user views, under the
+    page's _Sidebar if it has one
+  - A search can be set to tell the user about pages that start matching it.
+    Every save is checked against such searches, and a page that didn't
+    match before and does now counts as new until the user runs the search
+    again, when it's marked in the results
+  - For that, the pages a notifying search matched are kept with it. Pages
+    the user can't read are never counted
+*/
+type SavedSearch struct {
+  Name string
+  Query string
+  Notify bool `json:",omitempty"`
+  Matching []string `json:",omitempty"` // what a notifying search matches
+  New []string `json:",omitempty"` // what started matching since it was last run
+}
+
+const maxSavedSearches = 20
+
+/* Data for the saved searches page */
+type savedSearchesData struct {
+  Searches []SavedSearch
+  Error string
+}
+
+/* The user's saved search for query, nil if there isn't one */
+func savedSearchFor(u *User, query string) *SavedSearch {
+  for i := range u.Searches {
+    if u.Searches[i].Query == query {
+      return &u.Searches[i]
+    }
+  }
+  return nil
+}
+
+/* URL of the results of a search */
+func (s SavedSearch) URL() string {
+  return "/search?q=" + url.QueryEscape(s.Query)
+}
+
+/* Save a search for u, replacing any of the same name */
+func saveSearch(u *User, name, query string, notify bool) error {
+  if name == "" || len(name) > 64 {
+    return errors.New("Give the search a name of up to 64 characters")
+  }
+  sq, err := parseSearchQuery(query, searchAnalyzer())
+  if err != nil {
+    return err
+  }
+  if sq.empty() {
+    return errors.New("There's nothing to search for")
+  }
+  s := SavedSearch{Name: name, Query: query, Notify: notify}
+  if notify {
+    results, err := searchPages(sq, u)
+    if err != nil {
+      return err
+    }
+    for _, res := range results {
+      s.Matching = append(s.Matching, res.Title)
+    }
+  }
+  var errFull error
+  err = users.update(u.Name, func(u *User) {
+    for i := range u.Searches {
+      if u.Searches[i].Name == name {
+        u.Searches[i] = s
+        return
+      }
+    }
+    if len(u.Searches) >= maxSavedSearches {
+      errFull = errors.New("You can save up to " + strconv.Itoa(maxSavedSearches) + " searches; delete one first")
+      return
+    }
+    u.Searches = append(u.Searches, s)
+  })
+  if errFull != nil {
+    return errFull
+  }
+  return err
+}
+
+/* Saved searches at /account/searches; POST action=save with name, q and
+  notify saves one, action=delete with name deletes one
+*/
+func savedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+    return
+  }
+  data := &savedSearchesData{}
+  if r.Method == http.MethodPost {
+    var err error
+    switch r.FormValue("action") {
+    case "save":
+      err = saveSearch(u, strings.TrimSpace(r.FormValue("name")), strings.TrimSpace(r.FormValue("q")), r.FormValue("notify") != "")
+    case "delete":
+      name := r.FormValue("name")
+      err = users.update(u.Name, func(u *User) {
+        kept := []SavedSearch{}
+        for _, s := range u.Searches {
+          if s.Name != name {
+            kept = append(kept, s)
+          }
+        }
+        u.Searches = kept
+      })
+    default:
+      http.Error(w, "unknown action", http.StatusBadRequest)
+      return
+    }
+    if err == nil {
+      http.Redirect(w, r, "/account/searches", http.StatusSeeOther)
+      return
+    }
+    data.Error = err.Error()
+    w.WriteHeader(http.StatusBadRequest)
+    u = users.get(u.Name)
+  }
+  data.Searches = u.Searches
+  renderTemplate(w, "searches", data)
+}
+
+/* Mark the new results of the user's saved search for query as seen,
+  returning them
+*/
+func seenSavedSearch(u *User, query string) map[string]bool {
+  s := savedSearchFor(u, query)
+  if s == nil || len(s.New) == 0 {
+    return nil
+  }
+  seen := map[string]bool{}
+  for _, title := range s.New {
+    seen[title] = true
+  }
+  err := users.update(u.Name, func(u *User) {
+    if s := savedSearchFor(u, query); s != nil {
+      s.New = nil
+    }
+  })
+  if err != nil {
+    log.Printf("saved search %q of %s: %v", query, u.Name, err)
+  }
+  return seen
+}
+
+/* Check every save against the searches that notify (run from main) */
+func watchSavedSearches() {
+  ch := pageEvents.subscribeDurable()
+  for ev := range ch {
+    checkSavedSearches(ev.Type, ev.Title)
+  }
+}
+
+func checkSavedSearches(typ, title string) {
+  a := searchAnalyzer()
+  for _, u := range users.all() {
+    for _, s := range u.Searches {
+      if !s.Notify {
+        continue
+      }
+      matches := false
+      if typ != "delete" {
+        if sq, err := parseSearchQuery(s.Query, a); err == nil {
+          _, matches = searchPage(a, sq, title, u)
+        }
+      }
+      if matches == hasTitle(s.Matching, title) {
+        continue
+      }
+      err := users.update(u.Name, func(u *User) {
+        for i := range u.Searches {
+          if t := &u.Searches[i]; t.Name == s.Name && t.Query == s.Query && t.Notify {
+            t.Matching = withoutTitle(t.Matching, title)
+            t.New = withoutTitle(t.New, title)
+            if matches {
+              t.Matching = append(t.Matching, title)
+              t.New = append(t.New, title)
+            }
+          }
+        }
+      })
+      if err != nil {
+        log.Printf("saved search %q of %s: %v", s.Query, u.Name, err)
+      }
+    }
+  }
+}
+
+func hasTitle(titles []string, title string) bool {
+  for _, t := range titles {
+    if t == title {
+      return true
+    }
+  }
+  return false
+}
+
+/* A copy of titles without title */
+func withoutTitle(titles []string, title string) []string {
+  var kept []string
+  for _, t := range titles {
+    if t != title {
+      kept = append(kept, t)
+    }
+  }
+  return kept
+}
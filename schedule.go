@@ -0,0 +1,118 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "strings"
+  "time"
+)
+
+/* Scheduled publishing and expiry
+  - A page with PublishAt in the future is a 404 to anyone not signed in;
+    signed in users see it with a banner so they can check it before it goes out
+  - After ExpiresAt a page is shown with an "outdated" banner, or is a 410
+    Gone to anyone not signed in if ExpiryGone is set
+  - Set from the edit form. Times there are in the server's time zone
+  - runScheduler publishes a "publish" or "expire" event when a page's time
+    comes, so open views reload, like they do for a save
+*/
+
+/* Check that the reader of r may see p, under its schedule and draft status
+  - Writes the 404 or 410 and returns false if they can't, otherwise returns
+    the version of p they see and any banner to show
+*/
+func checkReadable(w http.ResponseWriter, r *http.Request, p *Page) (*Page, string, bool) {
+  p, banner, status, err := readStatus(r, p)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, "", false
+  }
+  switch status {
+  case http.StatusNotFound:
+    http.NotFound(w, r)
+    return nil, "", false
+  case http.StatusGone:
+    http.Error(w, "This page has expired.", http.StatusGone)
+    return nil, "", false
+  }
+  return p, banner, true
+}
+
+/* Where p is in its schedule and drafting for the reader of r: the version
+  they see (see authorizeRead), the status to answer with (200 unless it's
+  hidden from them) and any banner to show
+*/
+func readStatus(r *http.Request, p *Page) (*Page, string, int, error) {
+  m, err := pageMeta.Load(p.Title)
+  if err != nil {
+    return nil, "", 0, err
+  }
+  u := currentUser(r)
+  p, status, err := readableVersion(p, m, u, r.URL.Query().Get("share"))
+  if err != nil || status != http.StatusOK {
+    return nil, "", status, err
+  }
+  now := time.Now()
+  var banner string
+  switch {
+  case !m.PublishAt.IsZero() && now.Before(m.PublishAt):
+    banner = "Not published yet: this page goes live at " + m.PublishAt.Format("2006-01-02 15:04") + "."
+  case !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt):
+    banner = "This page expired on " + m.ExpiresAt.Format("2006-01-02") + " and may be outdated."
+  default:
+    if since, stale := staleSince(p.Title, m); stale {
+      banner = "This page hasn't been updated since " + since.In(viewerZone(r)).Format("2006-01-02") + " and may be outdated."
+    }
+  }
+  if draft := draftBanner(m, u); draft != "" {
+    banner = strings.TrimSpace(draft + " " + banner)
+  }
+  return p, banner, http.StatusOK, nil
+}
+
+/* Read the schedule fields posted with the edit form into m, in the
+  reader's zone
+*/
+func parseSchedule(r *http.Request, m *PageMeta) error {
+  loc := viewerZone(r)
+  parse := func(s string) (time.Time, error) {
+    if s == "" {
+      return time.Time{}, nil
+    }
+    return parseInputTime(s, loc)
+  }
+  var err error
+  if m.PublishAt, err = parse(r.FormValue("publish_at")); err != nil {
+    return err
+  }
+  if m.ExpiresAt, err = parse(r.FormValue("expires_at")); err != nil {
+    return err
+  }
+  m.ExpiryGone = r.FormValue("expiry") == "gone"
+  return nil
+}
+
+/* How often runScheduler looks for pages whose time has come */
+var scheduleInterval = 30 * time.Second
+
+/* Publish events as scheduled pages go live or expire */
+func runScheduler() {
+  last := time.Now()
+  for range time.Tick(scheduleInterval) {
+    now := time.Now()
+    all, err := pageMeta.All()
+    if err != nil {
+      log.Printf("scheduler: %v", err)
+      continue
+    }
+    for title, m := range all {
+      if m.PublishAt.After(last) && !m.PublishAt.After(now) {
+        pageEvents.publish("publish", title)
+      }
+      if m.ExpiresAt.After(last) && !m.ExpiresAt.After(now) {
+        pageEvents.publish("expire", title)
+      }
+    }
+    last = now
+  }
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/fs"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+/* Data format versions
+  - data/schema.json records which version of the on-disk format the data
+    is in. At start up the wiki runs the migrations newer than that, in
+    order, recording each as it finishes, so an upgrade that's interrupted
+    carries on from the step it was at next time
+  - -migrate-only runs them and exits, to upgrade ahead of restarting
+    the wiki. -migrate-to N moves the data to version N and exits: below
+    the current version it runs the down migrations, before going back to
+    an older release of the wiki
+  - The wiki won't start on data newer than it knows
+  - A new data directory starts at the latest version, and one from before
+    versions were recorded is at 0
+  - These are for the file backends; the memory store starts empty every
+    time, so has nothing to migrate
+*/
+type schemaMigration struct {
+  Name string
+  Up, Down func() error
+}
+
+/* schemaMigrations[i] takes the data from version i to i+1. Only ever add
+  to the end
+*/
+var schemaMigrations = []schemaMigration{
+  {"store attachment content once, by hash", hashAttachments, unhashAttachments},
+  {"checksum pages, revisions and proposals", checksumFiles, unchecksumFiles},
+}
+
+var schemaPath = "data/schema.json"
+
+type schemaVersion struct {
+  Version int
+}
+
+/* The version the data is at, and whether it was recorded */
+func loadSchemaVersion() (int, bool, error) {
+  data, err := ioutil.ReadFile(schemaPath)
+  if os.IsNotExist(err) {
+    return 0, false, nil
+  }
+  if err != nil {
+    return 0, false, err
+  }
+  var v schemaVersion
+  if err := json.Unmarshal(data, &v); err != nil {
+    return 0, false, err
+  }
+  return v.Version, true, nil
+}
+
+func saveSchemaVersion(path string, version int) error {
+  if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+    return err
+  }
+  data, err := json.Marshal(schemaVersion{Version: version})
+  if err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+    return err
+  }
+  return os.Rename(path+".tmp", path)
+}
+
+/* Move the data to version target, running migrations up or down; -1 is
+  the latest version. Called from main once the stores are set up
+*/
+func migrateSchema(target int) error {
+  latest := len(schemaMigrations)
+  if target < 0 {
+    target = latest
+  }
+  if target > latest {
+    return errors.New("-migrate-to " + strconv.Itoa(target) + ": this wiki knows versions up to " + strconv.Itoa(latest))
+  }
+  version, recorded, err := loadSchemaVersion()
+  if err != nil {
+    return err
+  }
+  if !recorded {
+    empty, err := dataEmpty()
+    if err != nil {
+      return err
+    }
+    if empty {
+      return saveSchemaVersion(schemaPath, target)
+    }
+  }
+  if version > latest {
+    return errors.New("the data is at version " + strconv.Itoa(version) + ", newer than this wiki knows (" + strconv.Itoa(latest) +
+      "): run the newer wiki with -migrate-to " + strconv.Itoa(latest) + " first")
+  }
+  for version < target {
+    m := schemaMigrations[version]
+    log.Printf("migrating data to version %d: %s", version+1, m.Name)
+    if err := m.Up(); err != nil {
+      return fmt.Errorf("migrating to version %d: %v", version+1, err)
+    }
+    version++
+    if err := saveSchemaVersion(schemaPath, version); err != nil {
+      return err
+    }
+  }
+  for version > target {
+    m := schemaMigrations[version-1]
+    log.Printf("migrating data back to version %d: undoing %s", version-1, m.Name)
+    if err := m.Down(); err != nil {
+      return fmt.Errorf("migrating back to version %d: %v", version-1, err)
+    }
+    version--
+    if err := saveSchemaVersion(schemaPath, version); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+/* Whether there are no pages, history or attachments yet */
+func dataEmpty() (bool, error) {
+  titles, err := store.List()
+  if err != nil || len(titles) > 0 {
+    return false, err
+  }
+  withHistory, err := history.Titles()
+  if err != nil || len(withHistory) > 0 {
+    return false, err
+  }
+  if fa, ok := attachments.(*fileAttachments); ok {
+    entries, err := os.ReadDir(fa.dir)
+    if err != nil && !os.IsNotExist(err) {
+      return false, err
+    }
+    return len(entries) == 0, nil
+  }
+  return true, nil
+}
+
+/* Every attachment's metadata file in s, with the page it's attached to */
+func (s *fileAttachments) eachMeta(fn func(page, name, metaPath string, m attachmentMeta) error) error {
+  dirs, err := os.ReadDir(s.dir)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  for _, d := range dirs {
+    if !d.IsDir() || d.Name() == ".blobs" {
+      continue
+    }
+    files, err := filepath.Glob(filepath.Join(s.dir, d.Name(), ".*.json"))
+    if err != nil {
+      return err
+    }
+    for _, f := range files {
+      m, err := s.meta(f)
+      if err != nil {
+        return fmt.Errorf("%s: %v", f, err)
+      }
+      if err := fn(m.Page, m.Name, f, m); err != nil {
+        return fmt.Errorf("attachment %s of %s: %v", m.Name, m.Page, err)
+      }
+    }
+  }
+  return nil
+}
+
+/* Version 1: move attachments stored in their page's directory into .blobs */
+func hashAttachments() error {
+  s, ok := attachments.(*fileAttachments)
+  if !ok {
+    return nil
+  }
+  return s.eachMeta(func(page, name, metaPath string, m attachmentMeta) error {
+    if m.Hash != "" {
+      return nil
+    }
+    data, _, err := s.Load(page, name)
+    if err != nil {
+      return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    hash, err := s.addRef(data)
+    if err != nil {
+      return err
+    }
+    if err := s.writeMeta(metaPath, attachmentMeta{Attachment: m.Attachment, Hash: hash}); err != nil {
+      return err
+    }
+    path, _ := s.paths(page, name)
+    return os.Remove(path)
+  })
+}
+
+func unhashAttachments() error {
+  s, ok := attachments.(*fileAttachments)
+  if !ok {
+    return nil
+  }
+  return s.eachMeta(func(page, name, metaPath string, m attachmentMeta) error {
+    if m.Hash == "" {
+      return nil
+    }
+    data, _, err := s.Load(page, name)
+    if err != nil {
+      return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if data, err = (&fileCodec{aead: s.aead}).encrypt(data); err != nil {
+      return err
+    }
+    path, _ := s.paths(page, name)
+    if err := ioutil.WriteFile(path, data, 0600); err != nil {
+      return err
+    }
+    if err := s.writeMeta(metaPath, attachmentMeta{Attachment: m.Attachment, Encrypted: s.aead != nil}); err != nil {
+      return err
+    }
+    return s.dropRef(page, m)
+  })
+}
+
+/* Version 2: write every page, revision and proposal again, which gives
+  them a checksum
+*/
+func checksumFiles() error {
+  return recodeFiles(false)
+}
+
+func unchecksumFiles() error {
+  return recodeFiles(true)
+}
+
+/* Read and write again the files the codecs wrote, with or without
+  checksums, keeping their modification times
+*/
+func recodeFiles(noChecksum bool) error {
+  type tree struct {
+    dir string
+    codec *fileCodec
+    top bool // only the files directly in dir
+  }
+  var trees []tree
+  if s, ok := store.(*fileStore); ok {
+    trees = append(trees, tree{s.dir, s.codec, true})
+  }
+  if h, ok := history.(*fileHistory); ok {
+    trees = append(trees, tree{h.dir, h.codec, false})
+  }
+  if p, ok := proposals.(*fileProposals); ok {
+    trees = append(trees, tree{p.dir, p.codec, false})
+  }
+  for _, t := range trees {
+    codec := *t.codec
+    codec.noChecksum = noChecksum
+    err := filepath.WalkDir(t.dir, func(path string, d fs.DirEntry, err error) error {
+      if os.IsNotExist(err) {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      if d.IsDir() {
+        if t.top && path != t.dir {
+          return filepath.SkipDir
+        }
+        return nil
+      }
+      if ext := filepath.Ext(path); ext != ".txt" && ext != ".delta" || strings.HasPrefix(d.Name(), ".") {
+        return nil
+      }
+      info, err := d.Info()
+      if err != nil {
+        return err
+      }
+      body, err := codec.read(path)
+      if err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+      }
+      if err := codec.write(path, body); err != nil {
+        return err
+      }
+      return os.Chtimes(path, info.ModTime(), info.ModTime())
+    })
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
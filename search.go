@@ -0,0 +1,399 @@
+package main
+
+import (
+  "html"
+  "html/template"
+  "net/http"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+)
+
+/* Full text search
+  - /search?q= and GET /api/{version}/search?q= find the pages whose title
+    or text contains every word of the query, ignoring case and the word's
+    ending (see analysis.go); words in "quotes" have to appear together, as
+    a phrase. Filters such as author:alice and modified:>2024-01-01 narrow
+    the results down (see searchfilter.go)
+  - Results come best first: a match in the title counts for more than one
+    in the text, and a page matching more often comes before one matching
+    less. Each comes with up to searchFragments fragments of its text, the
+    matches with some words either side, the matches highlighted; the API
+    gives each fragment as plain text and as HTML with <mark> around them
+  - Nothing is indexed: pages are read as they're searched, and only the ones
+    the user can read are
+  - ?limit= and ?offset= page through the results as for listings
+    (listing.go)
+*/
+const searchFragments = 3
+const searchContext = 60 // bytes either side of a match
+
+/* A page found by a search */
+type searchResult struct {
+  Title string `json:"title"`
+  URL string `json:"url"`
+  Score int `json:"score"`
+  Fragments []searchFragment `json:"fragments"`
+}
+
+type searchFragment struct {
+  Text string `json:"text"`
+  HTML template.HTML `json:"html"`
+}
+
+/* Data for the search page */
+type searchData struct {
+  Query string
+  Results []searchResult
+  Total int
+  Prev, Next string
+  SignedIn bool // the reader can save the search
+  Saved *SavedSearch // the reader's saved search for the query
+  New map[string]bool // results that started matching it since it was last run
+}
+
+/* A parsed query: the words and phrases of it, each as the terms to find in
+  order (see analysis.go), and its filters (see searchfilter.go)
+*/
+type searchQuery struct {
+  terms [][]string // in the title or the text
+  titleTerms [][]string // in the title only
+  filters []searchFilter
+}
+
+func (sq searchQuery) empty() bool {
+  return len(sq.terms) == 0 && len(sq.titleTerms) == 0 && len(sq.filters) == 0
+}
+
+func parseSearchQuery(q string, a analyzer) (searchQuery, error) {
+  var sq searchQuery
+  var stops [][]string
+  for q != "" {
+    q = strings.TrimLeftFunc(q, unicode.IsSpace)
+    if rest, ok := strings.CutPrefix(q, `"`); ok {
+      phrase, after, _ := strings.Cut(rest, `"`)
+      if t := termsOf(a.tokens(phrase)); len(t) > 0 {
+        sq.terms = append(sq.terms, t)
+      }
+      q = after
+      continue
+    }
+    if field, rest, ok := strings.Cut(q, ":"); ok && searchFields[field] {
+      var value string
+      if quoted, ok := strings.CutPrefix(rest, `"`); ok {
+        value, q, _ = strings.Cut(quoted, `"`)
+      } else {
+        end := strings.IndexFunc(rest, unicode.IsSpace)
+        if end < 0 {
+          end = len(rest)
+        }
+        value, q = rest[:end], rest[end:]
+      }
+      f, err := parseSearchFilter(field, strings.TrimSpace(value))
+      if err != nil {
+        return sq, err
+      }
+      if field == "title" {
+        if t := termsOf(a.tokens(f.value)); len(t) > 0 {
+          sq.titleTerms = append(sq.titleTerms, t)
+        }
+        continue
+      }
+      sq.filters = append(sq.filters, f)
+      continue
+    }
+    end := strings.IndexFunc(q, unicode.IsSpace)
+    if end < 0 {
+      end = len(q)
+    }
+    word := q[:end]
+    q = q[end:]
+    t := termsOf(a.tokens(word))
+    switch {
+    case len(t) == 0:
+    case a.isStop(word):
+      stops = append(stops, t)
+    default:
+      sq.terms = append(sq.terms, t)
+    }
+  }
+  if len(sq.terms) == 0 {
+    sq.terms = stops
+  }
+  return sq, nil
+}
+
+func termsOf(toks []token) []string {
+  terms := make([]string, len(toks))
+  for i, t := range toks {
+    terms[i] = t.term
+  }
+  return terms
+}
+
+/* Where the terms are found one after another in toks, as [start, end) pairs */
+func findTerms(toks []token, terms []string) [][2]int {
+  var spans [][2]int
+  for i := 0; i+len(terms) <= len(toks); i++ {
+    k := 0
+    for k < len(terms) && toks[i+k].term == terms[k] {
+      k++
+    }
+    if k == len(terms) {
+      spans = append(spans, [2]int{toks[i].start, toks[i+k-1].end})
+    }
+  }
+  return spans
+}
+
+/* The pages u can read matching sq, best first */
+func searchPages(sq searchQuery, u *User) ([]searchResult, error) {
+  titles, err := listPages()
+  if err == nil {
+    titles, err = visiblePages(titles, u)
+  }
+  if err != nil {
+    return nil, err
+  }
+  results := []searchResult{}
+  if sq.empty() {
+    return results, nil
+  }
+  a := searchAnalyzer()
+  for _, title := range titles {
+    if res, ok := searchPage(a, sq, title, u); ok {
+      results = append(results, res)
+    }
+  }
+  sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+  return results, nil
+}
+
+/* The result for title if it matches sq, searching the version of it u may
+  read (see authorizeRead), so a draft's text isn't found by those who see
+  its published revision
+*/
+func searchPage(a analyzer, sq searchQuery, title string, u *User) (searchResult, bool) {
+  if !filtersAllow(sq.filters, title) {
+    return searchResult{}, false
+  }
+  p, err := loadPage(title)
+  if err == nil {
+    p, _, err = authorizeRead(p, u, "")
+  }
+  if err != nil || p == nil {
+    return searchResult{}, false
+  }
+  return matchPage(a, title, string(p.Body), sq)
+}
+
+/* Score and fragments for a page, ok being false unless every term matches
+  - Titles are searched as written and with their WikiWords split, so
+    "GoLang" is found by both golang and lang
+*/
+func matchPage(a analyzer, title, text string, sq searchQuery) (searchResult, bool) {
+  res := searchResult{Title: title, URL: pageURL("view", title)}
+  titleToks, wordToks, toks := a.tokens(title), a.tokens(splitWikiWords(title)), a.tokens(text)
+  inTitle := func(t []string) int {
+    return max(len(findTerms(titleToks, t)), len(findTerms(wordToks, t)))
+  }
+  for _, t := range sq.titleTerms {
+    n := inTitle(t)
+    if n == 0 {
+      return res, false
+    }
+    res.Score += 10 * n
+  }
+  var spans [][2]int
+  for _, t := range sq.terms {
+    n := inTitle(t)
+    found := findTerms(toks, t)
+    if n == 0 && len(found) == 0 {
+      return res, false
+    }
+    res.Score += 10*n + len(found)
+    spans = append(spans, found...)
+  }
+  sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+  res.Fragments = fragments(text, spans)
+  return res, true
+}
+
+/* A title with spaces between the words run together in it: "GoLang" is
+  "Go Lang" and "APIDocs" is "API Docs"
+*/
+func splitWikiWords(title string) string {
+  r := []rune(title)
+  var b strings.Builder
+  for i, c := range r {
+    if i > 0 && unicode.IsUpper(c) && (unicode.IsLower(r[i-1]) || (unicode.IsUpper(r[i-1]) && i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+      b.WriteByte(' ')
+    }
+    b.WriteRune(c)
+  }
+  return b.String()
+}
+
+/* Up to searchFragments pieces of text around the spans, with the spans
+  marked; the start of the text if there are none
+*/
+func fragments(text string, spans [][2]int) []searchFragment {
+  if len(spans) == 0 {
+    if text == "" {
+      return []searchFragment{}
+    }
+    end := wordEnd(text, min(len(text), 2*searchContext))
+    return []searchFragment{newFragment(text, 0, end, nil)}
+  }
+  frags := []searchFragment{}
+  for i := 0; i < len(spans) && len(frags) < searchFragments; {
+    start := wordStart(text, max(0, spans[i][0]-searchContext), spans[i][0])
+    end := spans[i][1]
+    // Take in the following matches that are close enough to share it
+    j := i + 1
+    for j < len(spans) && spans[j][0] < end+searchContext && spans[j][1]-start < 4*searchContext {
+      end = max(end, spans[j][1])
+      j++
+    }
+    end = wordEnd(text, min(len(text), end+searchContext))
+    frags = append(frags, newFragment(text, start, end, spans[i:j]))
+    i = j
+  }
+  return frags
+}
+
+/* A fragment of text[start:end] with the spans in it marked */
+func newFragment(text string, start, end int, spans [][2]int) searchFragment {
+  var plain, marked strings.Builder
+  if start > 0 {
+    plain.WriteString("… ")
+    marked.WriteString("… ")
+  }
+  at := start
+  for _, s := range spans {
+    if s[0] < at {
+      continue // overlaps the previous match
+    }
+    marked.WriteString(html.EscapeString(oneLine(text[at:s[0]])))
+    marked.WriteString("<mark>" + html.EscapeString(oneLine(text[s[0]:s[1]])) + "</mark>")
+    at = s[1]
+  }
+  marked.WriteString(html.EscapeString(oneLine(text[at:end])))
+  plain.WriteString(oneLine(text[start:end]))
+  if end < len(text) {
+    plain.WriteString(" …")
+    marked.WriteString(" …")
+  }
+  return searchFragment{Text: plain.String(), HTML: template.HTML(marked.String())}
+}
+
+/* s with line breaks and tabs as spaces */
+func oneLine(s string) string {
+  return strings.Map(func(r rune) rune {
+    if r == '\n' || r == '\r' || r == '\t' {
+      return ' '
+    }
+    return r
+  }, s)
+}
+
+/* Move i, a place at or before limit, to the start of a word */
+func wordStart(text string, i, limit int) int {
+  for i > 0 && !utf8.RuneStart(text[i]) {
+    i++
+  }
+  if i == 0 {
+    return 0
+  }
+  if k := strings.IndexAny(text[i:limit], " \n\t"); k >= 0 {
+    return i + k + 1
+  }
+  return i
+}
+
+/* Move i back to the end of a word */
+func wordEnd(text string, i int) int {
+  for i < len(text) && !utf8.RuneStart(text[i]) {
+    i--
+  }
+  if i == len(text) {
+    return i
+  }
+  if k := strings.LastIndexAny(text[:i], " \n\t"); k > 0 && i-k < searchContext/2 {
+    return k
+  }
+  return i
+}
+
+/* The search query of r and the page of results it asks for */
+func runSearch(r *http.Request, limit int) (string, listQuery, []searchResult, int, error) {
+  v := r.URL.Query()
+  query := strings.TrimSpace(v.Get("q"))
+  q, err := parseListQuery(url.Values{"limit": v["limit"], "offset": v["offset"]}, limit)
+  if err != nil {
+    return query, q, nil, 0, err
+  }
+  sq, err := parseSearchQuery(query, searchAnalyzer())
+  if err != nil {
+    return query, q, nil, 0, err
+  }
+  results, err := searchPages(sq, currentUser(r))
+  if err != nil {
+    return query, q, nil, 0, err
+  }
+  total := len(results)
+  start := min(q.Offset, total)
+  end := total
+  if q.Limit > 0 {
+    end = min(start+q.Limit, total)
+  }
+  return query, q, results[start:end], total, nil
+}
+
+/* Handler for /search */
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+  query, q, results, total, err := runSearch(r, prefsOf(currentUser(r)).perPage(defaultPageLimit))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  data := &searchData{Query: query, Results: results, Total: total}
+  if u := currentUser(r); u != nil {
+    data.SignedIn = true
+    data.New = seenSavedSearch(u, query)
+    data.Saved = savedSearchFor(u, query)
+  }
+  prev, next := q.neighbours(total)
+  if prev != "" {
+    data.Prev = "/search?q=" + url.QueryEscape(query) + "&" + prev
+  }
+  if next != "" {
+    data.Next = "/search?q=" + url.QueryEscape(query) + "&" + next
+  }
+  renderTemplate(w, "search", data)
+}
+
+/* GET /api/{version}/search?q= */
+func apiSearchHandler(w http.ResponseWriter, r *http.Request, v *apiVersion) {
+  if r.Method != http.MethodGet {
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  query, q, results, total, err := runSearch(r, v.listLimit)
+  if err != nil {
+    writeJSONError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  w.Header().Set("X-Total-Count", strconv.Itoa(total))
+  prev, next := q.neighbours(total)
+  if prev != "" {
+    w.Header().Add("Link", "<"+v.prefix()+"/search?q="+url.QueryEscape(query)+"&"+prev+`>; rel="prev"`)
+  }
+  if next != "" {
+    w.Header().Add("Link", "<"+v.prefix()+"/search?q="+url.QueryEscape(query)+"&"+next+`>; rel="next"`)
+  }
+  writeJSON(w, http.StatusOK, map[string]interface{}{"query": query, "total": total, "results": results})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+  "errors"
+  "strings"
+  "time"
+)
+
+/* Search filters
+  - Words of a query written field:value narrow the results rather than
+    being searched for:
+    - author:alice keeps the pages alice has saved a revision of
+    - modified:2024-01-01 keeps the pages last changed that day, and
+      modified:>2024-01-01 those changed after it; >=, < and <= work too,
+      and a month (2024-01) or a year (2024) for the day. Dates are in UTC
+    - created: does the same for the page's first revision
+    - title:word only looks for word in the title
+    - tag:runbook keeps the pages tagged runbook (see tags.go)
+  - A value with spaces in it goes in quotes: author:"Jane Doe"
+  - A query of nothing but filters finds every page they let through
+*/
+type searchFilter struct {
+  field string
+  value string
+  from, to time.Time // the dates let through, from up to but not including to; zero for no limit
+}
+
+/* Fields that are filters; any other word with a colon is searched for */
+var searchFields = map[string]bool{"author": true, "modified": true, "created": true, "title": true, "tag": true}
+
+var errSearchDate = errors.New("modified: and created: take a date, as 2024-01-31, 2024-01 or 2024, after >, >=, < or <= if you like")
+
+func parseSearchFilter(field, value string) (searchFilter, error) {
+  f := searchFilter{field: field, value: value}
+  switch field {
+  case "tag":
+    f.value = strings.ToLower(value)
+  case "modified", "created":
+    op := ""
+    for _, o := range []string{">=", "<=", ">", "<", "="} {
+      if rest, ok := strings.CutPrefix(value, o); ok {
+        op, value = o, rest
+        break
+      }
+    }
+    start, end, err := searchPeriod(value)
+    if err != nil {
+      return f, err
+    }
+    switch op {
+    case ">":
+      f.from = end
+    case ">=":
+      f.from = start
+    case "<":
+      f.to = start
+    case "<=":
+      f.to = end
+    default:
+      f.from, f.to = start, end
+    }
+  }
+  if f.value == "" {
+    return f, errors.New(field + ": needs a value")
+  }
+  return f, nil
+}
+
+/* The start and end of a day, month or year */
+func searchPeriod(s string) (time.Time, time.Time, error) {
+  for _, p := range []struct {
+    layout string
+    y, m, d int
+  }{{"2006-01-02", 0, 0, 1}, {"2006-01", 0, 1, 0}, {"2006", 1, 0, 0}} {
+    if t, err := time.Parse(p.layout, s); err == nil {
+      return t, t.AddDate(p.y, p.m, p.d), nil
+    }
+  }
+  return time.Time{}, time.Time{}, errSearchDate
+}
+
+func (f searchFilter) allows(t time.Time) bool {
+  return (f.from.IsZero() || !t.Before(f.from)) && (f.to.IsZero() || t.Before(f.to))
+}
+
+/* Whether title gets through the filters; the title: ones are matched
+  with the text (see matchPage)
+*/
+func filtersAllow(filters []searchFilter, title string) bool {
+  var info *PageInfo
+  var revs []Revision
+  var meta *PageMeta
+  loaded := false
+  for _, f := range filters {
+    switch f.field {
+    case "tag":
+      if meta == nil {
+        m, err := pageMeta.Load(title)
+        if err != nil {
+          return false
+        }
+        meta = &m
+      }
+      if !meta.hasTag(f.value) {
+        return false
+      }
+    case "modified":
+      if info == nil {
+        i, err := store.Stat(title)
+        if err != nil {
+          return false
+        }
+        info = &i
+      }
+      if !f.allows(info.Modified) {
+        return false
+      }
+    case "author", "created":
+      if !loaded {
+        revs, _ = history.Revisions(title)
+        loaded = true
+      }
+      if f.field == "created" {
+        if len(revs) == 0 || !f.allows(revs[0].Time) {
+          return false
+        }
+        continue
+      }
+      found := false
+      for _, r := range revs {
+        if strings.EqualFold(r.Author, f.value) {
+          found = true
+          break
+        }
+      }
+      if !found {
+        return false
+      }
+    }
+  }
+  return true
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Sessions
+  - A signed in user has a Session, found from the wiki_session cookie
+  - Where sessions live is up to the SessionStore chosen with -sessions:
+      memory  in this process; lost on restart, not shared between instances
+      cookie  in the cookie itself, signed with -session-key
+      redis   in Redis at -redis-addr, shared by every instance
+  - The cookie is HttpOnly and SameSite=Lax, so other sites can't read it or
+    post forms with it
+  - Expiry slides: a session lasts -session-ttl from when it was last used.
+    Ticking "remember me" at sign in makes it last -remember-ttl instead,
+    with a cookie that outlives the browser; otherwise the cookie goes when
+    the browser closes
+  - /account/sessions lists a user's sessions and signs out any of them
+*/
+type Session struct {
+  ID string
+  User string
+  Created time.Time
+  Expires time.Time
+  LastSeen time.Time `json:",omitempty"`
+  Remember bool `json:",omitempty"`
+  IP string `json:",omitempty"`
+  Agent string `json:",omitempty"`
+}
+
+type SessionStore interface {
+  /* The request's session, nil if it has none or it has expired */
+  Load(r *http.Request) (*Session, error)
+  Save(w http.ResponseWriter, s *Session) error
+  Delete(w http.ResponseWriter, r *http.Request) error
+  /* The user's sessions that haven't expired */
+  List(user string) ([]*Session, error)
+  /* End the user's session with id */
+  Revoke(user, id string) error
+}
+
+const sessionCookie = "wiki_session"
+
+/* How long an unused session lasts, set with -session-ttl */
+var sessionTTL = 24 * time.Hour
+
+/* How long an unused "remember me" session lasts, set with -remember-ttl */
+var rememberTTL = 30 * 24 * time.Hour
+
+/* Sessions are saved again with a later expiry at most this often */
+const sessionRefresh = time.Minute
+
+var errNoRevoke = errors.New("Cookie sessions are kept only in the browser, so other sessions can't be listed or signed out")
+
+var sessions SessionStore = newMemorySessions()
+
+/* Set up the session store from the command line settings
+  - key signs cookie sessions; without one a random key is made, so cookie
+    sessions then don't survive a restart either
+*/
+func configureSessions(kind, key, redisAddr string) error {
+  switch kind {
+  case "memory":
+    sessions = newMemorySessions()
+  case "cookie":
+    secret := []byte(key)
+    if key == "" {
+      secret = make([]byte, 32)
+      if _, err := rand.Read(secret); err != nil {
+        return err
+      }
+    }
+    sessions = &cookieSessions{key: secret}
+  case "redis":
+    if redisAddr == "" {
+      return errors.New("redis sessions need -redis-addr")
+    }
+    sessions = &redisSessions{client: newRedisClient(redisAddr)}
+  default:
+    return errors.New("unknown session store " + kind)
+  }
+  return nil
+}
+
+/* Start a session for user, a long one if remember is set */
+func startSession(w http.ResponseWriter, r *http.Request, user string, remember bool) error {
+  id, err := randomID()
+  if err != nil {
+    return err
+  }
+  now := time.Now().UTC()
+  agent := r.UserAgent()
+  if len(agent) > 200 {
+    agent = agent[:200]
+  }
+  s := &Session{ID: id, User: user, Created: now, LastSeen: now, Remember: remember, IP: clientIP(r), Agent: agent}
+  s.Expires = now.Add(s.ttl())
+  return sessions.Save(w, s)
+}
+
+/* How long the session lasts unused */
+func (s *Session) ttl() time.Duration {
+  if s.Remember {
+    return rememberTTL
+  }
+  return sessionTTL
+}
+
+/* A name for the session that can be shown, unlike its ID */
+func (s *Session) Handle() string {
+  sum := sha256.Sum256([]byte(s.ID))
+  return hex.EncodeToString(sum[:8])
+}
+
+/* Wrapper pushing back the expiry of the session a request uses */
+func slideSessions(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !strings.HasPrefix(r.URL.Path, "/static/") && r.URL.Path != "/logout" {
+      if s, err := sessions.Load(r); err == nil && s != nil && time.Since(s.LastSeen) > sessionRefresh {
+        s.LastSeen = time.Now().UTC()
+        s.Expires = s.LastSeen.Add(s.ttl())
+        s.IP = clientIP(r)
+        sessions.Save(w, s)
+      }
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+/* The signed in user, nil if there isn't one
+  - API requests can sign in with a token instead, see apitoken.go
+  - WebDAV requests sign in with basic auth, see webdav.go
+*/
+func currentUser(r *http.Request) *User {
+  if strings.HasPrefix(r.URL.Path, davPrefix) {
+    return davUser(r)
+  }
+  if t, _, ok, err := requestToken(r); ok {
+    if err != nil || !strings.HasPrefix(r.URL.Path, "/api/") {
+      return nil
+    }
+    return users.get(t.User)
+  }
+  s, err := sessions.Load(r)
+  if err != nil || s == nil {
+    return nil
+  }
+  return users.get(s.User)
+}
+
+/* 128 random bits, hex encoded */
+func randomID() (string, error) {
+  b := make([]byte, 16)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(b), nil
+}
+
+/* The cookie for s holding value; only "remember me" cookies outlast the browser
+  - When the wiki serves HTTPS the cookie is marked Secure, so it is never
+    sent over the plain HTTP redirect listener
+*/
+func setSessionCookie(w http.ResponseWriter, value string, s *Session) {
+  c := &http.Cookie{
+    Name: sessionCookie, Value: value, Path: "/",
+    HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: servingTLS(),
+  }
+  if s.Remember {
+    c.Expires = s.Expires
+  }
+  http.SetCookie(w, c)
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+  http.SetCookie(w, &http.Cookie{
+    Name: sessionCookie, Value: "", Path: "/", MaxAge: -1,
+    HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: servingTLS(),
+  })
+}
+
+/* Whether the wiki serves HTTPS, from -tls-cert */
+func servingTLS() bool {
+  return tlsFiles.cert != ""
+}
+
+/* Session ID from the cookie, for the stores that keep sessions server side */
+func sessionID(r *http.Request) string {
+  c, err := r.Cookie(sessionCookie)
+  if err != nil {
+    return ""
+  }
+  return c.Value
+}
+
+/* In memory sessions
+  - Expired sessions are dropped when they are next looked at
+*/
+type memorySessions struct {
+  mu sync.Mutex
+  m map[string]*Session
+}
+
+func newMemorySessions() *memorySessions {
+  return &memorySessions{m: map[string]*Session{}}
+}
+
+func (s *memorySessions) Load(r *http.Request) (*Session, error) {
+  id := sessionID(r)
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  sess := s.m[id]
+  if sess == nil {
+    return nil, nil
+  }
+  if time.Now().After(sess.Expires) {
+    delete(s.m, id)
+    return nil, nil
+  }
+  c := *sess
+  return &c, nil
+}
+
+func (s *memorySessions) Save(w http.ResponseWriter, sess *Session) error {
+  c := *sess
+  s.mu.Lock()
+  s.m[sess.ID] = &c
+  s.mu.Unlock()
+  setSessionCookie(w, sess.ID, sess)
+  return nil
+}
+
+func (s *memorySessions) Delete(w http.ResponseWriter, r *http.Request) error {
+  s.mu.Lock()
+  delete(s.m, sessionID(r))
+  s.mu.Unlock()
+  clearSessionCookie(w)
+  return nil
+}
+
+func (s *memorySessions) List(user string) ([]*Session, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  list := []*Session{}
+  now := time.Now()
+  for id, sess := range s.m {
+    if now.After(sess.Expires) {
+      delete(s.m, id)
+      continue
+    }
+    if sess.User == user {
+      c := *sess
+      list = append(list, &c)
+    }
+  }
+  return list, nil
+}
+
+func (s *memorySessions) Revoke(user, id string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if sess := s.m[id]; sess != nil && sess.User == user {
+    delete(s.m, id)
+  }
+  return nil
+}
+
+/* Signed cookie sessions
+  - The cookie holds the session as base64 JSON followed by "." and an
+    HMAC-SHA256 of it, so it can't be altered without the key
+  - Nothing is kept on the server; Delete can only clear the cookie, so a copy
+    of the cookie stays valid until it expires
+*/
+type cookieSessions struct {
+  key []byte
+}
+
+func (s *cookieSessions) sign(payload string) string {
+  mac := hmac.New(sha256.New, s.key)
+  mac.Write([]byte(payload))
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *cookieSessions) Load(r *http.Request) (*Session, error) {
+  payload, sig, ok := strings.Cut(sessionID(r), ".")
+  if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+    return nil, nil
+  }
+  data, err := base64.RawURLEncoding.DecodeString(payload)
+  if err != nil {
+    return nil, nil
+  }
+  var sess Session
+  if err := json.Unmarshal(data, &sess); err != nil || time.Now().After(sess.Expires) {
+    return nil, nil
+  }
+  return &sess, nil
+}
+
+func (s *cookieSessions) Save(w http.ResponseWriter, sess *Session) error {
+  data, err := json.Marshal(sess)
+  if err != nil {
+    return err
+  }
+  payload := base64.RawURLEncoding.EncodeToString(data)
+  setSessionCookie(w, payload+"."+s.sign(payload), sess)
+  return nil
+}
+
+func (s *cookieSessions) Delete(w http.ResponseWriter, r *http.Request) error {
+  clearSessionCookie(w)
+  return nil
+}
+
+func (s *cookieSessions) List(user string) ([]*Session, error) {
+  return nil, errNoRevoke
+}
+
+func (s *cookieSessions) Revoke(user, id string) error {
+  return errNoRevoke
+}
+
+/* Redis sessions
+  - Stored as JSON under wiki:session:<id>, with a Redis expiry matching the
+    session so Redis cleans them up
+  - wiki:user-sessions:<user> is the set of a user's session IDs, for
+    listing them; IDs whose session has gone are dropped when it is listed
+*/
+type redisSessions struct {
+  client *redisClient
+}
+
+func (s *redisSessions) key(id string) string {
+  return "wiki:session:" + id
+}
+
+func (s *redisSessions) Load(r *http.Request) (*Session, error) {
+  id := sessionID(r)
+  if id == "" {
+    return nil, nil
+  }
+  v, err := s.client.do("GET", s.key(id))
+  if err == errRedisNil {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  var sess Session
+  if err := json.Unmarshal([]byte(v.(string)), &sess); err != nil || time.Now().After(sess.Expires) {
+    return nil, nil
+  }
+  return &sess, nil
+}
+
+func (s *redisSessions) Save(w http.ResponseWriter, sess *Session) error {
+  data, err := json.Marshal(sess)
+  if err != nil {
+    return err
+  }
+  ttl := strconv.Itoa(int(time.Until(sess.Expires).Seconds()) + 1)
+  if _, err := s.client.do("SET", s.key(sess.ID), string(data), "EX", ttl); err != nil {
+    return err
+  }
+  if _, err := s.client.do("SADD", s.userKey(sess.User), sess.ID); err != nil {
+    return err
+  }
+  // The set lasts as long as the longest session could
+  if _, err := s.client.do("EXPIRE", s.userKey(sess.User), strconv.Itoa(int(rememberTTL.Seconds())+1)); err != nil {
+    return err
+  }
+  setSessionCookie(w, sess.ID, sess)
+  return nil
+}
+
+func (s *redisSessions) userKey(user string) string {
+  return "wiki:user-sessions:" + user
+}
+
+func (s *redisSessions) List(user string) ([]*Session, error) {
+  v, err := s.client.do("SMEMBERS", s.userKey(user))
+  if err != nil {
+    return nil, err
+  }
+  ids, _ := v.([]interface{})
+  list := []*Session{}
+  for _, id := range ids {
+    id, _ := id.(string)
+    v, err := s.client.do("GET", s.key(id))
+    if err == errRedisNil {
+      if _, err := s.client.do("SREM", s.userKey(user), id); err != nil {
+        return nil, err
+      }
+      continue
+    }
+    if err != nil {
+      return nil, err
+    }
+    var sess Session
+    if json.Unmarshal([]byte(v.(string)), &sess) == nil && sess.User == user && time.Now().Before(sess.Expires) {
+      list = append(list, &sess)
+    }
+  }
+  return list, nil
+}
+
+func (s *redisSessions) Revoke(user, id string) error {
+  v, err := s.client.do("GET", s.key(id))
+  if err == errRedisNil {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  var sess Session
+  if err := json.Unmarshal([]byte(v.(string)), &sess); err != nil || sess.User != user {
+    return nil
+  }
+  if _, err := s.client.do("DEL", s.key(id)); err != nil {
+    return err
+  }
+  _, err = s.client.do("SREM", s.userKey(user), id)
+  return err
+}
+
+func (s *redisSessions) Delete(w http.ResponseWriter, r *http.Request) error {
+  clearSessionCookie(w)
+  if id := sessionID(r); id != "" {
+    _, err := s.client.do("DEL", s.key(id))
+    return err
+  }
+  return nil
+}
+
+/* Data for the login form */
+type loginData struct {
+  Next string
+  Name string
+  Error string
+  OpenRegistration bool
+}
+
+/* Only follow local redirects after login, never //other.site or an absolute URL */
+func safeNext(next string) string {
+  if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+    return "/"
+  }
+  return next
+}
+
+/* Sign in at /login
+  - Accounts with two-factor sign in also need a code, see twofactor.go
+  - Failures count towards a lockout, see loginlimit.go
+*/
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+  data := &loginData{Next: safeNext(r.FormValue("next")), OpenRegistration: openRegistration}
+  if r.Method == http.MethodPost {
+    data.Name = r.FormValue("name")
+    ip := clientIP(r)
+    if loginLocked(w, data.Name, ip) {
+      data.Error = errLockedOut.Error()
+      w.WriteHeader(http.StatusTooManyRequests)
+      renderTemplate(w, "login", data)
+      return
+    }
+    u, err := users.authenticate(data.Name, r.FormValue("password"))
+    if err == nil && u.TOTPSecret != "" {
+      err = users.checkSecondFactor(u.Name, r.FormValue("code"))
+    }
+    if err == nil {
+      loginSucceeded(u.Name)
+      audit("login", u.Name, ip, "")
+      if err := startSession(w, r, u.Name, r.FormValue("remember") != ""); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+      http.Redirect(w, r, data.Next, http.StatusFound)
+      return
+    }
+    loginFailed(data.Name, ip, err.Error())
+    data.Error = err.Error()
+    w.WriteHeader(http.StatusUnauthorized)
+  }
+  renderTemplate(w, "login", data)
+}
+
+/* Sign out at /logout */
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+  if err := sessions.Delete(w, r); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, "/", http.StatusFound)
+}
+
+/* Data for the sessions page */
+type sessionsData struct {
+  Sessions []*Session
+  Current string // handle of the session viewing the page
+  Zone *time.Location
+  Error string
+}
+
+/* A user's sessions at /account/sessions
+  - POST action=revoke with handle signs that session out; action=others
+    signs out every session but this one
+*/
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+  cur, err := sessions.Load(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if cur == nil || users.get(cur.User) == nil {
+    http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+    return
+  }
+  data := &sessionsData{Current: cur.Handle(), Zone: viewerZone(r)}
+  list, err := sessions.List(cur.User)
+  if err == errNoRevoke {
+    data.Error = err.Error()
+    list = []*Session{cur}
+  } else if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if r.Method == http.MethodPost && data.Error == "" {
+    action, handle := r.FormValue("action"), r.FormValue("handle")
+    if action != "revoke" && action != "others" {
+      http.Error(w, "unknown action", http.StatusBadRequest)
+      return
+    }
+    for _, s := range list {
+      if (action == "revoke" && s.Handle() == handle) || (action == "others" && s.ID != cur.ID) {
+        if err := sessions.Revoke(cur.User, s.ID); err != nil {
+          http.Error(w, err.Error(), http.StatusInternalServerError)
+          return
+        }
+      }
+    }
+    audit("sessions-revoked", cur.User, clientIP(r), action)
+    if action == "revoke" && handle == data.Current {
+      clearSessionCookie(w)
+      http.Redirect(w, r, "/", http.StatusSeeOther)
+      return
+    }
+    http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+    return
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+  data.Sessions = list
+  renderTemplate(w, "sessions", data)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Share links
+  - A page that isn't public (see visibility.go) can be shared with someone
+    without an account by a link carrying ?share={token}, which lets them
+    read it (view, raw, print and so on) until the link expires, if it was
+    given an expiry, or is revoked
+  - A token is the share's id and expiry signed with HMAC-SHA256, so it can't
+    be made up or have its expiry pushed back; the share must also still be
+    listed in the page's metadata, which is what revoking removes
+  - The key is in data/share.key, made on first use, so links survive a
+    restart. Deleting it revokes every link at once
+  - Signed in users who may change the page manage its links and visibility
+    from the view page, with POST /share/{title}
+*/
+type Share struct {
+  ID string
+  Expires time.Time // zero for never
+  Created time.Time
+  By string
+}
+
+var shareKey = struct {
+  sync.Mutex
+  path string
+  key []byte
+}{path: "data/share.key"}
+
+/* The signing key, read or made on first use */
+func shareSigningKey() ([]byte, error) {
+  shareKey.Lock()
+  defer shareKey.Unlock()
+  if shareKey.key != nil {
+    return shareKey.key, nil
+  }
+  key, err := ioutil.ReadFile(shareKey.path)
+  if os.IsNotExist(err) {
+    key = make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+      return nil, err
+    }
+    err = ioutil.WriteFile(shareKey.path, key, 0600)
+  }
+  if err != nil {
+    return nil, err
+  }
+  shareKey.key = key
+  return key, nil
+}
+
+/* Token for share s of title: id.expiry.signature */
+func shareToken(title string, s Share) (string, error) {
+  key, err := shareSigningKey()
+  if err != nil {
+    return "", err
+  }
+  payload := s.ID + "." + strconv.FormatInt(unixOrZero(s.Expires), 10)
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte(title + "\n" + payload))
+  return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func unixOrZero(t time.Time) int64 {
+  if t.IsZero() {
+    return 0
+  }
+  return t.Unix()
+}
+
+/* Whether token is a valid, current share token for title */
+func sharedWith(title string, m PageMeta, token string) bool {
+  if token == "" {
+    return false
+  }
+  id, _, _ := strings.Cut(token, ".")
+  for _, s := range m.Shares {
+    if s.ID != id {
+      continue
+    }
+    want, err := shareToken(title, s)
+    if err != nil || !hmac.Equal([]byte(token), []byte(want)) {
+      return false
+    }
+    return s.Expires.IsZero() || time.Now().Before(s.Expires)
+  }
+  return false
+}
+
+/* A share as the view page lists it */
+type shareLink struct {
+  Share
+  URL string
+}
+
+func shareLinks(r *http.Request, title string, m PageMeta) ([]shareLink, error) {
+  links := []shareLink{}
+  for _, s := range m.Shares {
+    token, err := shareToken(title, s)
+    if err != nil {
+      return nil, err
+    }
+    links = append(links, shareLink{s, siteBase(r) + pageURL("view", title) + "?share=" + token})
+  }
+  return links, nil
+}
+
+/* POST /share/{title}, for those who may change the page (see authorizeWrite)
+  - action=visibility sets visibility to public, signed-in, owner or group;
+    owner makes the user doing it the owner, and group takes group, which
+    they must be in unless they're an admin
+  - action=create adds a link, expiring at expires (datetime-local) if given
+  - action=revoke with id removes that link
+*/
+func shareHandler(w http.ResponseWriter, r *http.Request, title string) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+pageURL("view", title), http.StatusFound)
+    return
+  }
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if err := writeAccess(title, m, u); err != nil {
+    http.Error(w, err.Error(), saveErrorStatus(err))
+    return
+  }
+  switch r.FormValue("action") {
+  case "visibility":
+    switch v := r.FormValue("visibility"); v {
+    case "public":
+      m.Visibility, m.Owner, m.Group = visibilityPublic, "", ""
+    case visibilitySignedIn:
+      m.Visibility, m.Owner, m.Group = v, "", ""
+    case visibilityOwner:
+      if m.Visibility != visibilityOwner {
+        m.Owner = u.Name
+      }
+      m.Visibility, m.Group = v, ""
+    case visibilityGroup:
+      g := r.FormValue("group")
+      if !inGroup(u, g) && !u.Admin {
+        http.Error(w, "you can only give the page to a group you're in", http.StatusForbidden)
+        return
+      }
+      m.Visibility, m.Owner, m.Group = v, "", g
+    default:
+      http.Error(w, "visibility must be public, signed-in, owner or group", http.StatusBadRequest)
+      return
+    }
+  case "create":
+    s := Share{Created: time.Now().UTC(), By: u.Name}
+    if v := r.FormValue("expires"); v != "" {
+      if s.Expires, err = parseInputTime(v, viewerZone(r)); err != nil {
+        http.Error(w, "invalid expiry time", http.StatusBadRequest)
+        return
+      }
+    }
+    if s.ID, err = randomID(); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    s.ID = s.ID[:16]
+    m.Shares = append(m.Shares, s)
+  case "revoke":
+    kept := []Share{}
+    for _, s := range m.Shares {
+      if s.ID != r.FormValue("id") {
+        kept = append(kept, s)
+      }
+    }
+    m.Shares = kept
+  default:
+    http.Error(w, "unknown action", http.StatusBadRequest)
+    return
+  }
+  if err := pageMeta.Save(title, m); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+  "crypto/rand"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strings"
+  "sync"
+)
+
+/* Short links
+  - /s/{id} redirects to the page the id was made for, for slides and
+    printed documents where a long title is a nuisance to type
+  - POST /api/v1/shortlinks/{title} makes one, or returns the one the page
+    already has, as {"id", "url"}; a page only ever has one
+  - Ids follow the page when it's renamed (see apiBatchHandler), so a link
+    keeps working that a redirect from the old title wouldn't (another page
+    can take that title)
+  - Kept in data/shortlinks.json as id -> title
+*/
+var shortLinks = struct {
+  sync.RWMutex
+  path string
+  to map[string]string
+}{path: "data/shortlinks.json", to: map[string]string{}}
+
+/* Letters and digits, leaving out the ones that are easily misread */
+const shortLinkAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+const shortLinkLength = 6
+
+func loadShortLinks() error {
+  data, err := ioutil.ReadFile(shortLinks.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  m := map[string]string{}
+  if err := json.Unmarshal(data, &m); err != nil {
+    return err
+  }
+  shortLinks.Lock()
+  shortLinks.to = m
+  shortLinks.Unlock()
+  return nil
+}
+
+/* Write m out and make it current; the caller holds the lock */
+func saveShortLinks(m map[string]string) error {
+  data, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(shortLinks.path, data, 0600); err != nil {
+    return err
+  }
+  shortLinks.to = m
+  settingsChanged("shortlinks")
+  return nil
+}
+
+/* The short link id of title, "" if it has none */
+func shortLinkOf(title string) string {
+  shortLinks.RLock()
+  defer shortLinks.RUnlock()
+  for id, t := range shortLinks.to {
+    if t == title {
+      return id
+    }
+  }
+  return ""
+}
+
+/* The id for title, made up if the page doesn't have one yet */
+func mintShortLink(title string) (string, error) {
+  shortLinks.Lock()
+  defer shortLinks.Unlock()
+  for id, t := range shortLinks.to {
+    if t == title {
+      return id, nil
+    }
+  }
+  b := make([]byte, shortLinkLength)
+  for {
+    if _, err := rand.Read(b); err != nil {
+      return "", err
+    }
+    for i := range b {
+      b[i] = shortLinkAlphabet[int(b[i])%len(shortLinkAlphabet)]
+    }
+    if _, taken := shortLinks.to[string(b)]; !taken {
+      break
+    }
+  }
+  m := map[string]string{string(b): title}
+  for id, t := range shortLinks.to {
+    m[id] = t
+  }
+  return string(b), saveShortLinks(m)
+}
+
+/* Move the short link of a renamed page to its new title */
+func renameShortLink(from, to string) error {
+  shortLinks.Lock()
+  defer shortLinks.Unlock()
+  m := map[string]string{}
+  moved := false
+  for id, t := range shortLinks.to {
+    if t == from {
+      t, moved = to, true
+    }
+    m[id] = t
+  }
+  if !moved {
+    return nil
+  }
+  return saveShortLinks(m)
+}
+
+func shortLinkURL(id string) string {
+  return "/s/" + id
+}
+
+/* GET /s/{id} */
+func shortLinkHandler(w http.ResponseWriter, r *http.Request) {
+  shortLinks.RLock()
+  title, ok := shortLinks.to[strings.TrimPrefix(r.URL.Path, "/s/")]
+  shortLinks.RUnlock()
+  if !ok {
+    http.NotFound(w, r)
+    return
+  }
+  // Not permanent: the page can still be renamed
+  http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
+
+/* POST /api/v1/shortlinks/{title} */
+func apiShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  title := strings.TrimPrefix(r.URL.Path, "/shortlinks/")
+  if !validTitle.MatchString(title) {
+    writeJSONError(w, http.StatusNotFound, "invalid page title")
+    return
+  }
+  if !pageExists(title) {
+    writeJSONError(w, http.StatusNotFound, errNoSuchPage.Error())
+    return
+  }
+  id, err := mintShortLink(title)
+  if err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]string{"id": id, "url": shortLinkURL(id)})
+}
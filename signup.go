@@ -0,0 +1,221 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "os"
+  "regexp"
+  "sort"
+  "strconv"
+  "sync"
+  "time"
+)
+
+/* Registration
+  - /signup makes an account and signs it in. With -open-registration anyone
+    can; otherwise it takes an invite link from an admin, /signup?invite={token}
+  - Invites are made on the admin page, expire after the days given, and
+    are used up by the account made with them, so a link passed on can't
+    be used again
+  - Kept in data/invites.json as token -> invite; expired ones are dropped
+    whenever the invites are next changed
+  - Names that parse as IP addresses are refused, since that is how the
+    history records anonymous edits (see requestAuthor)
+*/
+var openRegistration bool
+
+type Invite struct {
+  Created time.Time
+  Expires time.Time
+  By string
+}
+
+var invites = struct {
+  sync.Mutex
+  path string
+}{path: "data/invites.json"}
+
+var validUserName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,31}$`)
+
+const minPasswordLength = 8
+
+var errBadInvite = errors.New("This invite link is not valid: it may have expired or been used already")
+var errUserExists = errors.New("That name is taken")
+
+/* Read the invites; the caller holds the lock */
+func readInvites() (map[string]Invite, error) {
+  m := map[string]Invite{}
+  data, err := ioutil.ReadFile(invites.path)
+  if os.IsNotExist(err) {
+    return m, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  return m, json.Unmarshal(data, &m)
+}
+
+/* Write the invites that haven't expired; the caller holds the lock */
+func writeInvites(m map[string]Invite) error {
+  now := time.Now()
+  for token, inv := range m {
+    if !now.Before(inv.Expires) {
+      delete(m, token)
+    }
+  }
+  data, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(invites.path, data, 0600)
+}
+
+/* Whether token is an invite that can still be used */
+func validInvite(token string) bool {
+  invites.Lock()
+  defer invites.Unlock()
+  m, err := readInvites()
+  inv, ok := m[token]
+  return err == nil && ok && time.Now().Before(inv.Expires)
+}
+
+/* An invite as the admin page lists it */
+type inviteInfo struct {
+  Invite
+  Token string
+}
+
+func inviteList() ([]inviteInfo, error) {
+  invites.Lock()
+  defer invites.Unlock()
+  m, err := readInvites()
+  if err != nil {
+    return nil, err
+  }
+  list := []inviteInfo{}
+  now := time.Now()
+  for token, inv := range m {
+    if now.Before(inv.Expires) {
+      list = append(list, inviteInfo{inv, token})
+    }
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+  return list, nil
+}
+
+/* POST /admin/invites: action=create with days, or action=revoke with token */
+func invitesHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  invites.Lock()
+  defer invites.Unlock()
+  m, err := readInvites()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  switch r.FormValue("action") {
+  case "create":
+    days, err := strconv.Atoi(r.FormValue("days"))
+    if err != nil || days < 1 || days > 90 {
+      http.Error(w, "days must be between 1 and 90", http.StatusBadRequest)
+      return
+    }
+    token, err := randomID()
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    by := ""
+    if u := currentUser(r); u != nil {
+      by = u.Name
+    }
+    now := time.Now().UTC()
+    m[token] = Invite{Created: now, Expires: now.AddDate(0, 0, days), By: by}
+  case "revoke":
+    delete(m, r.FormValue("token"))
+  default:
+    http.Error(w, "unknown action", http.StatusBadRequest)
+    return
+  }
+  if err := writeInvites(m); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+/* Make the account name with password, using up the invite token unless
+  registration is open
+*/
+func register(name, password, token string) error {
+  if !validUserName.MatchString(name) {
+    return errors.New("Names are up to 32 letters, digits, '.', '-' and '_'")
+  }
+  if net.ParseIP(name) != nil {
+    return errors.New("Names can't be IP addresses")
+  }
+  if len(password) < minPasswordLength {
+    return errors.New("The password must be at least " + strconv.Itoa(minPasswordLength) + " characters")
+  }
+  hash, err := hashPassword(password)
+  if err != nil {
+    return err
+  }
+  // Held throughout so two sign ups can't share one invite
+  invites.Lock()
+  defer invites.Unlock()
+  m, err := readInvites()
+  if err != nil {
+    return err
+  }
+  if !openRegistration {
+    if inv, ok := m[token]; !ok || !time.Now().Before(inv.Expires) {
+      return errBadInvite
+    }
+  }
+  if err := users.create(&User{Name: name, PasswordHash: hash}); err != nil {
+    return err
+  }
+  if _, ok := m[token]; ok {
+    delete(m, token)
+    return writeInvites(m)
+  }
+  return nil
+}
+
+/* Data for the sign up form */
+type signupData struct {
+  Invite string
+  Name string
+  Error string
+}
+
+/* Sign up at /signup */
+func signupHandler(w http.ResponseWriter, r *http.Request) {
+  data := &signupData{Invite: r.FormValue("invite")}
+  if !openRegistration && !validInvite(data.Invite) {
+    http.Error(w, errBadInvite.Error(), http.StatusForbidden)
+    return
+  }
+  if r.Method == http.MethodPost {
+    data.Name = r.FormValue("name")
+    err := register(data.Name, r.FormValue("password"), data.Invite)
+    if err == nil {
+      if err := startSession(w, r, data.Name, false); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+      http.Redirect(w, r, "/", http.StatusFound)
+      return
+    }
+    data.Error = err.Error()
+    w.WriteHeader(http.StatusUnprocessableEntity)
+  }
+  renderTemplate(w, "signup", data)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+  "net/http"
+  "sort"
+)
+
+/* Site map
+  - /sitemap shows every page the reader can see as a nested list, built
+    from the page tree (see tree.go): the pages under Projects are grouped
+    in a section that unfolds, as are the pages under Projects/Roadmap, and
+    so on down
+  - Namespaces with no page of their own are shown by name, without a link
+  - Below that the same pages are grouped by tag (see tags.go), each tag
+    unfolding to the tree of its pages
+*/
+type sitemapData struct {
+  Tree *treeNode
+  Tags []sitemapTag
+}
+
+type sitemapTag struct {
+  Name string
+  Tree *treeNode
+}
+
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+  titles, err := listPages()
+  if err == nil {
+    titles, err = visiblePages(titles, currentUser(r))
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  metas, err := pageMeta.All()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  tagged := map[string][]string{}
+  for _, t := range titles {
+    for _, tag := range metas[t].Tags {
+      tagged[tag] = append(tagged[tag], t)
+    }
+  }
+  data := &sitemapData{Tree: pageTree(titles), Tags: []sitemapTag{}}
+  for tag, list := range tagged {
+    data.Tags = append(data.Tags, sitemapTag{Name: tag, Tree: pageTree(list)})
+  }
+  sort.Slice(data.Tags, func(i, j int) bool { return data.Tags[i].Name < data.Tags[j].Name })
+  renderTemplate(w, "sitemap", data)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "time"
+)
+
+/* Server-sent events at /events
+  - Sends an event for every page save and delete:
+      event: save
+      data: {"type":"save","title":"FrontPage","time":"2024-01-02T15:04:05Z"}
+  - ?namespace=Projects only sends events for pages in that namespace, and
+    ?minor=hide leaves out minor edits, which otherwise have "minor":true
+  - Pages the reader can't see (see visibility.go) are left out
+  - A comment line every 30 seconds keeps proxies from closing an idle stream
+*/
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+    return
+  }
+  ns, filter := r.URL.Query()["namespace"]
+  hideMinor := r.URL.Query().Get("minor") == "hide"
+  u := currentUser(r)
+  ch := pageEvents.subscribe()
+  defer pageEvents.unsubscribe(ch)
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.WriteHeader(http.StatusOK)
+  flusher.Flush()
+
+  heartbeat := time.NewTicker(30 * time.Second)
+  defer heartbeat.Stop()
+  for {
+    select {
+    case <-r.Context().Done():
+      return
+    case <-heartbeat.C:
+      fmt.Fprint(w, ": keepalive\n\n")
+    case ev := <-ch:
+      if filter && namespaceOf(ev.Title) != ns[0] || hideMinor && ev.Minor {
+        continue
+      }
+      if ok, _ := pageReadableBy(ev.Title, u); !ok {
+        continue
+      }
+      msg := map[string]interface{}{
+        "type": ev.Type,
+        "title": ev.Title,
+        "time": ev.Time.UTC().Format(time.RFC3339),
+      }
+      if ev.Minor {
+        msg["minor"] = true
+      }
+      data, _ := json.Marshal(msg)
+      fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+    }
+    flusher.Flush()
+  }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+  "net/http"
+  "sort"
+  "strings"
+  "time"
+)
+
+/* Stale pages
+  - With -stale-days N, a page nobody has changed or marked as current for N
+    days is stale: it is shown with a banner saying it may be outdated, and
+    listed at /stale, oldest first, so someone can bring it up to date
+  - Signed in users can mark a stale page as still current from the banner
+    (POST /verify/{title}), which starts its clock again without an edit
+  - Pages with an expiry date (see schedule.go) have their own banner, and
+    _Header, _Sidebar and _Footer pages are never stale
+*/
+var staleDays int
+
+/* When title was last changed or marked current, and whether that makes it stale */
+func staleSince(title string, m PageMeta) (time.Time, bool) {
+  if staleDays <= 0 || !m.ExpiresAt.IsZero() || strings.HasPrefix(title[strings.LastIndex(title, "/")+1:], "_") {
+    return time.Time{}, false
+  }
+  info, err := store.Stat(title)
+  if err != nil {
+    return time.Time{}, false
+  }
+  since := info.Modified
+  if m.Verified.After(since) {
+    since = m.Verified
+  }
+  return since, time.Since(since) > time.Duration(staleDays)*24*time.Hour
+}
+
+/* POST /verify/{title}: mark a page as still current */
+func verifyHandler(w http.ResponseWriter, r *http.Request, title string) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+pageURL("view", title), http.StatusFound)
+    return
+  }
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if !pageExists(title) || readAccess(title, m, u, "") != http.StatusOK {
+    http.NotFound(w, r)
+    return
+  }
+  m.Verified = time.Now().UTC()
+  if err := pageMeta.Save(title, m); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, pageURL("view", title), http.StatusSeeOther)
+}
+
+/* A stale page in the report */
+type stalePage struct {
+  Title string
+  Since time.Time
+  Author string // of the latest revision
+}
+
+type staleData struct {
+  Days int
+  Pages []stalePage
+  Zone *time.Location
+}
+
+/* The stale page report at /stale */
+func staleHandler(w http.ResponseWriter, r *http.Request) {
+  data := &staleData{Days: staleDays, Pages: []stalePage{}, Zone: viewerZone(r)}
+  if staleDays > 0 {
+    titles, err := listPages()
+    if err == nil {
+      titles, err = visiblePages(titles, currentUser(r))
+    }
+    var all map[string]PageMeta
+    if err == nil {
+      all, err = pageMeta.All()
+    }
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    for _, title := range titles {
+      since, stale := staleSince(title, all[title])
+      if !stale {
+        continue
+      }
+      p := stalePage{Title: title, Since: since}
+      if revs, err := history.Revisions(title); err == nil && len(revs) > 0 {
+        p.Author = revs[len(revs)-1].Author
+      }
+      data.Pages = append(data.Pages, p)
+    }
+    sort.SliceStable(data.Pages, func(i, j int) bool { return data.Pages[i].Since.Before(data.Pages[j].Since) })
+  }
+  renderTemplate(w, "stale", data)
+}
@@ -0,0 +1,135 @@
+// Edit page: live preview and collaborative editing
+var collabURL = document.currentScript.dataset.collabUrl;
+var uploadURL = document.currentScript.dataset.uploadUrl;
+var livePreview = document.currentScript.dataset.preview === "true";
+
+// Send the text to /ws/preview as it changes and show the rendered HTML that comes back
+(function() {
+  if (!livePreview) return;
+  var body = document.getElementById("body");
+  var preview = document.getElementById("preview");
+  var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+  var ws = new WebSocket(scheme + location.host + "/ws/preview");
+  ws.onmessage = function(e) { preview.innerHTML = e.data; };
+  body.addEventListener("input", function() {
+    if (ws.readyState === WebSocket.OPEN) {
+      ws.send(body.value);
+    }
+  });
+})();
+
+// Edit together with anyone else who has this page open, see collab.go.
+// Everything here counts UTF-16 code units, like the server.
+(function() {
+  if (!collabURL) return; // collab-editing is off
+  var body = document.getElementById("body");
+  var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+  var url = scheme + location.host + collabURL;
+  var ws, id, rev, confirmed, pending, joined = false;
+
+  function apply(text, op) {
+    return text.slice(0, op.pos) + op.ins + text.slice(op.pos + op.del);
+  }
+  // Single replace turning a into b
+  function diff(a, b) {
+    var start = 0, end = 0;
+    while (start < a.length && start < b.length && a[start] === b[start]) start++;
+    while (end < a.length - start && end < b.length - start &&
+           a[a.length - 1 - end] === b[b.length - 1 - end]) end++;
+    return {pos: start, del: a.length - start - end, ins: b.slice(start, b.length - end)};
+  }
+  // Must match transformOp in collab.go
+  function transform(a, b, aFirst) {
+    var aStart = a.pos, aEnd = a.pos + a.del, bStart = b.pos, bEnd = b.pos + b.del, bLen = b.ins.length;
+    if (aEnd <= bStart && bEnd <= aStart) return aFirst ? a : {pos: a.pos + bLen, del: a.del, ins: a.ins};
+    if (aEnd <= bStart) return a;
+    if (aStart >= bEnd) return {pos: a.pos + bLen - b.del, del: a.del, ins: a.ins};
+    if (aStart < bStart || (aStart === bStart && aFirst)) {
+      return {pos: aStart, del: bStart - aStart + bLen + Math.max(0, aEnd - bEnd), ins: a.ins + b.ins};
+    }
+    return {pos: bStart + bLen, del: Math.max(0, aEnd - bEnd), ins: a.ins};
+  }
+  function shift(i, op) {
+    if (i <= op.pos) return i;
+    if (i >= op.pos + op.del) return i + op.ins.length - op.del;
+    return op.pos + op.ins.length;
+  }
+  // Send local changes, one op at a time
+  function flush() {
+    if (!ws || ws.readyState !== WebSocket.OPEN || pending || body.value === confirmed) return;
+    pending = diff(confirmed, body.value);
+    ws.send(JSON.stringify({rev: rev, op: pending}));
+  }
+  // Tell the server we're up to rev, so it can forget older history. An op
+  // sent carries its rev too, so this is only needed with none in flight
+  function ack() {
+    ws.send(JSON.stringify({rev: rev}));
+  }
+  function connect() {
+    ws = new WebSocket(url);
+    ws.onmessage = function(e) {
+      var msg = JSON.parse(e.data);
+      if (msg.type === "init") {
+        id = msg.id; rev = msg.rev; confirmed = msg.text; pending = null;
+        // On first join take the shared text, which may have unsaved edits;
+        // after a reconnect keep what we have and send it as a change
+        if (!joined) body.value = msg.text;
+        joined = true;
+        flush();
+        return;
+      }
+      if (msg.from === id) {
+        confirmed = apply(confirmed, msg.op);
+        rev = msg.rev;
+        pending = null;
+        flush();
+        if (!pending) ack();
+        return;
+      }
+      var known = pending ? apply(confirmed, pending) : confirmed;
+      var op = msg.op;
+      if (pending) {
+        op = transform(msg.op, pending, true);
+        pending = transform(pending, msg.op, false);
+      }
+      op = transform(op, diff(known, body.value), true);
+      confirmed = apply(confirmed, msg.op);
+      rev = msg.rev;
+      var start = body.selectionStart, end = body.selectionEnd;
+      body.value = apply(body.value, op);
+      body.selectionStart = shift(start, op);
+      body.selectionEnd = shift(end, op);
+      if (!pending) ack();
+    };
+    ws.onclose = function() { setTimeout(connect, 1000); };
+  }
+  body.addEventListener("input", flush);
+  connect();
+})();
+
+// Upload images pasted or dropped into the text and insert their markup where
+// the cursor is, see apiUploadHandler. The input event passes the change on to
+// the preview and the other editors
+(function() {
+  var body = document.getElementById("body");
+  function upload(files) {
+    var images = Array.prototype.filter.call(files, function(f) { return f.type.indexOf("image/") === 0; });
+    images.forEach(function(file) {
+      fetch(uploadURL, {method: "POST", body: file}).then(function(resp) {
+        return resp.json().then(function(data) {
+          if (!resp.ok) throw new Error(data.error);
+          body.setRangeText(data.markup, body.selectionStart, body.selectionEnd, "end");
+          body.dispatchEvent(new Event("input"));
+        });
+      }).catch(function(err) { alert("Upload failed: " + err.message); });
+    });
+    return images.length > 0;
+  }
+  body.addEventListener("paste", function(e) {
+    if (e.clipboardData && upload(e.clipboardData.files)) e.preventDefault();
+  });
+  body.addEventListener("dragover", function(e) { e.preventDefault(); });
+  body.addEventListener("drop", function(e) {
+    if (e.dataTransfer && upload(e.dataTransfer.files)) e.preventDefault();
+  });
+})();
@@ -0,0 +1,21 @@
+// Sort tables with class "sortable" by clicking a header; click again to reverse.
+// Columns where every cell is a number sort numerically
+document.querySelectorAll("table.sortable").forEach(function(table) {
+  var body = table.tBodies[0];
+  table.querySelectorAll("thead th").forEach(function(th, col) {
+    th.style.cursor = "pointer";
+    th.addEventListener("click", function() {
+      var rows = Array.prototype.slice.call(body.rows);
+      var text = function(row) { return row.cells[col] ? row.cells[col].textContent.trim() : ""; };
+      var numeric = rows.every(function(row) { return text(row) !== "" && !isNaN(Number(text(row))); });
+      var dir = th.dataset.dir === "asc" ? -1 : 1;
+      table.querySelectorAll("thead th").forEach(function(h) { delete h.dataset.dir; });
+      th.dataset.dir = dir === 1 ? "asc" : "desc";
+      rows.sort(function(a, b) {
+        var x = text(a), y = text(b);
+        return dir * (numeric ? Number(x) - Number(y) : x.localeCompare(y));
+      });
+      rows.forEach(function(row) { body.appendChild(row); });
+    });
+  });
+});
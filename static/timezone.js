@@ -0,0 +1,6 @@
+// Tell the wiki the browser's time zone so it can show times in it, see localtime.go
+(function() {
+  var zone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+  if (!zone || document.cookie.split("; ").indexOf("wiki_tz=" + zone) >= 0) return;
+  document.cookie = "wiki_tz=" + zone + "; path=/; max-age=31536000; samesite=lax";
+})();
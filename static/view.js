@@ -0,0 +1,36 @@
+// Keep the page up to date: show the new text when someone else saves it, and
+// reload when it is published or expires. See fragment.go
+(function() {
+  var title = document.currentScript.dataset.title;
+  var content = document.getElementById("content");
+  var history = document.getElementById("history");
+
+  // Fill el with the fragment at url, reloading the whole page if that fails
+  function load(el, url) {
+    fetch(url).then(function(resp) {
+      if (!resp.ok) throw new Error(resp.statusText);
+      return resp.text();
+    }).then(function(html) { el.innerHTML = html; })
+      .catch(function() { location.reload(); });
+  }
+  function loadHistory() {
+    load(history.querySelector("div"), history.dataset.src + location.search);
+  }
+  history.addEventListener("toggle", function() {
+    if (history.open) loadHistory();
+  });
+
+  var events = new EventSource("/events");
+  events.addEventListener("save", function(e) {
+    if (JSON.parse(e.data).title !== title) return;
+    load(content, content.dataset.src + location.search);
+    if (history.open) loadHistory();
+  });
+  ["publish", "expire"].forEach(function(type) {
+    events.addEventListener(type, function(e) {
+      if (JSON.parse(e.data).title === title) {
+        location.reload();
+      }
+    });
+  });
+})();
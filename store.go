@@ -0,0 +1,321 @@
+package main
+
+import (
+  "errors"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Page storage
+  - Everything that reads or writes page bodies goes through store, so the
+    storage backend can be swapped without touching the handlers
+  - Load and Stat return an error satisfying os.IsNotExist for a missing page
+  - List returns titles sorted alphabetically
+*/
+type PageStore interface {
+  Load(title string) ([]byte, error)
+  Stat(title string) (PageInfo, error)
+  Save(title string, body []byte) error
+  Delete(title string) error
+  List() ([]string, error)
+}
+
+/* Metadata about a stored page */
+type PageInfo struct {
+  Title string
+  Size int64
+  Modified time.Time
+}
+
+/* One write in a batch: Body is saved under Title, or Title is deleted if Delete is set
+  - Meta, if set, becomes the page's metadata: for a save before the body is
+    written, so a renamed page is never readable by more people than it was,
+    and for a delete after, clearing it when it's the zero PageMeta
+*/
+type storeOp struct {
+  Title string
+  Body []byte
+  Delete bool
+  Meta *PageMeta
+}
+
+/* Backends that can apply several writes as one
+  - Either all ops are applied or, on error, none of them are
+*/
+type atomicStore interface {
+  Apply(ops []storeOp) error
+}
+
+/* The store used by the wiki */
+var store PageStore = newFileStore("data")
+
+/* Set up the page, history and attachment stores from the command line settings
+  - kind is "file" or "memory" (see memory.go)
+  - compression is "none" or "gzip", encrypt switches on encryption with the
+    key from loadEncryptionKey (see compress.go)
+*/
+func configureStorage(kind, compression string, encrypt bool, keyFile string) error {
+  codec := &fileCodec{}
+  switch compression {
+  case "none":
+  case "gzip":
+    codec.compress = true
+  default:
+    return errors.New("unknown compression " + compression)
+  }
+  if encrypt || keyFile != "" {
+    aead, err := loadEncryptionKey(keyFile)
+    if err != nil {
+      return err
+    }
+    codec.aead = aead
+  }
+  fs, fh, fa := newFileStore("data"), newFileHistory("data/history"), newFileAttachments("data/attachments")
+  fp := newFileProposals("data/proposals")
+  fs.codec, fh.codec, fa.aead, fp.codec = codec, codec, codec.aead, codec
+  store, history, attachments, proposals = fs, fh, fa, fp
+  thumbCodec = &fileCodec{aead: codec.aead}
+  backupCodec = &fileCodec{aead: codec.aead}
+  switch strings.TrimSuffix(kind, "://") {
+  case "file":
+  case "memory":
+    store, history = newMemoryStore(), newMemoryHistory()
+  case "dropbox", "gdrive":
+    if codec.compress || codec.aead != nil {
+      return errors.New("-store " + kind + " keeps pages as plain files, and can't be used with -compress or -encrypt")
+    }
+    cs, err := newCloudStore(kind)
+    if err != nil {
+      return err
+    }
+    store = cs
+  default:
+    return errors.New("unknown store " + kind)
+  }
+  return nil
+}
+
+/* Apply ops to the store, atomically if the backend supports it; the
+  caller holds the locks of the pages they write (see lockPages)
+  - Returns whether the ops were applied atomically
+  - Without backend support the ops are applied in order and stop at the first error
+  - Each applied save is recorded in the history as a revision by author, and
+    every applied op is published to pageEvents
+*/
+func applyOps(ops []storeOp, author string) (bool, error) {
+  old := map[string][]byte{}
+  for _, op := range ops {
+    if _, seen := old[op.Title]; !seen {
+      old[op.Title], _ = store.Load(op.Title)
+    }
+  }
+  oldMeta, err := saveOpMeta(ops)
+  if err != nil {
+    restoreMeta(oldMeta)
+    return false, err
+  }
+  if a, ok := store.(atomicStore); ok {
+    if err := a.Apply(ops); err != nil {
+      restoreMeta(oldMeta)
+      return true, err
+    }
+    return true, afterOps(ops, old, author)
+  }
+  for i, op := range ops {
+    var err error
+    if op.Delete {
+      err = store.Delete(op.Title)
+    } else {
+      err = store.Save(op.Title, op.Body)
+    }
+    if err != nil {
+      afterOps(ops[:i], old, author)
+      return false, err
+    }
+  }
+  return false, afterOps(ops, old, author)
+}
+
+/* Write the metadata the saves in ops carry, returning what each page had
+  before, for restoreMeta
+*/
+func saveOpMeta(ops []storeOp) (map[string]PageMeta, error) {
+  old := map[string]PageMeta{}
+  for _, op := range ops {
+    if op.Meta == nil || op.Delete {
+      continue
+    }
+    if _, seen := old[op.Title]; !seen {
+      m, err := pageMeta.Load(op.Title)
+      if err != nil {
+        return old, err
+      }
+      old[op.Title] = m
+    }
+    if err := pageMeta.Save(op.Title, *op.Meta); err != nil {
+      return old, err
+    }
+  }
+  return old, nil
+}
+
+func restoreMeta(old map[string]PageMeta) {
+  for title, m := range old {
+    pageMeta.Save(title, m)
+  }
+}
+
+/* Record and publish ops that have been applied
+  - old holds each page's body before the batch, for recordRevision
+*/
+func afterOps(ops []storeOp, old map[string][]byte, author string) error {
+  var firstErr error
+  for _, op := range ops {
+    if op.Delete {
+      if op.Meta != nil {
+        if err := pageMeta.Save(op.Title, *op.Meta); err != nil && firstErr == nil {
+          firstErr = err
+        }
+      }
+      pageEvents.send(PageEvent{Type: "delete", Title: op.Title, Time: time.Now().UTC(), Author: author})
+      auditActivity("page-deleted", author, op.Title, "")
+      old[op.Title] = nil
+      continue
+    }
+    rev, err := recordRevision(op.Title, old[op.Title], op.Body, author, false)
+    if err != nil && firstErr == nil {
+      firstErr = err
+    }
+    old[op.Title] = op.Body
+    pageEvents.send(PageEvent{Type: "save", Title: op.Title, Time: time.Now().UTC(), Author: author, Revision: rev})
+  }
+  return firstErr
+}
+
+/* Storage name for a title
+  - Titles may contain spaces ("Project Plan") and slashes ("Projects/Roadmap"),
+    which we don't want in file names
+  - url.PathEscape maps the title to a safe name ("Project%20Plan") that can be
+    turned back into the title with url.PathUnescape when listing pages
+*/
+func storageName(title string) string {
+  return url.PathEscape(title)
+}
+
+/* File backend
+  - One .txt file per page in dir, named with storageName
+  - mu serialises writes so a batch can't interleave with a single save
+  - codec compresses and encrypts files as configured
+*/
+type fileStore struct {
+  dir string
+  mu sync.Mutex
+  codec *fileCodec
+}
+
+func newFileStore(dir string) *fileStore {
+  return &fileStore{dir: dir, codec: &fileCodec{}}
+}
+
+/* File a page is stored in */
+func (s *fileStore) filename(title string) string {
+  return filepath.Join(s.dir, storageName(title) + ".txt")
+}
+
+func (s *fileStore) Load(title string) ([]byte, error) {
+  return s.codec.read(s.filename(title))
+}
+
+/* Size is the size of the body, not of the possibly compressed or encrypted file */
+func (s *fileStore) Stat(title string) (PageInfo, error) {
+  info, err := os.Stat(s.filename(title))
+  if err != nil {
+    return PageInfo{}, err
+  }
+  size, err := s.codec.size(s.filename(title))
+  if err != nil {
+    return PageInfo{}, err
+  }
+  return PageInfo{Title: title, Size: size, Modified: info.ModTime()}, nil
+}
+
+func (s *fileStore) Save(title string, body []byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.codec.write(s.filename(title), body)
+}
+
+func (s *fileStore) Delete(title string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return os.Remove(s.filename(title))
+}
+
+/* Reads the titles back from the storage names, skipping files we didn't write */
+func (s *fileStore) List() ([]string, error) {
+  files, err := filepath.Glob(filepath.Join(s.dir, "*.txt"))
+  if err != nil {
+    return nil, err
+  }
+  titles := []string{}
+  for _, f := range files {
+    title, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(f), ".txt"))
+    if err != nil || !validTitle.MatchString(title) {
+      continue
+    }
+    titles = append(titles, title)
+  }
+  sort.Strings(titles)
+  return titles, nil
+}
+
+/* Apply a batch of writes, rolling back on failure
+  - The current contents of every page touched are read first
+  - If any write fails, those contents are put back byte for byte (or the page
+    removed if it didn't exist) so the data directory is left as it was
+  - Not crash safe: a crash half way through a batch can leave it partly applied
+*/
+func (s *fileStore) Apply(ops []storeOp) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  before := map[string][]byte{}
+  for _, op := range ops {
+    if _, seen := before[op.Title]; seen {
+      continue
+    }
+    body, err := ioutil.ReadFile(s.filename(op.Title))
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    before[op.Title] = body // nil when the page doesn't exist
+  }
+  for _, op := range ops {
+    var err error
+    if op.Delete {
+      err = os.Remove(s.filename(op.Title))
+    } else {
+      err = s.codec.write(s.filename(op.Title), op.Body)
+    }
+    if err != nil {
+      s.rollback(before)
+      return err
+    }
+  }
+  return nil
+}
+
+func (s *fileStore) rollback(before map[string][]byte) {
+  for title, body := range before {
+    if body == nil {
+      os.Remove(s.filename(title))
+    } else {
+      ioutil.WriteFile(s.filename(title), body, 0600)
+    }
+  }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+  "bytes"
+  "log"
+  "net/http"
+)
+
+/* Streaming render
+  - A page whose body is over streamThreshold (-stream-threshold) is sent as
+    it's rendered instead of all at once: the template up to the body, then
+    the body streamChunk at a time, then the rest of the template, flushing
+    each, so a browser starts showing a multi-megabyte page straight away
+  - Templates used this way define {name}_head and {name}_foot, the parts
+    before and after the body (see view.html)
+  - With no Content-Length the response goes out chunked
+  - Once the head is sent the status can't change, so a later error is
+    only logged and the page is cut short
+  - Streamed pages aren't under the request timeout, as http.TimeoutHandler
+    holds the whole response back (see withTimeout)
+*/
+var streamThreshold int64 = 1 << 20
+
+const streamChunk = 32 << 10
+
+/* Whether a page with this body is streamed */
+func streamed(body []byte) bool {
+  return streamThreshold > 0 && int64(len(body)) > streamThreshold
+}
+
+/* Whether r is for a page that will be streamed, going by its stored size */
+func streamedRequest(r *http.Request) bool {
+  if streamThreshold <= 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+    return false
+  }
+  m := validPath.FindStringSubmatch(r.URL.Path)
+  if m == nil || (m[1] != "view" && m[1] != "print") {
+    return false
+  }
+  info, err := store.Stat(m[2])
+  return err == nil && info.Size > streamThreshold
+}
+
+/* Execute the template name around body, streaming it */
+func streamTemplate(w http.ResponseWriter, name string, data interface{}, body []byte) {
+  t := templates.Load()
+  var buf bytes.Buffer
+  if err := t.ExecuteTemplate(&buf, name+"_head", data); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  rc := http.NewResponseController(w)
+  var err error
+  send := func() {
+    if err == nil {
+      _, err = w.Write(buf.Bytes())
+    }
+    if err == nil {
+      rc.Flush() // nothing to be done if it can't, it all arrives at the end
+    }
+    buf.Reset()
+  }
+  send()
+  renderBlocks(&buf, body, func() {
+    if buf.Len() >= streamChunk {
+      send()
+    }
+  })
+  if terr := t.ExecuteTemplate(&buf, name+"_foot", data); terr != nil && err == nil {
+    err = terr
+  }
+  send()
+  if err != nil {
+    log.Printf("streaming %s: %v", name, err)
+  }
+}
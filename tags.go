@@ -0,0 +1,77 @@
+package main
+
+import (
+  "errors"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "unicode"
+)
+
+/* Tags
+  - A page's tags are set on the edit form as words separated by spaces or
+    commas, and kept in its metadata (PageMeta.Tags), lower cased and sorted
+  - Each is up to 32 letters, digits, '.', '-' and '_', and a page has at
+    most maxTags
+  - The view page lists them, each linking to /pages?tag= for the pages
+    that have it (see listing.go), and search takes tag: (searchfilter.go)
+  - /epub?tag= makes a book of the pages with a tag (see epub.go), and the
+    site map groups the pages by tag (sitemap.go)
+  - GraphQL has a page's tags, and pages(tag:) (see graphql.go)
+*/
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+const maxTags = 20
+
+var errBadTag = errors.New("Tags are up to 32 letters, digits, '.', '-' and '_'")
+
+/* Tags from the edit form's field, nil for none */
+func parseTags(s string) ([]string, error) {
+  var tags []string
+  seen := map[string]bool{}
+  split := func(r rune) bool { return r == ',' || unicode.IsSpace(r) }
+  for _, t := range strings.FieldsFunc(strings.ToLower(s), split) {
+    if !validTag.MatchString(t) {
+      return nil, errBadTag
+    }
+    if !seen[t] {
+      seen[t] = true
+      tags = append(tags, t)
+    }
+  }
+  if len(tags) > maxTags {
+    return nil, errors.New("A page can have at most " + strconv.Itoa(maxTags) + " tags")
+  }
+  sort.Strings(tags)
+  return tags, nil
+}
+
+/* The tags as the edit form shows them */
+func (m PageMeta) TagText() string {
+  return strings.Join(m.Tags, " ")
+}
+
+func (m PageMeta) hasTag(tag string) bool {
+  for _, t := range m.Tags {
+    if t == tag {
+      return true
+    }
+  }
+  return false
+}
+
+/* Those of titles tagged tag, in the same order */
+func taggedPages(titles []string, tag string) ([]string, error) {
+  all, err := pageMeta.All()
+  if err != nil {
+    return nil, err
+  }
+  tagged := []string{}
+  for _, t := range titles {
+    if all[t].hasTag(tag) {
+      tagged = append(tagged, t)
+    }
+  }
+  return tagged, nil
+}
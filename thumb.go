@@ -0,0 +1,155 @@
+package main
+
+import (
+  "bytes"
+  "image"
+  "image/color"
+  _ "image/gif" // for image.Decode
+  "image/jpeg"
+  "image/png"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+)
+
+/* Thumbnails of image attachments at /thumb/{title}/{name}?w=300
+  - The image is scaled down to w pixels wide (never up), keeping its aspect
+    ratio, and kept in data/thumbs so each size is only made once; a thumbnail
+    older than its attachment is made again
+  - PNG, JPEG and GIF can be decoded with the standard library. Other images
+    (WebP) are redirected to the full file
+  - Huge images are refused before decoding, so a small file claiming to be
+    enormous can't use up all the memory
+*/
+var thumbDir = "data/thumbs"
+
+/* Encrypts cached thumbnails when -encrypt is on, like the attachments */
+var thumbCodec = &fileCodec{}
+
+const defaultThumbWidth = 200
+const maxThumbWidth = 1024
+const maxThumbSourcePixels = 50 << 20
+
+var thumbTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true}
+
+func thumbHandler(w http.ResponseWriter, r *http.Request) {
+  page, name, ok := attachmentPath(r.URL.Path, "/thumb/")
+  if !ok {
+    http.NotFound(w, r)
+    return
+  }
+  width := defaultThumbWidth
+  if s := r.FormValue("w"); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < 1 || n > maxThumbWidth {
+      http.Error(w, "w must be between 1 and "+strconv.Itoa(maxThumbWidth), http.StatusBadRequest)
+      return
+    }
+    width = n
+  }
+  if hideUnreadable(w, r, page) {
+    return
+  }
+  a, err := attachments.Stat(page, name)
+  if os.IsNotExist(err) {
+    http.NotFound(w, r)
+    return
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if !thumbTypes[a.Type] {
+    if inlineTypes[a.Type] {
+      http.Redirect(w, r, attachmentURL(page, name), http.StatusFound)
+      return
+    }
+    http.Error(w, "not an image", http.StatusUnsupportedMediaType)
+    return
+  }
+  thumb, typ, err := thumbnail(a, width)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  w.Header().Set("Content-Type", typ)
+  http.ServeContent(w, r, name, a.Uploaded, bytes.NewReader(thumb))
+}
+
+/* The thumbnail of a at width, from the cache or made now, and its type */
+func thumbnail(a Attachment, width int) ([]byte, string, error) {
+  typ := "image/png"
+  if a.Type == "image/jpeg" {
+    typ = "image/jpeg"
+  }
+  path := filepath.Join(thumbDir, storageName(a.Page), strconv.Itoa(width)+"-"+a.Name)
+  if info, err := os.Stat(path); err == nil && !info.ModTime().Before(a.Uploaded) {
+    if thumb, err := thumbCodec.read(path); err == nil {
+      return thumb, typ, nil
+    }
+  }
+  data, _, err := attachments.Load(a.Page, a.Name)
+  if err != nil {
+    return nil, "", err
+  }
+  cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+  if err != nil {
+    return nil, "", err
+  }
+  if cfg.Width*cfg.Height > maxThumbSourcePixels {
+    return nil, "", errAttachmentTooLarge
+  }
+  src, _, err := image.Decode(bytes.NewReader(data))
+  if err != nil {
+    return nil, "", err
+  }
+  var buf bytes.Buffer
+  dst := scaleDown(src, width)
+  if typ == "image/jpeg" {
+    err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+  } else {
+    err = png.Encode(&buf, dst)
+  }
+  if err != nil {
+    return nil, "", err
+  }
+  // A failure to cache only costs making it again next time
+  if os.MkdirAll(filepath.Dir(path), 0700) == nil {
+    thumbCodec.write(path, buf.Bytes())
+  }
+  return buf.Bytes(), typ, nil
+}
+
+/* Scale src to width pixels wide, averaging the source pixels behind each one */
+func scaleDown(src image.Image, width int) image.Image {
+  b := src.Bounds()
+  if width >= b.Dx() {
+    return src
+  }
+  height := max(1, b.Dy()*width/b.Dx())
+  dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+  for y := 0; y < height; y++ {
+    y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+    for x := 0; x < width; x++ {
+      x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+      var r, g, bl, al, n uint64
+      for sy := y0; sy < max(y1, y0+1); sy++ {
+        for sx := x0; sx < max(x1, x0+1); sx++ {
+          cr, cg, cb, ca := src.At(sx, sy).RGBA()
+          r, g, bl, al, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), al+uint64(ca), n+1
+        }
+      }
+      dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(al / n)})
+    }
+  }
+  return dst
+}
+
+/* Drop the cached thumbnails of an attachment that has gone */
+func removeThumbnails(page, name string) {
+  files, _ := filepath.Glob(filepath.Join(thumbDir, storageName(page), "*-"+name))
+  for _, f := range files {
+    os.Remove(f)
+  }
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+/* Page tree
+  - Titles nest with "/": Projects/Roadmap is under Projects. GET
+    /api/{version}/tree returns the pages as that tree, each node with the
+    last part of its title as its name, whether there's a page of that title
+    (Projects/Roadmap can exist without Projects), how many children it has
+    and how many pages there are under it in all
+  - ?root=Projects returns only the tree under Projects, and ?depth=1 only
+    that many levels of it; the nodes that are cut off keep their counts, so
+    a tree widget can show them as closed and ask for them when opened
+  - Pages the caller can't read are left out, and aren't counted
+*/
+type treeNode struct {
+  Name string `json:"name"`
+  Title string `json:"title"`
+  Exists bool `json:"exists"`
+  ChildCount int `json:"child_count"`
+  PageCount int `json:"page_count"` // pages under it, not counting itself
+  Children []*treeNode `json:"children,omitempty"`
+}
+
+/* The tree of titles, under a root with no title */
+func pageTree(titles []string) *treeNode {
+  titles = append([]string(nil), titles...)
+  sort.Strings(titles)
+  root := &treeNode{}
+  for _, t := range titles {
+    n := root
+    parts := strings.Split(t, "/")
+    for i, part := range parts {
+      n = n.child(part, strings.Join(parts[:i+1], "/"))
+    }
+    n.Exists = true
+  }
+  root.count()
+  return root
+}
+
+func (n *treeNode) child(name, title string) *treeNode {
+  for _, c := range n.Children {
+    if c.Name == name {
+      return c
+    }
+  }
+  c := &treeNode{Name: name, Title: title}
+  n.Children = append(n.Children, c)
+  return c
+}
+
+/* Fill in the counts, returning how many pages the subtree has */
+func (n *treeNode) count() int {
+  n.ChildCount = len(n.Children)
+  n.PageCount = 0
+  for _, c := range n.Children {
+    n.PageCount += c.count()
+  }
+  if n.Exists {
+    return n.PageCount + 1
+  }
+  return n.PageCount
+}
+
+/* The node for title, nil if there's nothing at or under it */
+func (n *treeNode) find(title string) *treeNode {
+  for _, part := range strings.Split(title, "/") {
+    var next *treeNode
+    for _, c := range n.Children {
+      if c.Name == part {
+        next = c
+        break
+      }
+    }
+    if next == nil {
+      return nil
+    }
+    n = next
+  }
+  return n
+}
+
+/* A copy of the tree down to depth levels below n */
+func (n *treeNode) prune(depth int) *treeNode {
+  c := *n
+  c.Children = nil
+  if depth > 0 {
+    for _, child := range n.Children {
+      c.Children = append(c.Children, child.prune(depth-1))
+    }
+  }
+  return &c
+}
+
+/* GET /api/{version}/tree */
+func apiTreeHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+  depth := -1
+  if s := r.FormValue("depth"); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < 0 {
+      writeJSONError(w, http.StatusBadRequest, "depth must be a number of levels")
+      return
+    }
+    depth = n
+  }
+  titles, err := listPages()
+  if err == nil {
+    titles, err = visiblePages(titles, currentUser(r))
+  }
+  if err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  tree := pageTree(titles)
+  if root := r.FormValue("root"); root != "" {
+    if !validTitle.MatchString(root) {
+      writeJSONError(w, http.StatusBadRequest, "invalid page title")
+      return
+    }
+    if tree = tree.find(root); tree == nil {
+      writeJSONError(w, http.StatusNotFound, "no pages at or under "+root)
+      return
+    }
+  }
+  if depth >= 0 {
+    tree = tree.prune(depth)
+  }
+  writeJSON(w, http.StatusOK, tree)
+}
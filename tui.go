@@ -0,0 +1,241 @@
+package main
+
+import (
+  "bufio"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "os/exec"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+)
+
+/* wiki tui, for reading a wiki from a terminal where there's no browser
+  - wiki tui -server https://wiki.example.com lists the pages; type a
+    number and Enter to read one. It works through the JSON API as wiki cli
+    does, with the same -token and WIKI_URL and WIKI_TOKEN
+  - A screenful at a time: n and p move through a long list or page
+  - /text shows only the titles containing text, and / on its own all of
+    them again. This only looks at titles, not at the text as the wiki's
+    search does (search.go)
+  - Reading a page lists its subpages (Title/...) to go on to; e edits it
+    as wiki cli edit does, b goes back, r fetches it again, q quits
+  - Commands are read a line at a time rather than a key at a time, so it
+    needs no terminal modes and works over any SSH session or serial line
+*/
+type tui struct {
+  c *cliClient
+  in *bufio.Reader
+  out io.Writer
+  width, height int
+  titles []string
+}
+
+/* A screen: the list of pages, or one page */
+type tuiScreen struct {
+  title string // "" for the list
+  filter string
+  lines []string
+  links []string // what the numbers shown open
+  top int // first line shown
+}
+
+func tuiMain(args []string) int {
+  flags := flag.NewFlagSet("tui", flag.ExitOnError)
+  server := flags.String("server", envOr("WIKI_URL", "http://localhost:8080"), "address of the wiki")
+  token := flags.String("token", os.Getenv("WIKI_TOKEN"), "API token to act with; reads don't need one unless the pages are private")
+  flags.Parse(args)
+  t := &tui{c: &cliClient{base: strings.TrimSuffix(*server, "/"), token: *token}, in: bufio.NewReader(os.Stdin), out: os.Stdout}
+  t.width, t.height = terminalSize()
+  if err := t.run(); err != nil && err != io.EOF {
+    fmt.Fprintln(os.Stderr, "wiki tui:", err)
+    return 1
+  }
+  return 0
+}
+
+/* Columns and rows of the terminal, from stty, $COLUMNS and $LINES, or 80x24 */
+func terminalSize() (int, int) {
+  w, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+  h, _ := strconv.Atoi(os.Getenv("LINES"))
+  cmd := exec.Command("stty", "size")
+  cmd.Stdin = os.Stdin
+  if out, err := cmd.Output(); err == nil {
+    if f := strings.Fields(string(out)); len(f) == 2 {
+      h, _ = strconv.Atoi(f[0])
+      w, _ = strconv.Atoi(f[1])
+    }
+  }
+  if w < 20 {
+    w = 80
+  }
+  if h < 5 {
+    h = 24
+  }
+  return w, h
+}
+
+func (t *tui) run() error {
+  var err error
+  if t.titles, err = t.c.titles(); err != nil {
+    return err
+  }
+  stack := []*tuiScreen{t.list("")}
+  message := ""
+  for {
+    s := stack[len(stack)-1]
+    t.draw(s, message)
+    message = ""
+    line, err := t.in.ReadString('\n')
+    if err != nil && line == "" {
+      return err
+    }
+    cmd := strings.TrimSpace(line)
+    rows := t.height - 3
+    switch {
+    case cmd == "q":
+      return nil
+    case cmd == "n" || cmd == "":
+      if s.top+rows < len(s.lines) {
+        s.top += rows
+      } else if cmd == "n" {
+        message = "at the end"
+      }
+    case cmd == "p":
+      s.top = max(0, s.top-rows)
+    case cmd == "b":
+      if len(stack) > 1 {
+        stack = stack[:len(stack)-1]
+      }
+    case strings.HasPrefix(cmd, "/"):
+      stack = append(stack, t.list(cmd[1:]))
+    case cmd == "r" && s.title != "":
+      next, err := t.page(s.title)
+      if err != nil {
+        message = err.Error()
+        break
+      }
+      stack[len(stack)-1] = next
+    case cmd == "e" && s.title != "":
+      if err := t.c.edit(s.title, false, t.in); err != nil {
+        message = err.Error()
+      }
+      if next, err := t.page(s.title); err == nil {
+        stack[len(stack)-1] = next
+      }
+      if t.titles, err = t.c.titles(); err != nil {
+        message = err.Error()
+      }
+    default:
+      n, err := strconv.Atoi(cmd)
+      if err != nil || n < 1 || n > len(s.links) {
+        message = "unknown command " + strconv.Quote(cmd)
+        break
+      }
+      next, err := t.page(s.links[n-1])
+      if err != nil {
+        message = err.Error()
+        break
+      }
+      stack = append(stack, next)
+    }
+  }
+}
+
+/* The titles containing filter, numbered */
+func (t *tui) list(filter string) *tuiScreen {
+  s := &tuiScreen{filter: filter}
+  needle := strings.ToLower(filter)
+  for _, title := range t.titles {
+    if strings.Contains(strings.ToLower(title), needle) {
+      s.links = append(s.links, title)
+      s.lines = append(s.lines, fmt.Sprintf("%4d  %s", len(s.links), title))
+    }
+  }
+  if len(s.lines) == 0 {
+    s.lines = []string{"no pages match"}
+  }
+  return s
+}
+
+/* A page's text, wrapped to the terminal, then its subpages numbered */
+func (t *tui) page(title string) (*tuiScreen, error) {
+  p, _, err := t.c.page(title)
+  if err == errCLINotFound {
+    return nil, fmt.Errorf("%s doesn't exist", title)
+  }
+  if err != nil {
+    return nil, err
+  }
+  s := &tuiScreen{title: title}
+  info := "revision " + strconv.Itoa(p.Revision)
+  if !p.Modified.IsZero() {
+    info += ", changed " + p.Modified.Local().Format("2 Jan 2006 15:04")
+  }
+  s.lines = append(s.lines, info, "")
+  for _, line := range strings.Split(strings.ReplaceAll(p.Body, "\r\n", "\n"), "\n") {
+    s.lines = append(s.lines, wrapLine(line, t.width)...)
+  }
+  for _, sub := range t.titles {
+    if rest, ok := strings.CutPrefix(sub, title+"/"); ok && !strings.Contains(rest, "/") {
+      if s.links == nil {
+        s.lines = append(s.lines, "", "Subpages:")
+      }
+      s.links = append(s.links, sub)
+      s.lines = append(s.lines, fmt.Sprintf("%4d  %s", len(s.links), rest))
+    }
+  }
+  return s, nil
+}
+
+/* Break line at spaces into lines at most width long, and words longer
+  than that wherever they reach it
+*/
+func wrapLine(line string, width int) []string {
+  var out []string
+  for utf8.RuneCountInString(line) > width {
+    cut := width
+    runes := []rune(line)
+    for i := width; i > 0; i-- {
+      if runes[i] == ' ' {
+        cut = i
+        break
+      }
+    }
+    out = append(out, string(runes[:cut]))
+    line = strings.TrimLeft(string(runes[cut:]), " ")
+  }
+  return append(out, line)
+}
+
+func (t *tui) draw(s *tuiScreen, message string) {
+  fmt.Fprint(t.out, "\x1b[H\x1b[2J") // home and clear
+  header := "Pages"
+  switch {
+  case s.title != "":
+    header = s.title
+  case s.filter != "":
+    header = "Pages containing " + strconv.Quote(s.filter)
+  }
+  fmt.Fprintf(t.out, "\x1b[1m%s\x1b[0m\n", header)
+  rows := t.height - 3
+  end := min(len(s.lines), s.top+rows)
+  for _, line := range s.lines[s.top:end] {
+    fmt.Fprintln(t.out, line)
+  }
+  for i := end - s.top; i < rows; i++ {
+    fmt.Fprintln(t.out)
+  }
+  if message != "" {
+    fmt.Fprintf(t.out, "\x1b[7m%s\x1b[0m\n", message)
+  } else {
+    fmt.Fprintf(t.out, "lines %d-%d of %d\n", min(s.top+1, end), end, len(s.lines))
+  }
+  help := "number: open  n/p: next/previous  /text: find titles  b: back  q: quit"
+  if s.title != "" {
+    help = "number: open subpage  n/p: next/previous  e: edit  r: reload  b: back  q: quit"
+  }
+  fmt.Fprint(t.out, help+" > ")
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* Resumable uploads, with the tus protocol (https://tus.io), version 1.0.0
+  - POST /api/{version}/uploads with Upload-Length and Upload-Metadata
+    naming the page ("page") and the file ("filename") starts an upload,
+    answering 201 with its URL in Location. The size and page are checked
+    then, as for any upload, so a file that won't be taken isn't sent
+  - PATCH to that URL, with Content-Type application/offset+octet-stream and
+    Upload-Offset saying where the body goes, adds to the file; whatever
+    arrives is kept, even if the connection drops part way. HEAD tells the
+    client where to carry on from, after which it sends the rest. The last
+    PATCH stores the attachment, going through processUpload like any other
+    upload, and its answer is the one to look at for a refusal
+  - DELETE abandons an upload. Unfinished uploads are removed
+    tusUploadExpiry after they're started, as Upload-Expires says
+  - Partial files are in data/uploads/, as {id}.bin with an {id}.json
+    describing the upload. The upload's URL is all it takes to carry on with
+    one, unless it was started signed in: then only the same user can
+  - Uploads are still limited by -max-attachment, which has to be raised for
+    large files, and a finished file is read into memory to be scanned and
+    stored. PATCH requests aren't subject to the request timeout
+*/
+var tusDir = "data/uploads"
+var tusUploadExpiry = 24 * time.Hour
+
+const tusVersion = "1.0.0"
+
+/* An upload in progress */
+type tusUpload struct {
+  ID string
+  Page string
+  Name string
+  Length int64
+  Uploader string
+  Owner string `json:",omitempty"` // the user who started it, if signed in
+  Started time.Time
+  Expires time.Time
+}
+
+/* Uploads being written to, so two PATCHes to one don't interleave */
+var tusBusy = struct {
+  sync.Mutex
+  ids map[string]bool
+}{ids: map[string]bool{}}
+
+var errUploadBusy = errors.New("The upload is already being written to")
+
+/* Whether r sends part of a resumable upload, left out of the request timeout */
+func tusChunk(r *http.Request) bool {
+  return r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/api/") && strings.Contains(r.URL.Path, "/uploads/")
+}
+
+/* Handler for /api/{version}/uploads and /api/{version}/uploads/{id} */
+func apiTusHandler(w http.ResponseWriter, r *http.Request, v *apiVersion) {
+  h := w.Header()
+  h.Set("Tus-Resumable", tusVersion)
+  if r.Method == http.MethodOptions {
+    h.Set("Tus-Version", tusVersion)
+    h.Set("Tus-Extension", "creation,expiration,termination")
+    h.Set("Tus-Max-Size", strconv.FormatInt(maxAttachmentSize, 10))
+    w.WriteHeader(http.StatusNoContent)
+    return
+  }
+  if r.Header.Get("Tus-Resumable") != tusVersion {
+    h.Set("Tus-Version", tusVersion)
+    writeJSONError(w, http.StatusPreconditionFailed, "Tus-Resumable "+tusVersion+" is required")
+    return
+  }
+  id, hasID := strings.CutPrefix(r.URL.Path, "/uploads/")
+  if !hasID || id == "" {
+    if r.Method != http.MethodPost {
+      writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+      return
+    }
+    tusCreate(w, r, v)
+    return
+  }
+  up, err := loadTusUpload(id)
+  if err != nil {
+    writeJSONError(w, http.StatusNotFound, "no such upload")
+    return
+  }
+  if up.Owner != "" {
+    if u := currentUser(r); u == nil || u.Name != up.Owner {
+      writeJSONError(w, http.StatusForbidden, "the upload was started by another user")
+      return
+    }
+  }
+  switch r.Method {
+  case http.MethodHead:
+    offset, err := up.offset()
+    if err != nil {
+      writeJSONError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+    h.Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+    h.Set("Upload-Expires", up.Expires.Format(http.TimeFormat))
+    h.Set("Cache-Control", "no-store")
+    w.WriteHeader(http.StatusOK)
+  case http.MethodPatch:
+    tusPatch(w, r, up)
+  case http.MethodDelete:
+    if !claimTusUpload(up.ID) {
+      writeJSONError(w, http.StatusConflict, errUploadBusy.Error())
+      return
+    }
+    defer releaseTusUpload(up.ID)
+    up.remove()
+    w.WriteHeader(http.StatusNoContent)
+  default:
+    writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+  }
+}
+
+/* POST: start an upload */
+func tusCreate(w http.ResponseWriter, r *http.Request, v *apiVersion) {
+  sweepTusUploads()
+  if r.Header.Get("Upload-Defer-Length") != "" {
+    writeJSONError(w, http.StatusBadRequest, "the length of the upload has to be given")
+    return
+  }
+  length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+  if err != nil || length < 0 {
+    writeJSONError(w, http.StatusBadRequest, "Upload-Length is missing or not a number")
+    return
+  }
+  meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+  page, name := meta["page"], meta["filename"]
+  if !validTitle.MatchString(page) {
+    writeJSONError(w, http.StatusBadRequest, "Upload-Metadata needs the page's title as \"page\"")
+    return
+  }
+  if !validAttachmentName.MatchString(name) {
+    writeJSONError(w, http.StatusBadRequest, errBadAttachmentName.Error())
+    return
+  }
+  if err := authorizeWrite(page, currentUser(r)); err != nil {
+    writeJSONError(w, saveErrorStatus(err), err.Error())
+    return
+  }
+  if err := checkAttachment(page, name, length); err != nil {
+    writeJSONError(w, saveErrorStatus(err), err.Error())
+    return
+  }
+  id, err := randomID()
+  if err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  now := time.Now().UTC()
+  up := tusUpload{
+    ID: id, Page: page, Name: name, Length: length, Uploader: requestAuthor(r),
+    Started: now, Expires: now.Add(tusUploadExpiry),
+  }
+  if u := currentUser(r); u != nil {
+    up.Owner = u.Name
+  }
+  if err := up.create(); err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  h := w.Header()
+  h.Set("Location", v.prefix()+"/uploads/"+id)
+  h.Set("Upload-Expires", up.Expires.Format(http.TimeFormat))
+  w.WriteHeader(http.StatusCreated)
+}
+
+/* PATCH: add to an upload, storing the attachment once it's all there */
+func tusPatch(w http.ResponseWriter, r *http.Request, up tusUpload) {
+  if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+    writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type has to be application/offset+octet-stream")
+    return
+  }
+  from, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+  if err != nil {
+    writeJSONError(w, http.StatusBadRequest, "Upload-Offset is missing or not a number")
+    return
+  }
+  if !claimTusUpload(up.ID) {
+    writeJSONError(w, http.StatusConflict, errUploadBusy.Error())
+    return
+  }
+  defer releaseTusUpload(up.ID)
+  offset, err := up.offset()
+  if err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  if from != offset {
+    w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+    writeJSONError(w, http.StatusConflict, "the upload is at offset "+strconv.FormatInt(offset, 10))
+    return
+  }
+  if r.ContentLength > up.Length-offset {
+    writeJSONError(w, http.StatusBadRequest, "the body goes past Upload-Length")
+    return
+  }
+  f, err := os.OpenFile(up.path(".bin"), os.O_WRONLY|os.O_APPEND, 0600)
+  if err != nil {
+    writeJSONError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  n, copyErr := io.Copy(f, io.LimitReader(r.Body, up.Length-offset))
+  if err := f.Close(); err != nil && copyErr == nil {
+    copyErr = err
+  }
+  offset += n
+  w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+  if copyErr != nil {
+    // What did arrive is kept; the client asks with HEAD and carries on
+    writeJSONError(w, http.StatusBadRequest, copyErr.Error())
+    return
+  }
+  if offset < up.Length {
+    w.WriteHeader(http.StatusNoContent)
+    return
+  }
+  if err := up.finish(currentUser(r)); err != nil {
+    writeJSONError(w, saveErrorStatus(err), err.Error())
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+/* Store the finished upload as its attachment for u; the upload goes either way */
+func (up tusUpload) finish(u *User) error {
+  defer up.remove()
+  // The page may have been protected, or hidden, since the upload started
+  if err := authorizeWrite(up.Page, u); err != nil {
+    return err
+  }
+  data, err := ioutil.ReadFile(up.path(".bin"))
+  if err != nil {
+    return err
+  }
+  // The page may have gone, or the quota filled up, since the upload started
+  if err := checkAttachment(up.Page, up.Name, int64(len(data))); err != nil {
+    return err
+  }
+  a := newAttachment(up.Page, up.Name, data, up.Uploader)
+  if data, err = processUpload(&a, data); err != nil {
+    return err
+  }
+  if err := attachments.Save(a, data); err != nil {
+    return err
+  }
+  auditActivity("file-uploaded", a.Uploader, a.Page, a.Name)
+  removeThumbnails(up.Page, up.Name)
+  return nil
+}
+
+/* Upload-Metadata: comma separated keys, each with its value in base64 */
+func parseTusMetadata(s string) map[string]string {
+  m := map[string]string{}
+  for _, pair := range strings.Split(s, ",") {
+    key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+    if key == "" {
+      continue
+    }
+    if b, err := base64.StdEncoding.DecodeString(value); err == nil {
+      m[key] = string(b)
+    }
+  }
+  return m
+}
+
+func (up tusUpload) path(ext string) string {
+  return filepath.Join(tusDir, up.ID+ext)
+}
+
+/* Bytes received so far: the size of the partial file */
+func (up tusUpload) offset() (int64, error) {
+  info, err := os.Stat(up.path(".bin"))
+  if err != nil {
+    return 0, err
+  }
+  return info.Size(), nil
+}
+
+func (up tusUpload) create() error {
+  if err := os.MkdirAll(tusDir, 0700); err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(up.path(".bin"), nil, 0600); err != nil {
+    return err
+  }
+  b, err := json.MarshalIndent(up, "", "  ")
+  if err == nil {
+    err = ioutil.WriteFile(up.path(".json"), b, 0600)
+  }
+  if err != nil {
+    os.Remove(up.path(".bin"))
+  }
+  return err
+}
+
+func (up tusUpload) remove() {
+  os.Remove(up.path(".json"))
+  os.Remove(up.path(".bin"))
+}
+
+/* The upload with id, if it hasn't expired */
+func loadTusUpload(id string) (tusUpload, error) {
+  var up tusUpload
+  if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+    return up, os.ErrNotExist
+  }
+  b, err := ioutil.ReadFile(filepath.Join(tusDir, id+".json"))
+  if err != nil {
+    return up, err
+  }
+  if err := json.Unmarshal(b, &up); err != nil {
+    return up, err
+  }
+  if time.Now().After(up.Expires) {
+    return up, os.ErrNotExist
+  }
+  return up, nil
+}
+
+/* Remove the uploads that have expired */
+func sweepTusUploads() {
+  names, _ := filepath.Glob(filepath.Join(tusDir, "*.json"))
+  for _, name := range names {
+    id := strings.TrimSuffix(filepath.Base(name), ".json")
+    up, err := loadTusUpload(id)
+    if err == nil || !claimTusUpload(id) {
+      continue
+    }
+    up.ID = id
+    up.remove()
+    releaseTusUpload(id)
+  }
+}
+
+func claimTusUpload(id string) bool {
+  tusBusy.Lock()
+  defer tusBusy.Unlock()
+  if tusBusy.ids[id] {
+    return false
+  }
+  tusBusy.ids[id] = true
+  return true
+}
+
+func releaseTusUpload(id string) {
+  tusBusy.Lock()
+  defer tusBusy.Unlock()
+  delete(tusBusy.ids, id)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha1"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base32"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "html/template"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+)
+
+/* Two-factor sign in
+  - Accounts can add a TOTP authenticator (RFC 6238: HMAC-SHA1, 30 second
+    steps, 6 digits) at /account/2fa by scanning a QR code and confirming a
+    code from it
+  - Enrolling also hands out backup codes, each good for one sign in, kept
+    as SHA-256 hashes and replaceable from the same page
+  - A code is accepted one step either side of now, for clock drift, but
+    never for a step at or before the last one used, so a code seen over a
+    shoulder can't be replayed
+  - -require-2fa admins or all makes those accounts enroll before they can do
+    anything else, and stops them turning it off
+*/
+var require2FA = "none"
+
+const (
+  totpStep = 30 * time.Second
+  totpDigits = 6
+  backupCodeCount = 10
+)
+
+var errNeedCode = errors.New("Enter the code from your authenticator app, or a backup code")
+var errBadCode = errors.New("That code is not right")
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func setRequire2FA(s string) error {
+  switch s {
+  case "none", "admins", "all":
+    require2FA = s
+    return nil
+  }
+  return fmt.Errorf("-require-2fa must be none, admins or all, not %q", s)
+}
+
+/* Whether the policy makes u use a second factor */
+func twoFactorRequired(u *User) bool {
+  return require2FA == "all" || (require2FA == "admins" && u.Admin)
+}
+
+/* The 6 digit code for a secret at a time step */
+func totpCode(secret []byte, step int64) string {
+  var msg [8]byte
+  binary.BigEndian.PutUint64(msg[:], uint64(step))
+  mac := hmac.New(sha1.New, secret)
+  mac.Write(msg[:])
+  sum := mac.Sum(nil)
+  off := sum[len(sum)-1] & 0x0f
+  n := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+  return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+/* The step a code from secret was made for, if it is within one step of now
+  and after last; 0 if it isn't
+*/
+func totpMatch(secret string, code string, last int64) int64 {
+  key, err := base32NoPad.DecodeString(secret)
+  if err != nil || len(code) != totpDigits {
+    return 0
+  }
+  now := time.Now().Unix() / int64(totpStep/time.Second)
+  for step := now - 1; step <= now+1; step++ {
+    if step > last && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+      return step
+    }
+  }
+  return 0
+}
+
+/* A fresh 160 bit secret, base32 for authenticator apps */
+func newTOTPSecret() (string, error) {
+  b := make([]byte, 20)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  return base32NoPad.EncodeToString(b), nil
+}
+
+/* The otpauth:// link an authenticator app reads from the QR code */
+func totpURI(secret, name string) string {
+  issuer := siteInfo().Title
+  v := url.Values{"secret": {secret}, "issuer": {issuer}}
+  return "otpauth://totp/" + url.PathEscape(issuer+":"+name) + "?" + v.Encode()
+}
+
+/* Backup codes to show once, and their hashes to keep */
+func newBackupCodes() (codes, hashes []string, err error) {
+  for i := 0; i < backupCodeCount; i++ {
+    b := make([]byte, 5)
+    if _, err := rand.Read(b); err != nil {
+      return nil, nil, err
+    }
+    code := hex.EncodeToString(b)
+    codes = append(codes, code[:5]+"-"+code[5:])
+    hashes = append(hashes, hashBackupCode(code))
+  }
+  return codes, hashes, nil
+}
+
+/* Backup codes are matched without the dash and case insensitively */
+func hashBackupCode(code string) string {
+  code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+  sum := sha256.Sum256([]byte(code))
+  return hex.EncodeToString(sum[:])
+}
+
+/* Check a TOTP or backup code for the named user, using it up
+  - Held under the store lock so the same code can't be used twice at once
+*/
+func (s *userStore) checkSecondFactor(name, code string) error {
+  code = strings.TrimSpace(code)
+  if code == "" {
+    return errNeedCode
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  u := s.users[name]
+  if u == nil || u.TOTPSecret == "" {
+    return errBadCode
+  }
+  c := *u
+  if step := totpMatch(c.TOTPSecret, code, c.TOTPLastStep); step != 0 {
+    c.TOTPLastStep = step
+  } else {
+    hash := hashBackupCode(code)
+    c.BackupCodes = nil
+    found := false
+    for _, h := range u.BackupCodes {
+      if !found && subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+        found = true
+        continue
+      }
+      c.BackupCodes = append(c.BackupCodes, h)
+    }
+    if !found {
+      return errBadCode
+    }
+  }
+  s.users[name] = &c
+  return s.write()
+}
+
+/* Paths an account that still has to enroll can use */
+var twoFactorExempt = []string{"/account", "/login", "/logout", "/static", "/branding"}
+
+/* Wrapper sending accounts the policy covers to /account/2fa until they enroll */
+func enforce2FA(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if require2FA == "none" {
+      next.ServeHTTP(w, r)
+      return
+    }
+    for _, p := range twoFactorExempt {
+      if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+        next.ServeHTTP(w, r)
+        return
+      }
+    }
+    u := currentUser(r)
+    if u == nil || u.TOTPSecret != "" || !twoFactorRequired(u) {
+      next.ServeHTTP(w, r)
+      return
+    }
+    if strings.HasPrefix(r.URL.Path, "/api/") {
+      writeJSONError(w, http.StatusForbidden, "set up two-factor sign in at /account/2fa first")
+      return
+    }
+    http.Redirect(w, r, "/account/2fa?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+  })
+}
+
+/* Data for the two-factor page */
+type twoFactorData struct {
+  Enabled bool
+  Required bool
+  Secret string // while enrolling
+  QR template.HTML
+  BackupCodes []string // just made, shown once
+  Remaining int // unused backup codes
+  Next string
+  Error string
+}
+
+/* Two-factor settings at /account/2fa
+  - GET starts enrolling with a new secret, or shows the settings once enrolled
+  - POST action=enable with secret and code turns it on; action=codes makes
+    new backup codes and action=disable turns it off, both with a current code
+*/
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+  u := currentUser(r)
+  if u == nil {
+    http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+    return
+  }
+  data := &twoFactorData{Required: twoFactorRequired(u)}
+  if next := r.FormValue("next"); next != "" {
+    data.Next = safeNext(next)
+  }
+  if r.Method == http.MethodPost {
+    var err error
+    switch r.FormValue("action") {
+    case "enable":
+      err = enableTwoFactor(u, r.FormValue("secret"), r.FormValue("code"), data)
+      if err != nil {
+        data.Secret = r.FormValue("secret")
+      }
+    case "codes":
+      if err = users.checkSecondFactor(u.Name, r.FormValue("code")); err == nil {
+        var hashes []string
+        if data.BackupCodes, hashes, err = newBackupCodes(); err == nil {
+          err = users.update(u.Name, func(u *User) { u.BackupCodes = hashes })
+        }
+      }
+    case "disable":
+      if data.Required {
+        err = errors.New("Two-factor sign in is required for this account")
+      } else if err = users.checkSecondFactor(u.Name, r.FormValue("code")); err == nil {
+        err = users.update(u.Name, func(u *User) {
+          u.TOTPSecret, u.TOTPLastStep, u.BackupCodes = "", 0, nil
+        })
+      }
+    default:
+      http.Error(w, "unknown action", http.StatusBadRequest)
+      return
+    }
+    if err != nil {
+      data.Error = err.Error()
+      w.WriteHeader(http.StatusBadRequest)
+    }
+    u = users.get(u.Name)
+  }
+  data.Enabled = u.TOTPSecret != ""
+  data.Remaining = len(u.BackupCodes)
+  if !data.Enabled && data.Secret == "" {
+    secret, err := newTOTPSecret()
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    data.Secret = secret
+  }
+  if !data.Enabled {
+    qr, err := qrSVG(totpURI(data.Secret, u.Name), 240)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    data.QR = qr
+  }
+  renderTemplate(w, "twofactor", data)
+}
+
+/* Turn on two-factor sign in for u once code shows their app has secret,
+  filling in the backup codes to show
+*/
+func enableTwoFactor(u *User, secret, code string, data *twoFactorData) error {
+  if u.TOTPSecret != "" {
+    return errors.New("Two-factor sign in is already on")
+  }
+  step := totpMatch(secret, strings.TrimSpace(code), 0)
+  if step == 0 {
+    return errBadCode
+  }
+  codes, hashes, err := newBackupCodes()
+  if err != nil {
+    return err
+  }
+  err = users.update(u.Name, func(u *User) {
+    u.TOTPSecret, u.TOTPLastStep, u.BackupCodes = secret, step, hashes
+  })
+  if err == nil {
+    data.BackupCodes = codes
+  }
+  return err
+}
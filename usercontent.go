@@ -0,0 +1,168 @@
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/base64"
+  "errors"
+  "mime"
+  "net/http"
+  "net/url"
+  "path"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/* Serving attachments without letting them run script on the wiki
+  - The type sent is the one sniffed from the content at upload, and only
+    if the file's extension agrees: a "photo.png" that's really HTML goes
+    out as application/octet-stream. securityHeaders' nosniff stops the
+    browser from guessing otherwise
+  - Raster images are shown inline; everything else, HTML and SVG
+    included, is sent as a download, and every file gets a
+    Content-Security-Policy sandbox with nothing allowed, so even one
+    opened directly can't run script or load anything
+  - -files-origin https://files.example.net serves attachments from a
+    second host name pointing at the same wiki, with no access to the
+    wiki's cookies. Files that aren't raster images are redirected there,
+    where the ones whose type checks out (SVG, text, HTML, audio and video)
+    are shown inline rather than downloaded. The files host serves nothing
+    but /files/ and /thumb/. It should be a different site, not a
+    subdomain of the wiki's, so script there can't set cookies for it
+  - The files host has no session, so the redirect carries a token signed
+    with the share key (see share.go) for that one file, good for
+    fileTokenTTL, which it takes in place of checking the reader
+*/
+var filesOrigin string
+var filesHost string
+
+const fileTokenTTL = 5 * time.Minute
+
+/* Content security policy for every file */
+const filesCSP = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; media-src 'self'; sandbox"
+
+/* Types shown inline on the files host, besides inlineTypes */
+var filesOriginInlineTypes = map[string]bool{
+  "image/svg+xml": true, "text/plain": true, "text/html": true,
+  "audio/mpeg": true, "audio/wave": true, "audio/ogg": true, "application/ogg": true,
+  "video/mp4": true, "video/webm": true,
+}
+
+/* Parse -files-origin */
+func setFilesOrigin(s string) error {
+  u, err := url.Parse(strings.TrimSuffix(s, "/"))
+  if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+    return errors.New("want a scheme and host, e.g. https://files.example.net")
+  }
+  filesOrigin, filesHost = u.String(), u.Host
+  return nil
+}
+
+/* Whether r came in on the files host */
+func onFilesHost(r *http.Request) bool {
+  return filesHost != "" && strings.EqualFold(r.Host, filesHost)
+}
+
+/* Wrapper turning away everything but files on the files host */
+func filesHostGate(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !onFilesHost(r) {
+      next.ServeHTTP(w, r)
+      return
+    }
+    if !strings.HasPrefix(r.URL.Path, "/files/") && !strings.HasPrefix(r.URL.Path, "/thumb/") {
+      http.NotFound(w, r)
+      return
+    }
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+      http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+/* Token for the files host to send page's attachment name until expires:
+  expiry.signature
+*/
+func fileToken(page, name string, expires time.Time) (string, error) {
+  key, err := shareSigningKey()
+  if err != nil {
+    return "", err
+  }
+  payload := strconv.FormatInt(expires.Unix(), 10)
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte("files\n" + page + "\n" + name + "\n" + payload))
+  return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+/* Whether r came in on the files host with a current token for page's
+  attachment name
+*/
+func fileTokenValid(r *http.Request, page, name string) bool {
+  token := r.URL.Query().Get("access")
+  expiry, _, _ := strings.Cut(token, ".")
+  n, err := strconv.ParseInt(expiry, 10, 64)
+  if !onFilesHost(r) || err != nil || time.Now().Unix() > n {
+    return false
+  }
+  want, err := fileToken(page, name, time.Unix(n, 0))
+  return err == nil && hmac.Equal([]byte(token), []byte(want))
+}
+
+/* The type to send a, as described above */
+func servedType(a Attachment, data []byte) string {
+  typ := a.Type
+  sniffed, _, err := mime.ParseMediaType(typ)
+  if err != nil {
+    return "application/octet-stream"
+  }
+  ext := strings.ToLower(path.Ext(a.Name))
+  // DetectContentType doesn't know SVG, which it sees as XML or text
+  if ext == ".svg" && (sniffed == "text/xml" || sniffed == "text/plain") && bytes.Contains(data, []byte("<svg")) {
+    return "image/svg+xml"
+  }
+  want, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+  switch {
+  case want == "" || want == sniffed:
+  case sniffed == "text/plain" && strings.HasPrefix(want, "text/"):
+    // program source and the like: fine as plain text
+  case sniffed == "application/ogg" && (strings.HasPrefix(want, "audio/") || strings.HasPrefix(want, "video/")):
+  default:
+    return "application/octet-stream"
+  }
+  return typ
+}
+
+/* Send an attachment with the headers above, or redirect it to the files host */
+func serveAttachment(w http.ResponseWriter, r *http.Request, a Attachment, data []byte) {
+  typ := servedType(a, data)
+  base, _, _ := mime.ParseMediaType(typ)
+  inline := inlineTypes[base]
+  if filesHost != "" && !inline {
+    if !onFilesHost(r) {
+      token, err := fileToken(a.Page, a.Name, time.Now().Add(fileTokenTTL))
+      if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+      q := r.URL.Query()
+      q.Del("share")
+      q.Set("access", token)
+      http.Redirect(w, r, filesOrigin+r.URL.EscapedPath()+"?"+q.Encode(), http.StatusFound)
+      return
+    }
+    inline = filesOriginInlineTypes[base]
+  }
+  h := w.Header()
+  h.Set("Content-Type", typ)
+  h.Set("Content-Security-Policy", filesCSP)
+  if inline {
+    h.Set("Content-Disposition", `inline; filename="`+a.Name+`"`)
+  } else {
+    h.Set("Content-Disposition", `attachment; filename="`+a.Name+`"`)
+  }
+  http.ServeContent(w, r, a.Name, a.Uploaded, bytes.NewReader(data))
+}
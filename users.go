@@ -0,0 +1,213 @@
+package main
+
+import (
+  "crypto/pbkdf2"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+/* User accounts
+  - Kept in data/users.json, loaded at start (and on a reload) and written
+    back on every change
+  - Passwords are stored as PBKDF2-SHA256 hashes:
+      pbkdf2-sha256$<iterations>$<salt>$<hash>   (salt and hash base64)
+  - The admin account is created (or its password reset) from -admin-user and
+    -admin-password at start up
+*/
+type User struct {
+  Name string
+  PasswordHash string
+  Admin bool
+  Starred []string `json:",omitempty"`
+  TOTPSecret string `json:",omitempty"` // base32, see twofactor.go
+  TOTPLastStep int64 `json:",omitempty"`
+  BackupCodes []string `json:",omitempty"` // SHA-256 hashes
+  Prefs Preferences `json:",omitzero"` // see prefs.go
+  Searches []SavedSearch `json:",omitempty"` // see savedsearch.go
+}
+
+type userStore struct {
+  path string
+  mu sync.Mutex
+  users map[string]*User
+}
+
+var users = &userStore{path: "data/users.json", users: map[string]*User{}}
+
+var errBadLogin = errors.New("Unknown user or wrong password")
+
+const passwordIterations = 600000
+
+/* Read the accounts file; a missing file just means no accounts yet */
+func (s *userStore) load() error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  data, err := ioutil.ReadFile(s.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  list := []*User{}
+  if err := json.Unmarshal(data, &list); err != nil {
+    return err
+  }
+  m := map[string]*User{}
+  for _, u := range list {
+    m[u.Name] = u
+  }
+  s.users = m
+  return nil
+}
+
+/* Write the accounts file; the caller holds mu */
+func (s *userStore) write() error {
+  list := make([]*User, 0, len(s.users))
+  for _, u := range s.users {
+    list = append(list, u)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+  data, err := json.MarshalIndent(list, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+    return err
+  }
+  settingsChanged("users")
+  return nil
+}
+
+/* Copy of the named user, nil if there isn't one */
+func (s *userStore) get(name string) *User {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  u := s.users[name]
+  if u == nil {
+    return nil
+  }
+  c := *u
+  return &c
+}
+
+/* Copies of every user */
+func (s *userStore) all() []*User {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  list := make([]*User, 0, len(s.users))
+  for _, u := range s.users {
+    c := *u
+    list = append(list, &c)
+  }
+  return list
+}
+
+/* Create or replace a user */
+func (s *userStore) put(u *User) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  c := *u
+  s.users[u.Name] = &c
+  return s.write()
+}
+
+/* Add a new user, failing with errUserExists if the name is taken */
+func (s *userStore) create(u *User) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.users[u.Name] != nil {
+    return errUserExists
+  }
+  c := *u
+  s.users[u.Name] = &c
+  return s.write()
+}
+
+/* Change the named user with fn, creating them if they don't exist yet */
+func (s *userStore) update(name string, fn func(u *User)) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  u := s.users[name]
+  if u == nil {
+    u = &User{Name: name}
+  }
+  c := *u
+  c.Starred = append([]string(nil), u.Starred...)
+  c.BackupCodes = append([]string(nil), u.BackupCodes...)
+  c.Searches = append([]SavedSearch(nil), u.Searches...)
+  fn(&c)
+  s.users[name] = &c
+  return s.write()
+}
+
+/* Check a name and password, returning the user
+  - A password is hashed even for an unknown user so the two cases take as long
+*/
+func (s *userStore) authenticate(name, password string) (*User, error) {
+  u := s.get(name)
+  hash := ""
+  if u != nil {
+    hash = u.PasswordHash
+  }
+  if !checkPassword(hash, password) || u == nil {
+    return nil, errBadLogin
+  }
+  return u, nil
+}
+
+/* Make the admin account from the command line settings */
+func bootstrapAdmin(name, password string) error {
+  if password == "" {
+    return nil
+  }
+  hash, err := hashPassword(password)
+  if err != nil {
+    return err
+  }
+  return users.update(name, func(u *User) {
+    u.PasswordHash = hash
+    u.Admin = true
+  })
+}
+
+func hashPassword(password string) (string, error) {
+  salt := make([]byte, 16)
+  if _, err := rand.Read(salt); err != nil {
+    return "", err
+  }
+  key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+  if err != nil {
+    return "", err
+  }
+  return "pbkdf2-sha256$" + strconv.Itoa(passwordIterations) + "$" +
+    base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+/* Check a password against a hash from hashPassword; an empty hash never matches */
+func checkPassword(hash, password string) bool {
+  parts := strings.Split(hash, "$")
+  if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+    // Still do the work so a missing user isn't faster to reject
+    pbkdf2.Key(sha256.New, password, []byte("no-such-user-salt"), passwordIterations, 32)
+    return false
+  }
+  iter, err1 := strconv.Atoi(parts[1])
+  salt, err2 := base64.RawStdEncoding.DecodeString(parts[2])
+  want, err3 := base64.RawStdEncoding.DecodeString(parts[3])
+  if err1 != nil || err2 != nil || err3 != nil {
+    return false
+  }
+  got, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+  return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "io/ioutil"
+  "log"
+  "net"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+/* Virus scanning of uploads
+  - -virus-scan sends every upload to a scanner before it's stored: clamd,
+    as clamd:host:port or clamd:/path/to/clamd.sock, or an HTTP service, as
+    its http(s) URL
+  - An HTTP service gets the file as the body of a POST with its name in
+    X-File-Name, and answers 2xx for a clean file, or 406 or 422 for an
+    infected one, naming what it found in a JSON "virus" or as plain text.
+    Any other answer counts as the scanner failing
+  - An infected upload is refused, and kept in data/quarantine/uploads/
+    (the file and a .json saying where it was going, who sent it and what
+    was found) for an admin to look at, with an entry in the audit log
+  - While the scanner can't be reached or fails, uploads are refused rather
+    than let through unchecked. Files uploaded before scanning was turned on
+    aren't scanned
+*/
+var virusScanner string
+var virusScanTimeout = 30 * time.Second
+
+var errInfected = errors.New("The file was found to contain a virus and wasn't stored")
+var errScanFailed = errors.New("Uploads can't be checked for viruses right now: try again later")
+
+/* A refused upload, as kept next to it in quarantine */
+type quarantined struct {
+  Attachment
+  Virus string
+  SHA256 string
+}
+
+/* Check data, to be stored as a, with -virus-scan */
+func scanUpload(a Attachment, data []byte) error {
+  if virusScanner == "" {
+    return nil
+  }
+  var virus string
+  var err error
+  if addr, ok := strings.CutPrefix(virusScanner, "clamd:"); ok {
+    virus, err = scanClamd(addr, data)
+  } else {
+    virus, err = scanHTTP(virusScanner, a.Name, data)
+  }
+  if err != nil {
+    log.Printf("virus scan of %s/%s: %v", a.Page, a.Name, err)
+    return errScanFailed
+  }
+  if virus == "" {
+    return nil
+  }
+  if err := quarantineUpload(a, data, virus); err != nil {
+    log.Printf("quarantine of %s/%s: %v", a.Page, a.Name, err)
+  }
+  audit("upload-infected", a.Uploader, "", a.Page+"/"+a.Name+": "+virus)
+  return errInfected
+}
+
+/* Scan with clamd's INSTREAM command, returning what it found */
+func scanClamd(addr string, data []byte) (string, error) {
+  network := "tcp"
+  if strings.HasPrefix(addr, "/") {
+    network = "unix"
+  }
+  conn, err := net.DialTimeout(network, addr, virusScanTimeout)
+  if err != nil {
+    return "", err
+  }
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(virusScanTimeout))
+  w := bufio.NewWriter(conn)
+  w.WriteString("zINSTREAM\x00")
+  // The file goes in chunks, each after its length; a zero length ends it
+  var size [4]byte
+  for len(data) > 0 {
+    chunk := data[:min(len(data), 64<<10)]
+    binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+    w.Write(size[:])
+    w.Write(chunk)
+    data = data[len(chunk):]
+  }
+  binary.BigEndian.PutUint32(size[:], 0)
+  w.Write(size[:])
+  if err := w.Flush(); err != nil {
+    return "", err
+  }
+  reply, err := bufio.NewReader(conn).ReadString(0)
+  if err != nil && reply == "" {
+    return "", err
+  }
+  // stream: OK, stream: {name} FOUND, or {message} ERROR
+  reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+  reply = strings.TrimPrefix(reply, "stream: ")
+  switch {
+  case reply == "OK":
+    return "", nil
+  case strings.HasSuffix(reply, " FOUND"):
+    return strings.TrimSuffix(reply, " FOUND"), nil
+  }
+  return "", errors.New("clamd: " + reply)
+}
+
+/* Scan with an HTTP service, as described above */
+func scanHTTP(url, name string, data []byte) (string, error) {
+  req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+  if err != nil {
+    return "", err
+  }
+  req.Header.Set("Content-Type", "application/octet-stream")
+  req.Header.Set("X-File-Name", name)
+  client := &http.Client{Timeout: virusScanTimeout}
+  resp, err := client.Do(req)
+  if err != nil {
+    return "", err
+  }
+  defer resp.Body.Close()
+  body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+  switch {
+  case resp.StatusCode/100 == 2:
+    return "", nil
+  case resp.StatusCode == http.StatusNotAcceptable || resp.StatusCode == http.StatusUnprocessableEntity:
+    var found struct {
+      Virus string `json:"virus"`
+    }
+    if json.Unmarshal(body, &found) == nil && found.Virus != "" {
+      return found.Virus, nil
+    }
+    if text := strings.TrimSpace(string(body)); text != "" && !strings.HasPrefix(text, "{") {
+      return text, nil
+    }
+    return "unnamed", nil
+  }
+  return "", errors.New(resp.Status)
+}
+
+/* Keep a refused upload with the corrupt files fsck finds (checksum.go) */
+func quarantineUpload(a Attachment, data []byte, virus string) error {
+  dir := filepath.Join(quarantineDir, "uploads")
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  sum := sha256.Sum256(data)
+  q := quarantined{Attachment: a, Virus: virus, SHA256: hex.EncodeToString(sum[:])}
+  base := filepath.Join(dir, a.Uploaded.Format("20060102-150405")+"-"+q.SHA256[:12])
+  if err := ioutil.WriteFile(base+".bin", data, 0600); err != nil {
+    return err
+  }
+  meta, err := json.MarshalIndent(q, "", "  ")
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(base+".json", meta, 0600)
+}
@@ -0,0 +1,35 @@
+package main
+
+/* Page visibility
+  - public, the default, is readable by anyone; signed-in only by signed in
+    users; owner only by the user who made it so (the page's Owner) and
+    admins; group only by the members of the page's Group (see groups.go)
+    and admins
+  - Anyone else gets a 404 for the page, whether reading, editing or saving
+    it, and doesn't see it in /pages, the API, GraphQL or gRPC listings, the
+    recent changes or the event stream
+  - A share link lets someone read a page that isn't public (see share.go)
+  - Set from the sharing panel on the view page, see shareHandler. Who may
+    read a page is decided in access.go
+*/
+const (
+  visibilityPublic = ""
+  visibilitySignedIn = "signed-in"
+  visibilityOwner = "owner"
+  visibilityGroup = "group"
+)
+
+/* Whether u, nil when not signed in, may read a page with this metadata */
+func (m PageMeta) readableBy(u *User) bool {
+  switch m.Visibility {
+  case visibilityPublic:
+    return true
+  case visibilitySignedIn:
+    return u != nil
+  case visibilityOwner:
+    return u != nil && (u.Name == m.Owner || u.Admin)
+  case visibilityGroup:
+    return u != nil && (inGroup(u, m.Group) || u.Admin)
+  }
+  return u != nil && u.Admin // not a setting this version knows
+}
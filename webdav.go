@@ -0,0 +1,784 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/xml"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/* WebDAV at /dav/, to mount the wiki as a network drive
+  - Every page is a file, Title.txt, with a page's subpages in a folder of
+    the same name: FrontPage.txt, Projects/Plan.txt. Title.md is the same
+    page, for editors that go by the extension
+  - Mounts sign in with HTTP basic auth: a user name and password, or for
+    accounts with two-factor sign in, the user name and an API token
+    (apitoken.go). A sign in is remembered for davAuthTTL
+  - Saving a file saves the page, through the same checks and history as
+    the edit form; deleting one deletes the page and moving one renames the
+    page, leaving a redirect, as a batch rename does. Moving a folder
+    renames every page in it
+  - Editors and file managers make files of their own alongside the ones
+    they edit: swap files, backups, ._ files and new empty files. Names that
+    aren't pages, and empty files not saved as a page yet, are held in
+    memory for the user for davScratchTTL and never reach the wiki. One
+    moved over a page saves it, which is how editors that write a temporary
+    file and rename it save; a page moved to such a name is copied, so the
+    page stays until it's deleted
+  - Locks are granted but not enforced: they're only there because Windows
+    and macOS won't write to a share without them. Properties can't be set;
+    PROPPATCH reports success so clients setting file times carry on
+*/
+const davPrefix = "/dav/"
+
+var davAuthTTL = 5 * time.Minute
+var davScratchTTL = time.Hour
+
+const davScratchMax = 16 << 20 // bytes held per user
+
+/* A file or, for names ending in /, folder that isn't a page */
+type davScratch struct {
+  data []byte
+  modified time.Time
+}
+
+var davState = struct {
+  sync.Mutex
+  auth map[[32]byte]davAuth // by hash of the Authorization header
+  scratch map[string]map[string]*davScratch // user -> path -> file
+}{auth: map[[32]byte]davAuth{}, scratch: map[string]map[string]*davScratch{}}
+
+type davAuth struct {
+  user string
+  expires time.Time
+}
+
+/* The user r signs in as, if davAuthenticate has let them in lately */
+func davUser(r *http.Request) *User {
+  if _, _, ok := r.BasicAuth(); !ok {
+    return nil
+  }
+  key := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+  davState.Lock()
+  a, ok := davState.auth[key]
+  davState.Unlock()
+  if !ok || time.Now().After(a.expires) {
+    return nil
+  }
+  return users.get(a.user)
+}
+
+/* Check r's basic auth, asking for it if there's none or it's wrong */
+func davAuthenticate(w http.ResponseWriter, r *http.Request) *User {
+  if u := davUser(r); u != nil {
+    return u
+  }
+  name, pass, ok := r.BasicAuth()
+  ask := func(status int, msg string) *User {
+    w.Header().Set("WWW-Authenticate", `Basic realm="wiki", charset="UTF-8"`)
+    http.Error(w, msg, status)
+    return nil
+  }
+  if !ok {
+    return ask(http.StatusUnauthorized, "Unauthorized")
+  }
+  if loginLocked(w, name, clientIP(r)) {
+    http.Error(w, errLockedOut.Error(), http.StatusTooManyRequests)
+    return nil
+  }
+  var u *User
+  apiTokens.RLock()
+  t, isToken := apiTokens.m[hashToken(pass)]
+  apiTokens.RUnlock()
+  if isToken && t.User == name {
+    u = users.get(name)
+  } else if u, _ = users.authenticate(name, pass); u != nil && (u.TOTPSecret != "" || twoFactorRequired(u)) {
+    return ask(http.StatusUnauthorized, "This account uses two-factor sign in: use an API token as the password")
+  }
+  if u == nil {
+    loginFailed(name, clientIP(r), errBadLogin.Error())
+    return ask(http.StatusUnauthorized, "Unauthorized")
+  }
+  loginSucceeded(name)
+  davState.Lock()
+  now := time.Now()
+  for k, a := range davState.auth {
+    if now.After(a.expires) {
+      delete(davState.auth, k)
+    }
+  }
+  davState.auth[sha256.Sum256([]byte(r.Header.Get("Authorization")))] = davAuth{user: u.Name, expires: now.Add(davAuthTTL)}
+  davState.Unlock()
+  return u
+}
+
+/* What a path under /dav/ names: a page, a folder, or a scratch file */
+type davPath struct {
+  path string // after /dav/, as given
+  title string // the page, for Title.txt and Title.md
+  folder bool // "" and names ending in /, or ones that are page folders
+}
+
+func parseDAVPath(p string) davPath {
+  p = strings.TrimPrefix(p, davPrefix)
+  d := davPath{path: p}
+  if p == "" || strings.HasSuffix(p, "/") {
+    d.folder = true
+    return d
+  }
+  for _, ext := range []string{".txt", ".md"} {
+    if title, ok := strings.CutSuffix(p, ext); ok && validTitle.MatchString(title) {
+      d.title = title
+      return d
+    }
+  }
+  return d
+}
+
+/* The folder path (ending in /, "" for the top) */
+func (d davPath) dir() string {
+  if d.path == "" || strings.HasSuffix(d.path, "/") {
+    return d.path
+  }
+  return d.path + "/"
+}
+
+func davHandler(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("DAV", "1, 2")
+  w.Header().Set("MS-Author-Via", "DAV")
+  if r.Method == http.MethodOptions {
+    w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, MOVE, COPY, LOCK, UNLOCK")
+    return
+  }
+  u := davAuthenticate(w, r)
+  if u == nil {
+    return
+  }
+  d := parseDAVPath(r.URL.Path)
+  if d.title == "" && !d.folder && davIsFolder(d.path+"/", u) {
+    d.folder, d.path = true, d.path+"/"
+  }
+  switch r.Method {
+  case "PROPFIND":
+    davPropfind(w, r, d, u)
+  case http.MethodGet, http.MethodHead:
+    davGet(w, r, d, u)
+  case http.MethodPut:
+    davPut(w, r, d, u)
+  case http.MethodDelete:
+    davDelete(w, r, d, u)
+  case "MKCOL":
+    if d.title != "" || davIsFolder(d.dir(), u) {
+      http.Error(w, "already exists", http.StatusMethodNotAllowed)
+      return
+    }
+    davSetScratch(u, d.dir(), nil)
+    w.WriteHeader(http.StatusCreated)
+  case "MOVE", "COPY":
+    davMove(w, r, d, u, r.Method == "MOVE")
+  case "LOCK":
+    davLock(w, r, d)
+  case "UNLOCK":
+    w.WriteHeader(http.StatusNoContent)
+  case "PROPPATCH":
+    davProppatch(w, r, d)
+  default:
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+/* A file or folder as PROPFIND lists it */
+type davEntry struct {
+  href string
+  folder bool
+  size int64
+  modified time.Time
+  etag string
+}
+
+/* Whether dir (ending in /) has pages or scratch files in it for u */
+func davIsFolder(dir string, u *User) bool {
+  if dir == "" {
+    return true
+  }
+  if davGetScratch(u, dir) != nil {
+    return true
+  }
+  entries, err := davList(dir, u)
+  return err == nil && len(entries) > 0
+}
+
+/* What's in dir (ending in /, "" for the top) for u */
+func davList(dir string, u *User) ([]davEntry, error) {
+  titles, err := listPages()
+  if err != nil {
+    return nil, err
+  }
+  if titles, err = visiblePages(titles, u); err != nil {
+    return nil, err
+  }
+  seen := map[string]bool{}
+  var out []davEntry
+  for _, title := range titles {
+    rest, ok := strings.CutPrefix(title, dir)
+    if !ok || rest == "" {
+      continue
+    }
+    if sub, _, nested := strings.Cut(rest, "/"); nested {
+      if !seen[sub+"/"] {
+        seen[sub+"/"] = true
+        out = append(out, davEntry{href: davHref(dir + sub + "/"), folder: true})
+      }
+      continue
+    }
+    info, err := store.Stat(title)
+    if err != nil {
+      continue
+    }
+    seen[rest+".txt"] = true
+    out = append(out, davEntry{href: davHref(title + ".txt"), size: info.Size, modified: info.Modified, etag: davETag(info)})
+  }
+  davState.Lock()
+  defer davState.Unlock()
+  for path, f := range davState.scratch[u.Name] {
+    rest, ok := strings.CutPrefix(path, dir)
+    if !ok || rest == "" || time.Since(f.modified) > davScratchTTL {
+      continue
+    }
+    name, _, nested := strings.Cut(rest, "/")
+    if nested {
+      name += "/"
+    }
+    if seen[name] {
+      continue
+    }
+    seen[name] = true
+    if nested {
+      out = append(out, davEntry{href: davHref(dir + name), folder: true, modified: f.modified})
+    } else {
+      out = append(out, davEntry{href: davHref(path), size: int64(len(f.data)), modified: f.modified})
+    }
+  }
+  sort.Slice(out, func(i, j int) bool { return out[i].href < out[j].href })
+  return out, nil
+}
+
+func davHref(path string) string {
+  parts := strings.Split(path, "/")
+  for i := range parts {
+    parts[i] = url.PathEscape(parts[i])
+  }
+  return davPrefix + strings.Join(parts, "/")
+}
+
+func davETag(info PageInfo) string {
+  return `"` + strconv.FormatInt(info.Modified.UnixNano(), 36) + "-" + strconv.FormatInt(info.Size, 36) + `"`
+}
+
+/* The page d names, if it exists and u may read it */
+func davPage(r *http.Request, d davPath) (*Page, error) {
+  p, err := loadPage(d.title)
+  if err != nil {
+    return nil, err
+  }
+  p, _, status, err := readStatus(r, p)
+  if err != nil {
+    return nil, err
+  }
+  if status != http.StatusOK {
+    return nil, os.ErrNotExist
+  }
+  return p, nil
+}
+
+/* The entry for d itself, nil if there's nothing there */
+func davStat(r *http.Request, d davPath, u *User) (*davEntry, error) {
+  if d.folder {
+    if !davIsFolder(d.path, u) {
+      return nil, nil
+    }
+    return &davEntry{href: davHref(d.path), folder: true}, nil
+  }
+  if f := davGetScratch(u, d.path); f != nil {
+    return &davEntry{href: davHref(d.path), size: int64(len(f.data)), modified: f.modified}, nil
+  }
+  if d.title == "" {
+    return nil, nil
+  }
+  if _, err := davPage(r, d); os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  info, err := store.Stat(d.title)
+  if err != nil {
+    return nil, err
+  }
+  return &davEntry{href: davHref(d.path), size: info.Size, modified: info.Modified, etag: davETag(info)}, nil
+}
+
+func davPropfind(w http.ResponseWriter, r *http.Request, d davPath, u *User) {
+  self, err := davStat(r, d, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if self == nil {
+    http.NotFound(w, r)
+    return
+  }
+  entries := []davEntry{*self}
+  if self.folder && r.Header.Get("Depth") != "0" {
+    children, err := davList(d.path, u)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    entries = append(entries, children...)
+  }
+  var b bytes.Buffer
+  b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">` + "\n")
+  for _, e := range entries {
+    b.WriteString("<D:response><D:href>")
+    xml.EscapeText(&b, []byte(e.href))
+    b.WriteString("</D:href><D:propstat><D:prop>")
+    name := strings.TrimSuffix(e.href, "/")
+    name, _ = url.PathUnescape(name[strings.LastIndex(name, "/")+1:])
+    b.WriteString("<D:displayname>")
+    xml.EscapeText(&b, []byte(name))
+    b.WriteString("</D:displayname>")
+    if e.folder {
+      b.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+    } else {
+      b.WriteString("<D:resourcetype/><D:getcontenttype>text/plain; charset=utf-8</D:getcontenttype>")
+      b.WriteString("<D:getcontentlength>" + strconv.FormatInt(e.size, 10) + "</D:getcontentlength>")
+    }
+    if !e.modified.IsZero() {
+      b.WriteString("<D:getlastmodified>" + e.modified.UTC().Format(http.TimeFormat) + "</D:getlastmodified>")
+    }
+    if e.etag != "" {
+      b.WriteString("<D:getetag>")
+      xml.EscapeText(&b, []byte(e.etag))
+      b.WriteString("</D:getetag>")
+    }
+    b.WriteString(`<D:supportedlock><D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry></D:supportedlock>`)
+    b.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>\n")
+  }
+  b.WriteString("</D:multistatus>\n")
+  w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+  w.WriteHeader(http.StatusMultiStatus)
+  w.Write(b.Bytes())
+}
+
+func davGet(w http.ResponseWriter, r *http.Request, d davPath, u *User) {
+  if d.folder {
+    http.Error(w, "a folder: browse it with a WebDAV client", http.StatusMethodNotAllowed)
+    return
+  }
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  if f := davGetScratch(u, d.path); f != nil {
+    http.ServeContent(w, r, "", f.modified, bytes.NewReader(f.data))
+    return
+  }
+  if d.title == "" {
+    http.NotFound(w, r)
+    return
+  }
+  p, err := davPage(r, d)
+  if pageCorrupt(w, err) {
+    return
+  }
+  if os.IsNotExist(err) {
+    http.NotFound(w, r)
+    return
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  var modified time.Time
+  if info, err := store.Stat(d.title); err == nil {
+    modified = info.Modified
+    w.Header().Set("ETag", davETag(info))
+  }
+  http.ServeContent(w, r, "", modified, bytes.NewReader(p.Body))
+}
+
+func davPut(w http.ResponseWriter, r *http.Request, d davPath, u *User) {
+  if d.folder {
+    http.Error(w, "can't write to a folder", http.StatusMethodNotAllowed)
+    return
+  }
+  data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize+1))
+  if err != nil || int64(len(data)) > maxBodySize {
+    http.Error(w, errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+    return
+  }
+  // New empty files are how file managers start a copy: hold them until
+  // there's something in them
+  if d.title == "" || len(data) == 0 && !pageExists(d.title) {
+    if err := davSetScratch(u, d.path, data); err != nil {
+      http.Error(w, err.Error(), http.StatusInsufficientStorage)
+      return
+    }
+    w.WriteHeader(http.StatusCreated)
+    return
+  }
+  status, err := davSave(r, d.title, data, u)
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+  davRemoveScratch(u, d.path)
+  w.WriteHeader(status)
+}
+
+/* Save data as title for u, as the edit form would, returning the status
+  to answer with: 201 for a new page, 204 for a changed one
+*/
+func davSave(r *http.Request, title string, data []byte, u *User) (int, error) {
+  p := &Page{Title: title, Body: data}
+  if err := authorizeSave(title, u); err != nil {
+    return saveErrorStatus(err), err
+  }
+  if err := checkSave(p); err != nil {
+    return saveErrorStatus(err), err
+  }
+  unlock, err := lockPage(title)
+  if err != nil {
+    return http.StatusServiceUnavailable, err
+  }
+  defer unlock()
+  if err := checkPreconditions(r, title); err == errPrecondition {
+    return http.StatusPreconditionFailed, err
+  } else if err != nil {
+    return http.StatusInternalServerError, err
+  }
+  status := http.StatusNoContent
+  if !pageExists(title) {
+    status = http.StatusCreated
+  }
+  if err := p.saveLocked(u.Name, false); err != nil {
+    return http.StatusInternalServerError, err
+  }
+  return status, nil
+}
+
+func davDelete(w http.ResponseWriter, r *http.Request, d davPath, u *User) {
+  if davRemoveScratch(u, d.path) {
+    w.WriteHeader(http.StatusNoContent)
+    return
+  }
+  if d.folder {
+    http.Error(w, "delete the pages in a folder one at a time", http.StatusForbidden)
+    return
+  }
+  if d.title == "" {
+    http.NotFound(w, r)
+    return
+  }
+  if _, err := davPage(r, d); os.IsNotExist(err) {
+    http.NotFound(w, r)
+    return
+  } else if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if err := authorizeWrite(d.title, u); err != nil {
+    http.Error(w, err.Error(), saveErrorStatus(err))
+    return
+  }
+  if err := deletePage(d.title, u.Name); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+/* MOVE and COPY, to the Destination header */
+func davMove(w http.ResponseWriter, r *http.Request, d davPath, u *User, move bool) {
+  dest, err := url.Parse(r.Header.Get("Destination"))
+  if err != nil || !strings.HasPrefix(dest.Path, davPrefix) {
+    http.Error(w, "Destination must be under "+davPrefix, http.StatusBadGateway)
+    return
+  }
+  to := parseDAVPath(dest.Path)
+  overwrite := r.Header.Get("Overwrite") != "F"
+  if d.folder {
+    if !move {
+      http.Error(w, "folders can't be copied", http.StatusForbidden)
+      return
+    }
+    davMoveFolder(w, r, d.dir(), to.dir(), u)
+    return
+  }
+  var data []byte
+  if f := davGetScratch(u, d.path); f != nil {
+    data = f.data
+  } else if d.title != "" {
+    p, err := davPage(r, d)
+    if os.IsNotExist(err) {
+      http.NotFound(w, r)
+      return
+    } else if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    data = p.Body
+  } else {
+    http.NotFound(w, r)
+    return
+  }
+  exists := davGetScratch(u, to.path) != nil || to.title != "" && pageExists(to.title)
+  if exists && !overwrite {
+    http.Error(w, "the destination exists", http.StatusPreconditionFailed)
+    return
+  }
+  status := http.StatusCreated
+  if exists {
+    status = http.StatusNoContent
+  }
+  switch {
+  case to.title == "":
+    // A page moved to a name that isn't one is only copied (see above)
+    if err := davSetScratch(u, to.path, data); err != nil {
+      http.Error(w, err.Error(), http.StatusInsufficientStorage)
+      return
+    }
+    if move {
+      davRemoveScratch(u, d.path)
+    }
+  case move && d.title != "" && davGetScratch(u, d.path) == nil && d.title != to.title:
+    if err := davRename(map[string]string{d.title: to.title}, u, overwrite); err != nil {
+      http.Error(w, err.Error(), davErrorStatus(err))
+      return
+    }
+  default:
+    if d.title == to.title && davGetScratch(u, d.path) == nil {
+      w.WriteHeader(http.StatusNoContent) // Title.txt and Title.md are the same page
+      return
+    }
+    if _, err := davSave(r, to.title, data, u); err != nil {
+      http.Error(w, err.Error(), davErrorStatus(err))
+      return
+    }
+    davRemoveScratch(u, to.path)
+    if move {
+      davRemoveScratch(u, d.path)
+    }
+  }
+  w.WriteHeader(status)
+}
+
+/* Rename every page under the folder from to the folder to */
+func davMoveFolder(w http.ResponseWriter, r *http.Request, from, to string, u *User) {
+  if from == "" || to == "" || strings.HasPrefix(to, from) {
+    http.Error(w, "can't move a folder there", http.StatusForbidden)
+    return
+  }
+  titles, err := listPages()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  renames := map[string]string{}
+  for _, title := range titles {
+    if rest, ok := strings.CutPrefix(title, from); ok {
+      renames[title] = to + rest
+    }
+  }
+  davState.Lock()
+  for path, f := range davState.scratch[u.Name] {
+    if rest, ok := strings.CutPrefix(path, from); ok {
+      delete(davState.scratch[u.Name], path)
+      davState.scratch[u.Name][to+rest] = f
+    }
+  }
+  davState.Unlock()
+  if len(renames) > 0 {
+    if err := davRename(renames, u, false); err != nil {
+      http.Error(w, err.Error(), davErrorStatus(err))
+      return
+    }
+  }
+  w.WriteHeader(http.StatusCreated)
+}
+
+/* An error from a batch, with the status it calls for */
+type davBatchError struct {
+  status int
+  err error
+}
+
+func (e davBatchError) Error() string {
+  return e.err.Error()
+}
+
+func davErrorStatus(err error) int {
+  var be davBatchError
+  if errors.As(err, &be) {
+    return be.status
+  }
+  if err == errPrecondition {
+    return http.StatusPreconditionFailed
+  }
+  return saveErrorStatus(err)
+}
+
+/* Rename pages as a batch does, old title to new; with overwrite an
+  existing page at a new title is replaced
+*/
+func davRename(renames map[string]string, u *User, overwrite bool) error {
+  var ops []batchOp
+  titles := []string{}
+  for from, to := range renames {
+    titles = append(titles, from, to)
+  }
+  unlock, err := lockPages(titles)
+  if err != nil {
+    return davBatchError{http.StatusServiceUnavailable, err}
+  }
+  defer unlock()
+  for from, to := range renames {
+    if overwrite && pageExists(to) {
+      ops = append(ops, batchOp{Op: "delete", Title: to})
+    }
+    ops = append(ops, batchOp{Op: "rename", Title: from, NewTitle: to})
+  }
+  writes, _, status, err := planBatch(ops, u)
+  if err != nil {
+    return davBatchError{status, err}
+  }
+  if _, err := applyOps(writes, u.Name); err != nil {
+    return davBatchError{http.StatusInternalServerError, err}
+  }
+  for _, op := range ops {
+    if op.Op == "rename" {
+      if err := recordRename(op.Title, op.NewTitle, u.Name); err != nil {
+        return davBatchError{http.StatusInternalServerError, err}
+      }
+      if err := renameShortLink(op.Title, op.NewTitle); err != nil {
+        return davBatchError{http.StatusInternalServerError, err}
+      }
+    }
+  }
+  return nil
+}
+
+/* Grant a lock, which nothing enforces (see above) */
+func davLock(w http.ResponseWriter, r *http.Request, d davPath) {
+  token, err := randomID()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  token = "opaquelocktoken:" + token[:8] + "-" + token[8:12] + "-" + token[12:16] + "-" + token[16:20] + "-" + token[20:]
+  if h := r.Header.Get("If"); h != "" && r.ContentLength == 0 {
+    // A refresh: keep the token the client has
+    if i, j := strings.Index(h, "<"), strings.Index(h, ">"); i >= 0 && j > i {
+      token = h[i+1 : j]
+    }
+  }
+  var b bytes.Buffer
+  b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`)
+  b.WriteString(`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope><D:depth>0</D:depth>`)
+  b.WriteString(`<D:timeout>Second-3600</D:timeout><D:locktoken><D:href>`)
+  xml.EscapeText(&b, []byte(token))
+  b.WriteString(`</D:href></D:locktoken><D:lockroot><D:href>`)
+  xml.EscapeText(&b, []byte(davHref(d.path)))
+  b.WriteString("</D:href></D:lockroot></D:activelock></D:lockdiscovery></D:prop>\n")
+  w.Header().Set("Lock-Token", "<"+token+">")
+  w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+  w.Write(b.Bytes())
+}
+
+/* Answer that every property asked to be set was, without keeping any */
+func davProppatch(w http.ResponseWriter, r *http.Request, d davPath) {
+  var names []xml.Name
+  dec := xml.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+  depth := 0
+  for {
+    tok, err := dec.Token()
+    if err != nil {
+      break
+    }
+    switch t := tok.(type) {
+    case xml.StartElement:
+      depth++
+      // propertyupdate > set|remove > prop > the properties
+      if depth == 4 {
+        names = append(names, t.Name)
+      }
+    case xml.EndElement:
+      depth--
+    }
+  }
+  var b bytes.Buffer
+  b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:"><D:response><D:href>`)
+  xml.EscapeText(&b, []byte(davHref(d.path)))
+  b.WriteString("</D:href><D:propstat><D:prop>")
+  for i, n := range names {
+    ns := "p" + strconv.Itoa(i)
+    b.WriteString("<" + ns + ":" + n.Local + ` xmlns:` + ns + `="`)
+    xml.EscapeText(&b, []byte(n.Space))
+    b.WriteString(`"/>`)
+  }
+  b.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response></D:multistatus>\n")
+  w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+  w.WriteHeader(http.StatusMultiStatus)
+  w.Write(b.Bytes())
+}
+
+func davGetScratch(u *User, path string) *davScratch {
+  davState.Lock()
+  defer davState.Unlock()
+  f := davState.scratch[u.Name][path]
+  if f == nil || time.Since(f.modified) > davScratchTTL {
+    return nil
+  }
+  return f
+}
+
+/* Hold data as path for u, dropping what's expired */
+func davSetScratch(u *User, path string, data []byte) error {
+  davState.Lock()
+  defer davState.Unlock()
+  files := davState.scratch[u.Name]
+  if files == nil {
+    files = map[string]*davScratch{}
+    davState.scratch[u.Name] = files
+  }
+  total := len(data)
+  for p, f := range files {
+    if time.Since(f.modified) > davScratchTTL {
+      delete(files, p)
+    } else if p != path {
+      total += len(f.data)
+    }
+  }
+  if total > davScratchMax {
+    return errors.New("too many files that aren't pages")
+  }
+  files[path] = &davScratch{data: data, modified: time.Now()}
+  return nil
+}
+
+/* Drop path for u, reporting whether there was one */
+func davRemoveScratch(u *User, path string) bool {
+  davState.Lock()
+  defer davState.Unlock()
+  if _, ok := davState.scratch[u.Name][path]; !ok {
+    return false
+  }
+  delete(davState.scratch[u.Name], path)
+  return true
+}
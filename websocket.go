@@ -0,0 +1,177 @@
+package main
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "encoding/base64"
+  "encoding/binary"
+  "errors"
+  "io"
+  "net"
+  "net/http"
+  "net/url"
+  "strings"
+  "sync"
+)
+
+/* Minimal WebSocket server side (RFC 6455)
+  - Enough for text messages between our own pages and the server: no
+    extensions, no subprotocols
+  - Fragments are reassembled, pings are answered, a close frame ends the connection
+  - One goroutine may read while another writes; writes are serialised by wmu
+*/
+type wsConn struct {
+  conn net.Conn
+  rw *bufio.ReadWriter
+  maxSize int64
+  wmu sync.Mutex
+}
+
+/* The handshake hashes the client's key with this fixed GUID */
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errWSClosed = errors.New("websocket closed")
+
+/* Upgrade an HTTP request to a WebSocket
+  - Checks the Origin matches the Host, since browsers send cookies with
+    cross-site WebSocket requests and we don't want other sites talking to us
+  - maxSize caps the size of a message from the client
+*/
+func wsUpgrade(w http.ResponseWriter, r *http.Request, maxSize int64) (*wsConn, error) {
+  if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+    !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+    http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+    return nil, errors.New("not a websocket request")
+  }
+  if origin := r.Header.Get("Origin"); origin != "" {
+    u, err := url.Parse(origin)
+    if err != nil || u.Host != r.Host {
+      http.Error(w, "Cross origin WebSocket not allowed", http.StatusForbidden)
+      return nil, errors.New("bad origin")
+    }
+  }
+  key := r.Header.Get("Sec-WebSocket-Key")
+  if key == "" {
+    http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+    return nil, errors.New("missing key")
+  }
+  hj, ok := w.(http.Hijacker)
+  if !ok {
+    http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+    return nil, errors.New("response can't be hijacked")
+  }
+  conn, rw, err := hj.Hijack()
+  if err != nil {
+    return nil, err
+  }
+  sum := sha1.Sum([]byte(key + wsGUID))
+  rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+  rw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+  rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+  if err := rw.Flush(); err != nil {
+    conn.Close()
+    return nil, err
+  }
+  return &wsConn{conn: conn, rw: rw, maxSize: maxSize}, nil
+}
+
+/* Read the next text or binary message */
+func (c *wsConn) ReadMessage() ([]byte, error) {
+  var msg []byte
+  for {
+    fin, op, payload, err := c.readFrame()
+    if err != nil {
+      return nil, err
+    }
+    switch op {
+    case 0x8: // close
+      c.writeFrame(0x8, nil)
+      return nil, errWSClosed
+    case 0x9: // ping
+      if err := c.writeFrame(0xA, payload); err != nil {
+        return nil, err
+      }
+      continue
+    case 0xA: // pong
+      continue
+    }
+    msg = append(msg, payload...)
+    if int64(len(msg)) > c.maxSize {
+      c.writeFrame(0x8, []byte{0x03, 0xF1}) // 1009 message too big
+      return nil, errors.New("websocket message too large")
+    }
+    if fin {
+      return msg, nil
+    }
+  }
+}
+
+/* Send a text message */
+func (c *wsConn) WriteMessage(msg []byte) error {
+  return c.writeFrame(0x1, msg)
+}
+
+func (c *wsConn) Close() error {
+  return c.conn.Close()
+}
+
+/* Read one frame; client frames are always masked */
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+  var hdr [2]byte
+  if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+    return false, 0, nil, err
+  }
+  fin, op := hdr[0]&0x80 != 0, hdr[0]&0x0F
+  masked, n := hdr[1]&0x80 != 0, uint64(hdr[1]&0x7F)
+  switch n {
+  case 126:
+    var ext [2]byte
+    if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+      return false, 0, nil, err
+    }
+    n = uint64(binary.BigEndian.Uint16(ext[:]))
+  case 127:
+    var ext [8]byte
+    if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+      return false, 0, nil, err
+    }
+    n = binary.BigEndian.Uint64(ext[:])
+  }
+  if !masked {
+    return false, 0, nil, errors.New("unmasked client frame")
+  }
+  if n > uint64(c.maxSize) {
+    return false, 0, nil, errors.New("websocket frame too large")
+  }
+  var mask [4]byte
+  if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+    return false, 0, nil, err
+  }
+  payload := make([]byte, n)
+  if _, err := io.ReadFull(c.rw, payload); err != nil {
+    return false, 0, nil, err
+  }
+  for i := range payload {
+    payload[i] ^= mask[i%4]
+  }
+  return fin, op, payload, nil
+}
+
+/* Write one unfragmented, unmasked frame */
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+  c.wmu.Lock()
+  defer c.wmu.Unlock()
+  hdr := []byte{0x80 | op}
+  switch n := len(payload); {
+  case n < 126:
+    hdr = append(hdr, byte(n))
+  case n <= 0xFFFF:
+    hdr = append(hdr, 126, byte(n>>8), byte(n))
+  default:
+    hdr = append(hdr, 127)
+    hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+  }
+  c.rw.Write(hdr)
+  c.rw.Write(payload)
+  return c.rw.Flush()
+}
@@ -2,11 +2,20 @@ package main
 
 import (
     "html/template" // to keep html in separate file
-    "io/ioutil"
     "log"
     "net/http"
+    "net/url" // to escape titles in links and file names
+    "os"
     "regexp"
+    "strconv"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+    "sync/atomic"
+    "time"
     "errors" // To create new errors
+    "flag" // command line settings
+    "path/filepath"
 )
 
 
@@ -14,40 +23,86 @@ import (
   Two fields, Title and Body
   []byte means a "bite slice"
     - type expected by the io libraries we will use
+  - Revision is the page's latest revision number when it was loaded or saved,
+    0 for a page with no history (see history.go)
 */
 type Page struct {
   Title string
   Body []byte
+  Revision int
 }
 
 /* Save method for a Page
   - "This is a method named save that takes as its receiver p,
-  a pointer to Page. It takes no parameters and returns a value of type error"
-  - Will save the Page's Body to a text file using Title as the file name
-  - error is the return type of WriteFile (a standard library function that writes
-    a byte slice to a file)
+  a pointer to Page. It takes the author of the change and returns a value of type error"
+  - minor marks it as a minor edit, one readers can filter out of recent changes
+  - Will save the Page's Body to the store using Title as the key (see store.go)
+    and record it as a new revision in the history
+  - Holds the page's write lock while it does (see cluster.go); saveLocked is
+    for callers that already hold it
   - If successful, Page.save() will return nil
-  - 0600 is passed to Writefile to indicate the file should be created with r/w permissions for the current user
 */
-func (p *Page) save() error{
-  filename := "data/" + p.Title + ".txt"
-  return ioutil.WriteFile(filename, p.Body, 0600)
+func (p *Page) save(author string, minor bool) error{
+  unlock, err := lockPage(p.Title)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  return p.saveLocked(author, minor)
+}
+
+func (p *Page) saveLocked(author string, minor bool) error {
+  old, _ := store.Load(p.Title)
+  if err := store.Save(p.Title, p.Body); err != nil {
+    return err
+  }
+  rev, err := recordRevision(p.Title, old, p.Body, author, minor)
+  if err != nil {
+    return err
+  }
+  p.Revision = rev
+  pageEvents.send(PageEvent{Type: "save", Title: p.Title, Time: time.Now().UTC(), Minor: minor, Author: author, Revision: rev})
+  return nil
+}
+
+/* Delete a page for by, letting subscribers know */
+func deletePage(title, by string) error {
+  unlock, err := lockPage(title)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  if err := store.Delete(title); err != nil {
+    return err
+  }
+  pageEvents.send(PageEvent{Type: "delete", Title: title, Time: time.Now().UTC(), Author: by})
+  auditActivity("page-deleted", by, title, "")
+  return nil
+}
+
+/* Page URL for an action ("view", "edit", "save")
+  - Escapes the title so spaces become %20 in links and redirects
+  - Each part of a nested title is escaped separately so the slashes stay slashes
+*/
+func pageURL(action, title string) string {
+  parts := strings.Split(title, "/")
+  for i := range parts {
+    parts[i] = url.PathEscape(parts[i])
+  }
+  return "/" + action + "/" + strings.Join(parts, "/")
 }
 
 
 /* Load a Page
-    - Constructs a filename from title parameter
-    - Reads the file's contents into variable body
+    - Reads the page's contents from the store into variable body
     - Returns a pointer to Page literal constructed and an error (nil for no error)
-    - ioutil.ReadFile() returns []byte and error
 */
 func loadPage(title string) (*Page, error) {
-  filename := title + ".txt"
-  body, err := ioutil.ReadFile(filename)
+  body, err := store.Load(title)
   if err != nil{
     return nil, err
   }
-  return &Page{Title: title, Body: body}, nil
+  return &Page{Title: title, Body: body, Revision: latestRevision(title)}, nil
 }
 
 /* viewHandler that allows users to view a wiki Page
@@ -57,12 +112,195 @@ func loadPage(title string) (*Page, error) {
   - Writes it to w, the http.ResponseWriter
 */
 func viewHandler(w http.ResponseWriter, r *http.Request, title string) {
-  p, err := loadPage(title)
+  p, err := viewPage(title)
+  if pageCorrupt(w, err) {
+    return
+  }
+  if err != nil {
+    if redirectRenamed(w, r, "view", title) {
+      return
+    }
+    http.Redirect(w, r, pageURL("edit", title), http.StatusFound)
+    return
+  }
+  p, banner, ok := checkReadable(w, r, p)
+  if !ok {
+    return
+  }
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  _, stale := staleSince(title, m)
+  pending, err := proposals.Proposals(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  u := currentUser(r)
+  var shares []shareLink
+  if u != nil {
+    if shares, err = shareLinks(r, title, m); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  data := &viewData{
+    Page: p, Crumbs: breadcrumbs(title), Stats: bodyStats(p.Body), Banner: banner,
+    Draft: m.Draft && u != nil, Protected: m.Protected, Admin: u != nil && u.Admin, Pending: len(pending),
+    Header: chromeFor(title, "_Header"), Sidebar: chromeFor(title, "_Sidebar"), Footer: chromeFor(title, "_Footer"),
+    Card: pageCardFor(r, p), ShortLink: shortLinkOf(title),
+    SignedIn: u != nil, Stale: u != nil && stale, Visibility: m.Visibility, Owner: m.Owner, Group: m.Group, Groups: groupList(), Shares: shares,
+    Tags: m.Tags, Zone: viewerZone(r),
+  }
+  if u != nil {
+    data.Searches = u.Searches
+  }
+  if streamed(p.Body) {
+    streamTemplate(w, "view", data, p.Body)
+    return
+  }
+  renderTemplate(w, "view", data)
+}
+
+/* Data for the view template */
+type viewData struct {
+  *Page
+  Crumbs []crumb
+  Stats pageStats
+  Banner string // from the page's schedule, drafting or staleness
+  Draft bool // a draft the reader may publish
+  Protected bool
+  Admin bool // the reader can protect and unprotect it
+  Pending int // proposals waiting for review
+  Header, Sidebar, Footer template.HTML
+  Card pageCard // OpenGraph and Twitter card tags
+  ShortLink string // id of the page's short link, if it has one
+  SignedIn bool // the reader can manage sharing
+  Stale bool // the reader can mark it as still current
+  Zone *time.Location
+  Visibility, Owner, Group string
+  Groups []groupInfo // that it can be made visible to
+  Shares []shareLink
+  Searches []SavedSearch // the reader's, see savedsearch.go
+  Tags []string
+}
+
+/* One ancestor of a nested page: the last segment of its title, and the full title */
+type crumb struct {
+  Name string
+  Title string
+}
+
+/* The ancestors of title, outermost first: Projects/Roadmap/2025 gives
+  Projects and Projects/Roadmap. A top level page has none
+*/
+func breadcrumbs(title string) []crumb {
+  parts := strings.Split(title, "/")
+  crumbs := []crumb{}
+  for i := 0; i < len(parts)-1; i++ {
+    crumbs = append(crumbs, crumb{Name: parts[i], Title: strings.Join(parts[:i+1], "/")})
+  }
+  return crumbs
+}
+
+/* The page on its own at /print/{title}, without the links and special
+  pages around it, for printing or saving as PDF
+*/
+func printHandler(w http.ResponseWriter, r *http.Request, title string) {
+  p, err := viewPage(title)
+  if pageCorrupt(w, err) {
+    return
+  }
+  if err != nil {
+    if redirectRenamed(w, r, "print", title) {
+      return
+    }
+    http.NotFound(w, r)
+    return
+  }
+  p, _, ok := checkReadable(w, r, p)
+  if !ok {
+    return
+  }
+  data := &printData{Page: p}
+  if id := shortLinkOf(title); id != "" {
+    data.ShortLink = siteBase(r) + shortLinkURL(id)
+  }
+  if streamed(p.Body) {
+    streamTemplate(w, "print", data, p.Body)
+    return
+  }
+  renderTemplate(w, "print", data)
+}
+
+/* Data for the print page; ShortLink is the page's short link in full, if it has one */
+type printData struct {
+  *Page
+  ShortLink string
+}
+
+/* One line of the source view; Break marks the blank lines between paragraphs */
+type sourceLine struct {
+  Number int
+  Text string
+  Break bool
+}
+
+type sourceData struct {
+  Title string
+  Lines []sourceLine
+}
+
+/* The page's text with line numbers at /source/{title}
+  - Each line can be linked to as #L{n}
+  - Plain text has no markup to highlight beyond its paragraph breaks, which
+    are shaded so the paragraphs renderBody will make are easy to see
+*/
+func sourceHandler(w http.ResponseWriter, r *http.Request, title string) {
+  p, err := viewPage(title)
+  if pageCorrupt(w, err) {
+    return
+  }
+  if err != nil {
+    if redirectRenamed(w, r, "source", title) {
+      return
+    }
+    http.NotFound(w, r)
+    return
+  }
+  p, _, ok := checkReadable(w, r, p)
+  if !ok {
+    return
+  }
+  data := &sourceData{Title: title}
+  text := strings.TrimSuffix(strings.Replace(string(p.Body), "\r\n", "\n", -1), "\n")
+  for i, line := range strings.Split(text, "\n") {
+    data.Lines = append(data.Lines, sourceLine{Number: i + 1, Text: line, Break: strings.TrimSpace(line) == ""})
+  }
+  renderTemplate(w, "source", data)
+}
+
+/* The page body as plain text at /raw/{title} */
+func rawHandler(w http.ResponseWriter, r *http.Request, title string) {
+  p, err := viewPage(title)
+  if pageCorrupt(w, err) {
+    return
+  }
   if err != nil {
-    http.Redirect(w, r, "/edit/"+title, http.StatusFound)
+    if redirectRenamed(w, r, "raw", title) {
+      return
+    }
+    http.NotFound(w, r)
+    return
+  }
+  p, _, ok := checkReadable(w, r, p)
+  if !ok {
     return
   }
-  renderTemplate(w, "view", p)
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  w.Write(p.Body)
 }
 
 /* editHandler
@@ -75,27 +313,404 @@ func viewHandler(w http.ResponseWriter, r *http.Request, title string) {
 */
 func editHandler(w http.ResponseWriter, r *http.Request, title string) {
   p, err := loadPage(title)
+  if pageCorrupt(w, err) {
+    return
+  }
   if err != nil {
     p = &Page{Title: title}
   }
-  renderTemplate(w, "edit", p)
+  m, err := pageMeta.Load(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  u := currentUser(r)
+  if readAccess(title, m, u, "") != http.StatusOK {
+    http.NotFound(w, r)
+    return
+  }
+  renderTemplate(w, "edit", &editData{Page: p, Meta: m, Review: reviewMode, Prefs: prefsOf(u), Zone: viewerZone(r)})
 }
 
-/* Save a page */
+/* Data for the edit form */
+type editData struct {
+  *Page
+  Meta PageMeta
+  Review bool // saves to protected pages become proposals
+  Prefs Preferences
+  Zone *time.Location
+}
+
+/* Save a page
+  - The request body is capped with http.MaxBytesReader so a huge paste is cut off
+    before it is read into memory. Form encoding can triple the size of the text,
+    hence the 3x allowance; the decoded body is checked against the real limit
+  - Too large is a 413, content we won't store (see validateBody) is a 422
+  - The page's lock is held from merging to saving, so a save in between
+    can't be overwritten unmerged
+  - A page the user can't read is a 404 before anything else
+*/
 func saveHandler(w http.ResponseWriter, r *http.Request, title string) {
-  body := r.FormValue("body")
-  p := &Page{Title: title, Body: []byte(body)}
-  err := p.save()
+  r.Body = http.MaxBytesReader(w, r.Body, 3*maxBodySize+4096)
+  if err := r.ParseForm(); err != nil {
+    http.Error(w, errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+    return
+  }
+  unlock, err := lockPage(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusServiceUnavailable)
+    return
+  }
+  defer unlock()
+  // Before merging, as a conflict shows the page as it stands
+  access := authorizeSave(title, currentUser(r))
+  if access == errNoSuchPage {
+    http.NotFound(w, r)
+    return
+  }
+  p := &Page{Title: title, Body: []byte(r.FormValue("body"))}
+  if base := r.FormValue("base"); base != "" {
+    n, _ := strconv.Atoi(base)
+    theirs, conflict, err := mergeStale(p, n)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    if conflict {
+      w.WriteHeader(http.StatusConflict)
+      renderTemplate(w, "conflict", &conflictData{Page: p, Theirs: theirs})
+      return
+    }
+  }
+  err = checkSave(p)
+  if err == nil {
+    err = access
+  }
+  if err == errNeedsReview {
+    if err := propose(p, latestRevision(title), requestAuthor(r), r.FormValue("minor") != ""); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+    return
+  }
+  if err != nil {
+    http.Error(w, err.Error(), saveErrorStatus(err))
+    return
+  }
+  // Only the edit form has the schedule and draft fields; other saves leave them be
+  fromEdit := r.FormValue("meta") != ""
+  meta, err := pageMeta.Load(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if fromEdit {
+    if err := parseSchedule(r, &meta); err != nil {
+      http.Error(w, "Invalid publish or expiry time", http.StatusUnprocessableEntity)
+      return
+    }
+    if meta.Tags, err = parseTags(r.FormValue("tags")); err != nil {
+      http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+      return
+    }
+  }
+  if err := p.saveLocked(requestAuthor(r), r.FormValue("minor") != ""); err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if fromEdit {
+    if err := setDraft(title, &meta, r.FormValue("draft") != ""); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    if err := pageMeta.Save(title, meta); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  http.Redirect(w, r, pageURL("view", title), http.StatusFound)
+}
+
+/* Data for the conflict page: the merge with conflict markers and the saved version */
+type conflictData struct {
+  *Page
+  Theirs *Page
+}
+
+/* Merge an edit made against revision base with whatever was saved since
+  - Does nothing if base is still the latest revision
+  - Otherwise replaces p.Body with a three-way merge of base, p.Body and the
+    saved page, and sets p.Revision to the latest revision so the user can try
+    again from the conflict page
+  - Returns the saved page and whether the merge had overlapping changes
+  - Base 0 means the page had no history when editing began: the page either
+    didn't exist (an empty base) or was recorded as revision 1 on the next save
+*/
+func mergeStale(p *Page, base int) (*Page, bool, error) {
+  theirs, err := loadPage(p.Title)
+  if os.IsNotExist(err) {
+    return nil, false, nil // deleted since; saving recreates it
+  }
+  if err != nil {
+    return nil, false, err
+  }
+  if theirs.Revision <= base {
+    return theirs, false, nil
+  }
+  var baseBody []byte
+  if base > 0 {
+    baseBody, err = history.LoadRevision(p.Title, base)
+  } else if revs, _ := history.Revisions(p.Title); len(revs) > 0 && revs[0].Author == "" {
+    baseBody, err = history.LoadRevision(p.Title, revs[0].Number)
+  }
+  if err != nil && !os.IsNotExist(err) {
+    return nil, false, err
+  }
+  merged, conflict := merge3(string(baseBody), string(p.Body), string(theirs.Body),
+    "your changes", "saved revision " + strconv.Itoa(theirs.Revision))
+  p.Body = []byte(merged)
+  p.Revision = theirs.Revision
+  return theirs, conflict, nil
+}
+
+/* Form data for the copy page */
+type copyData struct {
+  Title string
+  NewTitle string
+  Files int // how many attachments the page has
+  CopyFiles bool
+  Error string
+}
+
+/* Copy a page to a new title
+  - GET shows a form asking for the new title
+  - POST clones the body to the new title and opens it for editing
+  - Refuses to overwrite an existing page; the form is shown again with the error
+  - Copies the version of the page the user can read, and who may read it, so
+    a copy of a private page is as private; the schedule, draft status,
+    protection and share links aren't copied
+  - With files checked the attachments are copied too, each going through
+    checkAttachment; the quota is checked for the page and all of them
+    before anything is saved
+*/
+func copyHandler(w http.ResponseWriter, r *http.Request, title string) {
+  p, err := loadPage(title)
+  if err != nil {
+    http.NotFound(w, r)
+    return
+  }
+  p, status, err := authorizeRead(p, currentUser(r), "")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if status != http.StatusOK {
+    http.NotFound(w, r)
+    return
+  }
+  files, err := attachments.List(title)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data := &copyData{Title: title, Files: len(files)}
+  if r.Method == http.MethodPost {
+    data.NewTitle = strings.TrimSpace(r.FormValue("title"))
+    data.CopyFiles = r.FormValue("files") != ""
+    if !data.CopyFiles {
+      files = nil
+    }
+    size := int64(len(p.Body))
+    for _, a := range files {
+      size += a.Size
+    }
+    status := http.StatusOK
+    switch {
+    case !validTitle.MatchString(data.NewTitle):
+      data.Error, status = "Invalid page title", http.StatusUnprocessableEntity
+    case pageExists(data.NewTitle):
+      data.Error, status = "A page with that title already exists", http.StatusConflict
+    default:
+      c := &Page{Title: data.NewTitle, Body: p.Body}
+      err := checkSave(c)
+      if err == nil {
+        err = checkQuota(c.Title, size)
+      }
+      if err != nil {
+        data.Error, status = err.Error(), saveErrorStatus(err)
+        break
+      }
+      if err := authorizeWrite(c.Title, currentUser(r)); err != nil {
+        data.Error, status = err.Error(), saveErrorStatus(err)
+        break
+      }
+      if err := copyVisibility(title, c.Title); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+      if err := c.save(requestAuthor(r), false); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+      for _, a := range files {
+        if err := copyAttachment(a, c.Title, requestAuthor(r)); err != nil {
+          http.Error(w, "Copied the page, but not "+a.Name+": "+err.Error(), saveErrorStatus(err))
+          return
+        }
+      }
+      http.Redirect(w, r, pageURL("edit", c.Title), http.StatusFound)
+      return
+    }
+    w.WriteHeader(status)
+  }
+  err = templates.Load().ExecuteTemplate(w, "copy.html", data)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+  }
+}
+
+/* Copy attachment a of one page to page, as if uploaded there by uploader */
+func copyAttachment(a Attachment, page, uploader string) error {
+  data, _, err := attachments.Load(a.Page, a.Name)
+  if err != nil {
+    return err
+  }
+  if err := checkAttachment(page, a.Name, int64(len(data))); err != nil {
+    return err
+  }
+  c := newAttachment(page, a.Name, data, uploader)
+  if err := attachments.Save(c, data); err != nil {
+    return err
+  }
+  auditActivity("file-uploaded", c.Uploader, c.Page, c.Name)
+  return nil
+}
+
+/* Give the page at to the visibility of the page at from; done before the
+  copy is saved, so it's never readable by more people than the original
+*/
+func copyVisibility(from, to string) error {
+  src, err := pageMeta.Load(from)
+  if err != nil {
+    return err
+  }
+  m, err := pageMeta.Load(to)
+  if err != nil {
+    return err
+  }
+  m.Visibility, m.Owner, m.Group = src.Visibility, src.Owner, src.Group
+  return pageMeta.Save(to, m)
+}
+
+/* Whether a page has been saved under title */
+func pageExists(title string) bool {
+  _, err := store.Stat(title)
+  return err == nil
+}
+
+/* Maximum size of a page body in bytes, set with -max-body */
+var maxBodySize int64 = 1 << 20
+
+var errBodyTooLarge = errors.New("Page body is too large")
+var errInvalidContent = errors.New("Page body must be UTF-8 text")
+
+/* Validate a page body before it is saved
+  - Rejects bodies over maxBodySize
+  - Rejects anything that isn't UTF-8 text: invalid sequences or control
+    characters other than tab, newline and carriage return (e.g. NUL bytes from
+    a binary file pasted into the form)
+*/
+func validateBody(body []byte) error {
+  if int64(len(body)) > maxBodySize {
+    return errBodyTooLarge
+  }
+  if !utf8.Valid(body) {
+    return errInvalidContent
+  }
+  for _, c := range string(body) {
+    if unicode.IsControl(c) && c != '\t' && c != '\n' && c != '\r' {
+      return errInvalidContent
+    }
+  }
+  return nil
+}
+
+/* Checks on the body run before any page is saved, from the form or the
+  API, along with authorizeSave
+*/
+func checkSave(p *Page) error {
+  if err := validateBody(p.Body); err != nil {
+    return err
+  }
+  return checkQuota(p.Title, int64(len(p.Body)))
+}
+
+/* HTTP status for an error returned by checkSave */
+func saveErrorStatus(err error) int {
+  switch err {
+  case errBodyTooLarge, errAttachmentTooLarge:
+    return http.StatusRequestEntityTooLarge
+  case errNoSuchPage:
+    return http.StatusNotFound
+  case errQuotaExceeded:
+    return http.StatusInsufficientStorage
+  case errNeedsReview, errProtected:
+    return http.StatusForbidden
+  case errScanFailed:
+    return http.StatusServiceUnavailable
+  }
+  return http.StatusUnprocessableEntity
+}
+
+/* List all pages, sorted by title */
+func listPages() ([]string, error) {
+  return store.List()
+}
+
+/* Data for the page listing */
+type listData struct {
+  Titles []string
+  Total int
+  Tag string
+  Prev, Next string
+}
+
+/* Listing of pages at /pages, a screenful at a time (see listing.go) */
+func pagesHandler(w http.ResponseWriter, r *http.Request) {
+  u := currentUser(r)
+  q, err := parseListQuery(r.URL.Query(), prefsOf(u).perPage(defaultPageLimit))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  titles, total, err := queryPages(q, u)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
-  http.Redirect(w, r, "/view/"+title, http.StatusFound)
+  data := &listData{Titles: titles, Total: total, Tag: q.Tag}
+  prev, next := q.neighbours(total)
+  if prev != "" {
+    data.Prev = "/pages?" + prev
+  }
+  if next != "" {
+    data.Next = "/pages?" + next
+  }
+  err = templates.Load().ExecuteTemplate(w, "list.html", data)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+  }
 }
 
 
+/* The landing page at /: the -home page, or the dashboard (see home.go) */
 func rootHandler(w http.ResponseWriter, r *http.Request){
-  http.Redirect(w, r, "/view/FrontPage", http.StatusFound)
+  if homePage == "dashboard" {
+    dashboardHandler(w, r)
+    return
+  }
+  http.Redirect(w, r, pageURL("view", homePage), http.StatusFound)
 }
 
 
@@ -105,16 +720,34 @@ func rootHandler(w http.ResponseWriter, r *http.Request){
   - Must is a convenience wrapper that panics when passed a non-nil error value, otherwise returns the *Template unaltered
     - Panic is appropriate here if template can't be loaded, so it will exit the program
   - ParseFiles can take any number of strings
+  - Funcs must be registered before parsing; pageURL lets templates build escaped links
+  - Held in an atomic.Pointer so a reload (see reload.go) can swap in new
+    templates while requests are rendering with the old ones
 */
-var templates = template.Must(template.ParseFiles("tmpl/edit.html", "tmpl/view.html"))
+var templates atomic.Pointer[template.Template]
+
+func parseTemplates() (*template.Template, error) {
+  return template.New("").Funcs(template.FuncMap{
+    "pageURL": pageURL,
+    "render": renderBody,
+    "site": siteInfo,
+    "maintenance": maintenanceMessage,
+    "feature": featureEnabled,
+    "when": when,
+    "inputTime": inputTime,
+  }).ParseFiles("tmpl/edit.html", "tmpl/view.html", "tmpl/list.html", "tmpl/admin.html", "tmpl/copy.html",
+    "tmpl/conflict.html", "tmpl/blame.html", "tmpl/login.html", "tmpl/home.html", "tmpl/print.html", "tmpl/source.html",
+    "tmpl/attachments.html", "tmpl/leave.html", "tmpl/review.html", "tmpl/rollback.html", "tmpl/maintenance.html", "tmpl/fragments.html", "tmpl/signup.html", "tmpl/twofactor.html", "tmpl/sessions.html", "tmpl/preferences.html", "tmpl/tokens.html", "tmpl/stale.html", "tmpl/search.html", "tmpl/searches.html", "tmpl/sitemap.html", "tmpl/activity.html", "tmpl/notifications.html")
+}
 
 
 
 /* Render Template
   - Handles errors
+  - data is usually a *Page, but pages that need more pass their own struct
 */
-func renderTemplate(w http.ResponseWriter, tmpl string, p *Page){
-  err := templates.ExecuteTemplate(w, tmpl + ".html", p)
+func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}){
+  err := templates.Load().ExecuteTemplate(w, tmpl + ".html", data)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
@@ -125,8 +758,17 @@ func renderTemplate(w http.ResponseWriter, tmpl string, p *Page){
   - regexp.MustCompile will parse and compile the regex and return a
     regexp.Regexp.Mustcompile is distinct from Compile in that it will panic if expression
     compilation fails, while Compile returns an error as a second parameter.
+  - Titles are words of letters and digits separated by single spaces ("Project Plan")
+  - r.URL.Path is already decoded, so %20 in the link arrives here as a space
+  - Titles can be nested with slashes ("Projects/Roadmap"); the first part is the
+    page's namespace (see namespaceOf)
+  - The last part can also be one of the special pages _Sidebar, _Header and
+    _Footer (see chrome.go)
 */
-var validPath = regexp.MustCompile("^/(edit|save|view)/([a-zA-Z0-9]+)$")
+const titleSegment = "[a-zA-Z0-9]+(?: [a-zA-Z0-9]+)*"
+const titlePattern = "(?:" + titleSegment + "/)*(?:" + titleSegment + "|_Sidebar|_Header|_Footer)"
+var validPath = regexp.MustCompile("^/(edit|save|view|raw|print|epub|source|copy|blame|star|publish|review|protect|share|attachments|history|verify)/(" + titlePattern + ")$")
+var validTitle = regexp.MustCompile("^" + titlePattern + "$")
 
 // Don't need because we added makeHandler
 /* Function to validate path and extract the page title */
@@ -160,8 +802,174 @@ func makeHandler(fn func(http.ResponseWriter, *http.Request, string)) http.Handl
   }
 }
 
-/* Main */
+/* Main
+  - wiki fsck checks the data directory (see fsck.go), wiki migrate copies
+    it to another backend (see migrate.go), and wiki cli and wiki tui edit
+    and browse the pages of a running wiki (see cli.go, tui.go), instead of
+    serving
+  - The templates are only read when serving, so the others work from any
+    directory
+*/
 func main() {
+  if filepath.Base(os.Args[0]) == "wiki-cli" {
+    os.Exit(cliMain(os.Args[1:]))
+  }
+  if len(os.Args) > 1 {
+    switch os.Args[1] {
+    case "fsck":
+      os.Exit(fsckMain(os.Args[2:]))
+    case "migrate":
+      os.Exit(migrateMain(os.Args[2:]))
+    case "cli":
+      os.Exit(cliMain(os.Args[2:]))
+    case "tui":
+      os.Exit(tuiMain(os.Args[2:]))
+    }
+  }
+  templates.Store(template.Must(parseTemplates()))
+  flag.Int64Var(&maxBodySize, "max-body", maxBodySize, "maximum size of a page body in bytes")
+  flag.Func("search-language", "language of the pages, for search to find the other forms of words: english (default), german, french, spanish or simple (see analysis.go)", setSearchLanguage)
+  flag.Int64Var(&maxAttachmentSize, "max-attachment", maxAttachmentSize, "maximum size of an attachment in bytes")
+  flag.BoolVar(&stripImageMetadata, "strip-image-metadata", stripImageMetadata, "remove EXIF, GPS and other metadata from uploaded images")
+  flag.BoolVar(&reencodeImages, "image-reencode", false, "decode and encode uploaded images again, refusing the ones Go can't decode (WebP)")
+  flag.Func("files-origin", "serve attachments from this second origin, e.g. https://files.example.net (see usercontent.go)", setFilesOrigin)
+  flag.StringVar(&virusScanner, "virus-scan", "", "scan uploads with clamd:host:port, clamd:/path/to/clamd.sock or an HTTP scanning service's URL")
+  flag.IntVar(&quotaPages, "quota-pages", 0, "maximum pages per namespace (0 for no limit)")
+  flag.Int64Var(&quotaBytes, "quota-bytes", 0, "maximum bytes stored per namespace (0 for no limit)")
+  flag.BoolVar(&reviewMode, "review", false, "changes to protected pages need approval by a second user")
+  adminUser := flag.String("admin-user", "admin", "name of the admin account")
+  adminPassword := flag.String("admin-password", "", "create the admin account with this password, or reset it")
+  sessionStore := flag.String("sessions", "memory", "where sessions are kept: memory, cookie or redis")
+  sessionKey := flag.String("session-key", "", "secret for signing cookie sessions (random when empty)")
+  redisAddr := flag.String("redis-addr", "", "Redis server address, e.g. localhost:6379")
+  clusterKind := flag.String("cluster", "none", "run as one of several instances sharing the data: none or redis (needs -redis-addr)")
+  flag.IntVar(&loginAttempts, "login-attempts", loginAttempts, "failed sign ins to an account before it is locked out for a while (0 never locks)")
+  flag.DurationVar(&loginMaxLockout, "login-max-lockout", loginMaxLockout, "longest lockout after repeated failed sign ins")
+  flag.IntVar(&apiQuota, "api-quota", apiQuota, "API requests allowed per window for each token or signed in user (0 for no limit)")
+  flag.IntVar(&apiQuotaAnon, "api-quota-anon", apiQuotaAnon, "API requests allowed per window from each address without a token or sign in (0 for no limit)")
+  flag.DurationVar(&apiQuotaWindow, "api-quota-window", apiQuotaWindow, "period the API quotas are counted over")
+  flag.Func("require-2fa", "accounts that must use two-factor sign in: none, admins or all", setRequire2FA)
+  flag.BoolVar(&openRegistration, "open-registration", false, "let anyone sign up, rather than only people with an invite")
+  flag.DurationVar(&sessionTTL, "session-ttl", sessionTTL, "how long a sign in lasts unused")
+  flag.DurationVar(&rememberTTL, "remember-ttl", rememberTTL, "how long a sign in with \"remember me\" lasts unused")
+  flag.IntVar(&keepRevisions, "keep-revisions", 0, "keep only the newest N revisions of each page (0 for no limit)")
+  flag.IntVar(&keepDays, "keep-days", 0, "keep only revisions younger than N days (0 for no limit)")
+  flag.DurationVar(&pruneInterval, "prune-interval", pruneInterval, "how often old revisions are pruned")
+  flag.IntVar(&staleDays, "stale-days", 0, "mark pages nobody has updated for N days as possibly outdated (0 never does)")
+  flag.IntVar(&jobWorkers, "job-workers", jobWorkers, "background jobs run at once")
+  flag.Func("cron", "run a job on a schedule as kind=schedule, e.g. 'backup=0 3 * * *' or check-links=@weekly (repeatable)", addCronTask)
+  flag.StringVar(&gitRemote, "git-remote", "", "git repository to keep the pages in sync with, e.g. git@example.com:docs.git (see gitsync.go)")
+  flag.StringVar(&gitBranch, "git-branch", gitBranch, "branch of -git-remote to sync with")
+  flag.DurationVar(&gitSyncInterval, "git-sync-interval", gitSyncInterval, "how often to fetch -git-remote for changes made there")
+  flag.IntVar(&backupKeep, "backup-keep", backupKeep, "backups kept in data/backups (0 keeps them all)")
+  storeKind := flag.String("store", "file", "page storage: file, under data/, memory (gone on restart), or dropbox or gdrive (see clouddrive.go)")
+  flag.StringVar(&cloudFolder, "store-folder", cloudFolder, "folder of the Dropbox or Google Drive account to keep pages in")
+  seedDir := flag.String("seed", "", "load the .txt files in this directory as pages at start up, e.g. examples/")
+  compression := flag.String("compress", "none", "compression for stored pages and revisions: none or gzip")
+  encrypt := flag.Bool("encrypt", false, "encrypt stored pages and revisions with the key in WIKI_ENCRYPTION_KEY")
+  keyFile := flag.String("encryption-key-file", "", "file holding the encryption key (implies -encrypt)")
+  migrateOnly := flag.Bool("migrate-only", false, "bring the data directory up to the current format version and exit")
+  migrateTo := flag.Int("migrate-to", -1, "move the data directory to this format version, running down migrations to go back, and exit")
+  flag.StringVar(&contentSecurityPolicy, "csp", contentSecurityPolicy, "Content-Security-Policy header")
+  flag.StringVar(&frameOptions, "frame-options", frameOptions, "X-Frame-Options header")
+  flag.StringVar(&referrerPolicy, "referrer-policy", referrerPolicy, "Referrer-Policy header")
+  flag.IntVar(&hstsMaxAge, "hsts-max-age", 0, "Strict-Transport-Security max-age in seconds (0 to leave it out)")
+  flag.StringVar(&siteURL, "site-url", "", "public URL of the wiki, e.g. https://wiki.example.com, for links in shared page previews (default: from the request)")
+  flag.Var(cacheControl, "cache-control", "Cache-Control for a class of responses, as class=value (view, raw, static, api, files)")
+  flag.Var(surrogateControl, "surrogate-control", "Surrogate-Control for a class of responses, as class=value")
+  flag.StringVar(&homePage, "home", homePage, "page shown at /, or dashboard for recent changes and starred pages")
+  flag.Var(&oembed, "oembed", "oEmbed provider as pattern=endpoint, e.g. 'https://vimeo.com/*=https://vimeo.com/api/oembed.json' (repeatable)")
+  flag.StringVar(&externalRel, "external-rel", externalRel, "rel attribute for links off the wiki (empty for none)")
+  flag.BoolVar(&externalNewTab, "external-new-tab", false, "open links off the wiki in a new tab")
+  flag.BoolVar(&linkWarning, "link-warning", false, "send links to untrusted domains through a warning page")
+  flag.Func("feature", "turn a feature on or off as name=on|off, e.g. live-preview=off (repeatable)", setFeatureFlag)
+  flag.Func("trusted-domains", "comma separated domains -link-warning lets through directly", func(s string) error {
+    trustedDomains = nil
+    for _, d := range strings.Split(s, ",") {
+      if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+        trustedDomains = append(trustedDomains, d)
+      }
+    }
+    return nil
+  })
+  replicaDir := flag.String("replica-dir", "", "copy of the data directory to serve page views from (see replica.go)")
+  flag.DurationVar(&replicaMaxLag, "replica-max-lag", replicaMaxLag, "how far behind the primary a page in -replica-dir may be and still be shown")
+  cacheKind := flag.String("cache", "none", "page cache: none or redis (needs -redis-addr)")
+  flag.DurationVar(&cacheTTL, "cache-ttl", cacheTTL, "how long pages stay in the cache")
+  accessLogPath := flag.String("access-log", "", "write an access log in Combined Log Format to this file")
+  accessLogSize := flag.Int64("access-log-max-size", 100, "rotate the access log when it reaches this many MB (0 never rotates)")
+  accessLogKeep := flag.Int("access-log-keep", 5, "rotated access logs to keep")
+  flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "time a request may take before it gets a 503 (0 for no limit)")
+  flag.Int64Var(&streamThreshold, "stream-threshold", streamThreshold, "pages larger than this many bytes are streamed as they render (0 never streams)")
+  sentryDSN := flag.String("sentry-dsn", "", "report panics and 5xx errors to this Sentry compatible DSN")
+  listenSpec := flag.String("listen", ":8080", "address to serve on: host:port, unix:/path/to.sock, or systemd for socket activation")
+  flag.StringVar(&tlsFiles.cert, "tls-cert", "", "certificate file (PEM); with -tls-key, serve HTTPS")
+  flag.StringVar(&tlsFiles.key, "tls-key", "", "private key file (PEM) for -tls-cert")
+  redirectAddr := flag.String("redirect-addr", "", "with TLS, also listen here (e.g. :80) and redirect to HTTPS")
+  flag.StringVar(&acmeDir, "acme-dir", "", "directory of ACME HTTP-01 challenge files served by the redirect listener")
+  grpcAddr := flag.String("grpc-addr", "", "address for the gRPC service, e.g. :8081 (disabled when empty)")
+  flag.Parse()
+  if err := users.load(); err != nil {
+    log.Fatal(err)
+  }
+  if err := loadBranding(); err != nil {
+    log.Fatal(err)
+  }
+  if err := loadInterwiki(); err != nil {
+    log.Fatal(err)
+  }
+  if err := loadRedirects(); err != nil {
+    log.Fatal(err)
+  }
+  if err := loadShortLinks(); err != nil {
+    log.Fatal(err)
+  }
+  if err := loadGroups(); err != nil {
+    log.Fatal(err)
+  }
+  if err := loadTokens(); err != nil {
+    log.Fatal(err)
+  }
+  if err := loadFeatures(); err != nil {
+    log.Fatal(err)
+  }
+  if err := loadJobs(); err != nil {
+    log.Fatal(err)
+  }
+  if err := bootstrapAdmin(*adminUser, *adminPassword); err != nil {
+    log.Fatal(err)
+  }
+  if err := configureSessions(*sessionStore, *sessionKey, *redisAddr); err != nil {
+    log.Fatal(err)
+  }
+  if err := configureCluster(*clusterKind, *redisAddr, *sessionStore, *sessionKey); err != nil {
+    log.Fatal(err)
+  }
+  if err := configureStorage(*storeKind, *compression, *encrypt, *keyFile); err != nil {
+    log.Fatal(err)
+  }
+  if err := configureReplica(*replicaDir); err != nil {
+    log.Fatal(err)
+  }
+  if err := migrateSchema(*migrateTo); err != nil {
+    log.Fatal(err)
+  }
+  if *migrateOnly || *migrateTo >= 0 {
+    return
+  }
+  if *seedDir != "" {
+    n, err := seedPages(*seedDir)
+    if err != nil {
+      log.Fatal(err)
+    }
+    log.Printf("seeded %d pages from %s", n, *seedDir)
+  }
+  if homePage != "dashboard" && !validTitle.MatchString(homePage) {
+    log.Fatal("-home must be a page title or dashboard")
+  }
+  if err := configureCache(*cacheKind, *redisAddr); err != nil {
+    log.Fatal(err)
+  }
 
   // Page Functions
   // p1 := &Page{Title: "TestPage", Body: []byte("This is a sample Page.")}
@@ -174,8 +982,107 @@ func main() {
   // localhost:8080/view/[filename]
   http.HandleFunc("/", rootHandler)
   http.HandleFunc("/view/", makeHandler(viewHandler))
+  http.HandleFunc("/raw/", makeHandler(rawHandler))
+  http.HandleFunc("/print/", makeHandler(printHandler))
+  http.HandleFunc("/epub/", makeHandler(epubHandler))
+  http.HandleFunc("/epub", epubTagHandler)
+  http.HandleFunc(davPrefix, davHandler)
+  http.HandleFunc("/source/", makeHandler(sourceHandler))
   http.HandleFunc("/edit/", makeHandler(editHandler))
   http.HandleFunc("/save/", makeHandler(saveHandler))
-  log.Fatal(http.ListenAndServe(":8080", nil))
+  http.HandleFunc("/copy/", makeHandler(copyHandler))
+  http.HandleFunc("/blame/", makeHandler(blameHandler))
+  http.HandleFunc("/star/", makeHandler(starHandler))
+  http.HandleFunc("/publish/", makeHandler(publishHandler))
+  http.HandleFunc("/review/", makeHandler(reviewHandler))
+  http.HandleFunc("/verify/", makeHandler(verifyHandler))
+  http.HandleFunc("/protect/", requireAdmin(makeHandler(protectHandler)))
+  http.HandleFunc("/share/", makeHandler(shareHandler))
+  http.HandleFunc("/attachments/", makeHandler(galleryHandler))
+  http.Handle("/fragment/view/", http.StripPrefix("/fragment", makeHandler(viewFragmentHandler)))
+  http.Handle("/fragment/history/", http.StripPrefix("/fragment", makeHandler(historyFragmentHandler)))
+  http.HandleFunc("/files/", filesHandler)
+  http.HandleFunc("/thumb/", thumbHandler)
+  http.HandleFunc("/pages", pagesHandler)
+  http.HandleFunc("/search", searchHandler)
+  http.HandleFunc("/stale", staleHandler)
+  http.HandleFunc("/sitemap", sitemapHandler)
+  http.HandleFunc("/activity", activityHandler)
+  http.HandleFunc("/activity/", activityHandler)
+  http.HandleFunc("/notifications", notificationsHandler)
+  registerAPI()
+  http.HandleFunc("/s/", shortLinkHandler)
+  http.HandleFunc("/graphql", graphqlHandler)
+  http.HandleFunc("/ws/preview", requireFeature("live-preview", previewSocketHandler))
+  http.HandleFunc("/ws/collab/", requireFeature("collab-editing", collabSocketHandler))
+  http.HandleFunc("/events", eventsHandler)
+  http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+  http.HandleFunc("/admin", requireAdmin(adminHandler))
+  http.HandleFunc("/admin/branding", requireAdmin(brandingHandler))
+  http.HandleFunc("/admin/interwiki", requireAdmin(interwikiHandler))
+  http.HandleFunc("/admin/rollback", requireAdmin(rollbackHandler))
+  http.HandleFunc("/admin/maintenance", requireAdmin(maintenanceHandler))
+  http.HandleFunc("/admin/reload", requireAdmin(reloadHandler))
+  http.HandleFunc("/admin/features", requireAdmin(featuresHandler))
+  http.HandleFunc("/admin/groups", requireAdmin(groupsHandler))
+  http.HandleFunc("/admin/invites", requireAdmin(invitesHandler))
+  http.HandleFunc("/admin/lockouts", requireAdmin(lockoutsHandler))
+  http.HandleFunc("/admin/tokens", requireAdmin(adminTokensHandler))
+  http.HandleFunc("/admin/jobs", requireAdmin(jobsHandler))
+  http.HandleFunc("/signup", signupHandler)
+  http.HandleFunc("/account/2fa", twoFactorHandler)
+  http.HandleFunc("/account/sessions", sessionsHandler)
+  http.HandleFunc("/account/preferences", prefsHandler)
+  http.HandleFunc("/account/tokens", tokensHandler)
+  http.HandleFunc("/account/searches", savedSearchesHandler)
+  http.HandleFunc("/branding/logo", brandingImageHandler)
+  http.HandleFunc("/branding/favicon", brandingImageHandler)
+  http.HandleFunc("/leave", leaveHandler)
+  http.HandleFunc("/login", loginHandler)
+  http.HandleFunc("/logout", logoutHandler)
+  go runScheduler()
+  startJobWorkers()
+  go runCron()
+  go watchSavedSearches()
+  go watchNotifications()
+  if gitRemote != "" {
+    go runGitSync()
+  }
+  go reloadOnHangup()
+  if retentionEnabled() {
+    go runPruner()
+  }
+  if *grpcAddr != "" {
+    go serveGRPC(*grpcAddr)
+  }
+  if (tlsFiles.cert == "") != (tlsFiles.key == "") {
+    log.Fatal("-tls-cert and -tls-key go together")
+  }
+  if *redirectAddr != "" {
+    if tlsFiles.cert == "" {
+      log.Fatal("-redirect-addr needs TLS enabled with -tls-cert and -tls-key")
+    }
+    go serveRedirects(*redirectAddr, *listenSpec)
+  }
+  ln, err := listen(*listenSpec)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if *sentryDSN != "" {
+    if err := configureErrorReports(*sentryDSN); err != nil {
+      log.Fatal(err)
+    }
+  }
+  handler := securityHeaders(filesHostGate(reportErrors(withTimeout(cacheHeaders(maintenanceGate(enforce2FA(slideSessions(apiRateLimit(idempotentWrites(http.DefaultServeMux))))))))))
+  if *accessLogPath != "" {
+    if err := accessLog.open(*accessLogPath, *accessLogSize<<20, *accessLogKeep); err != nil {
+      log.Fatal(err)
+    }
+    handler = logAccess(handler)
+  }
+  if tlsFiles.cert != "" {
+    log.Fatal(serveTLS(ln, handler))
+  }
+  log.Fatal(http.Serve(ln, handler))
 
 }